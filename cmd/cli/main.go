@@ -2,28 +2,139 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	gm "google.golang.org/api/gmail/v1"
+
+	"walmart-order-checker/internal/security"
 	"walmart-order-checker/pkg/gmail"
 	"walmart-order-checker/pkg/report"
 	"walmart-order-checker/pkg/util"
 )
 
 const (
-	defaultDays   = 10
-	minDays       = 1
-	walmartSender = "help@walmart.com"
+	defaultDays = 10
+	minDays     = 1
 )
 
+// options carries the command-line settings shared by every processing mode.
+type options struct {
+	days         int
+	window       report.DateRange // from --since/--until; zero when scanning by --days
+	user         string           // Gmail user ID; "me" unless scanning a delegated mailbox
+	label        string           // when set, scan only this label and skip the subject filter
+	appendCSV    string
+	inlineImages bool
+	jsonl        bool
+	markdown     bool // also write a pasteable Markdown summary
+	exportPrices bool // also write the learned unit prices
+	ics          bool // also write a calendar of expected deliveries
+	imageWorkers int
+	imageTimeout time.Duration
+	passphrase   string // non-empty when reports are written encrypted
+	noOpen       bool   // print the report path instead of opening it
+	browser      string // command reports are opened with; empty uses BROWSER
+	// accountTimeout bounds each account in a parallel combined scan; zero
+	// means no limit.
+	accountTimeout time.Duration
+	// list prints a one-line-per-order summary instead of writing reports.
+	list     bool
+	statuses []string
+	// dryRun prints order counts instead of writing reports or sync state.
+	dryRun bool
+	// reparse extracts cached messages again from their cached bodies.
+	reparse     bool
+	cacheBodies bool // keep decoded message bodies in the cache for --reparse
+	// parseInvoices reads PDF invoice attachments for authoritative totals.
+	parseInvoices bool
+	audit         *auditLog // nil unless --audit-csv is set
+	retry         gmail.RetryPolicy
+	// extraCancels are user-supplied cancellation patterns, added to the
+	// defaults.
+	extraCancels []gmail.CancelPattern
+	query        gmail.QueryConfig
+	aliases      []report.ProductAlias // group product names in reports
+	// customQuery, when set, replaces the generated Gmail search.
+	customQuery  string
+	spendMode    string // report.SpendTotal or report.SpendMerchandise
+	fetchWorkers int
+	parseWorkers int
+	cache        gmail.Cache
+	// spillThreshold moves orders to disk past this many per account; zero
+	// keeps them in memory.
+	spillThreshold int
+	outDir         string // "out" by default
+	combinedDir    string // under outDir; "combined" by default
+	nameTemplate   *template.Template
+	incremental    bool
+	compact        bool // print-friendly HTML report
+	region         report.Region
+	// runDir, when set, is a per-run subfolder (a timestamp) that reports are
+	// written into so earlier runs are kept.
+	runDir string
+}
+
+// dateRange is the scan window: --since/--until when given, else --days.
+func (o options) dateRange() report.DateRange {
+	if o.window.Absolute() {
+		return o.window
+	}
+	return report.LastDays(o.days)
+}
+
+func (o options) htmlVariant() string {
+	if o.compact {
+		return report.VariantCompact
+	}
+	return report.VariantFull
+}
+
+// processOptions returns the gmail processing options for scanning account
+// with its authorized client.
+func (o options) processOptions(account string, client *http.Client) gmail.ProcessOptions {
+	p := gmail.ProcessOptions{
+		Account:        account,
+		ParseInvoices:  o.parseInvoices,
+		Audit:          o.audit.recorder(account),
+		Retry:          o.retry,
+		FetchWorkers:   o.fetchWorkers,
+		ParseWorkers:   o.parseWorkers,
+		Cache:          o.cache,
+		Client:         client,
+		Region:         o.region,
+		Query:          o.query,
+		SpillThreshold: o.spillThreshold,
+		Reparse:        o.reparse,
+		CacheBodies:    o.cacheBodies,
+	}
+	if len(o.extraCancels) > 0 {
+		p.CancelPatterns = append(slices.Clone(gmail.DefaultCancelPatterns), o.extraCancels...)
+	}
+	return p
+}
+
+// abandonGrace is how long a timed-out account gets to hand back the orders
+// it parsed before it is left out of the combined report entirely.
+const abandonGrace = 5 * time.Second
+
 type AccountConfig struct {
 	Name            string
 	Email           string
@@ -34,16 +145,155 @@ type AccountConfig struct {
 
 func main() {
 	daysFlag := flag.Int("days", defaultDays, "Number of days back to scan for emails")
+	sinceFlag := flag.String("since", "", "Scan mail from this date on (YYYY-MM-DD) instead of the last --days days")
+	untilFlag := flag.String("until", "", "Scan mail up to and including this date (YYYY-MM-DD) instead of up to today")
+	labelOnlyFlag := flag.String("label-only", "", "Scan only Walmart mail under this Gmail label, without the subject filter")
+	userFlag := flag.String("user", envOr("GMAIL_USER", gmail.DefaultUser), "Gmail user ID to scan (\"me\", or a mailbox address when using domain-wide delegation)")
 	clearCacheFlag := flag.Bool("clear-cache", false, "Clear message cache before scanning")
-	flag.Parse()
+	cacheTTLFlag := flag.Duration("cache-ttl", gmail.CacheTTL(), "How long parsed messages stay in the message cache (env CACHE_TTL)")
+	reparseFlag := flag.Bool("reparse", false, "Re-run extraction on cached message bodies instead of trusting cached results; messages without a cached body are fetched")
+	cacheBodiesFlag := flag.Bool("cache-bodies", false, "Keep decoded email bodies in the message cache, unencrypted, so --reparse and parser upgrades don't fetch them again")
+	strictFlag := flag.Bool("strict", false, "Exit with a non-zero status if messages fail to fetch or parse, or an account is skipped or only partly scanned")
+	strictThresholdFlag := flag.Float64("strict-threshold", 0, "Fraction of failed messages tolerated in --strict mode (0-1)")
+	appendCSVFlag := flag.String("append-csv", "", "Append new orders to this master CSV, skipping ones already present")
+	jsonlFlag := flag.Bool("jsonl", false, "Also write orders as JSON Lines (one order per line)")
+	exportPricesFlag := flag.Bool("export-prices", false, "Also write the estimated unit price of each product as JSON (learned_prices_<range>.json)")
+	icsFlag := flag.Bool("ics", false, "Also write the expected deliveries as an iCalendar file (shipped_orders_<range>.ics)")
+	formatFlag := flag.String("format", "", "Extra report format to write alongside HTML, CSV and JSON: md for a Markdown summary")
+	inlineImagesFlag := flag.Bool("inline-images", false, "Embed item images in the HTML report so it works offline")
+	imageWorkersFlag := flag.Int("image-workers", report.DefaultImageWorkers, "Concurrent image downloads for --inline-images")
+	imageTimeoutFlag := flag.Duration("image-timeout", report.DefaultImageTimeout, "Per-image download timeout for --inline-images")
+	encryptFlag := flag.Bool("encrypt-reports", false, "Encrypt generated reports with a passphrase (REPORT_PASSPHRASE or prompt)")
+	accountTimeoutFlag := flag.Duration("account-timeout", 0, "In parallel multi-account mode, stop waiting for an account after this long (e.g. 5m; 0 = no limit)")
+	listFlag := flag.Bool("list", false, "Print a one-line-per-order listing instead of generating reports")
+	noOpenFlag := flag.Bool("no-open", false, "Don't open the report in a browser; just print its path (for SSH sessions and CI)")
+	browserFlag := flag.String("browser", "", "Command to open reports with, e.g. wslview (defaults to $BROWSER, then the system opener)")
+	dryRunFlag := flag.Bool("dry-run", false, "Scan as usual but only print order counts; write no files and open no browser")
+	statusFlag := flag.String("status", "", "With --list, only show orders with these statuses (comma-separated, e.g. confirmed,pre-ordered)")
+	parseInvoicesFlag := flag.Bool("parse-invoices", false, "Use totals and item prices from attached PDF invoices when present (slower)")
+	auditCSVFlag := flag.String("audit-csv", "", "Write one CSV row per processed message (subject, category, order ID) to this path")
+	cancelPatternsFlag := flag.String("cancel-patterns", gmail.DefaultCancelPatternsPath, "JSON file of extra cancellation subject patterns ([{\"match\": \"contains\", \"pattern\": \"...\"}]) (optional)")
+	spendModeFlag := flag.String("spend-mode", report.SpendTotal, "How order totals count towards product spend: total, or merchandise to leave out driver tips and fees")
+	fetchWorkersFlag := flag.Int("fetch-workers", gmail.DefaultFetchWorkers, fmt.Sprintf("Concurrent Gmail message downloads (1-%d)", gmail.MaxFetchWorkers))
+	parseWorkersFlag := flag.Int("parse-workers", gmail.DefaultParseWorkers, "Concurrent message parsers (defaults to the number of CPUs)")
+	spillThresholdFlag := flag.Int("spill-threshold", 0, "Keep at most this many orders per account in memory while messages are parsed, spilling the rest to a temporary file that is read back for the reports (0 = no limit)")
+	outDirFlag := flag.String("out-dir", "out", "Folder that per-account and combined report folders are created in")
+	combinedDirFlag := flag.String("combined-dir", "combined", "Folder under --out-dir for the combined multi-account report")
+	nameTemplateFlag := flag.String("name-template", defaultNameTemplate, "Go template for report file names, relative to the report folder; fields: .Email, .Range, .Format, .Report")
+	runSubdirsFlag := flag.Bool("run-subdirs", false, "Write each run's reports into a timestamped subfolder (e.g. out/combined/2024-01-15T10-30/) instead of overwriting")
+	regionFlag := flag.String("region", envOr("WALMART_REGION", "US"), "Walmart storefront the emails come from, for money and date formats: US or CA (env WALMART_REGION)")
+	compactFlag := flag.Bool("compact", false, "Write a print-friendly HTML report with only orders and totals, without images")
+	incrementalFlag := flag.Bool("incremental", false, "Only fetch mail received since the last --incremental scan, when Gmail still has that history")
+	queryConfigFlag := flag.String("query-config", gmail.DefaultQueryConfigPath, "JSON file overriding the Gmail senders and subject phrases searched for (optional)")
+	aliasesFlag := flag.String("aliases", report.DefaultAliasesPath, "JSON file of product name aliases used to group items in reports, replacing the built-in rules (optional)")
+	queryFlag := flag.String("query", "", "Gmail search to use instead of the built-in one; newer_than:<days>d is added unless it has a date operator")
+	printQueryFlag := flag.Bool("print-query", false, "Print the Gmail search query the other flags produce and exit without scanning")
+	envRetry := gmail.RetryPolicyFromEnv()
+	retryAttemptsFlag := flag.Int("retry-attempts", envRetry.MaxAttempts, "Attempts per message on transient Gmail API errors (1-20; env GMAIL_RETRY_ATTEMPTS)")
+	retryBackoffFlag := flag.Duration("retry-backoff", envRetry.InitialBackoff, "Wait before the first retry, doubled after each (env GMAIL_RETRY_BACKOFF)")
+	retryMaxBackoffFlag := flag.Duration("retry-max-backoff", envRetry.MaxBackoff, "Longest wait between retries (env GMAIL_RETRY_MAX_BACKOFF)")
+
+	// "list" is accepted as a subcommand, equivalent to --list.
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		*listFlag = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
+	retry := gmail.RetryPolicy{MaxAttempts: *retryAttemptsFlag, InitialBackoff: *retryBackoffFlag, MaxBackoff: max(*retryMaxBackoffFlag, *retryBackoffFlag)}
+	if *cacheTTLFlag <= 0 {
+		log.Fatal("--cache-ttl must be positive")
+	}
+	if *retryAttemptsFlag < 1 {
+		log.Fatal("--retry-attempts must be at least 1")
+	}
+	if err := retry.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *fetchWorkersFlag < 1 || *parseWorkersFlag < 1 {
+		log.Fatal("--fetch-workers and --parse-workers must be at least 1")
+	}
+	if *fetchWorkersFlag > gmail.MaxFetchWorkers {
+		log.Fatalf("--fetch-workers cannot exceed %d", gmail.MaxFetchWorkers)
+	}
+	if *reparseFlag && *clearCacheFlag {
+		log.Fatal("--reparse cannot be combined with --clear-cache")
+	}
+	if *spillThresholdFlag < 0 {
+		log.Fatal("--spill-threshold cannot be negative")
+	}
+	if *incrementalFlag && *labelOnlyFlag != "" {
+		log.Fatal("--incremental cannot be combined with --label-only")
+	}
+	if strings.TrimSpace(*queryFlag) != "" {
+		if *labelOnlyFlag != "" {
+			log.Fatal("--query cannot be combined with --label-only")
+		}
+		if *incrementalFlag {
+			log.Fatal("--incremental cannot be combined with --query")
+		}
+	}
+	var window report.DateRange
+	if *sinceFlag != "" || *untilFlag != "" {
+		if *incrementalFlag {
+			log.Fatal("--incremental cannot be combined with --since or --until")
+		}
+		var err error
+		if window, err = report.ParseDateRange(*sinceFlag, *untilFlag); err != nil {
+			log.Fatalf("--since/--until: %v", err)
+		}
+	}
+	if strings.TrimSpace(*combinedDirFlag) == "" || filepath.IsAbs(*combinedDirFlag) {
+		log.Fatal("--combined-dir must be a folder name under --out-dir")
+	}
+	if strings.TrimSpace(*outDirFlag) == "" {
+		log.Fatal("--out-dir cannot be empty")
+	}
+	nameTemplate, err := parseNameTemplate(*nameTemplateFlag)
+	if err != nil {
+		log.Fatalf("--name-template: %v", err)
+	}
+	if *formatFlag != "" && *formatFlag != "md" {
+		log.Fatalf("unknown --format %q (want md)", *formatFlag)
+	}
+	region, err := report.ParseRegion(*regionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spendMode, err := report.ParseSpendMode(*spendModeFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	extraCancels, err := gmail.LoadCancelPatterns(*cancelPatternsFlag)
+	if err != nil {
+		log.Fatalf("failed to load cancel patterns: %v", err)
+	}
+
+	queryConfig, err := gmail.LoadQueryConfig(*queryConfigFlag)
+	if err != nil {
+		log.Fatalf("failed to load query config: %v", err)
+	}
+
+	aliases, err := report.LoadProductAliases(*aliasesFlag)
+	if err != nil {
+		log.Fatalf("failed to load product aliases: %v", err)
+	}
+
+	if *printQueryFlag {
+		fmt.Println(buildQuery(options{days: *daysFlag, window: window, label: *labelOnlyFlag, extraCancels: extraCancels, query: queryConfig, customQuery: strings.TrimSpace(*queryFlag)}))
+		return
+	}
+
+	// One cache serves every account, so a re-scan skips messages any of
+	// them already parsed.
+	cache := gmail.NewMessageCache(gmail.DefaultCachePath, *cacheTTLFlag)
+	defer cache.Close()
 	if *clearCacheFlag {
-		cache := gmail.NewMessageCache(".cache/messages", 24*time.Hour)
 		if err := cache.Clear(); err != nil {
-			log.Printf("Warning: failed to clear cache: %v", err)
-		} else {
-			fmt.Println("✓ Cache cleared successfully")
+			log.Fatalf("failed to clear cache: %v", err)
 		}
+		fmt.Println("✓ Cache cleared successfully")
 	}
 
 	accounts := discoverAccounts()
@@ -64,8 +314,85 @@ func main() {
 	}
 
 	maybePromptDays(daysFlag)
-	days := *daysFlag
+	opts := options{
+		days:           *daysFlag,
+		window:         window,
+		user:           *userFlag,
+		label:          *labelOnlyFlag,
+		appendCSV:      *appendCSVFlag,
+		inlineImages:   *inlineImagesFlag,
+		jsonl:          *jsonlFlag,
+		markdown:       *formatFlag == "md",
+		exportPrices:   *exportPricesFlag,
+		ics:            *icsFlag,
+		imageWorkers:   *imageWorkersFlag,
+		imageTimeout:   *imageTimeoutFlag,
+		accountTimeout: *accountTimeoutFlag,
+		list:           *listFlag,
+		dryRun:         *dryRunFlag,
+		noOpen:         *noOpenFlag,
+		browser:        *browserFlag,
+		parseInvoices:  *parseInvoicesFlag,
+		reparse:        *reparseFlag,
+		cacheBodies:    *cacheBodiesFlag,
+		retry:          retry,
+		spendMode:      spendMode,
+		fetchWorkers:   *fetchWorkersFlag,
+		parseWorkers:   *parseWorkersFlag,
+		cache:          cache,
+		spillThreshold: *spillThresholdFlag,
+		outDir:         *outDirFlag,
+		combinedDir:    *combinedDirFlag,
+		nameTemplate:   nameTemplate,
+		incremental:    *incrementalFlag,
+		compact:        *compactFlag,
+		region:         region,
+		extraCancels:   extraCancels,
+		customQuery:    strings.TrimSpace(*queryFlag),
+		query:          queryConfig,
+		aliases:        aliases,
+	}
+	if *runSubdirsFlag {
+		opts.runDir = time.Now().Format("2006-01-02T15-04")
+	}
+	if *statusFlag != "" {
+		opts.statuses = strings.Split(*statusFlag, ",")
+	}
+
+	if *encryptFlag {
+		if opts.appendCSV != "" {
+			log.Fatal("--append-csv cannot be combined with --encrypt-reports")
+		}
+		if opts.cacheBodies {
+			log.Fatal("--cache-bodies cannot be combined with --encrypt-reports")
+		}
+		pass, err := security.ReadPassphrase("REPORT_PASSPHRASE", "Report passphrase: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pass == "" {
+			log.Fatal("--encrypt-reports requires a non-empty passphrase")
+		}
+		opts.passphrase = pass
+	}
 
+	if *auditCSVFlag != "" {
+		audit, err := openAuditLog(*auditCSVFlag)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+		defer func() {
+			if err := audit.Close(); err != nil {
+				log.Printf("Warning: failed to write audit log: %v", err)
+			}
+		}()
+		opts.audit = audit
+	}
+
+	var (
+		stats    gmail.ScanStats
+		outcomes []report.AccountStatus // per account, in multi-account mode
+	)
 	if multiMode {
 		allHaveTokens := true
 		for _, acc := range accounts {
@@ -77,14 +404,54 @@ func main() {
 
 		if allHaveTokens {
 			fmt.Println("✓ All accounts authenticated - processing in parallel")
-			processAccountsInParallel(accounts, days)
+			stats, outcomes = processAccountsInParallel(accounts, opts)
 		} else {
 			fmt.Println("⚠️  One or more accounts need authentication - processing sequentially")
-			processAccountsSequentially(accounts, days)
+			stats, outcomes = processAccountsSequentially(accounts, opts)
 		}
 	} else {
-		processSingleAccount(accounts[0], days)
+		stats = processSingleAccount(accounts[0], opts)
+	}
+
+	strictFailed := false
+	if failed := stats.Failed(); failed > 0 {
+		fmt.Printf("⚠️  %d of %d messages could not be processed (%d fetch errors, %d parse errors)\n",
+			failed, stats.Total, stats.FetchErrors, stats.ParseErrors)
+		if *strictFlag && float64(failed) > *strictThresholdFlag*float64(stats.Total) {
+			fmt.Fprintln(os.Stderr, "strict mode: failure threshold exceeded")
+			strictFailed = true
+		}
+	}
+	// An account left out of a combined report, in whole or in part, is a
+	// failure whatever the threshold: its messages aren't even counted.
+	if n := incompleteAccounts(outcomes); *strictFlag && n > 0 {
+		fmt.Fprintf(os.Stderr, "strict mode: %d account(s) were skipped or incomplete\n", n)
+		strictFailed = true
+	}
+	if strictFailed {
+		opts.audit.Close()
+		cache.Close()
+		os.Exit(1)
+	}
+}
+
+// incompleteAccounts counts the accounts that were skipped or only partly
+// scanned.
+func incompleteAccounts(outcomes []report.AccountStatus) int {
+	n := 0
+	for _, a := range outcomes {
+		if a.Status != report.AccountScanned {
+			n++
+		}
+	}
+	return n
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
 }
 
 func maybePromptDays(days *int) bool {
@@ -114,25 +481,531 @@ func maybePromptDays(days *int) bool {
 	return true
 }
 
-func buildQuery(days int) string {
-	return fmt.Sprintf(
-		"from:%s subject:(\"thanks for your preorder\" OR \"thanks for your order\" OR \"Canceled: delivery from order\" OR \"was canceled\" OR \"Shipped:\" OR \"Arrived:\" OR \"Delivered:\") newer_than:%dd",
-		walmartSender, days,
-	)
+func buildQuery(opts options) string {
+	if opts.customQuery != "" {
+		return gmail.CustomQuery(opts.customQuery, opts.dateRange())
+	}
+	if opts.label != "" {
+		return opts.query.LabelQuery(labelQueryName(opts.label), opts.dateRange())
+	}
+	return opts.query.Query(opts.dateRange(), gmail.CancelSubjects(opts.extraCancels)...)
+}
+
+// labelQueryName converts a label name to the form Gmail search expects, where
+// spaces and nested-label slashes are written as hyphens.
+func labelQueryName(label string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.TrimSpace(label))
+}
+
+// formatDateRange names report files after the window they cover.
+func formatDateRange(r report.DateRange) string {
+	start, end := r.Bounds(time.Now())
+	if start.IsZero() {
+		return "until_" + end.Format(report.DateLayout)
+	}
+	return fmt.Sprintf("%s_to_%s", start.Format(report.DateLayout), end.Format(report.DateLayout))
+}
+
+// defaultNameTemplate gives report files names like orders_<range>.html.
+const defaultNameTemplate = "{{.Report}}_{{.Range}}.{{.Format}}"
+
+// reportName holds the fields --name-template can use.
+type reportName struct {
+	Email  string // the account's folder name, or --combined-dir for a combined report
+	Range  string
+	Format string // file extension: html, csv, json, jsonl, md or ics
+	Report string // orders, shipped_orders, canceled_orders or learned_prices
+}
+
+// reportFiles are the report and format pairs the CLI may write.
+var reportFiles = []reportName{
+	{Report: "orders", Format: "html"},
+	{Report: "orders", Format: "csv"},
+	{Report: "shipped_orders", Format: "csv"},
+	{Report: "shipped_orders", Format: "ics"},
+	{Report: "canceled_orders", Format: "csv"},
+	{Report: "orders", Format: "json"},
+	{Report: "orders", Format: "jsonl"},
+	{Report: "orders", Format: "md"},
+	{Report: "learned_prices", Format: "json"},
+}
+
+// parseNameTemplate parses --name-template and checks that it gives every
+// report file its own relative path.
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]string, len(reportFiles))
+	for _, f := range reportFiles {
+		f.Email, f.Range = "user@example.com", "2024-01-01_to_2024-01-10"
+		name, err := renderReportName(tmpl, f)
+		if err != nil {
+			return nil, err
+		}
+		kind := f.Report + " " + f.Format
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("the %s and %s reports would both be written to %s; use {{.Report}} and {{.Format}}", other, kind, name)
+		}
+		seen[name] = kind
+	}
+	return tmpl, nil
+}
+
+func renderReportName(tmpl *template.Template, f reportName) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, f); err != nil {
+		return "", err
+	}
+	name := filepath.FromSlash(b.String())
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%q is not a relative path inside the report folder", name)
+	}
+	return name, nil
 }
 
-func formatDateRange(days int) string {
-	end := time.Now()
-	start := end.AddDate(0, 0, -days)
-	return fmt.Sprintf("%s_to_%s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+// reportPaths builds the paths of the report files for one account, or for
+// the combined report, from --out-dir, --combined-dir, --run-subdirs and
+// --name-template.
+type reportPaths struct {
+	baseDir string // the account's folder, which keeps state across runs
+	outDir  string // baseDir, or the run's subfolder of it
+	name    reportName
+	tmpl    *template.Template
 }
 
-func openReport(path string) error {
+func (o options) reportPaths(email string, combined bool) reportPaths {
+	folder := accountDirName(email)
+	if combined {
+		folder = o.combinedDir
+	}
+	baseDir := filepath.Join(o.outDir, folder)
+	return reportPaths{
+		baseDir: baseDir,
+		outDir:  filepath.Join(baseDir, o.runDir),
+		name:    reportName{Email: folder, Range: formatDateRange(o.dateRange())},
+		tmpl:    o.nameTemplate,
+	}
+}
+
+// path returns where the given report is written, creating any folders the
+// name template adds.
+func (p reportPaths) path(kind, format string) (string, error) {
+	f := p.name
+	f.Report, f.Format = kind, format
+	name, err := renderReportName(p.tmpl, f)
+	if err != nil {
+		return "", fmt.Errorf("--name-template: %w", err)
+	}
+	path := filepath.Join(p.outDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return path, nil
+}
+
+// writeReports generates the HTML and CSV reports for email's account, or the
+// combined report, and returns the path of the HTML report. For a combined
+// report the orders CSV gains an Account column and the HTML report lists how
+// each account fared.
+func writeReports(email string, orders map[string]*report.Order, shipped []*report.ShippedOrder, accounts []report.AccountStatus, combined bool, opts options) (string, error) {
+	paths := opts.reportPaths(email, combined)
+	if err := os.MkdirAll(paths.outDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Order IDs and prices are stored in plain text, so skip this for
+	// encrypted reports. The records stay in the account's folder so per-run
+	// subfolders still see new orders and extend one price history.
+	if opts.passphrase == "" {
+		if err := markNewOrders(filepath.Join(paths.baseDir, previousOrdersFile), orders); err != nil {
+			log.Printf("Warning: could not track new orders: %v", err)
+		}
+		learned := report.LearnedPrices(orders, opts.spendMode, opts.aliases)
+		if err := report.AppendPriceHistory(learned, filepath.Join(paths.baseDir, priceHistoryFile)); err != nil {
+			log.Printf("Warning: could not update price history: %v", err)
+		}
+	}
+
+	if opts.inlineImages {
+		ctx, cancel := context.WithTimeout(context.Background(), report.DefaultInlineBudget)
+		fetcher := report.NewImageFetcher(opts.imageWorkers, opts.imageTimeout)
+		fmt.Printf("Inlined %d item image(s)\n", report.InlineImagesWith(ctx, orders, fetcher))
+		cancel()
+	}
+
+	htmlPath, err := paths.path("orders", "html")
+	if err != nil {
+		return "", err
+	}
+	csvPath, err := paths.path("orders", "csv")
+	if err != nil {
+		return "", err
+	}
+	shippedCSVPath, err := paths.path("shipped_orders", "csv")
+	if err != nil {
+		return "", err
+	}
+	canceledCSVPath, err := paths.path("canceled_orders", "csv")
+	if err != nil {
+		return "", err
+	}
+
+	// RenderHTML renames items as it groups them while the CSV writers read
+	// the names, so it gets its own copy.
+	htmlOrders := report.CloneOrders(orders)
+
+	var reportWg sync.WaitGroup
+	var htmlErr, csvErr, shippedErr, canceledErr error
+
+	reportWg.Add(4)
+	go func() {
+		defer reportWg.Done()
+		htmlPath, htmlErr = writeReport(htmlPath, opts, func(w io.Writer) error {
+			return report.RenderHTML(w, htmlOrders, shipped, report.HTMLOptions{
+				DaysScanned: opts.days,
+				Range:       opts.window,
+				Notices:     report.AccountNotices(accounts),
+				Accounts:    accounts,
+				SpendMode:   opts.spendMode,
+				Variant:     opts.htmlVariant(),
+				Region:      opts.region,
+				Aliases:     opts.aliases,
+			})
+		})
+	}()
+	go func() {
+		defer reportWg.Done()
+		_, csvErr = writeReport(csvPath, opts, func(w io.Writer) error {
+			if combined {
+				return report.GenerateCombinedCSVTo(w, orders)
+			}
+			return report.GenerateCSVTo(w, orders)
+		})
+	}()
+	go func() {
+		defer reportWg.Done()
+		_, shippedErr = writeReport(shippedCSVPath, opts, func(w io.Writer) error {
+			return report.GenerateShippedCSVTo(w, shipped)
+		})
+	}()
+	go func() {
+		defer reportWg.Done()
+		_, canceledErr = writeReport(canceledCSVPath, opts, func(w io.Writer) error {
+			return report.GenerateCanceledCSVTo(w, orders)
+		})
+	}()
+
+	reportWg.Wait()
+
+	if htmlErr != nil {
+		return "", fmt.Errorf("write html: %w", htmlErr)
+	}
+	if csvErr != nil {
+		return "", fmt.Errorf("write csv: %w", csvErr)
+	}
+	if shippedErr != nil {
+		return "", fmt.Errorf("write shipped csv: %w", shippedErr)
+	}
+	if canceledErr != nil {
+		return "", fmt.Errorf("write canceled csv: %w", canceledErr)
+	}
+
+	jsonPath, err := paths.path("orders", "json")
+	if err != nil {
+		return "", err
+	}
+	if _, err := writeReport(jsonPath, opts, func(w io.Writer) error {
+		return report.GenerateJSONTo(w, orders, shipped)
+	}); err != nil {
+		return "", fmt.Errorf("write json: %w", err)
+	}
+
+	if opts.jsonl {
+		jsonlPath, err := paths.path("orders", "jsonl")
+		if err != nil {
+			return "", err
+		}
+		if _, err := writeReport(jsonlPath, opts, func(w io.Writer) error {
+			return report.GenerateJSONLTo(w, orders)
+		}); err != nil {
+			return "", fmt.Errorf("write jsonl: %w", err)
+		}
+	}
+
+	if opts.markdown {
+		mdPath, err := paths.path("orders", "md")
+		if err != nil {
+			return "", err
+		}
+		if _, err := writeReport(mdPath, opts, func(w io.Writer) error {
+			return report.RenderMarkdown(w, orders, shipped, report.MarkdownOptions{
+				DaysScanned: opts.days,
+				Range:       opts.window,
+				SpendMode:   opts.spendMode,
+				Region:      opts.region,
+				Aliases:     opts.aliases,
+			})
+		}); err != nil {
+			return "", fmt.Errorf("write markdown: %w", err)
+		}
+	}
+
+	if opts.ics {
+		icsPath, err := paths.path("shipped_orders", "ics")
+		if err != nil {
+			return "", err
+		}
+		if _, err := writeReport(icsPath, opts, func(w io.Writer) error {
+			return report.GenerateShipmentsICSTo(w, shipped)
+		}); err != nil {
+			return "", fmt.Errorf("write calendar: %w", err)
+		}
+	}
+
+	if opts.exportPrices {
+		pricesPath, err := paths.path("learned_prices", "json")
+		if err != nil {
+			return "", err
+		}
+		if _, err := writeReport(pricesPath, opts, func(w io.Writer) error {
+			return report.ExportLearnedPricesTo(w, orders, opts.spendMode, opts.aliases)
+		}); err != nil {
+			return "", fmt.Errorf("write learned prices: %w", err)
+		}
+	}
+
+	if opts.appendCSV != "" {
+		added, err := report.AppendCSV(orders, opts.appendCSV)
+		if err != nil {
+			return "", fmt.Errorf("append csv: %w", err)
+		}
+		fmt.Printf("Appended %d new line(s) to %s\n", added, opts.appendCSV)
+	}
+
+	return htmlPath, nil
+}
+
+// priceHistoryFile collects, per output directory, each product's learned
+// unit price whenever it changes between runs.
+const priceHistoryFile = "price_history.csv"
+
+// previousOrdersFile records, per output directory, the order IDs of the last
+// report so the next one can flag what is new.
+const previousOrdersFile = ".previous_orders.json"
+
+// markNewOrders flags orders missing from the IDs saved at path, then saves
+// the current IDs there. Nothing is flagged the first time.
+func markNewOrders(path string, orders map[string]*report.Order) error {
+	var previous map[string]bool
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		previous = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			previous[id] = true
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	data, err = json.Marshal(report.MarkNewOrders(orders, previous))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// syncStateFile records, next to an account's token, where each Gmail user's
+// next --incremental scan resumes from.
+const syncStateFile = ".sync_state.json"
+
+// fetchMessages lists the account's messages, only looking at mail received
+// since the last scan with --incremental. save records the sync state for the
+// next incremental scan and should be called once the messages are processed.
+func fetchMessages(ctx context.Context, srv *gm.Service, acc AccountConfig, opts options) (messages []*gm.Message, save func(), err error) {
+	query := buildQuery(opts)
+	if !opts.incremental {
+		messages, err := gmail.FetchMessages(ctx, srv, opts.user, query)
+		return messages, func() {}, err
+	}
+
+	path := filepath.Join(filepath.Dir(acc.TokenPath), syncStateFile)
+	states := make(map[string]*gmail.SyncState)
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			log.Printf("Warning: ignoring %s: %v", path, err)
+		}
+	}
+	extra := gmail.CancelSubjects(opts.extraCancels)
+	match := func(from, subject string) bool { return opts.query.Matches(from, subject, extra...) }
+	prev := states[opts.user]
+	messages, state, fromHistory, err := gmail.FetchMessagesIncremental(ctx, srv, opts.user, query, match, prev, time.Duration(opts.days)*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromHistory {
+		fmt.Printf("  → Incremental scan: %d new message(s)\n", len(state.MessageIDs)-len(prev.MessageIDs))
+	}
+	if opts.dryRun {
+		return messages, func() {}, nil
+	}
+	return messages, func() {
+		states[opts.user] = state
+		data, err := json.Marshal(states)
+		if err == nil {
+			err = os.WriteFile(path, data, 0o600)
+		}
+		if err != nil {
+			log.Printf("Warning: could not save sync state: %v", err)
+		}
+	}, nil
+}
+
+// writeReport writes a single report file. With a passphrase configured the
+// report is rendered in memory and only the encrypted form, with a .enc
+// suffix, touches the disk. It returns the path actually written.
+func writeReport(path string, opts options, generate func(w io.Writer) error) (string, error) {
+	if opts.passphrase == "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return "", err
+		}
+		if err := generate(f); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+
+	var buf bytes.Buffer
+	if err := generate(&buf); err != nil {
+		return "", err
+	}
+	encrypted, err := security.EncryptWithPassphrase(buf.Bytes(), opts.passphrase)
+	if err != nil {
+		return "", err
+	}
+	path += ".enc"
+	return path, os.WriteFile(path, encrypted, 0o600)
+}
+
+func printOrderList(orders map[string]*report.Order, opts options) {
+	fmt.Println()
+	if err := report.WriteOrderList(os.Stdout, orders, opts.statuses); err != nil {
+		log.Printf("list orders: %v", err)
+	}
+}
+
+// printDryRunSummary prints what a --dry-run scan found: order, shipment and
+// cancellation counts, and how many orders have each status.
+func printDryRunSummary(orders map[string]*report.Order, shipped []*report.ShippedOrder) {
+	byStatus := make(map[string]int)
+	for _, o := range orders {
+		byStatus[o.Status]++
+	}
+	statuses := make([]string, 0, len(byStatus))
+	for status := range byStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Println("\nDry run, no reports written:")
+	fmt.Printf("  Orders:   %d\n", len(orders))
+	fmt.Printf("  Shipped:  %d\n", len(shipped))
+	fmt.Printf("  Canceled: %d\n", byStatus["canceled"])
+	fmt.Println("  By status:")
+	for _, status := range statuses {
+		label := status
+		if label == "" {
+			label = "(none)"
+		}
+		fmt.Printf("    %-12s %d\n", label, byStatus[status])
+	}
+}
+
+// auditLog writes the --audit-csv file. Accounts scanned in parallel share it,
+// so rows are written under a lock.
+type auditLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *csv.Writer
+	closed bool
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{f: f, w: csv.NewWriter(f)}
+	a.w.Write([]string{"Account", "Message ID", "Subject", "Category", "Order ID", "Items", "Tracking", "Cached"})
+	return a, nil
+}
+
+// recorder returns an audit callback tagging rows with account, or nil when
+// auditing is off.
+func (a *auditLog) recorder(account string) gmail.AuditCallback {
+	if a == nil {
+		return nil
+	}
+	return func(rec gmail.AuditRecord) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// An abandoned account scan can outlive the log.
+		if a.closed {
+			return
+		}
+		a.w.Write([]string{
+			account,
+			rec.MessageID,
+			rec.Subject,
+			rec.Category,
+			rec.OrderID,
+			strconv.Itoa(rec.Items),
+			strconv.Itoa(rec.Tracking),
+			strconv.FormatBool(rec.FromCache),
+		})
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	a.w.Flush()
+	err := a.w.Error()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func openReport(path string, opts options) error {
+	if opts.passphrase != "" {
+		fmt.Println("Reports are encrypted; decrypt with: go run ./cmd/tools/decrypt-report <file>")
+		return nil
+	}
 	abs, err := filepath.Abs(path)
 	if err != nil {
 		return fmt.Errorf("abs: %w", err)
 	}
-	return util.OpenBrowser(abs)
+	if opts.noOpen {
+		fmt.Println(abs)
+		return nil
+	}
+	return util.OpenBrowserWith(opts.browser, abs)
 }
 
 func discoverAccounts() []AccountConfig {
@@ -176,6 +1049,36 @@ func discoverAccounts() []AccountConfig {
 	return accounts
 }
 
+// accountDirName maps an email address to a directory name that is safe on
+// every platform. Addresses are case-insensitive, so the name is lowercased;
+// characters that are reserved on Windows or otherwise awkward are written as
+// %XX (with '%' itself escaped), which keeps the name readable and distinct
+// addresses from ever colliding.
+func accountDirName(email string) string {
+	var b strings.Builder
+	for _, c := range []byte(strings.ToLower(strings.TrimSpace(email))) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '@', c == '.', c == '_', c == '-', c == '+':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	name := b.String()
+	// Windows strips trailing dots, and a leading dot hides the folder.
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	if strings.HasSuffix(name, ".") {
+		name = name[:len(name)-1] + "%2E"
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return name
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -212,32 +1115,106 @@ func promptMultiAccountMode() bool {
 	return input == "y" || input == "yes"
 }
 
-func mergeOrders(dest, src map[string]*report.Order) {
-	for id, order := range src {
-		if existing, ok := dest[id]; ok {
-			if len(existing.Items) == 0 {
-				existing.Items = order.Items
-			}
-			if existing.Total == "" {
-				existing.Total = order.Total
-			}
-			if existing.OrderDate == "" {
-				existing.OrderDate = order.OrderDate
-				existing.OrderDateParsed = order.OrderDateParsed
-			}
-			if existing.Status != "canceled" {
-				existing.Status = order.Status
-			}
-		} else {
-			dest[id] = order
+// accountResult is what a single account contributes to a combined report.
+type accountResult struct {
+	email    string
+	orders   map[string]*report.Order
+	shipped  []*report.ShippedOrder
+	stats    gmail.ScanStats
+	messages int
+}
+
+// scanAccount fetches and processes one account's messages. If ctx ends while
+// messages are being processed, the orders parsed so far are returned together
+// with ctx.Err().
+func scanAccount(ctx context.Context, acc AccountConfig, opts options) (*accountResult, error) {
+	client, err := gmail.InitializeGmailClient(acc.CredentialsPath, acc.TokenPath)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := gmail.NewService(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &accountResult{email: acc.Email}
+	if acc.IsRoot {
+		profile, err := gmail.GetProfile(ctx, srv, opts.user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get profile: %w", scopeHint(err, acc.TokenPath))
 		}
+		res.email = profile.EmailAddress
+		fmt.Printf("  → Detected email: %s\n", res.email)
+	}
+
+	messages, saveSync, err := fetchMessages(ctx, srv, acc, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %w", scopeHint(err, acc.TokenPath))
+	}
+	res.messages = len(messages)
+
+	res.orders, res.shipped, res.stats, err = gmail.ProcessEmailsWithOptions(ctx, srv, opts.user, messages, opts.processOptions(res.email, client))
+	if err != nil {
+		return nil, fmt.Errorf("failed to process emails: %w", err)
+	}
+	if ctx.Err() == nil {
+		saveSync()
+	}
+	for _, order := range res.orders {
+		order.AddSourceAccounts(res.email)
+	}
+	return res, ctx.Err()
+}
+
+// scopeHint adds how to sign in again to an error caused by a token without
+// Gmail read access.
+func scopeHint(err error, tokenPath string) error {
+	if errors.Is(err, gmail.ErrInsufficientScope) {
+		return fmt.Errorf("%w; delete %s and run again, allowing read access to your email when asked", err, tokenPath)
+	}
+	return err
+}
+
+// scanAccountWithin runs scanAccount but stops waiting once ctx is done. The
+// scan is given abandonGrace to return partial results; after that it is
+// abandoned and left to finish in the background.
+func scanAccountWithin(ctx context.Context, acc AccountConfig, opts options) (*accountResult, error) {
+	type outcome struct {
+		res *accountResult
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := scanAccount(ctx, acc, opts)
+		done <- outcome{res, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.res, o.err
+	case <-ctx.Done():
+	}
+
+	select {
+	case o := <-done:
+		return o.res, o.err
+	case <-time.After(abandonGrace):
+		return nil, ctx.Err()
 	}
 }
 
-func processAccountsInParallel(accounts []AccountConfig, days int) {
+func accountLabel(acc AccountConfig, res *accountResult) string {
+	if res != nil && res.email != "" {
+		return res.email
+	}
+	return acc.Name
+}
+
+func processAccountsInParallel(accounts []AccountConfig, opts options) (gmail.ScanStats, []report.AccountStatus) {
 	allOrders := make(map[string]*report.Order)
 	var allShipped []*report.ShippedOrder
-	totalEmails := 0
+	var allStats gmail.ScanStats
+	var outcomes []report.AccountStatus
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
@@ -249,257 +1226,177 @@ func processAccountsInParallel(accounts []AccountConfig, days int) {
 			startTime := time.Now()
 			fmt.Printf("\nProcessing account: %s\n", acc.Name)
 
-			srv, err := gmail.InitializeGmailService(acc.CredentialsPath, acc.TokenPath)
-			if err != nil {
-				log.Printf("Error with %s: %v", acc.Name, err)
-				return
+			ctx := context.Background()
+			if opts.accountTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.accountTimeout)
+				defer cancel()
 			}
 
-			accountEmail := acc.Email
-			if acc.IsRoot {
-				profile, err := srv.Users.GetProfile("me").Do()
-				if err != nil {
-					log.Printf("Failed to get profile for %s: %v", acc.Name, err)
-					return
-				}
-				accountEmail = profile.EmailAddress
-				fmt.Printf("  → Detected email: %s\n", accountEmail)
-			}
+			res, err := scanAccountWithin(ctx, acc, opts)
+			name := accountLabel(acc, res)
 
-			query := buildQuery(days)
-			messages, err := gmail.FetchMessages(srv, "me", query)
-			if err != nil {
-				log.Printf("Failed to fetch messages for %s: %v", accountEmail, err)
+			mu.Lock()
+			defer mu.Unlock()
+
+			outcome := report.AccountStatus{Account: name, Status: report.AccountScanned}
+			switch {
+			case res == nil && errors.Is(err, context.DeadlineExceeded):
+				log.Printf("Timed out on %s after %s", name, opts.accountTimeout)
+				outcome.Status = report.AccountSkipped
+				outcome.Reason = fmt.Sprintf("timed out after %s", opts.accountTimeout)
+				outcomes = append(outcomes, outcome)
 				return
-			}
-
-			orders, shipped, err := gmail.ProcessEmails(srv, "me", messages)
-			if err != nil {
-				log.Printf("Failed to process emails for %s: %v", accountEmail, err)
+			case res == nil:
+				log.Printf("Error with %s: %v", name, err)
+				outcome.Status = report.AccountSkipped
+				outcome.Reason = err.Error()
+				outcomes = append(outcomes, outcome)
 				return
+			case err != nil:
+				log.Printf("Timed out on %s after %s; keeping %d of %d messages", name, opts.accountTimeout, res.stats.Processed, res.messages)
+				outcome.Status = report.AccountPartial
+				outcome.Reason = fmt.Sprintf("timed out after %s; only %d of %d messages are included", opts.accountTimeout, res.stats.Processed, res.messages)
+			default:
+				elapsed := time.Since(startTime)
+				fmt.Printf("  ✓ Completed %s in %s\n", name, elapsed.Round(time.Millisecond))
 			}
+			outcome.Orders = len(res.orders)
+			outcomes = append(outcomes, outcome)
 
-			elapsed := time.Since(startTime)
-			fmt.Printf("  ✓ Completed %s in %s\n", accountEmail, elapsed.Round(time.Millisecond))
-
-			mu.Lock()
-			mergeOrders(allOrders, orders)
-			allShipped = append(allShipped, shipped...)
-			totalEmails += len(messages)
-			mu.Unlock()
+			report.MergeOrders(allOrders, res.orders)
+			allShipped = append(allShipped, res.shipped...)
+			allStats.Add(res.stats)
 		}(account)
 	}
 
 	wg.Wait()
 
-	outDir := "out/combined"
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		log.Fatalf("failed to create output directory: %v", err)
-	}
-
-	dateRange := formatDateRange(days)
-	htmlPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.html", dateRange))
-	csvPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.csv", dateRange))
-	shippedCSVPath := filepath.Join(outDir, fmt.Sprintf("shipped_orders_%s.csv", dateRange))
-
-	var reportWg sync.WaitGroup
-	var htmlErr, csvErr, shippedErr error
-
-	reportWg.Add(3)
-	go func() {
-		defer reportWg.Done()
-		htmlErr = report.GenerateHTML(allOrders, totalEmails, days, htmlPath, allShipped)
-	}()
-	go func() {
-		defer reportWg.Done()
-		csvErr = report.GenerateCSV(allOrders, csvPath)
-	}()
-	go func() {
-		defer reportWg.Done()
-		shippedErr = report.GenerateShippedCSV(allShipped, shippedCSVPath)
-	}()
-
-	reportWg.Wait()
-
-	if htmlErr != nil {
-		log.Fatalf("write html: %v", htmlErr)
-	}
-	if csvErr != nil {
-		log.Fatalf("write csv: %v", csvErr)
-	}
-	if shippedErr != nil {
-		log.Fatalf("write shipped csv: %v", shippedErr)
-	}
-
-	fmt.Printf("\nCombined report has been generated: %s\n", htmlPath)
-	if err := openReport(htmlPath); err != nil {
-		log.Printf("open report: %v", err)
-	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].Account < outcomes[j].Account })
+	writeCombinedReport(allOrders, allShipped, outcomes, opts)
+	return allStats, outcomes
 }
 
-func processAccountsSequentially(accounts []AccountConfig, days int) {
+func processAccountsSequentially(accounts []AccountConfig, opts options) (gmail.ScanStats, []report.AccountStatus) {
 	allOrders := make(map[string]*report.Order)
 	var allShipped []*report.ShippedOrder
-	totalEmails := 0
+	var allStats gmail.ScanStats
+	var outcomes []report.AccountStatus
 
 	for _, account := range accounts {
 		startTime := time.Now()
 		fmt.Printf("\nProcessing account: %s\n", account.Name)
 
-		srv, err := gmail.InitializeGmailService(account.CredentialsPath, account.TokenPath)
-		if err != nil {
-			log.Printf("Error with %s: %v", account.Name, err)
-			continue
-		}
-
-		accountEmail := account.Email
-		if account.IsRoot {
-			profile, err := srv.Users.GetProfile("me").Do()
-			if err != nil {
-				log.Printf("Failed to get profile for %s: %v", account.Name, err)
-				continue
-			}
-			accountEmail = profile.EmailAddress
-			fmt.Printf("  → Detected email: %s\n", accountEmail)
-		}
-
-		query := buildQuery(days)
-		messages, err := gmail.FetchMessages(srv, "me", query)
-		if err != nil {
-			log.Printf("Failed to fetch messages for %s: %v", accountEmail, err)
-			continue
-		}
-
-		orders, shipped, err := gmail.ProcessEmails(srv, "me", messages)
+		res, err := scanAccount(context.Background(), account, opts)
+		name := accountLabel(account, res)
 		if err != nil {
-			log.Printf("Failed to process emails for %s: %v", accountEmail, err)
+			log.Printf("Error with %s: %v", name, err)
+			outcomes = append(outcomes, report.AccountStatus{Account: name, Status: report.AccountSkipped, Reason: err.Error()})
 			continue
 		}
 
 		elapsed := time.Since(startTime)
-		fmt.Printf("  ✓ Completed %s in %s\n", accountEmail, elapsed.Round(time.Millisecond))
+		fmt.Printf("  ✓ Completed %s in %s\n", name, elapsed.Round(time.Millisecond))
+		outcomes = append(outcomes, report.AccountStatus{Account: name, Status: report.AccountScanned, Orders: len(res.orders)})
 
-		mergeOrders(allOrders, orders)
-		allShipped = append(allShipped, shipped...)
-		totalEmails += len(messages)
+		report.MergeOrders(allOrders, res.orders)
+		allShipped = append(allShipped, res.shipped...)
+		allStats.Add(res.stats)
 	}
 
-	outDir := "out/combined"
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		log.Fatalf("failed to create output directory: %v", err)
-	}
-
-	dateRange := formatDateRange(days)
-	htmlPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.html", dateRange))
-	csvPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.csv", dateRange))
-	shippedCSVPath := filepath.Join(outDir, fmt.Sprintf("shipped_orders_%s.csv", dateRange))
-
-	var reportWg sync.WaitGroup
-	var htmlErr, csvErr, shippedErr error
+	writeCombinedReport(allOrders, allShipped, outcomes, opts)
+	return allStats, outcomes
+}
 
-	reportWg.Add(3)
-	go func() {
-		defer reportWg.Done()
-		htmlErr = report.GenerateHTML(allOrders, totalEmails, days, htmlPath, allShipped)
-	}()
-	go func() {
-		defer reportWg.Done()
-		csvErr = report.GenerateCSV(allOrders, csvPath)
-	}()
-	go func() {
-		defer reportWg.Done()
-		shippedErr = report.GenerateShippedCSV(allShipped, shippedCSVPath)
-	}()
+// printAccountSummary lists which accounts made it into a combined report.
+func printAccountSummary(accounts []report.AccountStatus) {
+	fmt.Println("\nAccounts:")
+	for _, a := range accounts {
+		switch a.Status {
+		case report.AccountScanned:
+			fmt.Printf("  ✓ %s: scanned, %d order(s)\n", a.Account, a.Orders)
+		case report.AccountPartial:
+			fmt.Printf("  ⚠️  %s: partial, %d order(s); %s\n", a.Account, a.Orders, a.Reason)
+		default:
+			fmt.Printf("  ✗ %s: skipped; %s\n", a.Account, a.Reason)
+		}
+	}
+}
 
-	reportWg.Wait()
+func writeCombinedReport(orders map[string]*report.Order, shipped []*report.ShippedOrder, accounts []report.AccountStatus, opts options) {
+	printAccountSummary(accounts)
 
-	if htmlErr != nil {
-		log.Fatalf("write html: %v", htmlErr)
+	if opts.list {
+		printOrderList(orders, opts)
+		return
 	}
-	if csvErr != nil {
-		log.Fatalf("write csv: %v", csvErr)
+	if opts.dryRun {
+		printDryRunSummary(orders, shipped)
+		return
 	}
-	if shippedErr != nil {
-		log.Fatalf("write shipped csv: %v", shippedErr)
+
+	htmlPath, err := writeReports("", orders, shipped, accounts, true, opts)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	fmt.Printf("\nCombined report has been generated: %s\n", htmlPath)
-	if err := openReport(htmlPath); err != nil {
+	if err := openReport(htmlPath, opts); err != nil {
 		log.Printf("open report: %v", err)
 	}
 }
 
-func processSingleAccount(account AccountConfig, days int) {
+func processSingleAccount(account AccountConfig, opts options) gmail.ScanStats {
 	startTime := time.Now()
 
-	srv, err := gmail.InitializeGmailService(account.CredentialsPath, account.TokenPath)
+	client, err := gmail.InitializeGmailClient(account.CredentialsPath, account.TokenPath)
+	if err != nil {
+		log.Fatalf("unable to initialize gmail service: %v", err)
+	}
+	srv, err := gmail.NewService(context.Background(), client)
 	if err != nil {
 		log.Fatalf("unable to initialize gmail service: %v", err)
 	}
 
-	const user = "me"
-	profile, err := srv.Users.GetProfile(user).Do()
+	user := opts.user
+	profile, err := gmail.GetProfile(context.Background(), srv, user)
 	if err != nil {
-		log.Fatalf("unable to retrieve user profile: %v", err)
+		log.Fatalf("unable to retrieve user profile: %v", scopeHint(err, account.TokenPath))
 	}
 
 	fmt.Printf("\nProcessing account: %s\n", profile.EmailAddress)
 
-	query := buildQuery(days)
-	allMessages, err := gmail.FetchMessages(srv, user, query)
+	allMessages, saveSync, err := fetchMessages(context.Background(), srv, account, opts)
 	if err != nil {
-		log.Fatalf("unable to fetch messages: %v", err)
+		log.Fatalf("unable to fetch messages: %v", scopeHint(err, account.TokenPath))
 	}
 
-	orders, shipped, err := gmail.ProcessEmails(srv, user, allMessages)
+	orders, shipped, stats, err := gmail.ProcessEmailsWithOptions(context.Background(), srv, user, allMessages, opts.processOptions(profile.EmailAddress, client))
 	if err != nil {
 		log.Fatalf("processing failed: %v", err)
 	}
+	saveSync()
 
 	elapsed := time.Since(startTime)
 	fmt.Printf("  ✓ Completed %s in %s\n", profile.EmailAddress, elapsed.Round(time.Millisecond))
 
-	outDir := filepath.Join("out", profile.EmailAddress)
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		log.Fatalf("failed to create output directory: %v", err)
-	}
-
-	dateRange := formatDateRange(days)
-	htmlPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.html", dateRange))
-	csvPath := filepath.Join(outDir, fmt.Sprintf("orders_%s.csv", dateRange))
-	shippedCSVPath := filepath.Join(outDir, fmt.Sprintf("shipped_orders_%s.csv", dateRange))
-
-	var reportWg sync.WaitGroup
-	var htmlErr, csvErr, shippedErr error
-
-	reportWg.Add(3)
-	go func() {
-		defer reportWg.Done()
-		htmlErr = report.GenerateHTML(orders, len(allMessages), days, htmlPath, shipped)
-	}()
-	go func() {
-		defer reportWg.Done()
-		csvErr = report.GenerateCSV(orders, csvPath)
-	}()
-	go func() {
-		defer reportWg.Done()
-		shippedErr = report.GenerateShippedCSV(shipped, shippedCSVPath)
-	}()
-
-	reportWg.Wait()
-
-	if htmlErr != nil {
-		log.Fatalf("write html: %v", htmlErr)
+	if opts.list {
+		printOrderList(orders, opts)
+		return stats
 	}
-	if csvErr != nil {
-		log.Fatalf("write csv: %v", csvErr)
+	if opts.dryRun {
+		printDryRunSummary(orders, shipped)
+		return stats
 	}
-	if shippedErr != nil {
-		log.Fatalf("write shipped csv: %v", shippedErr)
+
+	htmlPath, err := writeReports(profile.EmailAddress, orders, shipped, nil, false, opts)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	fmt.Printf("Report has been generated: %s\n", htmlPath)
-	if err := openReport(htmlPath); err != nil {
+	if err := openReport(htmlPath, opts); err != nil {
 		log.Printf("open report: %v", err)
 	}
+	return stats
 }
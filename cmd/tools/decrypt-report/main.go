@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"walmart-order-checker/internal/security"
+)
+
+func main() {
+	outFlag := flag.String("out", "", "Output path (default: input path without .enc)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: decrypt-report [-out path] <report.enc>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	in := flag.Arg(0)
+
+	out := *outFlag
+	if out == "" {
+		out = strings.TrimSuffix(in, ".enc")
+		if out == in {
+			log.Fatal("input has no .enc suffix; pass -out explicitly")
+		}
+	}
+
+	data, err := os.ReadFile(in)
+	if err != nil {
+		log.Fatalf("read %s: %v", in, err)
+	}
+
+	pass, err := security.ReadPassphrase("REPORT_PASSPHRASE", "Report passphrase: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plaintext, err := security.DecryptWithPassphrase(data, pass)
+	if err != nil {
+		log.Fatalf("decrypt %s: %v", in, err)
+	}
+
+	if err := os.WriteFile(out, plaintext, 0o600); err != nil {
+		log.Fatalf("write %s: %v", out, err)
+	}
+	fmt.Printf("Decrypted report written to %s\n", out)
+}
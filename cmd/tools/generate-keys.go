@@ -8,7 +8,7 @@ import (
 )
 
 func main() {
-	fmt.Println("=== Generate Secure Keys ===\n")
+	fmt.Print("=== Generate Secure Keys ===\n\n")
 
 	// Generate SESSION_KEY
 	sessionKey := make([]byte, 32)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/oauth2"
+
+	"walmart-order-checker/internal/security"
+	"walmart-order-checker/internal/storage"
+)
+
+const passphraseEnv = "TOKEN_EXPORT_PASSPHRASE"
+
+// exportFile is what an export holds once decrypted with its passphrase.
+type exportFile struct {
+	Version int           `json:"version"`
+	Tokens  []exportToken `json:"tokens"`
+}
+
+type exportToken struct {
+	Email string        `json:"email"`
+	Token *oauth2.Token `json:"token"`
+}
+
+func main() {
+	dbFlag := flag.String("db", ".data/tokens.db", "Token database to read from or write to")
+	yesFlag := flag.Bool("yes", false, "Confirm that you understand the export file holds every account's Gmail access")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: migrate-tokens [-db path] -yes export|import <file>")
+		fmt.Fprintln(os.Stderr, "\nMoves the web server's OAuth tokens between machines. export decrypts them with")
+		fmt.Fprintln(os.Stderr, "this machine's ENCRYPTION_KEY and writes them encrypted with a passphrase")
+		fmt.Fprintf(os.Stderr, "(from %s or a prompt); import re-encrypts them with the destination's key.\n\n", passphraseEnv)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, path := flag.Arg(0), flag.Arg(1)
+	if command != "export" && command != "import" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fmt.Fprintln(os.Stderr, "WARNING: the export file grants read access to the Gmail of every account in it.")
+	fmt.Fprintln(os.Stderr, "WARNING: it is only as safe as its passphrase; delete it as soon as the import is done.")
+	if !*yesFlag {
+		log.Fatal("refusing to continue without -yes")
+	}
+
+	godotenv.Load()
+	// Without a key, the token database would make up a temporary one: an
+	// export would fail to decrypt, and an import would be lost on restart.
+	if os.Getenv("ENCRYPTION_KEY") == "" {
+		log.Fatal("ENCRYPTION_KEY must be set (in the environment or .env)")
+	}
+
+	ts, err := storage.NewTokenStorage(*dbFlag)
+	if err != nil {
+		log.Fatalf("open %s: %v", *dbFlag, err)
+	}
+	defer ts.Close()
+
+	if command == "export" {
+		err = exportTokens(ts, path)
+	} else {
+		err = importTokens(ts, path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func exportTokens(ts *storage.TokenStorage, path string) error {
+	emails, err := ts.ListEmails()
+	if err != nil {
+		return fmt.Errorf("list accounts: %w", err)
+	}
+	export := exportFile{Version: 1}
+	for _, email := range emails {
+		token, err := ts.Load(email)
+		if err != nil {
+			return fmt.Errorf("load token for %s: %w", email, err)
+		}
+		export.Tokens = append(export.Tokens, exportToken{Email: email, Token: token})
+	}
+
+	pass, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	data, err := security.EncryptWithPassphrase(plaintext, pass)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	// Never overwrite: the file may be an earlier export still needed.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Printf("Exported %d account(s) to %s\n", len(export.Tokens), path)
+	return nil
+}
+
+func importTokens(ts *storage.TokenStorage, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pass, err := security.ReadPassphrase(passphraseEnv, "Export passphrase: ")
+	if err != nil {
+		return err
+	}
+	plaintext, err := security.DecryptWithPassphrase(data, pass)
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	var export exportFile
+	if err := json.Unmarshal(plaintext, &export); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if export.Version != 1 {
+		return fmt.Errorf("%s: unsupported export version %d", path, export.Version)
+	}
+
+	for _, t := range export.Tokens {
+		if t.Email == "" || t.Token == nil {
+			return fmt.Errorf("%s: incomplete token entry", path)
+		}
+		if err := ts.Save(t.Email, t.Token); err != nil {
+			return fmt.Errorf("save token for %s: %w", t.Email, err)
+		}
+		fmt.Printf("Imported %s\n", t.Email)
+	}
+	fmt.Printf("Imported %d account(s); you can now delete %s\n", len(export.Tokens), path)
+	return nil
+}
+
+// readNewPassphrase reads the passphrase an export is encrypted with, asking
+// twice when it is typed in.
+func readNewPassphrase() (string, error) {
+	if pass := os.Getenv(passphraseEnv); pass != "" {
+		return pass, nil
+	}
+	pass, err := security.ReadPassphrase(passphraseEnv, "Export passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", fmt.Errorf("the passphrase cannot be empty")
+	}
+	again, err := security.ReadPassphrase(passphraseEnv, "Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != pass {
+		return "", fmt.Errorf("passphrases don't match")
+	}
+	return pass, nil
+}
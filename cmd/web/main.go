@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,12 +22,20 @@ import (
 	"walmart-order-checker/internal/auth"
 	"walmart-order-checker/internal/security"
 	"walmart-order-checker/internal/storage"
+	"walmart-order-checker/pkg/gmail"
+	"walmart-order-checker/pkg/report"
 )
 
+// distDir holds the built frontend.
+const distDir = "./web/dist"
+
 func main() {
 	godotenv.Load()
 
 	port := flag.String("port", "3000", "Port to run the server on")
+	imageWorkers := flag.Int("image-workers", report.DefaultImageWorkers, "Concurrent upstream fetches for the image proxy")
+	imageTimeout := flag.Duration("image-timeout", report.DefaultImageTimeout, "Per-image timeout for the image proxy")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "On SIGINT/SIGTERM, how long to wait for requests and running scans to finish")
 	flag.Parse()
 
 	clientID := os.Getenv("GOOGLE_CLIENT_ID")
@@ -51,7 +65,22 @@ func main() {
 	}
 
 	authManager := auth.NewManager(clientID, clientSecret, redirectURL, tokenStorage)
-	server := api.NewServer(authManager, tokenStorage)
+	// One message cache serves every scan, so its SQLite handle and cleanup
+	// goroutine are opened once rather than per request.
+	cache := gmail.NewMessageCache(gmail.DefaultCachePath, gmail.CacheTTL())
+	defer cache.Close()
+
+	server := api.NewServer(authManager, tokenStorage, cache)
+	server.SetImageFetcher(report.NewImageFetcher(*imageWorkers, *imageTimeout))
+
+	// Health probes and metrics sit in front of the logger and rate limiters so
+	// frequent polling neither fills the log nor gets throttled.
+	root := chi.NewRouter()
+	root.Get("/healthz", server.HandleHealthz)
+	root.Get("/readyz", server.HandleReadyz(distDir))
+	if server.MetricsEnabled() {
+		root.Get("/metrics", server.HandleMetrics)
+	}
 
 	globalRateLimiter := api.NewRateLimiter(100, 10)
 	authRateLimiter := api.NewRateLimiter(20, 5)
@@ -84,39 +113,78 @@ func main() {
 	}))
 
 	r.Route("/api", func(r chi.Router) {
+		r.Use(api.GzipMiddleware)
+
 		r.Route("/auth", func(r chi.Router) {
 			r.Use(authRateLimiter.Middleware)
 			r.Get("/login", server.HandleLogin)
 			r.Get("/callback", server.HandleCallback)
 			r.Post("/logout", server.HandleLogout)
+			r.Delete("/account", server.HandleDeleteAccount)
 			r.Get("/status", server.HandleAuthStatus)
+			r.Get("/config-check", server.HandleAuthConfigCheck)
 		})
 
 		r.Group(func(r chi.Router) {
 			r.Use(api.JSONMiddleware)
 
 			r.Post("/scan", server.HandleScan)
+			r.Post("/scan/all", server.HandleScanAll)
+			r.Delete("/scan", server.HandleScanCancel)
 			r.Get("/scan/status", server.HandleScanStatus)
 			r.Get("/report", server.HandleReport)
+			r.Post("/report/recompute", server.HandleReportRecompute)
+			r.Post("/report/share", server.HandleShareReport)
+			r.Post("/orders/{orderID}/ack", server.HandleAckOrder)
+			r.Delete("/orders/{orderID}/ack", server.HandleAckOrder)
 
 			r.Get("/cache/stats", server.HandleCacheStats)
 			r.Delete("/cache/clear", server.HandleCacheClear)
 		})
 
+		r.Get("/report.jsonl", server.HandleReportJSONL)
+		r.Get("/report/html", server.HandleReportHTML)
+		r.Get("/report/csv", server.HandleReportCSV)
+		r.Get("/report/csv/shipped", server.HandleReportShippedCSV)
+		r.Get("/report/csv/canceled", server.HandleReportCanceledCSV)
+		r.Get("/report/ics", server.HandleReportICS)
+		r.Get("/shared/{token}", server.HandleSharedReport)
+		r.Get("/img", server.HandleImageProxy)
 		r.Get("/ws/scan", server.HandleWebSocket(authManager))
 	})
 
-	fileServer := http.FileServer(http.Dir("./web/dist"))
+	fileServer := http.FileServer(http.Dir(distDir))
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		if _, err := http.Dir("./web/dist").Open(r.URL.Path); err != nil {
-			http.ServeFile(w, r, "./web/dist/index.html")
+		if _, err := http.Dir(distDir).Open(r.URL.Path); err != nil {
+			http.ServeFile(w, r, filepath.Join(distDir, "index.html"))
 		} else {
 			fileServer.ServeHTTP(w, r)
 		}
 	})
+	root.Mount("/", r)
 
 	addr := ":" + *port
 	log.Printf("Starting server on http://localhost%s", addr)
 	log.Printf("OAuth redirect URL: %s", redirectURL)
-	log.Fatal(http.ListenAndServe(addr, r))
+
+	httpServer := &http.Server{Addr: addr, Handler: root}
+	go func() {
+		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, waiting up to %s for requests and scans...", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: HTTP shutdown: %v", err)
+	}
+	if err := server.WaitForScans(shutdownCtx); err != nil {
+		log.Printf("Warning: scans still running at shutdown: %v", err)
+	}
 }
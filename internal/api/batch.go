@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"walmart-order-checker/pkg/gmail"
+	"walmart-order-checker/pkg/report"
+)
+
+// allAccountsFromEnv reads SCAN_ALL_ACCOUNTS, a comma-separated list of the
+// signed-in accounts that /api/scan/all scans together. Any of them may start
+// a batch scan covering all of them; without the variable the endpoint is
+// off, so one user can never read another's mail by default.
+func allAccountsFromEnv() []string {
+	var accounts []string
+	for _, v := range strings.Split(os.Getenv("SCAN_ALL_ACCOUNTS"), ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			accounts = append(accounts, v)
+		}
+	}
+	return accounts
+}
+
+// updateBatch copies an account scan's progress into the batch scan it is
+// part of, if any. s.scanMu must be held.
+func (p *ScanProgress) updateBatch() {
+	b := p.batch
+	if b == nil {
+		return
+	}
+	b.TotalMessages = b.doneTotal + p.TotalMessages
+	b.Processed = b.doneProcessed + p.Processed
+	b.Rate = p.Rate
+	b.CurrentEmail = p.CurrentEmail
+	b.LastProgressUpdate = time.Now()
+}
+
+// HandleScanAll scans every account listed in SCAN_ALL_ACCOUNTS that has
+// signed in, one after another, and merges their orders into one report. It
+// takes the same body as HandleScan. The batch runs as the signed-in
+// account's scan, so its progress arrives over the usual WebSocket and its
+// report is served by /api/report.
+func (s *Server) HandleScanAll(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	email := s.sessionEmail(r)
+	if !slices.Contains(s.allAccounts, strings.ToLower(email)) {
+		writeJSONError(w, http.StatusForbidden, "Batch scans aren't enabled for this account", "batch_scan_disabled")
+		return
+	}
+
+	var req struct {
+		Days        int    `json:"days"`
+		ClearCache  bool   `json:"clear_cache"`
+		Incremental bool   `json:"incremental"`
+		Workers     int    `json:"workers"`
+		Query       string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request", "invalid_request")
+		return
+	}
+	if req.Days <= 0 {
+		req.Days = 10
+	}
+	if req.Days > 365 {
+		req.Days = 365
+	}
+	req.Workers = max(0, min(req.Workers, gmail.MaxFetchWorkers))
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query != "" && req.Incremental {
+		writeJSONError(w, http.StatusBadRequest, "A custom query can't be used for an incremental scan", "invalid_request")
+		return
+	}
+
+	stored, err := s.tokenStorage.ListEmails()
+	if err != nil {
+		log.Printf("Failed to list accounts: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list accounts", "accounts_unavailable")
+		return
+	}
+	var accounts []string
+	for _, account := range stored {
+		if slices.Contains(s.allAccounts, strings.ToLower(account)) {
+			accounts = append(accounts, account)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	batch := &ScanProgress{
+		InProgress:         true,
+		StartTime:          now,
+		LastProgressUpdate: now,
+		CurrentEmail:       email,
+		DaysScanned:        req.Days,
+		cancel:             cancel,
+		done:               make(chan struct{}),
+	}
+
+	s.scanMu.Lock()
+	if existing := s.activeScans[email]; existing != nil && existing.InProgress {
+		s.scanMu.Unlock()
+		cancel()
+		writeJSONError(w, http.StatusConflict, "Scan already in progress", "scan_in_progress")
+		return
+	}
+	s.activeScans[email] = batch
+	s.scanMu.Unlock()
+
+	go s.watchProgress(batch, cancel)
+	s.scans.Add(1)
+	go s.runBatchScan(ctx, batch, email, accounts, req.Days, req.ClearCache, req.Incremental, req.Workers, req.Query)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "scan_started",
+		"accounts": accounts,
+	})
+}
+
+// runBatchScan runs runScan for each of accounts in turn, feeding their
+// progress into batch, and leaves the merged orders in batch. An account
+// that fails is skipped and noted in batch.Accounts. The accounts' own
+// stored results are left as they were; the merged ones are saved as owner's,
+// the account the batch runs as.
+func (s *Server) runBatchScan(ctx context.Context, batch *ScanProgress, owner string, accounts []string, days int, clearCache, incremental bool, workers int, customQuery string) {
+	log.Printf("Batch scan started: %d account(s), %d days", len(accounts), days)
+	defer s.scans.Done()
+	defer func() {
+		s.scanMu.Lock()
+		batch.InProgress = false
+		if batch.cancel != nil {
+			batch.cancel()
+			batch.cancel = nil
+		}
+		s.scanMu.Unlock()
+		close(batch.done)
+	}()
+
+	orders := make(map[string]*report.Order)
+	var shipped []*report.ShippedOrder
+	var statuses []report.AccountStatus
+	skip := func(account, reason string) {
+		log.Printf("Batch scan: skipping %s: %s", account, reason)
+		statuses = append(statuses, report.AccountStatus{Account: account, Status: report.AccountSkipped, Reason: reason})
+	}
+
+	for _, account := range accounts {
+		if ctx.Err() != nil {
+			break
+		}
+
+		s.scanMu.Lock()
+		own := s.activeScans[account]
+		busy := own != nil && own != batch && own.InProgress
+		s.scanMu.Unlock()
+		if busy {
+			skip(account, "a scan of this account is already running")
+			continue
+		}
+
+		client, err := s.authManager.GmailClientFor(account)
+		if err != nil {
+			skip(account, err.Error())
+			continue
+		}
+
+		now := time.Now()
+		scan := &ScanProgress{
+			InProgress:         true,
+			StartTime:          now,
+			LastProgressUpdate: now,
+			CurrentEmail:       account,
+			DaysScanned:        days,
+			batch:              batch,
+			done:               make(chan struct{}),
+		}
+		s.scanMu.Lock()
+		scan.updateBatch()
+		s.scanMu.Unlock()
+
+		// The message cache is shared, so clearing it once is enough.
+		s.metrics.scanStarted()
+		s.scans.Add(1)
+		s.runScan(ctx, scan, client, account, days, clearCache, incremental, workers, customQuery)
+		clearCache = false
+
+		s.scanMu.Lock()
+		batch.doneTotal += scan.TotalMessages
+		batch.doneProcessed += scan.Processed
+		scanErr, scanOrders, scanShipped := scan.Error, scan.Orders, scan.Shipped
+		s.scanMu.Unlock()
+
+		if scanErr != "" {
+			skip(account, scanErr)
+			continue
+		}
+		for _, order := range scanOrders {
+			order.AddSourceAccounts(account)
+		}
+		report.MergeOrders(orders, scanOrders)
+		shipped = append(shipped, scanShipped...)
+		statuses = append(statuses, report.AccountStatus{Account: account, Status: report.AccountScanned, Orders: len(scanOrders)})
+	}
+
+	s.scanMu.Lock()
+	switch {
+	case ctx.Err() != nil:
+		if batch.Error == "" {
+			batch.Error = ctx.Err().Error()
+		}
+		log.Printf("Batch scan stopped: %s", batch.Error)
+		s.scanMu.Unlock()
+		return
+	case len(statuses) > 0 && !slices.ContainsFunc(statuses, func(a report.AccountStatus) bool { return a.Status == report.AccountScanned }):
+		batch.Error = "no account could be scanned"
+	case len(accounts) == 0:
+		batch.Error = "no account in SCAN_ALL_ACCOUNTS has signed in"
+	}
+	batch.Accounts = statuses
+	if batch.Error != "" {
+		log.Printf("Batch scan failed: %s", batch.Error)
+		s.scanMu.Unlock()
+		return
+	}
+
+	batch.Orders = orders
+	batch.Shipped = shipped
+	batch.Processed = batch.doneProcessed
+	batch.TotalMessages = batch.doneTotal
+	batch.CompletedAt = time.Now()
+	s.scanMu.Unlock()
+
+	s.saveScanResults(owner, batch, days)
+	log.Printf("Batch scan completed: %d account(s), %d orders, %d shipments", len(accounts), len(orders), len(shipped))
+}
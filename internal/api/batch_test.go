@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"walmart-order-checker/internal/auth"
+	"walmart-order-checker/internal/security"
+	"walmart-order-checker/internal/storage"
+	"walmart-order-checker/pkg/gmail"
+	"walmart-order-checker/pkg/report"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// fakeGmail points every default-transport request, as the OAuth clients
+// send them, at a Gmail API whose mailboxes are empty.
+func fakeGmail(t *testing.T) {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/profile"):
+			json.NewEncoder(w).Encode(map[string]any{"historyId": "100"})
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			json.NewEncoder(w).Encode(map[string]any{"resultSizeEstimate": 0})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	target, _ := url.Parse(ts.URL)
+	base := ts.Client().Transport
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host, r.Host = target.Scheme, target.Host, ""
+		return base.RoundTrip(r)
+	})
+	t.Cleanup(func() { http.DefaultTransport = orig })
+}
+
+func TestBatchScanKeepsMemberResults(t *testing.T) {
+	encKey, err := security.GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_KEY", encKey)
+	sessionKey, err := security.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SESSION_KEY", sessionKey)
+	tokens, err := storage.NewTokenStorage(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+	fakeGmail(t)
+
+	const owner, member = "owner@example.com", "member@example.com"
+	for _, email := range []string{owner, member} {
+		if err := tokens.Save(email, &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The member's own last scan found one order.
+	earlier := &storage.ScanResults{Orders: map[string]*report.Order{"1234": {ID: "1234", Status: "confirmed"}}, DaysScanned: 30}
+	if err := tokens.SaveScanResults(member, earlier); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.SaveScanOrders(member, []string{"1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.SaveSyncState(member, []byte(`{"history_id":7}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		authManager:  auth.NewManager("id", "secret", "http://localhost/api/auth/callback", tokens),
+		tokenStorage: tokens,
+		activeScans:  make(map[string]*ScanProgress),
+		cache:        gmail.NewMemoryCache(time.Hour),
+		query:        gmail.DefaultQueryConfig,
+	}
+	batch := &ScanProgress{InProgress: true, StartTime: time.Now(), done: make(chan struct{})}
+	s.activeScans[owner] = batch
+	s.scans.Add(1)
+	s.runBatchScan(context.Background(), batch, owner, []string{owner, member}, 10, false, false, 0, "")
+
+	if batch.Error != "" || len(batch.Accounts) != 2 {
+		t.Fatalf("batch error %q, accounts %+v; want both scanned", batch.Error, batch.Accounts)
+	}
+	got, err := tokens.ScanResults(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.DaysScanned != 30 || got.Orders["1234"] == nil {
+		t.Errorf("member's stored results = %+v, want its own earlier scan", got)
+	}
+	if ids, _, _ := tokens.PreviousScanOrders(member); !ids["1234"] {
+		t.Errorf("member's order history = %v, want its earlier order", ids)
+	}
+	if state, _ := tokens.SyncState(member); string(state) != `{"history_id":7}` {
+		t.Errorf("member's sync state = %s, want it unchanged", state)
+	}
+
+	// The merged result is what the owner's report shows after a restart.
+	merged, err := tokens.ScanResults(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged == nil || merged.DaysScanned != 10 || !merged.StartedAt.Equal(batch.StartTime) {
+		t.Errorf("owner's stored results = %+v, want the batch's", merged)
+	}
+}
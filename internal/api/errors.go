@@ -0,0 +1,23 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type errorBody struct {
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// writeJSONError replies with {"error": {"message": ..., "code": ...}} so
+// clients can handle failures the same way on every /api endpoint. code is a
+// stable machine-readable identifier; message is for display.
+func writeJSONError(w http.ResponseWriter, status int, message, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]errorBody{
+		"error": {Message: message, Code: code},
+	})
+}
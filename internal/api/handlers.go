@@ -3,13 +3,19 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	gm "google.golang.org/api/gmail/v1"
+	"github.com/go-chi/chi/v5"
 
 	"walmart-order-checker/internal/auth"
 	"walmart-order-checker/internal/storage"
@@ -21,13 +27,31 @@ type Server struct {
 	authManager  *auth.Manager
 	tokenStorage *storage.TokenStorage
 	scanMu       sync.Mutex
-	activeScan   *ScanProgress
+	activeScans  map[string]*ScanProgress // latest scan per account email
+	scans        sync.WaitGroup           // running runScan goroutines
+	imageFetcher *report.ImageFetcher
+	retry        gmail.RetryPolicy
+	query        gmail.QueryConfig
+	region       report.Region // from WALMART_REGION
+	shareKey     []byte        // signs share links; see share.go
+	metrics      *metrics      // nil unless METRICS_ENABLED; see metrics.go
+	allAccounts  []string      // accounts /api/scan/all covers; see batch.go
+	cache        gmail.Cache   // shared by every scan and cache endpoint
+	// aliases group product names in reports; from report.DefaultAliasesPath.
+	aliases []report.ProductAlias
+	// extraCancels are added to the default cancel patterns; from
+	// gmail.DefaultCancelPatternsPath.
+	extraCancels []gmail.CancelPattern
+	// maxOrderLines bounds the order_lines of a report response; from
+	// REPORT_MAX_ORDER_LINES.
+	maxOrderLines int
 }
 
 type ScanProgress struct {
 	InProgress         bool                     `json:"in_progress"`
 	TotalMessages      int                      `json:"total_messages"`
 	Processed          int                      `json:"processed"`
+	Rate               float64                  `json:"rate"` // messages per second
 	CurrentEmail       string                   `json:"current_email"`
 	StartTime          time.Time                `json:"start_time"`
 	LastProgressUpdate time.Time                `json:"-"` // Internal field, not sent to frontend
@@ -35,19 +59,58 @@ type ScanProgress struct {
 	Shipped            []*report.ShippedOrder   `json:"shipped,omitempty"`
 	Error              string                   `json:"error,omitempty"`
 	DaysScanned        int                      `json:"days_scanned,omitempty"`
+	// CompletedAt is when the scan finished successfully; zero until then.
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+	// Truncated marks a WebSocket snapshot that left out Orders and Shipped
+	// because it was too large; the client should fetch ReportURL instead.
+	Truncated bool   `json:"truncated,omitempty"`
+	ReportURL string `json:"report_url,omitempty"`
+	// Accounts lists how each account of a batch scan fared.
+	Accounts []report.AccountStatus `json:"accounts,omitempty"`
+
+	// cancel stops the scan's workers; nil once the scan isn't running.
+	cancel context.CancelFunc
+	// canceling is set once the scan has been told to stop. It stays
+	// InProgress until its goroutine returns, so a new scan of the account
+	// can't start alongside it.
+	canceling bool
+	// done is closed once the scan's goroutine has returned and written
+	// everything it is going to; nil for a scan restored from storage.
+	done chan struct{}
+	// batch is the batch scan this account scan is part of, if any; see
+	// updateBatch.
+	batch *ScanProgress
+	// doneTotal and doneProcessed count the messages of a batch scan's
+	// finished accounts.
+	doneTotal, doneProcessed int
 }
 
-func NewServer(authManager *auth.Manager, tokenStorage *storage.TokenStorage) *Server {
-	return &Server{
-		authManager:  authManager,
-		tokenStorage: tokenStorage,
+// NewServer returns a Server that keeps parsed messages in cache. The caller
+// owns cache and closes it once the server has stopped.
+func NewServer(authManager *auth.Manager, tokenStorage *storage.TokenStorage, cache gmail.Cache) *Server {
+	s := &Server{
+		authManager:   authManager,
+		tokenStorage:  tokenStorage,
+		activeScans:   make(map[string]*ScanProgress),
+		retry:         gmail.RetryPolicyFromEnv(),
+		query:         loadQueryConfig(),
+		aliases:       loadProductAliases(),
+		extraCancels:  loadCancelPatterns(),
+		region:        regionFromEnv(),
+		shareKey:      newShareKey(),
+		metrics:       metricsFromEnv(),
+		allAccounts:   allAccountsFromEnv(),
+		cache:         cache,
+		maxOrderLines: maxOrderLinesFromEnv(),
 	}
+	s.SetImageFetcher(report.NewImageFetcher(report.DefaultImageWorkers, report.DefaultImageTimeout))
+	return s
 }
 
 func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	url, err := s.authManager.GetLoginURL(w, r)
 	if err != nil {
-		http.Error(w, "Failed to generate login URL", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to generate login URL", "login_failed")
 		return
 	}
 
@@ -68,7 +131,7 @@ func (s *Server) HandleCallback(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	if err := s.authManager.Logout(w, r); err != nil {
-		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to logout", "logout_failed")
 		return
 	}
 
@@ -78,6 +141,61 @@ func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleDeleteAccount unlinks the signed-in Gmail account: its token is
+// revoked with Google, any running scan is stopped, everything stored for the
+// account and its cached messages are deleted, and the session is cleared. A
+// failed revocation is logged but doesn't stop the removal.
+func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	token, email, err := s.authManager.GetToken(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	if err := s.authManager.Revoke(r.Context(), token); err != nil {
+		log.Printf("Failed to revoke token for %s: %v", email, err)
+	}
+
+	// Stop the account's scan and let it finish writing before its stored
+	// results are deleted, so none of them reappear afterwards.
+	s.scanMu.Lock()
+	scan := s.activeScans[email]
+	delete(s.activeScans, email)
+	var cancel context.CancelFunc
+	if scan != nil {
+		cancel = scan.cancel
+	}
+	s.scanMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if scan != nil && scan.done != nil {
+		select {
+		case <-scan.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if err := s.tokenStorage.DeleteAccount(email); err != nil {
+		log.Printf("Failed to delete account %s: %v", email, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete account", "delete_failed")
+		return
+	}
+	if err := s.cache.DeleteAccount(email); err != nil {
+		log.Printf("Failed to delete cached messages for %s: %v", email, err)
+	}
+
+	if err := s.authManager.Logout(w, r); err != nil {
+		log.Printf("Failed to clear session for %s: %v", email, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "account_deleted",
+	})
+}
+
 func (s *Server) HandleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	authenticated := s.authManager.IsAuthenticated(r)
 
@@ -93,27 +211,36 @@ func (s *Server) HandleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleAuthConfigCheck reports whether the OAuth client is configured, to
+// help diagnose redirect_uri_mismatch and missing-variable errors before
+// attempting a login.
+func (s *Server) HandleAuthConfigCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.authManager.CheckConfig())
+}
+
 func (s *Server) HandleScan(w http.ResponseWriter, r *http.Request) {
 	if !s.authManager.IsAuthenticated(r) {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
 		return
 	}
 
-	s.scanMu.Lock()
-	if s.activeScan != nil && s.activeScan.InProgress {
-		s.scanMu.Unlock()
-		http.Error(w, "Scan already in progress", http.StatusConflict)
-		return
-	}
-	s.scanMu.Unlock()
-
 	var req struct {
 		Days       int  `json:"days"`
 		ClearCache bool `json:"clear_cache"`
+		// Incremental fetches only mail received since the account's last
+		// scan, falling back to a full scan when that isn't possible.
+		Incremental bool `json:"incremental"`
+		// Workers is how many messages are fetched at once; zero means
+		// gmail.DefaultFetchWorkers.
+		Workers int `json:"workers"`
+		// Query, when set, is the Gmail search to run instead of the
+		// built-in one. See gmail.CustomQuery.
+		Query string `json:"query"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Invalid request", "invalid_request")
 		return
 	}
 
@@ -123,28 +250,52 @@ func (s *Server) HandleScan(w http.ResponseWriter, r *http.Request) {
 	if req.Days > 365 {
 		req.Days = 365
 	}
+	req.Workers = max(0, min(req.Workers, gmail.MaxFetchWorkers))
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query != "" && req.Incremental {
+		writeJSONError(w, http.StatusBadRequest, "A custom query can't be used for an incremental scan", "invalid_request")
+		return
+	}
 
-	srv, email, err := s.authManager.GetGmailService(r)
+	client, email, err := s.authManager.GetGmailClient(r)
 	if err != nil {
-		http.Error(w, "Failed to get Gmail service", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get Gmail service", "gmail_unavailable")
+		return
+	}
+	if !s.checkReadAccess(w, r, client) {
 		return
 	}
 
+	// Create cancellable context for timeout detection and HandleScanCancel
+	ctx, cancel := context.WithCancel(context.Background())
+
 	now := time.Now()
-	s.scanMu.Lock()
-	s.activeScan = &ScanProgress{
+	scan := &ScanProgress{
 		InProgress:         true,
 		StartTime:          now,
 		LastProgressUpdate: now,
 		CurrentEmail:       email,
 		DaysScanned:        req.Days,
+		cancel:             cancel,
+		done:               make(chan struct{}),
 	}
+
+	// Scans for different accounts run side by side; only a second scan of
+	// the same account is refused.
+	s.scanMu.Lock()
+	if existing := s.activeScans[email]; existing != nil && existing.InProgress {
+		s.scanMu.Unlock()
+		cancel()
+		writeJSONError(w, http.StatusConflict, "Scan already in progress", "scan_in_progress")
+		return
+	}
+	s.activeScans[email] = scan
 	s.scanMu.Unlock()
 
-	// Create cancellable context for timeout detection
-	ctx, cancel := context.WithCancel(context.Background())
-	go s.watchProgress(cancel)
-	go s.runScan(ctx, srv, email, req.Days, req.ClearCache)
+	s.metrics.scanStarted()
+	go s.watchProgress(scan, cancel)
+	s.scans.Add(1)
+	go s.runScan(ctx, scan, client, email, req.Days, req.ClearCache, req.Incremental, req.Workers, req.Query)
 
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -152,22 +303,98 @@ func (s *Server) HandleScan(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) watchProgress(cancel context.CancelFunc) {
+// checkReadAccess answers 403 insufficient_scope, and returns false, when
+// client's token may not read mail, so the user can sign in again before a
+// scan starts. Any other failure is left for the scan to report.
+func (s *Server) checkReadAccess(w http.ResponseWriter, r *http.Request, client *http.Client) bool {
+	srv, err := gmail.NewService(r.Context(), client)
+	if err != nil {
+		return true
+	}
+	err = gmail.CheckReadAccess(r.Context(), srv, gmail.DefaultUser)
+	if !errors.Is(err, gmail.ErrInsufficientScope) {
+		return true
+	}
+	writeJSONError(w, http.StatusForbidden, "Gmail read access was not granted. Log out and sign in again, allowing access to read your email.", "insufficient_scope")
+	return false
+}
+
+// HandleScanCancel stops the signed-in account's running scan. The stopped
+// scan keeps its progress and reports the cancellation as its error, which
+// the WebSocket picks up on its next update. It stays in progress until its
+// workers have stopped.
+func (s *Server) HandleScanCancel(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	email := s.sessionEmail(r)
+	s.scanMu.Lock()
+	scan := s.activeScans[email]
+	if scan == nil || !scan.InProgress || scan.canceling {
+		s.scanMu.Unlock()
+		writeJSONError(w, http.StatusConflict, "No scan in progress", "no_scan_in_progress")
+		return
+	}
+	scan.Error = "canceled by user"
+	scan.canceling = true
+	cancel := scan.cancel
+	scan.cancel = nil
+	s.scanMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	log.Printf("Scan canceled by user for %s", email)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "scan_canceled",
+	})
+}
+
+// WaitForScans blocks until every running scan has finished or ctx ends,
+// so a shutting-down server doesn't cut scans off mid-write.
+func (s *Server) WaitForScans(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.scans.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sessionEmail returns the signed-in account, which keys its scan in
+// activeScans.
+func (s *Server) sessionEmail(r *http.Request) string {
+	_, email, err := s.authManager.GetToken(r)
+	if err != nil {
+		return ""
+	}
+	return email
+}
+
+func (s *Server) watchProgress(scan *ScanProgress, cancel context.CancelFunc) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		s.scanMu.Lock()
-		if s.activeScan == nil || !s.activeScan.InProgress {
+		if !scan.InProgress || scan.canceling {
 			s.scanMu.Unlock()
-			return // Scan completed normally
+			return
 		}
 
-		idle := time.Since(s.activeScan.LastProgressUpdate)
+		idle := time.Since(scan.LastProgressUpdate)
 		if idle > 30*time.Second {
-			log.Printf("Scan timeout: no progress for %v (processed: %d/%d)", idle, s.activeScan.Processed, s.activeScan.TotalMessages)
-			s.activeScan.Error = "Scan timed out - no progress for 30 seconds. Please try again."
-			s.activeScan.InProgress = false
+			log.Printf("Scan timeout for %s: no progress for %v (processed: %d/%d)", scan.CurrentEmail, idle, scan.Processed, scan.TotalMessages)
+			scan.Error = "Scan timed out - no progress for 30 seconds. Please try again."
+			scan.canceling = true
 			s.scanMu.Unlock()
 			cancel() // Stop all workers
 			return
@@ -176,154 +403,766 @@ func (s *Server) watchProgress(cancel context.CancelFunc) {
 	}
 }
 
-func (s *Server) runScan(ctx context.Context, srv interface{}, email string, days int, clearCache bool) {
+// scanQuery returns the Gmail search for a scan of the last days, and the
+// filter that stands in for it on incremental scans. Like the CLI's, the
+// search covers the extra cancel patterns' phrases. A customQuery replaces
+// the search.
+func (s *Server) scanQuery(days int, customQuery string) (string, func(from, subject string) bool) {
+	extra := gmail.CancelSubjects(s.extraCancels)
+	match := func(from, subject string) bool { return s.query.Matches(from, subject, extra...) }
+	if customQuery != "" {
+		return gmail.CustomQuery(customQuery, report.LastDays(days)), match
+	}
+	return s.query.Query(report.LastDays(days), extra...), match
+}
+
+func (s *Server) runScan(ctx context.Context, scan *ScanProgress, client *http.Client, email string, days int, clearCache, incremental bool, workers int, customQuery string) {
 	log.Printf("Scan started: %d days for %s", days, email)
+	defer s.scans.Done()
 	defer func() {
 		s.scanMu.Lock()
-		if s.activeScan != nil {
-			s.activeScan.InProgress = false
+		scan.InProgress = false
+		if scan.cancel != nil {
+			scan.cancel()
+			scan.cancel = nil
 		}
 		s.scanMu.Unlock()
+		close(scan.done)
 	}()
 
-	gmailSrv, ok := srv.(*gm.Service)
-	if !ok {
+	// fail records why the scan stopped. A timeout or user cancellation set
+	// first is kept over the context error it causes.
+	fail := func(msg string) {
 		s.scanMu.Lock()
-		if s.activeScan != nil {
-			s.activeScan.Error = "invalid gmail service"
+		if scan.Error == "" {
+			scan.Error = msg
 		}
 		s.scanMu.Unlock()
+	}
+
+	gmailSrv, err := gmail.NewService(ctx, client)
+	if err != nil {
+		fail(err.Error())
 		return
 	}
 
+	cache := s.cache
 	if clearCache {
 		log.Printf("Clearing cache...")
 		clearStart := time.Now()
-		cache := gmail.NewMessageCache(".cache/messages", 24*time.Hour)
-		cache.Clear()
-		log.Printf("Cache cleared in %v", time.Since(clearStart))
+		if err := cache.Clear(); err != nil {
+			log.Printf("Failed to clear cache: %v", err)
+		} else {
+			log.Printf("Cache cleared in %v", time.Since(clearStart))
+		}
 	}
 
-	query := buildQuery(days)
-	messages, err := gmail.FetchMessages(gmailSrv, "me", query)
+	var prev *gmail.SyncState
+	if incremental {
+		prev = s.loadSyncState(email)
+	}
+	query, match := s.scanQuery(days, customQuery)
+	messages, syncState, fromHistory, err := gmail.FetchMessagesIncremental(ctx, gmailSrv, gmail.DefaultUser, query, match, prev, time.Duration(days)*24*time.Hour)
 	if err != nil {
-		s.scanMu.Lock()
-		if s.activeScan != nil {
-			s.activeScan.Error = err.Error()
-		}
-		s.scanMu.Unlock()
-		log.Printf("Scan failed: %v", err)
+		fail(err.Error())
+		log.Printf("Scan failed for %s: %v", email, err)
 		return
 	}
+	if fromHistory {
+		log.Printf("Incremental scan for %s: %d new message(s)", email, len(syncState.MessageIDs)-len(prev.MessageIDs))
+	}
 
-	log.Printf("Processing %d messages...", len(messages))
+	log.Printf("Processing %d messages for %s...", len(messages), email)
 	s.scanMu.Lock()
-	if s.activeScan != nil {
-		s.activeScan.TotalMessages = len(messages)
-	}
+	scan.TotalMessages = len(messages)
+	scan.updateBatch()
 	s.scanMu.Unlock()
 
 	// Create progress callback to update scan progress and last update time
-	progressCallback := func(processed int) {
+	progressCallback := func(p gmail.Progress) {
 		s.scanMu.Lock()
-		if s.activeScan != nil && s.activeScan.Processed != processed {
-			s.activeScan.Processed = processed
-			s.activeScan.LastProgressUpdate = time.Now()
+		if scan.Processed != p.Processed {
+			scan.Processed = p.Processed
+			scan.Rate = p.Rate
+			scan.LastProgressUpdate = time.Now()
+			scan.updateBatch()
 		}
 		s.scanMu.Unlock()
 	}
 
-	orders, shipped, err := gmail.ProcessEmailsWithProgress(ctx, gmailSrv, "me", messages, progressCallback)
+	opts := gmail.ProcessOptions{
+		Progress:     progressCallback,
+		Account:      email,
+		Retry:        s.metrics.retryPolicy(s.retry),
+		Cache:        cache,
+		Client:       client,
+		Region:       s.region,
+		Query:        s.query,
+		FetchWorkers: workers,
+	}
+	if len(s.extraCancels) > 0 {
+		opts.CancelPatterns = append(slices.Clone(gmail.DefaultCancelPatterns), s.extraCancels...)
+	}
+	orders, shipped, stats, err := gmail.ProcessEmailsWithOptions(ctx, gmailSrv, gmail.DefaultUser, messages, opts)
+	s.metrics.observeScan(stats)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
-		s.scanMu.Lock()
-		if s.activeScan != nil {
-			s.activeScan.Error = err.Error()
-		}
-		s.scanMu.Unlock()
-		log.Printf("Scan failed: %v", err)
+		fail(err.Error())
+		log.Printf("Scan failed for %s: %v", email, err)
 		return
 	}
 
+	// A scan that is part of a batch still flags orders new since the
+	// account's own last scan, but leaves what is stored for the account
+	// alone; the batch saves its merged result instead.
+	member := scan.batch != nil
+	if !member {
+		if data, err := json.Marshal(syncState); err != nil {
+			log.Printf("Failed to encode sync state for %s: %v", email, err)
+		} else if err := s.tokenStorage.SaveSyncState(email, data); err != nil {
+			log.Printf("Failed to save sync state for %s: %v", email, err)
+		}
+	}
+
+	previous, seen, err := s.tokenStorage.PreviousScanOrders(email)
+	if err != nil {
+		log.Printf("Failed to load previous scan for %s: %v", email, err)
+	} else {
+		if !seen {
+			previous = nil
+		}
+		ids := report.MarkNewOrders(orders, previous)
+		if !member {
+			if err := s.tokenStorage.SaveScanOrders(email, ids); err != nil {
+				log.Printf("Failed to save scan history for %s: %v", email, err)
+			}
+		}
+	}
+
+	completedAt := time.Now()
 	s.scanMu.Lock()
-	if s.activeScan != nil {
-		s.activeScan.Orders = orders
-		s.activeScan.Shipped = shipped
-		s.activeScan.Processed = len(messages)
+	scan.Orders = orders
+	scan.Shipped = shipped
+	scan.Processed = len(messages)
+	scan.CompletedAt = completedAt
+	s.scanMu.Unlock()
+
+	if !member {
+		s.saveScanResults(email, scan, days)
+	}
+
+	log.Printf("Scan completed for %s: %d orders, %d shipments", email, len(orders), len(shipped))
+}
+
+// saveScanResults stores scan, which has just completed, as email's last
+// scan so its report survives a restart.
+func (s *Server) saveScanResults(email string, scan *ScanProgress, days int) {
+	s.scanMu.Lock()
+	results := &storage.ScanResults{
+		Orders:      scan.Orders,
+		Shipped:     scan.Shipped,
+		DaysScanned: days,
+		StartedAt:   scan.StartTime,
+		CompletedAt: scan.CompletedAt,
 	}
 	s.scanMu.Unlock()
+	if err := s.tokenStorage.SaveScanResults(email, results); err != nil {
+		log.Printf("Failed to save scan results for %s: %v", email, err)
+	}
+}
 
-	log.Printf("Scan completed: %d orders, %d shipments", len(orders), len(shipped))
+// restoreScan loads email's last completed scan from storage when there is
+// none in memory, as after a restart.
+func (s *Server) restoreScan(email string) {
+	if email == "" {
+		return
+	}
+	s.scanMu.Lock()
+	_, ok := s.activeScans[email]
+	s.scanMu.Unlock()
+	if ok {
+		return
+	}
+
+	results, err := s.tokenStorage.ScanResults(email)
+	if err != nil {
+		log.Printf("Failed to load scan results for %s: %v", email, err)
+		return
+	}
+	if results == nil {
+		return
+	}
+
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	if s.activeScans[email] == nil {
+		s.activeScans[email] = &ScanProgress{
+			CurrentEmail: email,
+			StartTime:    results.StartedAt,
+			Orders:       results.Orders,
+			Shipped:      results.Shipped,
+			DaysScanned:  results.DaysScanned,
+			CompletedAt:  results.CompletedAt,
+		}
+	}
 }
 
-func buildQuery(days int) string {
-	return "from:help@walmart.com subject:(\"thanks for your preorder\" OR \"thanks for your order\" OR \"Canceled: delivery from order\" OR \"was canceled\" OR \"Shipped:\" OR \"Arrived:\" OR \"Delivered:\") newer_than:" + strconv.Itoa(days) + "d"
+// regionFromEnv reads WALMART_REGION, falling back to report.RegionUS when it
+// is unset or unknown.
+func regionFromEnv() report.Region {
+	region, err := report.ParseRegion(os.Getenv("WALMART_REGION"))
+	if err != nil {
+		log.Printf("Warning: %v, using US", err)
+		return report.RegionUS
+	}
+	return region
+}
+
+// loadSyncState returns where email's next incremental scan resumes from,
+// or nil when nothing usable was saved.
+func (s *Server) loadSyncState(email string) *gmail.SyncState {
+	data, err := s.tokenStorage.SyncState(email)
+	if err != nil {
+		log.Printf("Failed to load sync state for %s: %v", email, err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	var state gmail.SyncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Failed to decode sync state for %s: %v", email, err)
+		return nil
+	}
+	return &state
+}
+
+// loadQueryConfig reads gmail.DefaultQueryConfigPath, falling back to the
+// built-in search when the file is unusable.
+func loadQueryConfig() gmail.QueryConfig {
+	cfg, err := gmail.LoadQueryConfig(gmail.DefaultQueryConfigPath)
+	if err != nil {
+		log.Printf("Ignoring query config: %v", err)
+	}
+	return cfg
+}
+
+// loadCancelPatterns reads gmail.DefaultCancelPatternsPath, returning none
+// when the file is missing or unusable.
+func loadCancelPatterns() []gmail.CancelPattern {
+	patterns, err := gmail.LoadCancelPatterns(gmail.DefaultCancelPatternsPath)
+	if err != nil {
+		log.Printf("Ignoring cancel patterns: %v", err)
+		return nil
+	}
+	return patterns
+}
+
+// loadProductAliases reads report.DefaultAliasesPath, returning none, and so
+// keeping the built-in name rules, when the file is missing or unusable.
+func loadProductAliases() []report.ProductAlias {
+	aliases, err := report.LoadProductAliases(report.DefaultAliasesPath)
+	if err != nil {
+		log.Printf("Ignoring product aliases: %v", err)
+		return nil
+	}
+	return aliases
 }
 
 func (s *Server) HandleScanStatus(w http.ResponseWriter, r *http.Request) {
 	if !s.authManager.IsAuthenticated(r) {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
 		return
 	}
 
+	email := s.sessionEmail(r)
+	s.restoreScan(email)
 	s.scanMu.Lock()
 	defer s.scanMu.Unlock()
 
-	if s.activeScan == nil {
+	scan := s.activeScans[email]
+	if scan == nil {
 		json.NewEncoder(w).Encode(map[string]bool{
 			"in_progress": false,
 		})
 		return
 	}
 
-	json.NewEncoder(w).Encode(s.activeScan)
+	json.NewEncoder(w).Encode(scan)
 }
 
 func (s *Server) HandleReport(w http.ResponseWriter, r *http.Request) {
 	if !s.authManager.IsAuthenticated(r) {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
 		return
 	}
 
+	email := s.sessionEmail(r)
+	s.restoreScan(email)
 	s.scanMu.Lock()
 	defer s.scanMu.Unlock()
 
-	if s.activeScan == nil || s.activeScan.Orders == nil {
-		http.Error(w, "No scan results available", http.StatusNotFound)
+	scan := s.activeScans[email]
+	if scan == nil || scan.Orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	daysScanned := scan.DaysScanned
+	if daysScanned == 0 {
+		daysScanned = 10
+	}
+
+	opts := reportOptions{daysScanned: daysScanned, region: s.region, completedAt: scan.CompletedAt, maxOrderLines: s.maxOrderLines}
+	if err := opts.parseQuery(r); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request")
 		return
 	}
+	if r.URL.Query().Get("exclude_acked") == "true" {
+		acked, err := s.ackedOrders(r)
+		if err != nil {
+			log.Printf("Failed to load acknowledged orders: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load acknowledged orders", "acks_unavailable")
+			return
+		}
+		opts.acked = acked
+	}
+
+	resp := buildReport(scan.Orders, scan.Shipped, opts)
+	if len(scan.Accounts) > 0 {
+		resp["accounts"] = scan.Accounts
+		resp["account_notices"] = report.AccountNotices(scan.Accounts)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
 
-	orders := s.activeScan.Orders
-	shipped := s.activeScan.Shipped
+// ackedOrders loads the acknowledged order IDs of the signed-in user.
+func (s *Server) ackedOrders(r *http.Request) (map[string]bool, error) {
+	_, email, err := s.authManager.GetToken(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokenStorage.AckedOrders(email)
+}
 
+// HandleReportJSONL streams the scanned orders as JSON Lines, flushing as it
+// goes so large exports never have to be buffered in full.
+func (s *Server) HandleReportJSONL(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orders, _ := s.scanResults(r)
+	if orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="orders.jsonl"`)
+	if err := report.GenerateJSONLTo(flushWriter{w}, orders); err != nil {
+		log.Printf("Failed to stream orders: %v", err)
+	}
+}
+
+// scanResults returns the orders and shipments of the signed-in user's last
+// scan; orders is nil if there are none yet.
+func (s *Server) scanResults(r *http.Request) (map[string]*report.Order, []*report.ShippedOrder) {
+	email := s.sessionEmail(r)
+	s.restoreScan(email)
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	scan := s.activeScans[email]
+	if scan == nil {
+		return nil, nil
+	}
+	// Neither is modified once a scan has finished.
+	return scan.Orders, scan.Shipped
+}
+
+// HandleReportCSV downloads the orders CSV the CLI writes as orders_*.csv.
+func (s *Server) HandleReportCSV(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orders, _ := s.scanResults(r)
+	if orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+	if err := report.GenerateCSVTo(w, orders); err != nil {
+		log.Printf("Failed to write orders CSV: %v", err)
+	}
+}
+
+// HandleReportHTML serves the HTML report the CLI writes as orders_*.html;
+// ?variant=compact gives the print-friendly one.
+func (s *Server) HandleReportHTML(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+	variant, err := report.ParseVariant(r.URL.Query().Get("variant"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request")
+		return
+	}
+
+	email := s.sessionEmail(r)
+	s.restoreScan(email)
+	s.scanMu.Lock()
+	scan := s.activeScans[email]
+	if scan == nil || scan.Orders == nil {
+		s.scanMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+	daysScanned := scan.DaysScanned
+	if daysScanned == 0 {
+		daysScanned = 10
+	}
+	// RenderHTML renames items as it groups them.
+	orders := report.CloneOrders(scan.Orders)
+	shipped := scan.Shipped
+	s.scanMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := report.RenderHTML(w, orders, shipped, report.HTMLOptions{DaysScanned: daysScanned, Variant: variant, Region: s.region, Aliases: s.aliases}); err != nil {
+		log.Printf("Failed to render report: %v", err)
+	}
+}
+
+// HandleReportShippedCSV downloads the shipments CSV the CLI writes as
+// shipped_orders_*.csv.
+func (s *Server) HandleReportShippedCSV(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orders, shipped := s.scanResults(r)
+	if orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="shipped_orders.csv"`)
+	if err := report.GenerateShippedCSVTo(w, shipped); err != nil {
+		log.Printf("Failed to write shipments CSV: %v", err)
+	}
+}
+
+// HandleReportICS downloads the expected deliveries as the calendar the CLI
+// writes with --ics.
+func (s *Server) HandleReportICS(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orders, shipped := s.scanResults(r)
+	if orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="shipped_orders.ics"`)
+	if err := report.GenerateShipmentsICSTo(w, shipped); err != nil {
+		log.Printf("Failed to write shipments calendar: %v", err)
+	}
+}
+
+// HandleReportCanceledCSV downloads the canceled orders CSV the CLI writes as
+// canceled_orders_*.csv.
+func (s *Server) HandleReportCanceledCSV(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orders, _ := s.scanResults(r)
+	if orders == nil {
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="canceled_orders.csv"`)
+	if err := report.GenerateCanceledCSVTo(w, orders); err != nil {
+		log.Printf("Failed to write canceled orders CSV: %v", err)
+	}
+}
+
+// flushWriter flushes the response after every write so each line reaches the
+// client as soon as it is encoded.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
+
+func (s *Server) HandleReportRecompute(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	var req struct {
+		NormalizationRules []report.NormalizationRule `json:"normalization_rules"`
+		PriceOverrides     map[string]float64         `json:"price_overrides"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request", "invalid_request")
+		return
+	}
+	if req.NormalizationRules == nil {
+		req.NormalizationRules = report.NormalizationRules(s.aliases)
+	}
+
+	email := s.sessionEmail(r)
+	s.restoreScan(email)
+	s.scanMu.Lock()
+	scan := s.activeScans[email]
+	if scan == nil || scan.Orders == nil {
+		s.scanMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+	// Recompute on a copy so the stored scan keeps its original item names.
+	orders := report.CloneOrders(scan.Orders)
+	shipped := scan.Shipped
+	daysScanned := scan.DaysScanned
+	completedAt := scan.CompletedAt
+	s.scanMu.Unlock()
+
+	if daysScanned == 0 {
+		daysScanned = 10
+	}
+
+	opts := reportOptions{daysScanned: daysScanned, region: s.region, priceOverrides: req.PriceOverrides, completedAt: completedAt, maxOrderLines: s.maxOrderLines}
+	if err := opts.parseQuery(r); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request")
+		return
+	}
+	if r.URL.Query().Get("exclude_acked") == "true" {
+		acked, err := s.ackedOrders(r)
+		if err != nil {
+			log.Printf("Failed to load acknowledged orders: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load acknowledged orders", "acks_unavailable")
+			return
+		}
+		opts.acked = acked
+	}
+
+	report.NormalizeProductNames(orders, s.aliases, req.NormalizationRules)
+	json.NewEncoder(w).Encode(buildReport(orders, shipped, opts))
+}
+
+// HandleAckOrder marks a live order as reviewed so it can be hidden from the
+// live list on later scans. DELETE on the same path removes the mark.
+func (s *Server) HandleAckOrder(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	_, email, err := s.authManager.GetToken(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	orderID := normalizeOrderID(chi.URLParam(r, "orderID"))
+	if orderID == "" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid order ID", "invalid_order_id")
+		return
+	}
+
+	status := "acknowledged"
+	if r.Method == http.MethodDelete {
+		err = s.tokenStorage.UnackOrder(email, orderID)
+		status = "unacknowledged"
+	} else {
+		err = s.tokenStorage.AckOrder(email, orderID)
+	}
+	if err != nil {
+		log.Printf("Failed to update acknowledgement for %s: %v", orderID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update order", "ack_failed")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"order_id": orderID,
+		"status":   status,
+	})
+}
+
+// normalizeOrderID accepts both raw and display-formatted (dashed) order IDs
+// and returns the raw form used as the key in scan results.
+func normalizeOrderID(id string) string {
+	id = report.CanonicalOrderID(id)
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return ""
+		}
+	}
+	return id
+}
+
+type reportOptions struct {
+	daysScanned    int
+	spendMode      string
+	productSort    string
+	productLimit   int // 0 means every product
+	priceOverrides map[string]float64
+	acked          map[string]bool // orders to leave out of the live list
+	region         report.Region
+	completedAt    time.Time // when the scan finished; zero if unknown
+	filter         orderFilter
+	maxOrderLines  int
+}
+
+// parseQuery reads the report query parameters shared by the report
+// endpoints: spend_mode, sort and limit for product_spend, and the order
+// filter (see parseOrderFilter).
+func (o *reportOptions) parseQuery(r *http.Request) error {
+	q := r.URL.Query()
+	mode, err := report.ParseSpendMode(q.Get("spend_mode"))
+	if err != nil {
+		return err
+	}
+	o.spendMode = mode
+	o.productSort = q.Get("sort")
+	if !report.ValidProductSort(o.productSort) {
+		return fmt.Errorf("unknown sort %q (want spend, units, price or name)", o.productSort)
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("limit must be a positive number")
+		}
+		o.productLimit = n
+	}
+	o.filter, err = parseOrderFilter(q)
+	return err
+}
+
+func buildReport(orders map[string]*report.Order, shipped []*report.ShippedOrder, opts reportOptions) map[string]interface{} {
 	nonCanceled := filterNonCanceled(orders)
-	learned := report.LearnPrices(nonCanceled)
-	productSummaries := buildProductSummaries(nonCanceled, learned)
-	orderDetails := report.PrepareOrderDetails(nonCanceled, learned)
+	learned := report.LearnPricesWithMode(nonCanceled, opts.spendMode)
+	for name, price := range opts.priceOverrides {
+		learned[name] = price
+	}
+	productSummaries := report.SortProductSummaries(buildProductSummaries(nonCanceled, learned), opts.productSort, opts.productLimit)
+	orderDetails, totalLines := recentOrderLines(nonCanceled, learned, opts.maxOrderLines)
 	liveOrdersFiltered := filterLiveOrders(nonCanceled, shipped)
+	if len(opts.acked) > 0 {
+		liveOrdersFiltered = excludeAcked(liveOrdersFiltered, opts.acked)
+	}
 	liveOrdersForTemplate := report.PrepareOrderDetails(liveOrdersFiltered, learned)
 	liveOrderSummary := report.CalculateLiveOrderSummary(liveOrdersFiltered, learned)
 	emailStats := report.CalculateEmailStats(orders, len(liveOrdersFiltered))
 	productCancel := report.CalculateProductStats(orders)
+	fulfillment := report.CalculateFulfillment(orders, shipped)
+	paymentSpend := report.CalculatePaymentMethodSpend(nonCanceled)
+	shipped = report.SortShipments(shipped)
 
-	daysScanned := s.activeScan.DaysScanned
-	if daysScanned == 0 {
-		daysScanned = 10
+	// The full orders map can dwarf the rest of the response, so it is only
+	// sent a page at a time, through the order filter.
+	resp := map[string]interface{}{
+		"shipped":             shipped,
+		"email_stats":         emailStats,
+		"live_order_summary":  liveOrderSummary,
+		"live_orders":         liveOrdersForTemplate,
+		"product_cancel":      productCancel,
+		"order_lines":         orderDetails,
+		"product_spend":       productSummaries,
+		"shipments":           shipped,
+		"date_range":          buildDateRange(opts.daysScanned),
+		"fulfillment":         fulfillment,
+		"fulfillment_buckets": report.FulfillmentBucketLabels(),
+		"payment_spend":       paymentSpend,
+		"discrepancies":       report.FindTotalDiscrepancies(orders),
+		"currency":            opts.region.Currency,
+		"currency_symbol":     opts.region.Symbol,
+	}
+	if !opts.completedAt.IsZero() {
+		resp["completed_at"] = opts.completedAt.UTC().Format(time.RFC3339)
 	}
+	if opts.filter.active() {
+		page, total := opts.filter.apply(orders, shipped, opts.acked)
+		pageOrders := make(map[string]*report.Order, len(page))
+		for _, o := range page {
+			pageOrders[o.ID] = o
+		}
+		resp["orders"] = pageOrders
+		resp["total"] = total
+		orderDetails = opts.filter.orderLines(page, learned)
+		totalLines = len(orderDetails)
+		if limit := opts.maxOrderLines; totalLines > limit {
+			orderDetails = orderDetails[:limit]
+		}
+		resp["order_lines"] = orderDetails
+	}
+	if len(orderDetails) < totalLines {
+		resp["truncated"] = true
+		resp["order_lines_total"] = totalLines
+		resp["full_export"] = "/api/report.jsonl"
+	}
+	return resp
+}
 
-	response := map[string]interface{}{
-		"orders":             orders,
-		"shipped":            shipped,
-		"email_stats":        emailStats,
-		"live_order_summary": liveOrderSummary,
-		"live_orders":        liveOrdersForTemplate,
-		"product_cancel":     productCancel,
-		"order_lines":        orderDetails,
-		"product_spend":      productSummaries,
-		"shipments":          shipped,
-		"date_range":         buildDateRange(daysScanned),
+// defaultMaxOrderLines bounds the order_lines of a report response unless
+// REPORT_MAX_ORDER_LINES says otherwise.
+const defaultMaxOrderLines = 5000
+
+func maxOrderLinesFromEnv() int {
+	if v := os.Getenv("REPORT_MAX_ORDER_LINES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Report: invalid REPORT_MAX_ORDER_LINES %q, using %d", v, defaultMaxOrderLines)
 	}
+	return defaultMaxOrderLines
+}
 
-	json.NewEncoder(w).Encode(response)
+// recentOrderLines returns at most limit order lines, newest orders first when
+// some have to be left out, along with how many lines there are in total.
+func recentOrderLines(orders []*report.Order, learned map[string]float64, limit int) ([]report.OrderDetail, int) {
+	total := 0
+	for _, o := range orders {
+		total += len(o.Items)
+	}
+	if total <= limit {
+		return report.PrepareOrderDetails(orders, learned), total
+	}
+	sorted := append([]*report.Order(nil), orders...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].OrderDateParsed.After(sorted[j].OrderDateParsed)
+	})
+	// Only the newest orders, enough to fill limit, are turned into lines.
+	n, lines := 0, 0
+	for lines < limit {
+		lines += len(sorted[n].Items)
+		n++
+	}
+	return report.PrepareOrderDetails(sorted[:n], learned)[:limit], total
 }
 
 func filterNonCanceled(orders map[string]*report.Order) []*report.Order {
@@ -351,6 +1190,16 @@ func filterLiveOrders(nonCanceledOrders []*report.Order, shippedOrders []*report
 	return liveOrders
 }
 
+func excludeAcked(orders []*report.Order, acked map[string]bool) []*report.Order {
+	var result []*report.Order
+	for _, o := range orders {
+		if !acked[o.ID] {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
 func buildProductSummaries(orders []*report.Order, learnedPrices map[string]float64) []report.ProductSummary {
 	m := report.CalculateSummaries(orders, learnedPrices)
 	out := make([]report.ProductSummary, 0, len(m))
@@ -367,10 +1216,9 @@ func buildDateRange(days int) string {
 }
 
 func (s *Server) HandleCacheStats(w http.ResponseWriter, r *http.Request) {
-	cache := gmail.NewMessageCache(".cache/messages", 24*time.Hour)
-	total, size, err := cache.Stats()
+	total, size, err := s.cache.Stats()
 	if err != nil {
-		http.Error(w, "Failed to get cache stats", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to get cache stats", "cache_stats_failed")
 		return
 	}
 
@@ -382,13 +1230,13 @@ func (s *Server) HandleCacheStats(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) HandleCacheClear(w http.ResponseWriter, r *http.Request) {
 	if !s.authManager.IsAuthenticated(r) {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
 		return
 	}
 
-	cache := gmail.NewMessageCache(".cache/messages", 24*time.Hour)
-	if err := cache.Clear(); err != nil {
-		http.Error(w, "Failed to clear cache", http.StatusInternalServerError)
+	if err := s.cache.Clear(); err != nil {
+		log.Printf("Failed to clear cache: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to clear cache", "cache_clear_failed")
 		return
 	}
 
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"walmart-order-checker/pkg/gmail"
+	"walmart-order-checker/pkg/report"
+)
+
+func TestBuildReportCapsOrderLines(t *testing.T) {
+	orders := make(map[string]*report.Order)
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"1", "2", "3"} {
+		orders[id] = &report.Order{
+			ID:              id,
+			Status:          "confirmed",
+			OrderDateParsed: day.AddDate(0, 0, i),
+			Items:           []report.Item{{Name: "Lamp " + id, Quantity: 1}, {Name: "Rug " + id, Quantity: 1}},
+		}
+	}
+
+	resp := buildReport(orders, nil, reportOptions{maxOrderLines: 3})
+
+	if _, ok := resp["orders"]; ok {
+		t.Error("unfiltered report includes the full orders map")
+	}
+	lines := resp["order_lines"].([]report.OrderDetail)
+	if len(lines) != 3 {
+		t.Fatalf("got %d order lines, want 3", len(lines))
+	}
+	for i, want := range []string{"Lamp 3", "Rug 3", "Lamp 2"} {
+		if lines[i].Name != want {
+			t.Errorf("line %d = %q, want %q (newest first)", i, lines[i].Name, want)
+		}
+	}
+	if resp["truncated"] != true || resp["order_lines_total"] != 6 {
+		t.Errorf("truncated = %v, order_lines_total = %v; want true, 6", resp["truncated"], resp["order_lines_total"])
+	}
+}
+
+func TestScanQueryIncludesCancelPhrases(t *testing.T) {
+	s := &Server{
+		query:        gmail.DefaultQueryConfig,
+		extraCancels: []gmail.CancelPattern{{Match: gmail.MatchContains, Pattern: "Your order was cancelled"}},
+	}
+	query, match := s.scanQuery(30, "")
+	if !strings.Contains(query, `"Your order was cancelled"`) {
+		t.Errorf("query %q leaves out the extra cancel phrase", query)
+	}
+	if !match("help@walmart.com", "Your order was cancelled") {
+		t.Error("incremental filter rejects a subject matching the extra cancel phrase")
+	}
+}
+
+func TestSharedReportLeavesStoredOrdersAlone(t *testing.T) {
+	const email = "me@example.com"
+	start := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	scan := &ScanProgress{
+		StartTime: start,
+		Orders: map[string]*report.Order{
+			"1": {ID: "1", Status: "confirmed", Items: []report.Item{{Name: "Pokemon Evolutions Booster", Quantity: 2}}},
+			"2": {ID: "2", Status: "confirmed", Items: []report.Item{{Name: "Pokemon Evolutions Booster", Quantity: 1}}},
+			"3": {
+				ID:            "3",
+				Status:        "confirmed",
+				Items:         []report.Item{{Name: "Desk Lamp", Quantity: 1}},
+				CanceledItems: []report.Item{{Name: "Pokemon Trading Card Games Evolutions Booster", Quantity: 1}},
+			},
+		},
+	}
+	s := &Server{activeScans: map[string]*ScanProgress{email: scan}, shareKey: newShareKey()}
+	token := s.signShare(shareClaims{Email: email, ScanStart: start.UnixNano(), Expires: time.Now().Add(time.Hour).Unix()})
+	router := chi.NewRouter()
+	router.Get("/api/shared/{token}", s.HandleSharedReport)
+
+	// Rendering renames items as it groups them; each render must start
+	// from the names the scan found.
+	for i := range 2 {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/shared/"+token+"?format=html", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("render %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	if got := scan.Orders["3"].CanceledItems[0].Name; got != "Pokemon Trading Card Games Evolutions Booster" {
+		t.Errorf("stored canceled item renamed to %q", got)
+	}
+	if got := scan.Orders["2"].Items[0].Name; got != "Pokemon Evolutions Booster" {
+		t.Errorf("stored item renamed to %q", got)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// healthTimeout bounds the database check so a wedged DB fails the probe
+// instead of hanging it.
+const healthTimeout = 2 * time.Second
+
+type healthStatus struct {
+	OK       bool   `json:"ok"`
+	Database bool   `json:"database"`
+	DBError  string `json:"database_error,omitempty"`
+	OAuth    bool   `json:"oauth_configured"`
+	// Frontend is only reported by /readyz.
+	Frontend *bool `json:"frontend,omitempty"`
+}
+
+func (s *Server) checkHealth(ctx context.Context) healthStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	var h healthStatus
+	if err := s.tokenStorage.Ping(ctx); err != nil {
+		h.DBError = err.Error()
+	} else {
+		h.Database = true
+	}
+	cfg := s.authManager.CheckConfig()
+	h.OAuth = cfg.ClientIDSet && cfg.ClientSecretSet
+	h.OK = h.Database && h.OAuth
+	return h
+}
+
+func writeHealth(w http.ResponseWriter, h healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !h.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// HandleHealthz reports whether the token database answers and the OAuth
+// client is configured: 200 when both hold, 503 otherwise.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.checkHealth(r.Context()))
+}
+
+// HandleReadyz is HandleHealthz plus a check that the built frontend in
+// distDir is there to serve.
+func (s *Server) HandleReadyz(distDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := s.checkHealth(r.Context())
+		info, err := os.Stat(distDir)
+		frontend := err == nil && info.IsDir()
+		h.Frontend = &frontend
+		h.OK = h.OK && frontend
+		writeHealth(w, h)
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// imageProxyHosts are the only hosts HandleImageProxy will fetch from, so the
+// proxy can't be used to reach arbitrary URLs from the server.
+var imageProxyHosts = []string{"walmartimages.com", "walmart.com"}
+
+// SetImageFetcher replaces the fetcher used by the image proxy. It is
+// restricted to imageProxyHosts, redirects included.
+func (s *Server) SetImageFetcher(f *report.ImageFetcher) {
+	f.RestrictURLs(allowedImageURL)
+	s.imageFetcher = f
+}
+
+// HandleImageProxy serves item thumbnails through the server so the dashboard
+// doesn't hotlink Walmart's CDN from the browser.
+func (s *Server) HandleImageProxy(w http.ResponseWriter, r *http.Request) {
+	if !s.authManager.IsAuthenticated(r) {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	raw := r.URL.Query().Get("url")
+	u, err := url.Parse(raw)
+	if err != nil || !allowedImageURL(u) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid image URL", "invalid_image_url")
+		return
+	}
+
+	img, err := s.imageFetcher.Fetch(r.Context(), u.String())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "Failed to fetch image", "image_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(img.Data)
+}
+
+func allowedImageURL(u *url.URL) bool {
+	if u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range imageProxyHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
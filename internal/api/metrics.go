@@ -0,0 +1,156 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"walmart-order-checker/pkg/gmail"
+)
+
+// metrics holds the counters served at /metrics in the Prometheus text
+// format. A nil *metrics, as when METRICS_ENABLED is unset, ignores every
+// update.
+type metrics struct {
+	token      string       // required as a bearer token when set
+	allowedIPs []net.IPNet  // allowed client addresses; empty allows any
+	scans      atomic.Int64 // scans started
+	processed  atomic.Int64 // messages processed
+	cacheHits  atomic.Int64
+	cacheMiss  atomic.Int64
+	retries    atomic.Int64 // Gmail requests retried after a transient error
+	rateLimits atomic.Int64 // Gmail requests refused for quota
+}
+
+// metricsFromEnv returns nil unless METRICS_ENABLED is true. METRICS_TOKEN
+// and METRICS_ALLOWED_IPS, a comma-separated list of addresses or CIDR
+// ranges, restrict who may scrape.
+func metricsFromEnv() *metrics {
+	if !strings.EqualFold(os.Getenv("METRICS_ENABLED"), "true") {
+		return nil
+	}
+	m := &metrics{token: os.Getenv("METRICS_TOKEN")}
+	for _, v := range strings.Split(os.Getenv("METRICS_ALLOWED_IPS"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Printf("Metrics: ignoring invalid METRICS_ALLOWED_IPS entry %q", v)
+			continue
+		}
+		m.allowedIPs = append(m.allowedIPs, *ipNet)
+	}
+	return m
+}
+
+func (m *metrics) scanStarted() {
+	if m != nil {
+		m.scans.Add(1)
+	}
+}
+
+func (m *metrics) observeScan(stats gmail.ScanStats) {
+	if m == nil {
+		return
+	}
+	m.processed.Add(int64(stats.Processed))
+	m.cacheHits.Add(int64(stats.FromCache))
+	m.cacheMiss.Add(int64(max(0, stats.Processed-stats.FromCache)))
+}
+
+// retryPolicy returns p reporting its retries to m.
+func (m *metrics) retryPolicy(p gmail.RetryPolicy) gmail.RetryPolicy {
+	if m == nil {
+		return p
+	}
+	p.OnRetry = func(err error) {
+		m.retries.Add(1)
+		if gmail.IsRateLimited(err) {
+			m.rateLimits.Add(1)
+		}
+	}
+	return p
+}
+
+// allowed reports whether r may read the metrics. The address checked is the
+// connection's own, not a forwarded one, so that it can't be spoofed.
+func (m *metrics) allowed(r *http.Request) bool {
+	if m.token != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(m.token)) != 1 {
+			return false
+		}
+	}
+	if len(m.allowedIPs) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range m.allowedIPs {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsEnabled reports whether METRICS_ENABLED turned on /metrics.
+func (s *Server) MetricsEnabled() bool {
+	return s.metrics != nil
+}
+
+// HandleMetrics serves the scan and cache counters in the Prometheus text
+// format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !m.allowed(r) {
+		writeJSONError(w, http.StatusForbidden, "Forbidden", "forbidden")
+		return
+	}
+
+	s.scanMu.Lock()
+	active := 0
+	for _, scan := range s.activeScans {
+		if scan.InProgress {
+			active++
+		}
+	}
+	s.scanMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"walmart_checker_scans_total", "counter", "Scans started.", m.scans.Load()},
+		{"walmart_checker_messages_processed_total", "counter", "Messages processed by scans.", m.processed.Load()},
+		{"walmart_checker_cache_hits_total", "counter", "Messages served from the message cache.", m.cacheHits.Load()},
+		{"walmart_checker_cache_misses_total", "counter", "Messages fetched from Gmail because they weren't cached.", m.cacheMiss.Load()},
+		{"walmart_checker_gmail_retries_total", "counter", "Gmail requests retried after a transient error.", m.retries.Load()},
+		{"walmart_checker_gmail_rate_limited_total", "counter", "Gmail requests refused for quota.", m.rateLimits.Load()},
+		{"walmart_checker_active_scans", "gauge", "Scans running now.", int64(active)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
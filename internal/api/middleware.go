@@ -54,7 +54,7 @@ func AuthMiddleware(authManager *auth.Manager) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !authManager.IsAuthenticated(r) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "not_authenticated")
 				return
 			}
 			next.ServeHTTP(w, r)
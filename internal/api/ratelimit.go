@@ -70,7 +70,7 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 		if !limiter.Allow() {
 			log.Printf("SECURITY: Rate limit exceeded for IP %s on %s %s", ip, r.Method, r.URL.Path)
 			w.Header().Set("Retry-After", "60")
-			http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded. Please try again later.", "rate_limited")
 			return
 		}
 
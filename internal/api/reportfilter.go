@@ -0,0 +1,141 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// orderFilter narrows the orders and order_lines of a report response. The
+// aggregate sections are always computed over every order.
+type orderFilter struct {
+	status  string // "live", "canceled" or "shipped"; empty for all
+	product string // lower-cased substring of an item name
+	sort    string // "date" (newest first, the default) or "total" (largest first)
+	limit   int    // 0 means no limit
+	offset  int
+}
+
+// parseOrderFilter reads status, product, order_sort, order_limit and
+// order_offset. sort and limit already belong to product_spend.
+func parseOrderFilter(q url.Values) (orderFilter, error) {
+	f := orderFilter{
+		status:  q.Get("status"),
+		product: strings.ToLower(strings.TrimSpace(q.Get("product"))),
+		sort:    q.Get("order_sort"),
+	}
+	switch f.status {
+	case "", "live", "canceled", "shipped":
+	default:
+		return f, fmt.Errorf("unknown status %q (want live, canceled or shipped)", f.status)
+	}
+	switch f.sort {
+	case "", "date", "total":
+	default:
+		return f, fmt.Errorf("unknown order_sort %q (want date or total)", f.sort)
+	}
+	if v := q.Get("order_limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("order_limit must be a positive number")
+		}
+		f.limit = n
+	}
+	if v := q.Get("order_offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("order_offset cannot be negative")
+		}
+		f.offset = n
+	}
+	return f, nil
+}
+
+func (f orderFilter) active() bool {
+	return f != orderFilter{}
+}
+
+// apply returns one page of the orders that pass the filter, sorted, and how
+// many passed in all. Live orders leave out acked ones, as in live_orders.
+func (f orderFilter) apply(orders map[string]*report.Order, shipped []*report.ShippedOrder, acked map[string]bool) ([]*report.Order, int) {
+	shippedIDs := make(map[string]bool, len(shipped))
+	for _, s := range shipped {
+		shippedIDs[s.ID] = true
+	}
+
+	var matched []*report.Order
+	for _, o := range orders {
+		canceled := o.Status == "canceled"
+		switch f.status {
+		case "live":
+			if canceled || shippedIDs[o.ID] || acked[o.ID] {
+				continue
+			}
+		case "canceled":
+			if !canceled {
+				continue
+			}
+		case "shipped":
+			if canceled || !shippedIDs[o.ID] {
+				continue
+			}
+		}
+		if f.product != "" && len(f.matchingItems(o)) == 0 {
+			continue
+		}
+		matched = append(matched, o)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if f.sort == "total" {
+			ta, _ := a.Spend(report.SpendTotal)
+			tb, _ := b.Spend(report.SpendTotal)
+			if ta != tb {
+				return ta > tb
+			}
+		}
+		if !a.OrderDateParsed.Equal(b.OrderDateParsed) {
+			return a.OrderDateParsed.After(b.OrderDateParsed)
+		}
+		return a.ID < b.ID
+	})
+
+	total := len(matched)
+	start := min(f.offset, total)
+	end := total
+	if f.limit > 0 {
+		end = min(start+f.limit, total)
+	}
+	return matched[start:end], total
+}
+
+// matchingItems returns the items of o the product filter keeps.
+func (f orderFilter) matchingItems(o *report.Order) []report.Item {
+	if f.product == "" {
+		return o.Items
+	}
+	var items []report.Item
+	for _, item := range o.Items {
+		if strings.Contains(strings.ToLower(item.Name), f.product) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// orderLines returns the order lines of page, in page order, keeping only
+// the items the product filter matches.
+func (f orderFilter) orderLines(page []*report.Order, learned map[string]float64) []report.OrderDetail {
+	filtered := make([]*report.Order, 0, len(page))
+	for _, o := range page {
+		c := *o
+		c.Items = f.matchingItems(o)
+		filtered = append(filtered, &c)
+	}
+	return report.PrepareOrderDetails(filtered, learned)
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"walmart-order-checker/internal/security"
+	"walmart-order-checker/pkg/report"
+)
+
+const (
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 24 * time.Hour
+)
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link expired")
+)
+
+// shareClaims is what a share token vouches for: one account's scan, as of
+// the scan that was current when the link was made.
+type shareClaims struct {
+	Email     string `json:"e"`
+	ScanStart int64  `json:"s"` // UnixNano of the scan's StartTime
+	Expires   int64  `json:"x"` // Unix seconds
+}
+
+// newShareKey returns the key that signs share links. It is derived from
+// SESSION_KEY, so links outlive a restart just as the sessions and stored scan
+// results do. Without SESSION_KEY, which only development allows, the key is
+// random and links stop working when the server restarts.
+func newShareKey() []byte {
+	if secret, err := security.DecodeKey(os.Getenv("SESSION_KEY")); err == nil && len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("walmart-order-checker share links"))
+		return mac.Sum(nil)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate share key: %v", err))
+	}
+	return key
+}
+
+func (s *Server) signShare(c shareClaims) string {
+	payload, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, s.shareKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) verifyShare(token string) (shareClaims, error) {
+	var c shareClaims
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, errShareInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return c, errShareInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return c, errShareInvalid
+	}
+	mac := hmac.New(sha256.New, s.shareKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return c, errShareInvalid
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, errShareInvalid
+	}
+	if time.Now().Unix() >= c.Expires {
+		return c, errShareExpired
+	}
+	return c, nil
+}
+
+// HandleShareReport issues a read-only link to the caller's current report.
+// Links expire after ttl_minutes (default 60, at most 24 hours) and stop
+// working as soon as the account runs a new scan.
+func (s *Server) HandleShareReport(w http.ResponseWriter, r *http.Request) {
+	email := s.sessionEmail(r)
+	if email == "" {
+		writeJSONError(w, http.StatusUnauthorized, "Not authenticated", "not_authenticated")
+		return
+	}
+
+	var req struct {
+		TTLMinutes int `json:"ttl_minutes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid request", "invalid_request")
+			return
+		}
+	}
+	ttl := defaultShareTTL
+	if req.TTLMinutes > 0 {
+		ttl = min(time.Duration(req.TTLMinutes)*time.Minute, maxShareTTL)
+	}
+
+	s.restoreScan(email)
+	s.scanMu.Lock()
+	scan := s.activeScans[email]
+	if scan == nil || scan.InProgress || scan.Orders == nil {
+		s.scanMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "No scan results available", "no_results")
+		return
+	}
+	scanStart := scan.StartTime.UnixNano()
+	s.scanMu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	token := s.signShare(shareClaims{Email: email, ScanStart: scanStart, Expires: expires.Unix()})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        "/api/shared/" + token,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// HandleSharedReport serves a shared report without a session. It returns
+// the report JSON, or the HTML report with ?format=html (add
+// &variant=compact for the print-friendly one).
+func (s *Server) HandleSharedReport(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.verifyShare(chi.URLParam(r, "token"))
+	if errors.Is(err, errShareExpired) {
+		writeJSONError(w, http.StatusGone, "Share link has expired", "share_expired")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Share link is invalid", "share_invalid")
+		return
+	}
+
+	s.restoreScan(claims.Email)
+	s.scanMu.Lock()
+	scan := s.activeScans[claims.Email]
+	if scan == nil || scan.Orders == nil || scan.StartTime.UnixNano() != claims.ScanStart {
+		s.scanMu.Unlock()
+		writeJSONError(w, http.StatusGone, "The shared report has been replaced by a newer scan", "share_stale")
+		return
+	}
+	daysScanned := scan.DaysScanned
+	if daysScanned == 0 {
+		daysScanned = 10
+	}
+	orders := report.CloneOrders(scan.Orders)
+	shipped := scan.Shipped
+	completedAt := scan.CompletedAt
+	s.scanMu.Unlock()
+
+	if r.URL.Query().Get("format") == "html" {
+		variant, err := report.ParseVariant(r.URL.Query().Get("variant"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := report.RenderHTML(w, orders, shipped, report.HTMLOptions{DaysScanned: daysScanned, Variant: variant, Region: s.region, Aliases: s.aliases}); err != nil {
+			log.Printf("Failed to render shared report: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildReport(orders, shipped, reportOptions{daysScanned: daysScanned, region: s.region, completedAt: completedAt, maxOrderLines: s.maxOrderLines}))
+}
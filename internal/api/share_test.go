@@ -0,0 +1,29 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"walmart-order-checker/internal/security"
+)
+
+func TestShareLinksSurviveRestart(t *testing.T) {
+	key, err := security.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SESSION_KEY", key)
+
+	before := &Server{shareKey: newShareKey()}
+	token := before.signShare(shareClaims{Email: "me@example.com", ScanStart: 1, Expires: time.Now().Add(time.Hour).Unix()})
+
+	after := &Server{shareKey: newShareKey()}
+	if _, err := after.verifyShare(token); err != nil {
+		t.Errorf("link made before the restart: %v", err)
+	}
+
+	t.Setenv("SESSION_KEY", "")
+	if _, err := (&Server{shareKey: newShareKey()}).verifyShare(token); err == nil {
+		t.Error("link verified with a random key")
+	}
+}
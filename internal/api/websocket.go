@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +20,93 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     checkWebSocketOrigin,
 }
 
+// defaultMaxFrameBytes bounds a single scan snapshot frame unless
+// WS_MAX_FRAME_BYTES says otherwise.
+const defaultMaxFrameBytes = 1 << 20
+
+func maxFrameBytes() int {
+	if v := os.Getenv("WS_MAX_FRAME_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("WebSocket: invalid WS_MAX_FRAME_BYTES %q, using %d", v, defaultMaxFrameBytes)
+	}
+	return defaultMaxFrameBytes
+}
+
+// Types of the frames sent on the scan WebSocket. A scan sends progress
+// frames while it runs, then a single complete or error frame.
+const (
+	frameProgress = "progress"
+	frameComplete = "complete"
+	frameError    = "error"
+)
+
+// wsFrame is the envelope every scan WebSocket message is wrapped in.
+type wsFrame struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// progressData is the data of a progress frame: counts only, without the
+// orders found so far.
+type progressData struct {
+	TotalMessages int       `json:"total_messages"`
+	Processed     int       `json:"processed"`
+	Rate          float64   `json:"rate"`
+	CurrentEmail  string    `json:"current_email"`
+	StartTime     time.Time `json:"start_time"`
+	DaysScanned   int       `json:"days_scanned,omitempty"`
+}
+
+func progressOf(scan *ScanProgress) progressData {
+	return progressData{
+		TotalMessages: scan.TotalMessages,
+		Processed:     scan.Processed,
+		Rate:          scan.Rate,
+		CurrentEmail:  scan.CurrentEmail,
+		StartTime:     scan.StartTime,
+		DaysScanned:   scan.DaysScanned,
+	}
+}
+
+// marshalFrame encodes the next frame to send for scan. The complete or
+// error frame of a finished scan is returned once; after that final is true
+// and nothing more is sent for that scan.
+func marshalFrame(scan *ScanProgress, limit int) (data []byte, final bool, err error) {
+	switch {
+	case scan.InProgress:
+		data, err = json.Marshal(wsFrame{Type: frameProgress, Data: progressOf(scan)})
+		return data, false, err
+	case scan.Error != "":
+		data, err = json.Marshal(wsFrame{Type: frameError, Data: map[string]string{"error": scan.Error}})
+		return data, true, err
+	default:
+		snapshot, err := marshalSnapshot(scan, limit)
+		if err != nil {
+			return nil, true, err
+		}
+		data, err = json.Marshal(wsFrame{Type: frameComplete, Data: json.RawMessage(snapshot)})
+		return data, true, err
+	}
+}
+
+// marshalSnapshot encodes scan for the WebSocket. If the full snapshot would
+// exceed limit bytes, a summary without the orders and shipments is sent
+// instead, pointing the client at the HTTP report.
+func marshalSnapshot(scan *ScanProgress, limit int) ([]byte, error) {
+	data, err := json.Marshal(scan)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
+	summary := *scan
+	summary.Orders = nil
+	summary.Shipped = nil
+	summary.Truncated = true
+	summary.ReportURL = "/api/report"
+	return json.Marshal(&summary)
+}
+
 func checkWebSocketOrigin(r *http.Request) bool {
 	origin := r.Header.Get("Origin")
 	if origin == "" {
@@ -45,7 +133,13 @@ func checkWebSocketOrigin(r *http.Request) bool {
 func (s *Server) HandleWebSocket(authManager *auth.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !authManager.IsAuthenticated(r) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "not_authenticated")
+			return
+		}
+
+		_, email, err := authManager.GetToken(r)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "Unauthorized", "not_authenticated")
 			return
 		}
 
@@ -56,6 +150,8 @@ func (s *Server) HandleWebSocket(authManager *auth.Manager) http.HandlerFunc {
 		}
 		defer conn.Close()
 
+		frameLimit := maxFrameBytes()
+
 		// Set up ping/pong to keep connection alive
 		const (
 			writeWait      = 10 * time.Second
@@ -92,6 +188,14 @@ func (s *Server) HandleWebSocket(authManager *auth.Manager) http.HandlerFunc {
 		pingTicker := time.NewTicker(pingPeriod)
 		defer pingTicker.Stop()
 
+		// finished is the last scan a complete or error frame was sent for,
+		// and sent the last progress frame's data, which isn't sent again
+		// until it changes.
+		var (
+			finished *ScanProgress
+			sent     progressData
+		)
+
 		for {
 			select {
 			case <-done:
@@ -100,10 +204,21 @@ func (s *Server) HandleWebSocket(authManager *auth.Manager) http.HandlerFunc {
 
 			case <-updateTicker.C:
 				s.scanMu.Lock()
-				if s.activeScan != nil {
-					data, err := json.Marshal(s.activeScan)
+				if scan := s.activeScans[email]; scan != nil && scan != finished {
+					if scan.InProgress {
+						progress := progressOf(scan)
+						if progress == sent {
+							s.scanMu.Unlock()
+							continue
+						}
+						sent = progress
+					}
+					data, final, err := marshalFrame(scan, frameLimit)
 					s.scanMu.Unlock()
 
+					if final {
+						finished = scan
+					}
 					if err != nil {
 						log.Printf("JSON marshal error: %v", err)
 						continue
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -17,18 +19,23 @@ import (
 
 	"walmart-order-checker/internal/security"
 	"walmart-order-checker/internal/storage"
+	"walmart-order-checker/pkg/oauth"
 )
 
 const (
 	sessionName   = "walmart-checker-session"
 	oauthStateKey = "oauth-state"
 	emailKey      = "user-email"
+
+	revokeURL     = "https://oauth2.googleapis.com/revoke"
+	revokeTimeout = 10 * time.Second
 )
 
 type Manager struct {
 	config       *oauth2.Config
 	store        *sessions.CookieStore
 	tokenStorage *storage.TokenStorage
+	refreshSkew  time.Duration
 }
 
 func NewManager(clientID, clientSecret, redirectURL string, tokenStorage *storage.TokenStorage) *Manager {
@@ -63,6 +70,7 @@ func NewManager(clientID, clientSecret, redirectURL string, tokenStorage *storag
 		},
 		store:        sessions.NewCookieStore(sessionKeyBytes),
 		tokenStorage: tokenStorage,
+		refreshSkew:  oauth.RefreshSkew(),
 	}
 }
 
@@ -88,6 +96,55 @@ func (m *Manager) GetLoginURL(w http.ResponseWriter, r *http.Request) (string, e
 	return url, nil
 }
 
+// ConfigStatus describes the OAuth client configuration for setup debugging.
+// It deliberately carries no secret material.
+type ConfigStatus struct {
+	OK              bool     `json:"ok"`
+	ClientIDSet     bool     `json:"client_id_set"`
+	ClientSecretSet bool     `json:"client_secret_set"`
+	ClientID        string   `json:"client_id"`
+	RedirectURL     string   `json:"redirect_url"`
+	Scopes          []string `json:"scopes"`
+	SampleAuthURL   string   `json:"sample_auth_url"`
+	Problems        []string `json:"problems,omitempty"`
+}
+
+// CheckConfig validates the OAuth configuration without starting a login. The
+// sample auth URL uses a placeholder state that is not stored, so it cannot
+// complete a login.
+func (m *Manager) CheckConfig() ConfigStatus {
+	status := ConfigStatus{
+		ClientIDSet:     m.config.ClientID != "",
+		ClientSecretSet: m.config.ClientSecret != "",
+		ClientID:        m.config.ClientID,
+		RedirectURL:     m.config.RedirectURL,
+		Scopes:          m.config.Scopes,
+		SampleAuthURL:   m.config.AuthCodeURL("config-check", oauth2.AccessTypeOffline),
+	}
+
+	if !status.ClientIDSet {
+		status.Problems = append(status.Problems, "GOOGLE_CLIENT_ID is not set")
+	} else if !strings.HasSuffix(m.config.ClientID, ".apps.googleusercontent.com") {
+		status.Problems = append(status.Problems, "GOOGLE_CLIENT_ID does not look like a Google OAuth client ID")
+	}
+	if !status.ClientSecretSet {
+		status.Problems = append(status.Problems, "GOOGLE_CLIENT_SECRET is not set")
+	}
+
+	u, err := url.Parse(m.config.RedirectURL)
+	switch {
+	case err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https"):
+		status.Problems = append(status.Problems, "REDIRECT_URL is not an absolute http(s) URL")
+	case u.Path != "/api/auth/callback":
+		status.Problems = append(status.Problems, "REDIRECT_URL path should be /api/auth/callback")
+	case u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1":
+		status.Problems = append(status.Problems, "Google only allows http redirect URLs for localhost; use https")
+	}
+
+	status.OK = len(status.Problems) == 0
+	return status
+}
+
 func getSessionOptionsForOAuth(r *http.Request, maxAge int) *sessions.Options {
 	secure := isSecureContext(r)
 
@@ -182,25 +239,36 @@ func (m *Manager) GetToken(r *http.Request) (*oauth2.Token, string, error) {
 		return nil, "", fmt.Errorf("no user in session")
 	}
 
+	token, err := m.tokenFor(email)
+	if err != nil {
+		return nil, "", err
+	}
+	return token, email, nil
+}
+
+// tokenFor loads email's stored token, refreshing it first when it is about
+// to expire.
+func (m *Manager) tokenFor(email string) (*oauth2.Token, error) {
 	token, err := m.tokenStorage.Load(email)
 	if err != nil {
-		return nil, "", fmt.Errorf("load token: %w", err)
+		return nil, fmt.Errorf("load token: %w", err)
 	}
 
-	if token.Expiry.Before(time.Now()) {
-		newToken, err := m.config.TokenSource(context.Background(), token).Token()
+	// Refresh a little early so the token can't expire mid-request.
+	if token.Expiry.Before(time.Now().Add(m.refreshSkew)) {
+		newToken, err := oauth.RefreshToken(context.Background(), m.config, token)
 		if err != nil {
-			return nil, "", fmt.Errorf("refresh token: %w", err)
+			return nil, fmt.Errorf("refresh token: %w", err)
 		}
 
 		if err := m.tokenStorage.Save(email, newToken); err != nil {
-			return nil, "", fmt.Errorf("save refreshed token: %w", err)
+			return nil, fmt.Errorf("save refreshed token: %w", err)
 		}
 
-		return newToken, email, nil
+		return newToken, nil
 	}
 
-	return token, email, nil
+	return token, nil
 }
 
 func (m *Manager) IsAuthenticated(r *http.Request) bool {
@@ -214,17 +282,49 @@ func (m *Manager) Logout(w http.ResponseWriter, r *http.Request) error {
 	return session.Save(r, w)
 }
 
-func (m *Manager) GetGmailService(r *http.Request) (*gm.Service, string, error) {
+// Revoke asks Google to revoke token, which also invalidates every other
+// token issued from the same grant.
+func (m *Manager) Revoke(ctx context.Context, token *oauth2.Token) error {
+	value := token.RefreshToken
+	if value == "" {
+		value = token.AccessToken
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, revokeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {value}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("revoke token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoke token: %s", resp.Status)
+	}
+	return nil
+}
+
+// GetGmailClient returns an HTTP client authorized for the session's Gmail
+// account, and the account's address.
+func (m *Manager) GetGmailClient(r *http.Request) (*http.Client, string, error) {
 	token, email, err := m.GetToken(r)
 	if err != nil {
 		return nil, "", err
 	}
+	return oauth.NewClient(context.Background(), m.config, token), email, nil
+}
 
-	client := m.config.Client(context.Background(), token)
-	srv, err := gm.NewService(context.Background(), option.WithHTTPClient(client))
+// GmailClientFor returns an HTTP client authorized for email's stored token,
+// for work on an account other than the session's own.
+func (m *Manager) GmailClientFor(email string) (*http.Client, error) {
+	token, err := m.tokenFor(email)
 	if err != nil {
-		return nil, "", fmt.Errorf("create gmail service: %w", err)
+		return nil, err
 	}
-
-	return srv, email, nil
+	return oauth.NewClient(context.Background(), m.config, token), nil
 }
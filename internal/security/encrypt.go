@@ -0,0 +1,135 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	passphraseMagic      = "WOCENC1\n"
+	passphraseSaltSize   = 16
+	passphraseIterations = 600_000
+)
+
+// Encrypt seals plaintext with AES-GCM under key. The random nonce is
+// prepended to the returned ciphertext.
+func Encrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens ciphertext produced by Encrypt.
+func Decrypt(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// EncryptWithPassphrase encrypts plaintext under a key derived from passphrase
+// with PBKDF2-SHA256. The output is self-describing: a format marker and the
+// salt precede the AES-GCM ciphertext.
+func EncryptWithPassphrase(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+
+	sealed, err := Encrypt(key, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+
+	out := make([]byte, 0, len(passphraseMagic)+len(salt)+len(sealed))
+	out = append(out, passphraseMagic...)
+	out = append(out, salt...)
+	return append(out, sealed...), nil
+}
+
+// DecryptWithPassphrase reverses EncryptWithPassphrase.
+func DecryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(passphraseMagic)) {
+		return nil, fmt.Errorf("not an encrypted report")
+	}
+	data = data[len(passphraseMagic):]
+	if len(data) < passphraseSaltSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, data[:passphraseSaltSize], passphraseIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+
+	plaintext, err := Decrypt(key, data[passphraseSaltSize:])
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted file")
+	}
+	return plaintext, nil
+}
+
+// ReadPassphrase returns the value of envVar if set, otherwise prompts for a
+// passphrase on the terminal without echoing it.
+func ReadPassphrase(envVar, prompt string) (string, error) {
+	if pass := os.Getenv(envVar); pass != "" {
+		return pass, nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("read passphrase: %w", err)
+		}
+		return string(pass), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+const createAcknowledgedOrdersTable = `
+	CREATE TABLE IF NOT EXISTS acknowledged_orders (
+		email TEXT NOT NULL,
+		order_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (email, order_id)
+	)
+`
+
+// AckOrder marks an order as reviewed by email. Acknowledging an order twice
+// is not an error.
+func (ts *TokenStorage) AckOrder(email, orderID string) error {
+	_, err := ts.db.Exec(`
+		INSERT INTO acknowledged_orders (email, order_id, created_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(email, order_id) DO NOTHING
+	`, email, orderID, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("ack order: %w", err)
+	}
+	return nil
+}
+
+func (ts *TokenStorage) UnackOrder(email, orderID string) error {
+	_, err := ts.db.Exec("DELETE FROM acknowledged_orders WHERE email = ? AND order_id = ?", email, orderID)
+	if err != nil {
+		return fmt.Errorf("unack order: %w", err)
+	}
+	return nil
+}
+
+// AckedOrders returns the set of order IDs email has acknowledged.
+func (ts *TokenStorage) AckedOrders(email string) (map[string]bool, error) {
+	rows, err := ts.db.Query("SELECT order_id FROM acknowledged_orders WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("query acked orders: %w", err)
+	}
+	defer rows.Close()
+
+	acked := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		acked[id] = true
+	}
+	return acked, rows.Err()
+}
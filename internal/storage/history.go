@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const createScanHistoryTable = `
+	CREATE TABLE IF NOT EXISTS scan_history (
+		email TEXT PRIMARY KEY,
+		order_ids TEXT NOT NULL,
+		scanned_at INTEGER NOT NULL
+	)
+`
+
+// PreviousScanOrders returns the order IDs found by email's last completed
+// scan. ok is false if the account has never finished a scan.
+func (ts *TokenStorage) PreviousScanOrders(email string) (ids map[string]bool, ok bool, err error) {
+	var data string
+	err = ts.db.QueryRow("SELECT order_ids FROM scan_history WHERE email = ?", email).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("query scan history: %w", err)
+	}
+
+	var list []string
+	if err := json.Unmarshal([]byte(data), &list); err != nil {
+		return nil, false, fmt.Errorf("decode scan history: %w", err)
+	}
+	ids = make(map[string]bool, len(list))
+	for _, id := range list {
+		ids[id] = true
+	}
+	return ids, true, nil
+}
+
+// SaveScanOrders replaces email's stored scan with the given order IDs.
+func (ts *TokenStorage) SaveScanOrders(email string, ids []string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	_, err = ts.db.Exec(`
+		INSERT INTO scan_history (email, order_ids, scanned_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET order_ids = excluded.order_ids, scanned_at = excluded.scanned_at
+	`, email, string(data), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("save scan history: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"walmart-order-checker/pkg/report"
+)
+
+const createScanResultsTable = `
+	CREATE TABLE IF NOT EXISTS scan_results (
+		email TEXT PRIMARY KEY,
+		results TEXT NOT NULL,
+		completed_at INTEGER NOT NULL
+	)
+`
+
+// ScanResults is what an account's last completed scan found, kept so the
+// report survives a server restart.
+type ScanResults struct {
+	Orders      map[string]*report.Order `json:"orders"`
+	Shipped     []*report.ShippedOrder   `json:"shipped"`
+	DaysScanned int                      `json:"days_scanned"`
+	StartedAt   time.Time                `json:"started_at"`
+	CompletedAt time.Time                `json:"-"`
+}
+
+// ScanResults returns email's last completed scan, or nil if it has none.
+func (ts *TokenStorage) ScanResults(email string) (*ScanResults, error) {
+	var data string
+	var completedAt int64
+	err := ts.db.QueryRow("SELECT results, completed_at FROM scan_results WHERE email = ?", email).Scan(&data, &completedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query scan results: %w", err)
+	}
+	var results ScanResults
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return nil, fmt.Errorf("decode scan results: %w", err)
+	}
+	results.CompletedAt = time.Unix(completedAt, 0)
+	return &results, nil
+}
+
+// SaveScanResults replaces email's stored scan results.
+func (ts *TokenStorage) SaveScanResults(email string, results *ScanResults) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	_, err = ts.db.Exec(`
+		INSERT INTO scan_results (email, results, completed_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET results = excluded.results, completed_at = excluded.completed_at
+	`, email, string(data), results.CompletedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("save scan results: %w", err)
+	}
+	return nil
+}
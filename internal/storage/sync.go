@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const createSyncStateTable = `
+	CREATE TABLE IF NOT EXISTS sync_state (
+		email TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)
+`
+
+// SyncState returns the sync state last saved for email, or nil if it has
+// none. Storage keeps the state as an opaque blob; the scan that saved it
+// decides what it holds.
+func (ts *TokenStorage) SyncState(email string) ([]byte, error) {
+	var data string
+	err := ts.db.QueryRow("SELECT state FROM sync_state WHERE email = ?", email).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query sync state: %w", err)
+	}
+	return []byte(data), nil
+}
+
+// SaveSyncState replaces email's stored sync state.
+func (ts *TokenStorage) SaveSyncState(email string, state []byte) error {
+	_, err := ts.db.Exec(`
+		INSERT INTO sync_state (email, state, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at
+	`, email, string(state), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("save sync state: %w", err)
+	}
+	return nil
+}
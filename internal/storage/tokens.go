@@ -1,13 +1,10 @@
 package storage
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -19,6 +16,24 @@ import (
 	"walmart-order-checker/internal/security"
 )
 
+const (
+	tokenDBMaxConns    = 4
+	defaultBusyTimeout = 5 * time.Second
+)
+
+// busyTimeout is how long a connection waits on a locked token database before
+// failing with "database is locked". TOKEN_DB_BUSY_TIMEOUT overrides it.
+func busyTimeout() time.Duration {
+	if v := os.Getenv("TOKEN_DB_BUSY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Warning: invalid TOKEN_DB_BUSY_TIMEOUT %q, using %s", v, defaultBusyTimeout)
+	}
+	return defaultBusyTimeout
+}
+
 type TokenStorage struct {
 	db  *sql.DB
 	key []byte
@@ -32,11 +47,21 @@ func NewTokenStorage(dbPath string) (*TokenStorage, error) {
 		}
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	// Pragmas go in the DSN rather than through db.Exec so that every pooled
+	// connection gets them, not just the first one.
+	dsn := fmt.Sprintf("%s?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(%d)",
+		dbPath, busyTimeout().Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
+	// WAL lets readers proceed alongside a writer; SQLite still serializes
+	// writes, so a small pool is enough.
+	db.SetMaxOpenConns(tokenDBMaxConns)
+	db.SetMaxIdleConns(tokenDBMaxConns)
+	db.SetConnMaxLifetime(0)
+
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS oauth_tokens (
 			email TEXT PRIMARY KEY,
@@ -49,6 +74,22 @@ func NewTokenStorage(dbPath string) (*TokenStorage, error) {
 		return nil, fmt.Errorf("create table: %w", err)
 	}
 
+	if _, err := db.Exec(createAcknowledgedOrdersTable); err != nil {
+		return nil, fmt.Errorf("create acknowledged_orders table: %w", err)
+	}
+
+	if _, err := db.Exec(createScanHistoryTable); err != nil {
+		return nil, fmt.Errorf("create scan_history table: %w", err)
+	}
+
+	if _, err := db.Exec(createSyncStateTable); err != nil {
+		return nil, fmt.Errorf("create sync_state table: %w", err)
+	}
+
+	if _, err := db.Exec(createScanResultsTable); err != nil {
+		return nil, fmt.Errorf("create scan_results table: %w", err)
+	}
+
 	encryptionKey := os.Getenv("ENCRYPTION_KEY")
 	if encryptionKey == "" {
 		environment := os.Getenv("ENVIRONMENT")
@@ -81,47 +122,11 @@ func NewTokenStorage(dbPath string) (*TokenStorage, error) {
 }
 
 func (ts *TokenStorage) encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(ts.key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return security.Encrypt(ts.key, plaintext)
 }
 
 func (ts *TokenStorage) decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(ts.key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return plaintext, nil
+	return security.Decrypt(ts.key, ciphertext)
 }
 
 func (ts *TokenStorage) Save(email string, token *oauth2.Token) error {
@@ -179,6 +184,25 @@ func (ts *TokenStorage) Delete(email string) error {
 	return err
 }
 
+// accountTables are the tables holding rows keyed by an account's email.
+var accountTables = []string{"oauth_tokens", "acknowledged_orders", "scan_history", "sync_state", "scan_results"}
+
+// DeleteAccount removes everything stored for email, its token included, in
+// one transaction.
+func (ts *TokenStorage) DeleteAccount(email string) error {
+	tx, err := ts.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	for _, table := range accountTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+			return fmt.Errorf("delete from %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
 func (ts *TokenStorage) ListEmails() ([]string, error) {
 	rows, err := ts.db.Query("SELECT email FROM oauth_tokens ORDER BY updated_at DESC")
 	if err != nil {
@@ -198,6 +222,12 @@ func (ts *TokenStorage) ListEmails() ([]string, error) {
 	return emails, nil
 }
 
+// Ping checks that the database answers a trivial query.
+func (ts *TokenStorage) Ping(ctx context.Context) error {
+	var one int
+	return ts.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
 func (ts *TokenStorage) Close() error {
 	return ts.db.Close()
 }
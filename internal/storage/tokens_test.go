@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"walmart-order-checker/internal/security"
+	"walmart-order-checker/pkg/report"
+)
+
+func newTestStorage(t *testing.T) *TokenStorage {
+	t.Helper()
+	key, err := security.GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_KEY", key)
+	ts, err := NewTokenStorage(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	return ts
+}
+
+func TestDeleteAccountRemovesEveryTable(t *testing.T) {
+	ts := newTestStorage(t)
+	for _, email := range []string{"gone@example.com", "kept@example.com"} {
+		if err := ts.Save(email, &oauth2.Token{AccessToken: "token"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.AckOrder(email, "1234"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveScanOrders(email, []string{"1234"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveSyncState(email, []byte(`{"history_id":1}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveScanResults(email, &ScanResults{Orders: map[string]*report.Order{"1234": {ID: "1234"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ts.DeleteAccount("gone@example.com"); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+
+	for _, table := range accountTables {
+		var gone, kept int
+		ts.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE email = ?", "gone@example.com").Scan(&gone)
+		ts.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE email = ?", "kept@example.com").Scan(&kept)
+		if gone != 0 {
+			t.Errorf("%s still has %d row(s) for the deleted account", table, gone)
+		}
+		if kept != 1 {
+			t.Errorf("%s has %d row(s) for the other account, want 1", table, kept)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gm "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// batchSize is how many messages are requested per batch call; Gmail
+// recommends no more than 50.
+const batchSize = 50
+
+// batchDelay is how long a partial batch waits for more IDs before it is
+// sent anyway.
+const batchDelay = 100 * time.Millisecond
+
+// NewService returns a Gmail service using client. Keep client too: passed
+// as ProcessOptions.Client, it lets scans fetch messages in batches.
+func NewService(ctx context.Context, client *http.Client) (*gm.Service, error) {
+	srv, err := gm.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("gmail service: %w", err)
+	}
+	return srv, nil
+}
+
+// batchFetch fetches the IDs read from ids batchSize at a time, one batch
+// call after another, and passes each message or error to deliver. Every
+// fetch worker feeds the same batchFetch, so however many workers run, only
+// one batch of requests is against the quota at a time. It returns once ids
+// is closed and the last batch has been delivered.
+func (p RetryPolicy) batchFetch(ctx context.Context, client *http.Client, basePath, user string, ids <-chan string, deliver func(id string, msg *gm.Message, err error)) {
+	var batch []string
+	timer := time.NewTimer(batchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		msgs, errs := p.batchGet(ctx, client, basePath, user, batch)
+		for _, id := range batch {
+			deliver(id, msgs[id], errs[id])
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case id, ok := <-ids:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, id); len(batch) == 1 {
+				timer.Reset(batchDelay)
+			}
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// batchGet fetches messages in full through Gmail's batch endpoint, retrying
+// the ones that fail transiently under p. Every ID ends up in exactly one of
+// the returned maps.
+func (p RetryPolicy) batchGet(ctx context.Context, client *http.Client, basePath, user string, ids []string) (map[string]*gm.Message, map[string]error) {
+	msgs := make(map[string]*gm.Message, len(ids))
+	errs := make(map[string]error)
+	pending := ids
+	err := p.do(ctx, func() error {
+		got, failed, err := batchRequest(ctx, client, basePath, user, pending)
+		if err != nil {
+			return err
+		}
+		var retry []string
+		var lastErr error
+		for i, id := range pending {
+			switch {
+			case got[i] != nil:
+				msgs[id] = got[i]
+			case isTransient(failed[i]):
+				retry = append(retry, id)
+				lastErr = failed[i]
+			default:
+				errs[id] = failed[i]
+			}
+		}
+		pending = retry
+		return lastErr
+	})
+	if err != nil {
+		for _, id := range pending {
+			errs[id] = err
+		}
+	}
+	return msgs, errs
+}
+
+// batchRequest sends one batch call for ids. For each ID it returns either
+// the message or the error Gmail answered with; err is set only when the
+// batch call as a whole failed.
+func batchRequest(ctx context.Context, client *http.Client, basePath, user string, ids []string) (msgs []*gm.Message, errs []error, err error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, id := range ids {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<item-" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(part, "GET /gmail/v1/users/%s/messages/%s?format=full HTTP/1.1\r\n\r\n", url.PathEscape(user), url.PathEscape(id))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(basePath, "/")+"/batch/gmail/v1", &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil, fmt.Errorf("batch response: unexpected content type %q", res.Header.Get("Content-Type"))
+	}
+
+	msgs = make([]*gm.Message, len(ids))
+	errs = make([]error, len(ids))
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("batch response: %w", err)
+		}
+		// Responses carry the request's Content-ID as <response-item-N>, in
+		// no particular order.
+		cid := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(cid, "response-item-"))
+		if err != nil || i < 0 || i >= len(ids) {
+			continue
+		}
+		inner, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			errs[i] = fmt.Errorf("batch response: %w", err)
+			continue
+		}
+		if err := googleapi.CheckResponse(inner); err != nil {
+			errs[i] = err
+			inner.Body.Close()
+			continue
+		}
+		var msg gm.Message
+		err = json.NewDecoder(inner.Body).Decode(&msg)
+		inner.Body.Close()
+		if err != nil {
+			errs[i] = fmt.Errorf("decode message: %w", err)
+			continue
+		}
+		msgs[i] = &msg
+	}
+	for i := range ids {
+		if msgs[i] == nil && errs[i] == nil {
+			errs[i] = fmt.Errorf("batch response: no answer for message %s", ids[i])
+		}
+	}
+	return msgs, errs, nil
+}
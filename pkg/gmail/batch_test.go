@@ -0,0 +1,161 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gm "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// batchCalls counts the batch calls a batchServer receives and the most it
+// was answering at once.
+type batchCalls struct {
+	total, inFlight, peak atomic.Int32
+}
+
+// batchServer answers Gmail batch calls with a small HTML message for every
+// ID requested. Each answer takes a little while, so calls sent together
+// overlap.
+func batchServer(t *testing.T, calls *batchCalls) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch/gmail/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		calls.total.Add(1)
+		n := calls.inFlight.Add(1)
+		defer calls.inFlight.Add(-1)
+		for peak := calls.peak.Load(); n > peak && !calls.peak.CompareAndSwap(peak, n); peak = calls.peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The part holds "GET /gmail/v1/users/me/messages/<id>?format=full HTTP/1.1".
+			line, _ := io.ReadAll(part)
+			target := strings.Fields(string(line))[1]
+			id := path.Base(strings.SplitN(target, "?", 2)[0])
+			msg := htmlMessage("Hello", "<p>Hello</p>")
+			msg.Id = id
+			data, _ := json.Marshal(msg)
+
+			out, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-Id":   {"<response-" + strings.Trim(part.Header.Get("Content-Id"), "<>") + ">"},
+			})
+			fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(data), data)
+		}
+		mw.Close()
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.Write(body.Bytes())
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestBatchedFetchSharesBatchesAcrossWorkers(t *testing.T) {
+	var calls batchCalls
+	ts := batchServer(t, &calls)
+	srv, err := gm.NewService(context.Background(), option.WithHTTPClient(ts.Client()), option.WithEndpoint(ts.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	msgs := make([]*gm.Message, n)
+	for i := range msgs {
+		msgs[i] = &gm.Message{Id: fmt.Sprintf("msg-%03d", i)}
+	}
+	_, _, stats, err := ProcessEmailsWithOptions(context.Background(), srv, "me", msgs, ProcessOptions{
+		Client:       ts.Client(),
+		Cache:        NewMemoryCache(CacheTTL()),
+		FetchWorkers: DefaultFetchWorkers,
+		Progress:     func(Progress) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Processed != n || stats.FetchErrors != 0 {
+		t.Fatalf("processed %d messages with %d fetch errors, want %d and 0", stats.Processed, stats.FetchErrors, n)
+	}
+	// Four full batches, plus at most a partial one sent on the timer.
+	if got := calls.total.Load(); got > n/batchSize+1 {
+		t.Errorf("%d batch calls for %d messages, want at most %d", got, n, n/batchSize+1)
+	}
+	if got := calls.peak.Load(); got != 1 {
+		t.Errorf("%d batch calls in flight at once, want 1", got)
+	}
+}
+
+// BenchmarkProcessEmails runs the fetch and parse pipeline over a server that
+// answers single message requests after a fixed latency, for several splits
+// of fetch and parse workers. One parse worker behind one fetch worker is
+// roughly what a single-stage pool of one worker did.
+func BenchmarkProcessEmails(b *testing.B) {
+	body, err := os.ReadFile(filepath.Join("testdata", "order_3_items.html"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		msg := htmlMessage("Thanks for your order", string(body))
+		msg.Id = path.Base(r.URL.Path)
+		json.NewEncoder(w).Encode(msg)
+	}))
+	defer ts.Close()
+	srv, err := gm.NewService(context.Background(), option.WithHTTPClient(ts.Client()), option.WithEndpoint(ts.URL+"/"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs := make([]*gm.Message, 200)
+	for i := range msgs {
+		msgs[i] = &gm.Message{Id: fmt.Sprintf("msg-%03d", i)}
+	}
+
+	for _, w := range []struct{ fetch, parse int }{{1, 1}, {8, 1}, {8, 4}, {DefaultFetchWorkers, DefaultParseWorkers}} {
+		b.Run(fmt.Sprintf("fetch=%d/parse=%d", w.fetch, w.parse), func(b *testing.B) {
+			for b.Loop() {
+				_, _, _, err := ProcessEmailsWithOptions(context.Background(), srv, "me", msgs, ProcessOptions{
+					Cache:        NewMemoryCache(CacheTTL()),
+					FetchWorkers: w.fetch,
+					ParseWorkers: w.parse,
+					Progress:     func(Progress) {},
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
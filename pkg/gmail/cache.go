@@ -3,7 +3,9 @@ package gmail
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
@@ -14,38 +16,118 @@ import (
 	"walmart-order-checker/pkg/report"
 )
 
+// Where and for how long scans cache parsed messages unless told otherwise.
+// Gmail message IDs never change meaning, so the TTL only bounds disk use.
+const (
+	DefaultCachePath = ".cache/messages"
+	DefaultCacheTTL  = 24 * time.Hour
+)
+
+// CacheTTL returns the CACHE_TTL duration (e.g. "72h"), or DefaultCacheTTL
+// when it is unset or invalid.
+func CacheTTL() time.Duration {
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: invalid CACHE_TTL %q, using %s", v, DefaultCacheTTL)
+	}
+	return DefaultCacheTTL
+}
+
+// ParserVersion identifies how cached results were extracted. Bump it when
+// extraction changes enough that old results are wrong: they are then parsed
+// again from the cached raw message, or fetched again if it has none.
+//
+// Version 2 records why orders were canceled.
+const ParserVersion = 2
+
+// Cache stores the parsed result of each message so repeat scans skip
+// fetching it again. Get only returns results parsed at ParserVersion;
+// GetRaw returns the message itself whenever it was kept.
+type Cache interface {
+	Get(msgID string) (*CachedResult, bool)
+	GetRaw(msgID string) (*RawMessage, bool)
+	Set(msgID string, result *CachedResult) error
+	Clear() error
+	// DeleteAccount removes the entries set with result.Account == account.
+	DeleteAccount(account string) error
+	Stats() (total int, size int64, err error)
+	Close() error
+}
+
+// MessageCache is the SQLite-backed Cache.
 type MessageCache struct {
 	db       *sql.DB
 	ttl      time.Duration
 	getStmt  *sql.Stmt
+	rawStmt  *sql.Stmt
 	setStmt  *sql.Stmt
 	stmtLock sync.RWMutex
+	done     chan struct{} // closed by Close to stop periodicCleanup
+	closed   sync.Once
 }
 
 type CachedResult struct {
 	Order   *report.Order
 	Shipped []*report.ShippedOrder
+	// InvoiceChecked records that PDF attachments were already looked at, so
+	// a scan with ProcessOptions.ParseInvoices can trust this entry.
+	InvoiceChecked bool `json:",omitempty"`
+	// Subject and Category let audit logs describe cached messages without
+	// fetching them again.
+	Subject  string `json:",omitempty"`
+	Category string `json:",omitempty"`
+	// Raw is the message the result was parsed from. Caches store it apart
+	// from the result, and Get leaves it nil.
+	Raw *RawMessage `json:"-"`
+	// Account is the mailbox the message came from, kept so the account's
+	// entries can be deleted with it. Get leaves it empty.
+	Account string `json:"-"`
+}
+
+// ErrDiskCacheUnavailable is returned by Clear on the in-memory cache
+// NewMessageCache falls back to: the cache on disk couldn't be opened, so it
+// wasn't cleared either.
+var ErrDiskCacheUnavailable = errors.New("message cache on disk unavailable")
+
+// NewMessageCache opens the SQLite cache at cachePath. The cache is optional,
+// so if SQLite can't be used (e.g. a read-only filesystem) it logs a warning and
+// returns an in-memory cache that lasts for the life of the process instead.
+// Clearing that cache fails with ErrDiskCacheUnavailable.
+func NewMessageCache(cachePath string, ttl time.Duration) Cache {
+	c, err := OpenMessageCache(cachePath, ttl)
+	if err != nil {
+		log.Printf("Warning: message cache unavailable, using memory only: %v", err)
+		mem := NewMemoryCache(ttl)
+		mem.diskErr = err
+		return mem
+	}
+	return c
 }
 
-func NewMessageCache(cachePath string, ttl time.Duration) *MessageCache {
+// OpenMessageCache opens the SQLite cache at cachePath, a directory or a
+// database file.
+func OpenMessageCache(cachePath string, ttl time.Duration) (*MessageCache, error) {
 	dbPath := cachePath
 	if filepath.Ext(cachePath) == "" {
 		dbPath = filepath.Join(cachePath, "messages.db")
 		if err := os.MkdirAll(cachePath, 0o755); err != nil {
-			panic(fmt.Sprintf("failed to create cache directory: %v", err))
+			return nil, fmt.Errorf("create cache directory: %w", err)
 		}
 	} else {
 		dir := filepath.Dir(cachePath)
 		if dir != "." && dir != "" {
 			if err := os.MkdirAll(dir, 0o755); err != nil {
-				panic(fmt.Sprintf("failed to create cache directory: %v", err))
+				return nil, fmt.Errorf("create cache directory: %w", err)
 			}
 		}
 	}
 
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to open cache database: %v", err))
+		return nil, fmt.Errorf("open cache database: %w", err)
 	}
 
 	db.SetMaxOpenConns(1)
@@ -62,7 +144,8 @@ func NewMessageCache(cachePath string, ttl time.Duration) *MessageCache {
 
 	for _, pragma := range pragmas {
 		if _, err := db.Exec(pragma); err != nil {
-			panic(fmt.Sprintf("failed to set pragma %s: %v", pragma, err))
+			db.Close()
+			return nil, fmt.Errorf("set pragma %s: %w", pragma, err)
 		}
 	}
 
@@ -75,33 +158,82 @@ func NewMessageCache(cachePath string, ttl time.Duration) *MessageCache {
 		CREATE INDEX IF NOT EXISTS idx_parsed_created_at ON parsed_results(created_at);
 	`)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create cache table: %v", err))
+		db.Close()
+		return nil, fmt.Errorf("create cache table: %w", err)
+	}
+	if err := addCacheColumns(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	cache := &MessageCache{
-		db:  db,
-		ttl: ttl,
+		db:   db,
+		ttl:  ttl,
+		done: make(chan struct{}),
 	}
 
-	cache.prepareStatements()
+	if err := cache.prepareStatements(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	go cache.periodicCleanup()
 
-	return cache
+	return cache, nil
+}
+
+// addCacheColumns brings a cache created before raw messages and accounts were
+// kept up to date. Its rows count as parsed by version 0, so they are
+// refetched.
+func addCacheColumns(db *sql.DB) error {
+	have := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM pragma_table_info('parsed_results')")
+	if err != nil {
+		return fmt.Errorf("read cache schema: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("read cache schema: %w", err)
+		}
+		have[name] = true
+	}
+	rows.Close()
+
+	for _, col := range []struct{ name, def string }{
+		{"raw_message", "BLOB"},
+		{"parser_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"account", "TEXT"},
+	} {
+		if have[col.name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE parsed_results ADD COLUMN " + col.name + " " + col.def); err != nil {
+			return fmt.Errorf("add cache column %s: %w", col.name, err)
+		}
+	}
+	return nil
 }
 
-func (c *MessageCache) prepareStatements() {
+func (c *MessageCache) prepareStatements() error {
 	var err error
 
-	c.getStmt, err = c.db.Prepare("SELECT result_data FROM parsed_results WHERE message_id = ? AND created_at > ?")
+	c.getStmt, err = c.db.Prepare("SELECT result_data FROM parsed_results WHERE message_id = ? AND created_at > ? AND parser_version = ?")
+	if err != nil {
+		return fmt.Errorf("prepare get statement: %w", err)
+	}
+
+	c.rawStmt, err = c.db.Prepare("SELECT raw_message FROM parsed_results WHERE message_id = ? AND created_at > ? AND raw_message IS NOT NULL")
 	if err != nil {
-		panic(fmt.Sprintf("failed to prepare get statement: %v", err))
+		return fmt.Errorf("prepare raw statement: %w", err)
 	}
 
-	c.setStmt, err = c.db.Prepare("INSERT OR REPLACE INTO parsed_results (message_id, result_data, created_at) VALUES (?, ?, ?)")
+	c.setStmt, err = c.db.Prepare("INSERT OR REPLACE INTO parsed_results (message_id, result_data, raw_message, parser_version, account, created_at) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
-		panic(fmt.Sprintf("failed to prepare set statement: %v", err))
+		return fmt.Errorf("prepare set statement: %w", err)
 	}
+	return nil
 }
 
 func (c *MessageCache) Get(msgID string) (*CachedResult, bool) {
@@ -111,7 +243,7 @@ func (c *MessageCache) Get(msgID string) (*CachedResult, bool) {
 	defer c.stmtLock.RUnlock()
 
 	var data []byte
-	err := c.getStmt.QueryRow(msgID, cutoff).Scan(&data)
+	err := c.getStmt.QueryRow(msgID, cutoff, ParserVersion).Scan(&data)
 	if err != nil {
 		return nil, false
 	}
@@ -124,16 +256,44 @@ func (c *MessageCache) Get(msgID string) (*CachedResult, bool) {
 	return &result, true
 }
 
+func (c *MessageCache) GetRaw(msgID string) (*RawMessage, bool) {
+	cutoff := time.Now().Add(-c.ttl).Unix()
+
+	c.stmtLock.RLock()
+	defer c.stmtLock.RUnlock()
+
+	var data []byte
+	if err := c.rawStmt.QueryRow(msgID, cutoff).Scan(&data); err != nil {
+		return nil, false
+	}
+	raw, err := decodeRaw(data)
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
 func (c *MessageCache) Set(msgID string, result *CachedResult) error {
 	data, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
+	var raw []byte
+	if result.Raw != nil {
+		if raw, err = encodeRaw(result.Raw); err != nil {
+			return err
+		}
+	}
 
 	c.stmtLock.RLock()
 	defer c.stmtLock.RUnlock()
 
-	_, err = c.setStmt.Exec(msgID, data, time.Now().Unix())
+	_, err = c.setStmt.Exec(msgID, data, raw, ParserVersion, result.Account, time.Now().Unix())
+	return err
+}
+
+func (c *MessageCache) DeleteAccount(account string) error {
+	_, err := c.db.Exec("DELETE FROM parsed_results WHERE account = ?", account)
 	return err
 }
 
@@ -148,7 +308,7 @@ func (c *MessageCache) Clear() error {
 
 func (c *MessageCache) Stats() (total int, size int64, err error) {
 	err = c.db.QueryRow(
-		"SELECT COUNT(*), COALESCE(SUM(length(result_data)), 0) FROM parsed_results",
+		"SELECT COUNT(*), COALESCE(SUM(length(result_data) + COALESCE(length(raw_message), 0)), 0) FROM parsed_results",
 	).Scan(&total, &size)
 	return
 }
@@ -157,19 +317,38 @@ func (c *MessageCache) periodicCleanup() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		cutoff := time.Now().Add(-c.ttl).Unix()
-		c.db.Exec("DELETE FROM parsed_results WHERE created_at <= ?", cutoff)
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-c.ttl).Unix()
+			c.db.Exec("DELETE FROM parsed_results WHERE created_at <= ?", cutoff)
+		case <-c.done:
+			return
+		}
 	}
 }
 
+// Close stops the background cleanup and closes the database. It is safe to
+// call more than once.
 func (c *MessageCache) Close() error {
+	var err error
+	c.closed.Do(func() {
+		close(c.done)
+		err = c.close()
+	})
+	return err
+}
+
+func (c *MessageCache) close() error {
 	c.stmtLock.Lock()
 	defer c.stmtLock.Unlock()
 
 	if c.getStmt != nil {
 		c.getStmt.Close()
 	}
+	if c.rawStmt != nil {
+		c.rawStmt.Close()
+	}
 	if c.setStmt != nil {
 		c.setStmt.Close()
 	}
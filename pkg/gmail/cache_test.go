@@ -0,0 +1,102 @@
+package gmail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"walmart-order-checker/pkg/report"
+)
+
+func TestCacheDeleteAccount(t *testing.T) {
+	disk, err := OpenMessageCache(filepath.Join(t.TempDir(), "messages.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	for name, c := range map[string]Cache{"sqlite": disk, "memory": NewMemoryCache(time.Hour)} {
+		t.Run(name, func(t *testing.T) {
+			set := func(id, account string) {
+				t.Helper()
+				err := c.Set(id, &CachedResult{
+					Order:   &report.Order{ID: id},
+					Raw:     &RawMessage{MimeType: "text/html", Body: "<p>order " + id + "</p>"},
+					Account: account,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			set("m1", "gone@example.com")
+			set("m2", "kept@example.com")
+
+			if err := c.DeleteAccount("gone@example.com"); err != nil {
+				t.Fatalf("DeleteAccount: %v", err)
+			}
+			if _, ok := c.Get("m1"); ok {
+				t.Error("result for the deleted account is still cached")
+			}
+			if _, ok := c.GetRaw("m1"); ok {
+				t.Error("raw body for the deleted account is still cached")
+			}
+			if _, ok := c.Get("m2"); !ok {
+				t.Error("result for the other account was deleted")
+			}
+		})
+	}
+}
+
+func TestMemoryFallbackClearFails(t *testing.T) {
+	// A file where the cache directory should be can't be opened as one.
+	blocker := filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewMessageCache(filepath.Join(blocker, "messages"), time.Hour)
+	defer c.Close()
+	if _, ok := c.(*MemoryCache); !ok {
+		t.Fatalf("got %T, want the in-memory fallback", c)
+	}
+	if err := c.Clear(); !errors.Is(err, ErrDiskCacheUnavailable) {
+		t.Errorf("Clear = %v, want ErrDiskCacheUnavailable", err)
+	}
+	if err := NewMemoryCache(time.Hour).Clear(); err != nil {
+		t.Errorf("Clear on a plain memory cache = %v, want nil", err)
+	}
+}
+
+func TestRescanReadsFromCache(t *testing.T) {
+	disk, err := OpenMessageCache(filepath.Join(t.TempDir(), "messages.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	for name, c := range map[string]Cache{"sqlite": disk, "memory": NewMemoryCache(time.Hour)} {
+		t.Run(name, func(t *testing.T) {
+			order := fixtureMessage(t, "Thanks for your order", "order_3_items.html")
+			order.Id = "order"
+			shipment := fixtureMessage(t, "Shipped: Desk Lamp", "shipped_single_date.html")
+			shipment.Id = "shipment"
+
+			orders, shipped, calls := scanMailbox(t, c, order, shipment)
+			if calls.total.Load() == 0 {
+				t.Fatal("first scan fetched nothing")
+			}
+			again, shippedAgain, calls := scanMailbox(t, c, order, shipment)
+			if got := calls.total.Load(); got != 0 {
+				t.Errorf("second scan made %d fetch calls, want 0", got)
+			}
+			o, cached := orders["200012345678901"], again["200012345678901"]
+			if len(again) != len(orders) || cached == nil || cached.Total != o.Total || len(cached.Items) != len(o.Items) {
+				t.Errorf("second scan orders = %v, want the first scan's %v", again, orders)
+			}
+			if len(shipped) != 1 || len(shippedAgain) != 1 || shippedAgain[0].TrackingNumber != shipped[0].TrackingNumber {
+				t.Errorf("second scan shipments = %+v, want the first scan's %+v", shippedAgain, shipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+
+	gm "google.golang.org/api/gmail/v1"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// How a CancelPattern is compared against a subject line.
+const (
+	MatchExact    = "exact"
+	MatchContains = "contains"
+	MatchRegexp   = "regexp"
+)
+
+// CancelPattern recognizes the subject of a cancellation email.
+type CancelPattern struct {
+	Match   string `json:"match"` // MatchExact, MatchContains or MatchRegexp
+	Pattern string `json:"pattern"`
+	// Category is reported in audit logs; empty means CategoryCanceled.
+	Category string `json:"category,omitempty"`
+}
+
+// DefaultCancelPatterns are the cancellation subjects Walmart is known to
+// send: a canceled delivery, and an order canceled after a payment problem.
+var DefaultCancelPatterns = []CancelPattern{
+	{Match: MatchContains, Pattern: "Canceled:", Category: CategoryCanceled},
+	{Match: MatchRegexp, Pattern: `was canceled 🔴$`, Category: CategoryPaymentCanceled},
+}
+
+// DefaultCancelPatternsPath is where the CLI and web server look for extra
+// cancel patterns. The file is optional.
+const DefaultCancelPatternsPath = "cancels.json"
+
+// LoadCancelPatterns reads extra patterns from a JSON file holding an array of
+// {"match": ..., "pattern": ...} objects. A missing file yields none.
+func LoadCancelPatterns(path string) ([]CancelPattern, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var patterns []CancelPattern
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if _, err := newCancelMatcher(patterns); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// CancelSubjects returns the plain-text phrases of patterns, which must be
+// searched for too or their emails are never fetched. Regexp patterns only
+// apply to mail fetched anyway.
+func CancelSubjects(patterns []CancelPattern) []string {
+	var subjects []string
+	for _, p := range patterns {
+		if p.Match != MatchRegexp {
+			subjects = append(subjects, p.Pattern)
+		}
+	}
+	return subjects
+}
+
+type compiledCancelPattern struct {
+	CancelPattern
+	re *regexp.Regexp
+}
+
+type cancelMatcher []compiledCancelPattern
+
+func newCancelMatcher(patterns []CancelPattern) (cancelMatcher, error) {
+	m := make(cancelMatcher, 0, len(patterns))
+	for _, p := range patterns {
+		c := compiledCancelPattern{CancelPattern: p}
+		if c.Category == "" {
+			c.Category = CategoryCanceled
+		}
+		switch p.Match {
+		case MatchExact, MatchContains:
+			if p.Pattern == "" {
+				return nil, fmt.Errorf("empty %s cancel pattern", p.Match)
+			}
+		case MatchRegexp:
+			re, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("cancel pattern %q: %w", p.Pattern, err)
+			}
+			c.re = re
+		default:
+			return nil, fmt.Errorf("cancel pattern %q: unknown match type %q", p.Pattern, p.Match)
+		}
+		m = append(m, c)
+	}
+	return m, nil
+}
+
+// match returns the category of the first pattern matching subject.
+func (m cancelMatcher) match(subject string) (string, bool) {
+	for _, p := range m {
+		var ok bool
+		switch p.Match {
+		case MatchExact:
+			ok = strings.TrimSpace(subject) == p.Pattern
+		case MatchContains:
+			ok = strings.Contains(subject, p.Pattern)
+		case MatchRegexp:
+			ok = p.re.MatchString(subject)
+		}
+		if ok {
+			return p.Category, true
+		}
+	}
+	return "", false
+}
+
+// messageOrderID finds the order a cancellation or refund email refers to:
+// from the subject if it carries the ID, otherwise from the order link in the
+// body.
+func messageOrderID(subject string, msg *gm.Message) string {
+	if id := extractOrderIDFromSubject(subject); id != "" {
+		return id
+	}
+	if i := strings.LastIndex(subject, "#"); i >= 0 {
+		if f := strings.Fields(subject[i+1:]); len(f) > 0 {
+			return report.CanonicalOrderID(f[0])
+		}
+	}
+	doc, err := parseMessageHTML(msg)
+	if err != nil {
+		return ""
+	}
+	return orderIDFromDoc(doc)
+}
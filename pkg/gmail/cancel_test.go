@@ -0,0 +1,59 @@
+package gmail
+
+import "testing"
+
+func TestDefaultCancelPatterns(t *testing.T) {
+	// Every default pattern has subjects it must and mustn't match.
+	cases := map[string]struct {
+		category string
+		match    []string
+		noMatch  []string
+	}{
+		"Canceled:": {
+			category: CategoryCanceled,
+			match:    []string{"Canceled: delivery from order #2000123-45678901", "Item Canceled: Desk Lamp"},
+			noMatch:  []string{"canceled: delivery from order #2000123-45678901", "Shipped: Desk Lamp"},
+		},
+		`was canceled 🔴$`: {
+			category: CategoryPaymentCanceled,
+			match:    []string{"Your order #2000123-45678901 was canceled 🔴"},
+			noMatch:  []string{"Your order was canceled 🔴 - see details", "Your order #2000123-45678901 was canceled"},
+		},
+	}
+
+	for _, p := range DefaultCancelPatterns {
+		tc, ok := cases[p.Pattern]
+		if !ok {
+			t.Errorf("no test case for default cancel pattern %q", p.Pattern)
+			continue
+		}
+		m, err := newCancelMatcher([]CancelPattern{p})
+		if err != nil {
+			t.Fatalf("%q: %v", p.Pattern, err)
+		}
+		if p.Category != tc.category {
+			t.Errorf("%q has category %q, want %q", p.Pattern, p.Category, tc.category)
+		}
+		for _, subject := range tc.match {
+			if category, ok := m.match(subject); !ok || category != tc.category {
+				t.Errorf("%q on %q = %q, %v; want %q, true", p.Pattern, subject, category, ok, tc.category)
+			}
+		}
+		for _, subject := range tc.noMatch {
+			if _, ok := m.match(subject); ok {
+				t.Errorf("%q matched %q", p.Pattern, subject)
+			}
+		}
+	}
+}
+
+func TestCancelSubjects(t *testing.T) {
+	got := CancelSubjects([]CancelPattern{
+		{Match: MatchContains, Pattern: "Your order was cancelled"},
+		{Match: MatchExact, Pattern: "Order canceled"},
+		{Match: MatchRegexp, Pattern: "(?i)cancell?ation confirmed$"},
+	})
+	if len(got) != 2 || got[0] != "Your order was cancelled" || got[1] != "Order canceled" {
+		t.Errorf("CancelSubjects = %q, want the contains and exact phrases", got)
+	}
+}
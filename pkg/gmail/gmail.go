@@ -7,11 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,8 +25,8 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	gm "google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
 
+	"walmart-order-checker/pkg/oauth"
 	"walmart-order-checker/pkg/report"
 	"walmart-order-checker/pkg/util"
 )
@@ -31,19 +35,38 @@ var (
 	carrierRe   = regexp.MustCompile(`(\w+)\s+tracking\s+number`)
 	orderDateRe = regexp.MustCompile(`Order date:\s*(.*)`)
 	orderIDRe   = regexp.MustCompile(`\b(\d{7})-?(\d{8})\b`)
+	cardRe      = regexp.MustCompile(`(?i)\b(visa|mastercard|master card|amex|american express|discover|walmart rewards(?: card)?|capital one|debit card|credit card)?[^\S\n]*(?:card\s+)?ending\s+in\s+(\d{4})\b`)
+	giftCardRe  = regexp.MustCompile(`(?i)\b(?:paid\s+with|using)\s+(?:a\s+)?(?:walmart\s+)?gift\s*card\b`)
+	monthDayRe  = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2})\b(?:\s*[-–—]\s*(\d{1,2})\b)?`)
+
+	// A payment breakdown line: "Driver tip", "Delivery fee", "Bag fees",
+	// "Estimated taxes"...
+	chargeLabelRe  = regexp.MustCompile(`(?i)^(driver tip|(?:estimated |sales )?tax(?:es)?|[a-z][a-z ]* fees?)[\s:]*$`)
+	chargeAmountRe = regexp.MustCompile(`^[\s:]*\$\s*([\d,]+\.\d{2})`)
+	refundAmountRe = regexp.MustCompile(`(?i)refund(?:ed)?\b[^$]{0,80}\$\s*([\d,]+\.\d{2})`)
+
+	// A price in an item's row: "$12.34" for the line, or "$6.17/ea" each.
+	itemPriceRe = regexp.MustCompile(`(?i)\$\s*([\d,]+\.\d{2})(\s*(?:/\s*ea(?:ch)?\b|each\b))?`)
+	// Text marking the part of an email past the item list.
+	orderTotalsRe = regexp.MustCompile(`(?i)subtotal|order total|includes all fees`)
+
+	// "Delivered Mon, Jan 6", "Arrived on Tuesday, January 7, 2025"...
+	deliveredDateRe = regexp.MustCompile(`(?i)\b(?:delivered|arrived)(?:\s+on)?:?\s+((?:mon|tue|wed|thu|fri|sat|sun)[a-z]*\.?,?\s+[a-z]{3,9}\.?\s+\d{1,2}(?:,\s*\d{4})?)\b`)
 )
 
-func findHTMLPart(part *gm.MessagePart) string {
+// findPart returns the still-encoded body of the first part of mimeType,
+// however deeply it is nested in multipart parts.
+func findPart(part *gm.MessagePart, mimeType string) string {
 	if part == nil {
 		return ""
 	}
-	if part.MimeType == "text/html" && part.Body != nil && part.Body.Size > 0 {
+	if part.MimeType == mimeType && part.Body != nil && part.Body.Size > 0 {
 		return part.Body.Data
 	}
 	if strings.HasPrefix(part.MimeType, "multipart/") {
 		for _, sub := range part.Parts {
-			if html := findHTMLPart(sub); html != "" {
-				return html
+			if data := findPart(sub, mimeType); data != "" {
+				return data
 			}
 		}
 	}
@@ -84,34 +107,83 @@ func getClient(config *oauth2.Config, tokenPath string) (*http.Client, error) {
 			return nil, err
 		}
 	}
-	return config.Client(context.Background(), tok), nil
+	return oauth.NewClient(context.Background(), config, tok), nil
 }
 
-func startOAuthWebServer(authURL string) (string, error) {
-	codeChan := make(chan string, 1)
-
-	const listenAddr = "127.0.0.1:80"
-	ln, err := net.Listen("tcp", listenAddr)
+// listenLoopback listens for the OAuth redirect on 127.0.0.1 and returns a
+// copy of config redirecting there. The port is OAUTH_REDIRECT_PORT, for
+// clients whose redirect URIs must be registered in advance, or else one the
+// OS picks: Google accepts any loopback port for desktop-app clients.
+func listenLoopback(config *oauth2.Config) (net.Listener, *oauth2.Config, error) {
+	port := os.Getenv("OAUTH_REDIRECT_PORT")
+	if port == "" {
+		port = "0"
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
 	if err != nil {
-		return "", fmt.Errorf("listen on %s: %w", listenAddr, err)
+		return nil, nil, fmt.Errorf("listen for the OAuth redirect: %w", err)
+	}
+
+	// Keep "localhost" from credentials.json, since a registered redirect
+	// URI has to match it exactly.
+	host := "127.0.0.1"
+	if u, err := url.Parse(config.RedirectURL); err == nil && u.Hostname() == "localhost" {
+		host = "localhost"
+	}
+	cfg := *config
+	cfg.RedirectURL = "http://" + net.JoinHostPort(host, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+	return ln, &cfg, nil
+}
+
+// DefaultOAuthTimeout is how long the CLI waits for the browser sign-in to
+// finish before giving up.
+const DefaultOAuthTimeout = 5 * time.Minute
+
+// OAuthTimeout returns the OAUTH_TIMEOUT duration (e.g. "10m"), or
+// DefaultOAuthTimeout when it is unset or invalid.
+func OAuthTimeout() time.Duration {
+	if v := os.Getenv("OAUTH_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: invalid OAUTH_TIMEOUT %q, using %s", v, DefaultOAuthTimeout)
+	}
+	return DefaultOAuthTimeout
+}
+
+// startOAuthWebServer waits on ln for Google to redirect back with an
+// authorization code. It fails if the user declines, or if nothing arrives
+// before ctx ends.
+func startOAuthWebServer(ctx context.Context, ln net.Listener, authURL string) (string, error) {
+	type result struct {
+		code string
+		err  error
 	}
+	results := make(chan result, 1)
 	addr := ln.Addr().String()
 
 	mux := http.NewServeMux()
 	srv := &http.Server{Handler: mux}
+	defer srv.Close()
 
 	var once sync.Once
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		if code != "" {
+		q := r.URL.Query()
+		switch {
+		case q.Get("code") != "":
 			once.Do(func() {
 				_, _ = fmt.Fprint(w, "Authorization successful! You can close this window.")
-				codeChan <- code
-				go func() {
-					_ = srv.Shutdown(context.Background())
-				}()
+				results <- result{code: q.Get("code")}
 			})
-		} else {
+		case q.Get("error") != "":
+			// Google redirects here with ?error=access_denied when the user
+			// declines; sending them back to the consent page would loop.
+			once.Do(func() {
+				_, _ = fmt.Fprintf(w, "Authorization failed (%s). You can close this window.", q.Get("error"))
+				results <- result{err: fmt.Errorf("authorization failed: %s", q.Get("error"))}
+			})
+		default:
 			http.Redirect(w, r, authURL, http.StatusFound)
 		}
 	})
@@ -124,16 +196,34 @@ func startOAuthWebServer(authURL string) (string, error) {
 		log.Printf("open browser failed: %v; navigate to: %s", err, "http://"+addr)
 	}
 
-	code := <-codeChan
-	return code, nil
+	select {
+	case res := <-results:
+		// Let the browser receive its page before the server goes away.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		return res.code, res.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("timed out waiting for authorization in the browser: %w", ctx.Err())
+	}
 }
 
 func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+	ln, config, err := listenLoopback(config)
+	if err != nil {
+		return nil, err
+	}
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Println("Attempting to open the authorization link in your browser.")
 	fmt.Printf("If it doesn't open automatically, please go to this link:\n%v\n", authURL)
 
-	code, err := startOAuthWebServer(authURL)
+	timeout := OAuthTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	code, err := startOAuthWebServer(ctx, ln, authURL)
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Printf("No authorization within %s; run again to retry (OAUTH_TIMEOUT sets the wait).\n", timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +256,9 @@ func saveToken(path string, token *oauth2.Token) error {
 	return json.NewEncoder(f).Encode(token)
 }
 
-func InitializeGmailService(credentialsPath, tokenPath string) (*gm.Service, error) {
+// InitializeGmailClient returns an HTTP client authorized with the token at
+// tokenPath, running the OAuth flow first if there is none.
+func InitializeGmailClient(credentialsPath, tokenPath string) (*http.Client, error) {
 	credentials, err := os.ReadFile(credentialsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -187,32 +279,45 @@ func InitializeGmailService(credentialsPath, tokenPath string) (*gm.Service, err
 	if err != nil {
 		return nil, fmt.Errorf("parse credentials: %w", err)
 	}
-	client, err := getClient(config, tokenPath)
+	return getClient(config, tokenPath)
+}
+
+func InitializeGmailService(credentialsPath, tokenPath string) (*gm.Service, error) {
+	client, err := InitializeGmailClient(credentialsPath, tokenPath)
 	if err != nil {
 		return nil, err
 	}
-	srv, err := gm.NewService(context.Background(), option.WithHTTPClient(client))
-	if err != nil {
-		return nil, fmt.Errorf("gmail service: %w", err)
-	}
-	return srv, nil
+	return NewService(context.Background(), client)
 }
 
-func FetchMessages(srv *gm.Service, user, query string) ([]*gm.Message, error) {
+// DefaultUser is the Gmail API alias for the authenticated account. A full
+// address can be used instead to read a mailbox the credentials have been
+// delegated access to.
+const DefaultUser = "me"
+
+// FetchMessages lists every message matching query, page by page. It stops
+// between pages, or mid-request, once ctx ends.
+func FetchMessages(ctx context.Context, srv *gm.Service, user, query string) ([]*gm.Message, error) {
 	var all []*gm.Message
 	var pageToken string
 	for {
-		req := srv.Users.Messages.List(user).Q(query)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		req := srv.Users.Messages.List(user).Q(query).Context(ctx)
 		if pageToken != "" {
 			req.PageToken(pageToken)
 		}
 		r, err := req.Do()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			// Check if this is a Gmail API rate limit error
 			if strings.Contains(err.Error(), "rateLimitExceeded") || strings.Contains(err.Error(), "RATE_LIMIT_EXCEEDED") {
 				return nil, fmt.Errorf("Gmail API rate limit exceeded. Please wait a few minutes before scanning again")
 			}
-			return nil, fmt.Errorf("list messages: %w", err)
+			return nil, fmt.Errorf("list messages: %w", scopeError(err))
 		}
 		all = append(all, r.Messages...)
 		if r.NextPageToken == "" {
@@ -223,17 +328,19 @@ func FetchMessages(srv *gm.Service, user, query string) ([]*gm.Message, error) {
 	return all, nil
 }
 
-func processCanceledEmail(subject string, orders map[string]*report.Order) {
-	parts := strings.Split(subject, "#")
-	if len(parts) <= 1 {
-		return
-	}
-	orderID := parts[1]
-	if existing, ok := orders[orderID]; ok {
-		existing.Status = "canceled"
-	} else {
-		orders[orderID] = &report.Order{ID: orderID, Status: "canceled"}
+// orderIDFromDoc reads the order number Walmart links near the top of its
+// order emails, or failing that the first order number in the text.
+func orderIDFromDoc(doc *goquery.Document) string {
+	if id := report.CanonicalOrderID(doc.Find("a[aria-label*=' ']").First().Text()); id != "" {
+		return id
 	}
+	return orderIDFromText(doc)
+}
+
+// orderIDFromText finds an order number anywhere in doc's text, for emails
+// without the usual order link, such as plain-text ones.
+func orderIDFromText(doc *goquery.Document) string {
+	return extractOrderIDFromSubject(doc.Text())
 }
 
 func extractOrderIDFromSubject(subject string) string {
@@ -244,34 +351,12 @@ func extractOrderIDFromSubject(subject string) string {
 	return ""
 }
 
-func processPaymentFailCancelEmail(msg *gm.Message, subject string, orders map[string]*report.Order) {
-	orderID := extractOrderIDFromSubject(subject)
-
-	if orderID == "" {
-		doc, err := parseMessageHTML(msg)
-		if err != nil {
-			return
-		}
-		orderIDRaw := strings.TrimSpace(doc.Find("a[aria-label*=' ']").First().Text())
-		if orderIDRaw == "" {
-			return
-		}
-		orderID = strings.ReplaceAll(orderIDRaw, "-", "")
-	}
-
-	if orderID != "" {
-		if existing, ok := orders[orderID]; ok {
-			existing.Status = "canceled"
-		} else {
-			orders[orderID] = &report.Order{ID: orderID, Status: "canceled"}
-		}
-	}
-}
-
-func processDeliveredEmail(msg *gm.Message) string {
+// processDeliveredEmail returns the order a delivery email is for and the
+// delivery date it states, or "" for the date when it gives none.
+func processDeliveredEmail(msg *gm.Message) (orderID, deliveredDate string) {
 	doc, err := parseMessageHTML(msg)
 	if err != nil {
-		return ""
+		return "", ""
 	}
 
 	orderIDRaw := ""
@@ -284,13 +369,17 @@ func processDeliveredEmail(msg *gm.Message) string {
 		}
 	})
 
-	if orderIDRaw == "" {
-		return ""
+	orderID = report.CanonicalOrderID(orderIDRaw)
+	if orderID == "" {
+		if orderID = orderIDFromText(doc); orderID == "" {
+			return "", ""
+		}
 	}
 
-	orderID := strings.TrimPrefix(orderIDRaw, "#")
-	orderID = strings.ReplaceAll(orderID, "-", "")
-	return orderID
+	if m := deliveredDateRe.FindStringSubmatch(doc.Text()); m != nil {
+		deliveredDate = strings.Join(strings.Fields(m[1]), " ")
+	}
+	return orderID, deliveredDate
 }
 
 func processShippedEmail(msg *gm.Message) []*report.ShippedOrder {
@@ -298,52 +387,167 @@ func processShippedEmail(msg *gm.Message) []*report.ShippedOrder {
 	if err != nil {
 		return nil
 	}
-	return extractShippingInfo(doc)
+	return extractShippingInfo(doc, messageTime(msg))
 }
 
-func parseMessageHTML(msg *gm.Message) (*goquery.Document, error) {
-	body := findHTMLPart(msg.Payload)
-	if body == "" {
-		return nil, fmt.Errorf("html part not found")
+// messageTime returns when Gmail received msg, falling back to now when the
+// internal date is missing.
+func messageTime(msg *gm.Message) time.Time {
+	if msg.InternalDate > 0 {
+		return time.UnixMilli(msg.InternalDate)
 	}
-	decoded, err := decodeBase64(body)
+	return time.Now()
+}
+
+func parseMessageHTML(msg *gm.Message) (*goquery.Document, error) {
+	body, _, err := messageBody(msg)
 	if err != nil {
 		return nil, err
 	}
-	return goquery.NewDocumentFromReader(strings.NewReader(decoded))
+	return goquery.NewDocumentFromReader(strings.NewReader(body))
+}
+
+// messageBody returns msg's decoded HTML. When there is no HTML part, or it
+// can't be decoded, the text/plain part is returned instead, wrapped in a
+// <pre> so it parses as HTML, and plain is true.
+func messageBody(msg *gm.Message) (body string, plain bool, err error) {
+	if data := findPart(msg.Payload, "text/html"); data != "" {
+		if decoded, err := decodeBase64(data); err == nil {
+			return decoded, false, nil
+		}
+	}
+	data := findPart(msg.Payload, "text/plain")
+	if data == "" {
+		return "", false, fmt.Errorf("no decodable html or text part")
+	}
+	decoded, err := decodeBase64(data)
+	if err != nil {
+		return "", false, err
+	}
+	return "<pre>" + html.EscapeString(decoded) + "</pre>", true, nil
 }
 
-func extractShippingInfo(doc *goquery.Document) []*report.ShippedOrder {
-	orderID := strings.ReplaceAll(strings.TrimSpace(doc.Find("a[aria-label*=' ']").First().Text()), "-", "")
+const (
+	trackingLinkSelector = "span:contains('tracking number') a"
+	arrivalSelector      = "strong:contains('Arrives')"
+)
+
+func extractShippingInfo(doc *goquery.Document, received time.Time) []*report.ShippedOrder {
+	orderID := orderIDFromDoc(doc)
 	var shippedOrders []*report.ShippedOrder
 
-	var trackingNumbers []string
-	doc.Find("span:contains('tracking number') a").Each(func(i int, s *goquery.Selection) {
-		trackingNumbers = append(trackingNumbers, strings.TrimSpace(s.Text()))
+	links := doc.Find(trackingLinkSelector)
+	arrivals := doc.Find(arrivalSelector)
+	carrier := extractCarrier(doc)
+
+	// Multi-package emails give each package its own block, so a tracking
+	// number takes its arrival date and carrier from its block. If no block
+	// holds a date, dates pair with tracking numbers by position instead.
+	// Either way a package without a date is kept, with none.
+	byBlock := make([]string, links.Length())
+	found := false
+	links.Each(func(i int, link *goquery.Selection) {
+		if byBlock[i] = packageArrival(link); byBlock[i] != "" {
+			found = true
+		}
 	})
 
-	var arrivalDates []string
-	doc.Find("strong:contains('Arrives')").Each(func(i int, s *goquery.Selection) {
-		arrivalDates = append(arrivalDates, s.Text())
+	links.Each(func(i int, link *goquery.Selection) {
+		tracking := strings.TrimSpace(link.Text())
+		if tracking == "" {
+			return
+		}
+		shipped := &report.ShippedOrder{
+			ID:             orderID,
+			TrackingNumber: tracking,
+			Carrier:        carrier,
+			ShippedAt:      received,
+		}
+		if m := carrierRe.FindStringSubmatch(link.Parent().Text()); len(m) > 1 {
+			shipped.Carrier = m[1]
+		}
+		arrival := byBlock[i]
+		if !found && i < arrivals.Length() {
+			arrival = arrivals.Eq(i).Text()
+		}
+		if arrival != "" {
+			shipped.EstimatedArrival = arrival
+			shipped.ArrivalStart, shipped.ArrivalEnd = parseArrival(arrival, received)
+		}
+		shippedOrders = append(shippedOrders, shipped)
 	})
 
-	carrier := extractCarrier(doc)
+	return shippedOrders
+}
 
-	count := min(len(arrivalDates), len(trackingNumbers))
+// packageArrival returns the arrival date nearest to a tracking link within
+// its package's block: the ancestors of link that hold no other tracking
+// number.
+func packageArrival(link *goquery.Selection) string {
+	for block := link.Parent(); block.Length() > 0 && !block.Is("body"); block = block.Parent() {
+		if block.Find(trackingLinkSelector).Length() > 1 {
+			break
+		}
+		if arrival := block.Find(arrivalSelector); arrival.Length() > 0 {
+			return arrival.First().Text()
+		}
+	}
+	return ""
+}
 
-	for i := range count {
-		if trackingNumbers[i] == "" {
-			continue
+// parseArrival turns text such as "Arrives Jan 6", "Arrives Jan 6 - Jan 8" or
+// "Arrives Mon–Wed, Jan 6–8" into a date range. Emails omit the year, so it is
+// inferred from when the email was received. Zero times are returned when the
+// text contains no recognizable date.
+func parseArrival(text string, received time.Time) (time.Time, time.Time) {
+	ref := time.Date(received.Year(), received.Month(), received.Day(), 0, 0, 0, 0, time.Local)
+	lower := strings.ToLower(text)
+
+	matches := monthDayRe.FindAllStringSubmatch(text, 2)
+	if len(matches) == 0 {
+		switch {
+		case strings.Contains(lower, "today"):
+			return ref, ref
+		case strings.Contains(lower, "tomorrow"):
+			next := ref.AddDate(0, 0, 1)
+			return next, next
 		}
-		shippedOrders = append(shippedOrders, &report.ShippedOrder{
-			ID:               orderID,
-			TrackingNumber:   trackingNumbers[i],
-			Carrier:          carrier,
-			EstimatedArrival: arrivalDates[i],
-		})
+		return time.Time{}, time.Time{}
 	}
 
-	return shippedOrders
+	start, ok := monthDay(matches[0][1], matches[0][2], ref)
+	if !ok {
+		return time.Time{}, time.Time{}
+	}
+	end := start
+	switch {
+	case matches[0][3] != "":
+		if d, ok := monthDay(matches[0][1], matches[0][3], ref); ok {
+			end = d
+		}
+	case len(matches) > 1:
+		if d, ok := monthDay(matches[1][1], matches[1][2], ref); ok {
+			end = d
+		}
+	}
+	if end.Before(start) {
+		end = end.AddDate(1, 0, 0)
+	}
+	return start, end
+}
+
+func monthDay(month, day string, ref time.Time) (time.Time, bool) {
+	parsed, err := time.Parse("Jan 2", strings.ToUpper(month[:1])+strings.ToLower(month[1:3])+" "+day)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Date(ref.Year(), parsed.Month(), parsed.Day(), 0, 0, 0, 0, ref.Location())
+	// An arrival date well before the email was sent belongs to next year
+	// (e.g. a late-December shipment arriving in early January).
+	if t.Before(ref.AddDate(0, -6, 0)) {
+		t = t.AddDate(1, 0, 0)
+	}
+	return t, true
 }
 
 func extractCarrier(doc *goquery.Document) string {
@@ -354,30 +558,64 @@ func extractCarrier(doc *goquery.Document) string {
 	return ""
 }
 
-func extractOrderInfo(doc *goquery.Document, subject string) *report.Order {
-	orderID := strings.ReplaceAll(strings.TrimSpace(doc.Find("a[aria-label*=' ']").First().Text()), "-", "")
-	orderDate, parsedDate := extractOrderDate(doc)
+func extractOrderInfo(doc *goquery.Document, subject string, region report.Region) *report.Order {
+	orderID := orderIDFromDoc(doc)
+	orderDate, parsedDate := extractOrderDate(doc, region)
+	status := determineStatus(subject)
+	charges := extractCharges(doc, region)
 	return &report.Order{
 		ID:              orderID,
 		Items:           extractItems(doc),
 		Total:           extractTotal(doc),
+		Tip:             charges.tip,
+		Fees:            charges.fees,
+		Tax:             charges.tax,
 		OrderDate:       orderDate,
 		OrderDateParsed: parsedDate,
-		Status:          determineStatus(subject),
+		Status:          status,
+		WasPreorder:     status == "pre-ordered",
+		PaymentMethod:   extractPaymentMethod(doc.Text()),
 	}
 }
 
-func extractOrderDate(doc *goquery.Document) (string, time.Time) {
+var cardBrands = map[string]string{
+	"visa":                 "Visa",
+	"mastercard":           "Mastercard",
+	"master card":          "Mastercard",
+	"amex":                 "Amex",
+	"american express":     "Amex",
+	"discover":             "Discover",
+	"walmart rewards":      "Walmart Rewards",
+	"walmart rewards card": "Walmart Rewards",
+	"capital one":          "Capital One",
+	"debit card":           "Debit",
+	"credit card":          "Card",
+}
+
+// extractPaymentMethod describes how an order was paid, e.g. "Visa ending in
+// 1234" or "Gift card". It returns "" when the email doesn't say.
+func extractPaymentMethod(text string) string {
+	if m := cardRe.FindStringSubmatch(text); m != nil {
+		brand := cardBrands[strings.ToLower(strings.Join(strings.Fields(m[1]), " "))]
+		if brand == "" {
+			brand = "Card"
+		}
+		return brand + " ending in " + m[2]
+	}
+	if giftCardRe.MatchString(text) {
+		return "Gift card"
+	}
+	return ""
+}
+
+func extractOrderDate(doc *goquery.Document, region report.Region) (string, time.Time) {
 	dateText := doc.Find("div:contains('Order date:')").Text()
 	m := orderDateRe.FindStringSubmatch(dateText)
 	if len(m) <= 1 {
 		return "", time.Time{}
 	}
 	orderDate := strings.TrimSpace(m[1])
-	parsed, err := time.Parse("Mon, Jan 2, 2006", orderDate)
-	if err != nil {
-		return orderDate, time.Time{}
-	}
+	parsed, _ := region.ParseDate(orderDate)
 	return orderDate, parsed
 }
 
@@ -389,6 +627,66 @@ func extractTotal(doc *goquery.Document) string {
 		Text()
 }
 
+// orderCharges are the parts of an order total other than merchandise, as
+// "$x.xx" strings; each is "" when the email doesn't itemize it.
+type orderCharges struct {
+	tip, fees, tax string
+}
+
+// extractCharges reads the driver tip, the sum of the fee lines (delivery,
+// bag, service...) and the tax from an order's payment breakdown.
+func extractCharges(doc *goquery.Document, region report.Region) orderCharges {
+	sums := make(map[string]float64)
+	doc.Find("strong, span, td, div, p").Each(func(i int, s *goquery.Selection) {
+		if s.Children().Length() > 0 {
+			return
+		}
+		m := chargeLabelRe.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if m == nil {
+			return
+		}
+		amount, ok := chargeAmount(s)
+		if !ok {
+			return
+		}
+		label := strings.ToLower(m[1])
+		switch {
+		case label == "driver tip":
+			sums["tip"] += amount
+		case strings.Contains(label, "tax"):
+			sums["tax"] += amount
+		default:
+			sums["fees"] += amount
+		}
+	})
+	format := func(kind string) string {
+		if v, ok := sums[kind]; ok {
+			return region.FormatAmount(v)
+		}
+		return ""
+	}
+	return orderCharges{tip: format("tip"), fees: format("fees"), tax: format("tax")}
+}
+
+// chargeAmount reads the amount printed right after a breakdown label, looking
+// a few levels up for the row that holds both. Lines without an amount, such
+// as "Delivery fee Free", don't match.
+func chargeAmount(label *goquery.Selection) (float64, bool) {
+	text := label.Text()
+	row := label.Parent()
+	for depth := 0; depth < 3 && row.Length() > 0; depth++ {
+		rowText := row.Text()
+		if i := strings.Index(rowText, text); i >= 0 {
+			if m := chargeAmountRe.FindStringSubmatch(rowText[i+len(text):]); m != nil {
+				v, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+				return v, err == nil
+			}
+		}
+		row = row.Parent()
+	}
+	return 0, false
+}
+
 func extractItems(doc *goquery.Document) []report.Item {
 	var items []report.Item
 	doc.Find("img[alt*='quantity']").Each(func(i int, s *goquery.Selection) {
@@ -414,13 +712,132 @@ func parseItemFromImage(s *goquery.Selection) (report.Item, bool) {
 	if imageURL != "" {
 		imageURL = fmt.Sprintf("https://images.weserv.nl/?url=%s&trim=10&bg=00000000", imageURL)
 	}
+	unitPrice, _ := itemUnitPrice(s, qty)
 	return report.Item{
-		Name:     parts[1],
-		Quantity: qty,
-		ImageURL: imageURL,
+		Name:      parts[1],
+		Quantity:  qty,
+		ImageURL:  imageURL,
+		UnitPrice: unitPrice,
 	}, true
 }
 
+// itemUnitPrice reads the price printed in an item's row, climbing from its
+// image until some ancestor shows a price but stopping before one that holds
+// other items or the order's totals too. A line total is divided by qty. Rows
+// showing several prices, such as a sale next to the old price, are ambiguous
+// unless exactly one is marked per unit.
+func itemUnitPrice(img *goquery.Selection, qty int) (float64, bool) {
+	row := img.Parent()
+	for depth := 0; depth < 4 && row.Length() > 0; depth++ {
+		if row.Find("img[alt*='quantity']").Length() > 1 || orderTotalsRe.MatchString(row.Text()) {
+			break
+		}
+		matches := itemPriceRe.FindAllStringSubmatch(row.Text(), -1)
+		if len(matches) == 0 {
+			row = row.Parent()
+			continue
+		}
+		var each [][]string
+		for _, m := range matches {
+			if m[2] != "" {
+				each = append(each, m)
+			}
+		}
+		var m []string
+		switch {
+		case len(each) == 1:
+			m = each[0]
+		case len(matches) == 1:
+			m = matches[0]
+		default:
+			return 0, false
+		}
+		v, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+		if err != nil || v <= 0 {
+			return 0, false
+		}
+		if m[2] == "" && qty > 1 {
+			v /= float64(qty)
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+// processCanceledEmail returns the cancellation of orderID. A delivery
+// cancellation may drop only some of the order's items; when the email lists
+// them they become CanceledItems, and whether the whole order went is decided
+// once its confirmation has been merged. See report.Order.ApplyCanceledItems.
+func processCanceledEmail(msg *gm.Message, orderID, category string) *report.Order {
+	order := &report.Order{ID: orderID, Status: "canceled", CancelReason: cancelReason(category)}
+	if category != CategoryCanceled {
+		return order
+	}
+	if doc, err := parseMessageHTML(msg); err == nil {
+		if items := extractItems(doc); len(items) > 0 {
+			order.Status = ""
+			order.CanceledItems = items
+		}
+	}
+	return order
+}
+
+// cancelReason is the report.CancelReason of a cancellation email of
+// category. Categories of custom cancel patterns count as Walmart's.
+func cancelReason(category string) string {
+	if category == CategoryPaymentCanceled {
+		return report.CancelReasonPaymentFailed
+	}
+	return report.CancelReasonWalmart
+}
+
+func isRefundSubject(subject string) bool {
+	return strings.Contains(strings.ToLower(subject), "your refund")
+}
+
+// processRefundEmail returns the order a refund email is for, carrying only
+// the refunded amount. It returns nil when the order can't be identified.
+func processRefundEmail(msg *gm.Message, subject string) *report.Order {
+	orderID := messageOrderID(subject, msg)
+	if orderID == "" {
+		return nil
+	}
+	order := &report.Order{ID: orderID, Refunded: true}
+	if doc, err := parseMessageHTML(msg); err == nil {
+		text := strings.Join(strings.Fields(doc.Text()), " ")
+		if m := refundAmountRe.FindStringSubmatch(text); m != nil {
+			order.RefundTotal = "$" + m[1]
+		}
+	}
+	return order
+}
+
+func isOrderUpdatedSubject(subject string) bool {
+	lower := strings.ToLower(subject)
+	return strings.Contains(lower, "order was updated") || strings.Contains(lower, "order has been updated")
+}
+
+// extractUpdatedOrder parses an "order updated" email, whose item list replaces
+// the original order's. It carries no status, so merging it leaves the order's
+// cancel/preorder state alone.
+func extractUpdatedOrder(doc *goquery.Document, received time.Time, region report.Region) *report.Order {
+	orderID := orderIDFromDoc(doc)
+	items := extractItems(doc)
+	if orderID == "" || len(items) == 0 {
+		return nil
+	}
+	charges := extractCharges(doc, region)
+	return &report.Order{
+		ID:             orderID,
+		Items:          items,
+		Total:          extractTotal(doc),
+		Tip:            charges.tip,
+		Fees:           charges.fees,
+		Tax:            charges.tax,
+		ItemsUpdatedAt: received,
+	}
+}
+
 func determineStatus(subject string) string {
 	if strings.Contains(subject, "preorder") {
 		return "pre-ordered"
@@ -430,39 +847,223 @@ func determineStatus(subject string) string {
 
 func mergeOrCreateOrder(orders map[string]*report.Order, newOrder *report.Order) {
 	if existing, ok := orders[newOrder.ID]; ok {
-		if len(existing.Items) == 0 {
-			existing.Items = newOrder.Items
-		}
-		if existing.Status != "canceled" {
-			existing.Status = newOrder.Status
-		}
+		mergeOrder(existing, newOrder)
 		return
 	}
 	orders[newOrder.ID] = newOrder
 }
 
+// mergeOrder folds another email for the same order into existing.
+func mergeOrder(existing, newOrder *report.Order) {
+	existing.MergeItems(newOrder)
+	existing.MergeTotal(newOrder)
+	if existing.PaymentMethod == "" {
+		existing.PaymentMethod = newOrder.PaymentMethod
+	}
+	existing.MergeStatus(newOrder)
+	existing.MergeRefund(newOrder)
+	existing.CanceledItems = append(existing.CanceledItems, newOrder.CanceledItems...)
+}
+
 func getSubject(headers []*gm.MessagePartHeader) string {
-	for _, h := range headers {
-		if h.Name == "Subject" {
-			return h.Value
-		}
+	return header(headers, "Subject")
+}
+
+// Progress is a snapshot of a ProcessEmails run, passed to ProgressCallback
+// after every message.
+type Progress struct {
+	Processed int
+	Total     int
+	Elapsed   time.Duration
+	Rate      float64 // messages per second since processing started
+}
+
+func newProgress(processed, total int, start time.Time) Progress {
+	p := Progress{Processed: processed, Total: total, Elapsed: time.Since(start)}
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.Rate = float64(processed) / secs
 	}
-	return ""
+	return p
+}
+
+type ProgressCallback func(p Progress)
+
+// Message categories reported in AuditRecord.
+const (
+	CategoryOrder           = "order"
+	CategoryCanceled        = "canceled"
+	CategoryPaymentCanceled = "payment-canceled"
+	CategoryUpdated         = "updated"
+	CategoryShipped         = "shipped"
+	CategoryDelivered       = "delivered"
+	CategoryRefund          = "refund"
+	CategoryFetchError      = "fetch-error"
+)
+
+// AuditRecord describes how a single message was classified and what it
+// yielded.
+type AuditRecord struct {
+	MessageID string
+	Subject   string
+	Category  string
+	OrderID   string
+	Items     int
+	Tracking  int
+	FromCache bool
+}
+
+// AuditCallback receives one AuditRecord per processed message. Calls are
+// serialized, so the callback need not lock.
+type AuditCallback func(rec AuditRecord)
+
+func newAuditRecord(id string, result *CachedResult, fromCache bool) AuditRecord {
+	rec := AuditRecord{
+		MessageID: id,
+		Subject:   result.Subject,
+		Category:  result.Category,
+		Tracking:  len(result.Shipped),
+		FromCache: fromCache,
+	}
+	if result.Order != nil {
+		rec.OrderID = result.Order.ID
+		rec.Items = len(result.Order.Items)
+	} else if len(result.Shipped) > 0 {
+		rec.OrderID = result.Shipped[0].ID
+	}
+	return rec
 }
 
-type ProgressCallback func(processed int)
+// ScanStats counts how messages fared during a ProcessEmails run.
+type ScanStats struct {
+	Total       int
+	Processed   int
+	FromCache   int
+	FetchErrors int // messages that could not be retrieved from Gmail
+	ParseErrors int // messages retrieved but yielding no order or shipment
+	// PlainText counts fetched messages read from their text/plain part
+	// because they had no usable HTML.
+	PlainText int
+	// Reparsed counts cached messages whose result was extracted again from
+	// the cached body; they are included in FromCache.
+	Reparsed int
+}
+
+func (s *ScanStats) Add(other ScanStats) {
+	s.Total += other.Total
+	s.Processed += other.Processed
+	s.FromCache += other.FromCache
+	s.FetchErrors += other.FetchErrors
+	s.ParseErrors += other.ParseErrors
+	s.PlainText += other.PlainText
+	s.Reparsed += other.Reparsed
+}
+
+func (s ScanStats) Failed() int {
+	return s.FetchErrors + s.ParseErrors
+}
+
+type ProcessOptions struct {
+	Progress ProgressCallback
+	// ParseInvoices downloads PDF invoices attached to order confirmations and
+	// uses their totals and line prices instead of the scraped values. It
+	// costs an extra API call per attachment.
+	ParseInvoices bool
+	// Audit, when set, is told how every message was classified.
+	Audit AuditCallback
+	// Retry governs retries of transient errors when fetching messages; the
+	// zero value uses the defaults.
+	Retry RetryPolicy
+	// CancelPatterns recognize cancellation subjects; nil means
+	// DefaultCancelPatterns.
+	CancelPatterns []CancelPattern
+	// Cache holds parsed messages across scans; nil opens the cache at
+	// DefaultCachePath for the duration of the call.
+	Cache Cache
+	// FetchWorkers download messages and ParseWorkers parse them; zero means
+	// DefaultFetchWorkers and DefaultParseWorkers. FetchWorkers is capped at
+	// MaxFetchWorkers.
+	FetchWorkers int
+	ParseWorkers int
+	// SpillThreshold, when positive, moves orders to a temporary database on
+	// disk once more than this many are held, while messages are processed.
+	// They are all read back when the scan ends, since ProcessEmails returns
+	// every order.
+	SpillThreshold int
+	// Region decides how order dates and charges are read; the zero value
+	// is report.RegionUS.
+	Region report.Region
+	// Query supplies the subjects of shipment and delivery emails; lists
+	// left empty use DefaultQueryConfig's.
+	Query QueryConfig
+	// Reparse extracts every cached message again from its cached body,
+	// even when its parsed result is current. Messages cached without a body
+	// are fetched as usual.
+	Reparse bool
+	// CacheBodies keeps each message's decoded body in the cache, unencrypted,
+	// so later scans can re-parse it instead of fetching it again. Bodies
+	// already cached are kept when re-parsed either way.
+	CacheBodies bool
+	// Account is the mailbox being scanned. Cache entries are tagged with it
+	// so Cache.DeleteAccount can remove them.
+	Account string
+	// Client, when set, is the authorized HTTP client srv was built with.
+	// Messages are then fetched through Gmail's batch endpoint, up to 50 per
+	// request and one request at a time, rather than one request each.
+	Client *http.Client
+}
+
+// DefaultFetchWorkers is sized for API latency rather than CPU: fetches spend
+// nearly all their time waiting on Gmail.
+const DefaultFetchWorkers = 24
+
+// MaxFetchWorkers bounds FetchWorkers. Past this, parallel fetches mostly
+// earn rate-limit errors, and the retries they trigger slow the scan down.
+const MaxFetchWorkers = 32
+
+// DefaultParseWorkers is how many messages are parsed at once: one per CPU.
+var DefaultParseWorkers = runtime.NumCPU()
+
+func (o ProcessOptions) workers() (fetch, parse int) {
+	fetch, parse = o.FetchWorkers, o.ParseWorkers
+	if fetch <= 0 {
+		fetch = DefaultFetchWorkers
+	}
+	fetch = min(fetch, MaxFetchWorkers)
+	if parse <= 0 {
+		parse = DefaultParseWorkers
+	}
+	return fetch, parse
+}
 
 func ProcessEmails(srv *gm.Service, user string, allMessages []*gm.Message) (map[string]*report.Order, []*report.ShippedOrder, error) {
 	return ProcessEmailsWithProgress(context.Background(), srv, user, allMessages, nil)
 }
 
 func ProcessEmailsWithProgress(ctx context.Context, srv *gm.Service, user string, allMessages []*gm.Message, progressCallback ProgressCallback) (map[string]*report.Order, []*report.ShippedOrder, error) {
-	orders := make(map[string]*report.Order)
+	orders, shipped, _, err := ProcessEmailsWithOptions(ctx, srv, user, allMessages, ProcessOptions{Progress: progressCallback})
+	return orders, shipped, err
+}
+
+func ProcessEmailsWithOptions(ctx context.Context, srv *gm.Service, user string, allMessages []*gm.Message, opts ProcessOptions) (map[string]*report.Order, []*report.ShippedOrder, ScanStats, error) {
+	cancelPatterns := opts.CancelPatterns
+	if cancelPatterns == nil {
+		cancelPatterns = DefaultCancelPatterns
+	}
+	cancels, err := newCancelMatcher(cancelPatterns)
+	if err != nil {
+		return nil, nil, ScanStats{}, err
+	}
+
+	fetchWorkers, parseWorkers := opts.workers()
+	progressCallback := opts.Progress
+	start := time.Now()
+	stats := ScanStats{Total: len(allMessages)}
+	acc := newOrderAccumulator(opts.SpillThreshold)
+	defer acc.close()
+	var spillErr error
 	var shipped []*report.ShippedOrder
 	shippedIDs := make(map[string]struct{})
 
-	var mu sync.Mutex
-
 	// Disable progress bar for web server (it pollutes logs)
 	// Only show if callback is nil (CLI mode)
 	var bar *progressbar.ProgressBar
@@ -477,213 +1078,309 @@ func ProcessEmailsWithProgress(ctx context.Context, srv *gm.Service, user string
 		)
 	}
 
-	processedCount := 0
-	rateLimitErrors := 0
 	const maxRateLimitErrors = 5 // Abort after 5 rate limit errors
 
-	const workers = 24
-	jobs := make(chan string, workers*2)
-	var wg sync.WaitGroup
-
-	cache := NewMessageCache(".cache/messages", 24*time.Hour)
-	rateLimitAbort := make(chan struct{}, 1) // Signal channel for rate limit abort
+	cache := opts.Cache
+	if cache == nil {
+		cache = NewMessageCache(DefaultCachePath, CacheTTL())
+		defer cache.Close()
+	}
 
-	processMessage := func(id string) (*CachedResult, bool, error) {
-		if cached, ok := cache.Get(id); ok {
-			return cached, true, nil
-		}
+	// runCtx also stops the pipeline when too many requests hit the rate limit.
+	runCtx, abort := context.WithCancel(ctx)
+	defer abort()
 
-		const maxAttempts = 5
-		backoff := time.Second
-		var msg *gm.Message
-		var err error
+	// The scan is a pipeline: fetch workers download messages (or find them in
+	// the cache) and hand them to parse workers through a bounded channel, so
+	// slow fetches and slow parses each get their own pool and a full parse
+	// queue holds fetching back. Results are merged here, on one goroutine.
+	jobs := make(chan string, fetchWorkers*2)
+	fetched := make(chan fetchedMessage, parseWorkers*2)
+	results := make(chan messageResult, fetchWorkers+parseWorkers)
 
-		for attempt := 0; attempt < maxAttempts; attempt++ {
-			msg, err = srv.Users.Messages.Get(user, id).Context(ctx).Format("full").Do()
-			if err == nil {
-				break
-			}
-			if strings.Contains(err.Error(), "rateLimitExceeded") || strings.Contains(err.Error(), "backendError") {
-				time.Sleep(backoff)
-				backoff *= 2
-				continue
-			}
-			return nil, false, err
-		}
-		if msg == nil {
-			return nil, false, fmt.Errorf("max retries exceeded")
-		}
-
-		subject := getSubject(msg.Payload.Headers)
-		result := &CachedResult{}
-
-		switch {
-		case strings.Contains(subject, "Canceled:"):
-			parts := strings.Split(subject, "#")
-			if len(parts) > 1 {
-				result.Order = &report.Order{ID: parts[1], Status: "canceled"}
-			}
-		case strings.HasSuffix(subject, "was canceled 🔴"):
-			orderID := extractOrderIDFromSubject(subject)
-			if orderID == "" {
-				doc, err := parseMessageHTML(msg)
-				if err == nil {
-					orderIDRaw := strings.TrimSpace(doc.Find("a[aria-label*=' ']").First().Text())
-					if orderIDRaw != "" {
-						orderID = strings.ReplaceAll(orderIDRaw, "-", "")
-					}
-				}
-			}
-			if orderID != "" {
-				result.Order = &report.Order{ID: orderID, Status: "canceled"}
-			}
-		case strings.Contains(subject, "Shipped:"):
-			result.Shipped = processShippedEmail(msg)
-		case strings.HasPrefix(subject, "Arrived:"), strings.HasPrefix(subject, "Delivered:"):
-			deliveredOrderID := processDeliveredEmail(msg)
-			if deliveredOrderID != "" {
-				result.Shipped = []*report.ShippedOrder{
-					{
-						ID:               deliveredOrderID,
-						TrackingNumber:   "DELIVERED",
-						Carrier:          "Delivered",
-						EstimatedArrival: "",
-					},
+	go func() {
+		defer close(jobs)
+		for _, m := range allMessages {
+			select {
+			case <-runCtx.Done():
+				if ctx.Err() != nil {
+					log.Printf("Scan cancelled, stopping %d fetch and %d parse workers...", fetchWorkers, parseWorkers)
 				}
-			}
-		default:
-			doc, err := parseMessageHTML(msg)
-			if err == nil {
-				result.Order = extractOrderInfo(doc, subject)
+				return
+			case jobs <- m.Id:
 			}
 		}
+	}()
 
-		cache.Set(id, result)
-		return result, false, nil
-	}
-
-	canceledWorkers := 0
-	var cancelMu sync.Mutex
+	// With a client, messages missing from the cache go to a single batcher
+	// and are fetched batchSize at a time instead of one request each.
+	misses := make(chan string, batchSize)
+	batched := make(chan struct{})
+	go func() {
+		defer close(batched)
+		if opts.Client == nil {
+			return
+		}
+		opts.Retry.batchFetch(runCtx, opts.Client, srv.BasePath, user, misses, func(id string, msg *gm.Message, err error) {
+			if msg != nil {
+				fetched <- fetchedMessage{msg: msg}
+			} else {
+				results <- messageResult{id: id, err: err}
+			}
+		})
+	}()
 
-	for range workers {
-		wg.Add(1)
+	var fetchWg, parseWg sync.WaitGroup
+	for range fetchWorkers {
+		fetchWg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer fetchWg.Done()
 			for id := range jobs {
-				// Check if context was cancelled (timeout or manual stop)
-				select {
-				case <-ctx.Done():
-					cancelMu.Lock()
-					canceledWorkers++
-					if canceledWorkers == 1 {
-						log.Printf("Scan cancelled, stopping %d workers...", workers)
-					}
-					cancelMu.Unlock()
+				if runCtx.Err() != nil {
 					return
-				default:
 				}
-
-				result, fromCache, err := processMessage(id)
-				if err != nil {
-					// Skip logging context canceled errors
-					if !strings.Contains(err.Error(), "context canceled") {
-						log.Printf("process message %s: %v", id, err)
-
-						// Check if this is a rate limit error (max retries exceeded)
-						if strings.Contains(err.Error(), "max retries exceeded") {
-							mu.Lock()
-							rateLimitErrors++
-							if rateLimitErrors >= maxRateLimitErrors {
-								log.Printf("Rate limit threshold exceeded (%d errors), aborting scan", rateLimitErrors)
-								select {
-								case rateLimitAbort <- struct{}{}:
-								default:
-								}
-							}
-							mu.Unlock()
-						}
+				if !opts.Reparse {
+					if cached, ok := cache.Get(id); ok && (!opts.ParseInvoices || cached.InvoiceChecked) {
+						results <- messageResult{id: id, result: cached, fromCache: true}
+						continue
 					}
-					mu.Lock()
-					processedCount++
-					if progressCallback != nil {
-						progressCallback(processedCount)
-					}
-					mu.Unlock()
-					if bar != nil {
-						bar.Add(1)
-					}
-					continue
-				}
-
-				mu.Lock()
-				if result.Order != nil && result.Order.ID != "" {
-					mergeOrCreateOrder(orders, result.Order)
 				}
-				for _, s := range result.Shipped {
-					key := s.ID + ":" + s.TrackingNumber
-					if _, ok := shippedIDs[key]; !ok {
-						shipped = append(shipped, s)
-						shippedIDs[key] = struct{}{}
+				// A result that is stale or being re-parsed is extracted again
+				// from the cached body. Invoices need the attachments, which
+				// aren't kept.
+				if !opts.ParseInvoices {
+					if raw, ok := cache.GetRaw(id); ok {
+						fetched <- fetchedMessage{msg: raw.message(id), fromRaw: true}
+						continue
 					}
 				}
-				processedCount++
-				if progressCallback != nil {
-					progressCallback(processedCount)
+				if opts.Client != nil {
+					misses <- id
+					continue
 				}
-				mu.Unlock()
-
-				// Only update progress bar for non-cached items to show API progress
-				if bar != nil && !fromCache {
-					bar.Add(1)
+				var msg *gm.Message
+				err := opts.Retry.do(runCtx, func() error {
+					var err error
+					msg, err = srv.Users.Messages.Get(user, id).Context(runCtx).Format("full").Do()
+					return err
+				})
+				if err != nil {
+					results <- messageResult{id: id, err: err}
+					continue
 				}
+				fetched <- fetchedMessage{msg: msg}
+			}
+		}()
+	}
+	for range parseWorkers {
+		parseWg.Add(1)
+		go func() {
+			defer parseWg.Done()
+			for f := range fetched {
+				msg := f.msg
+				result := classifyMessage(runCtx, srv, user, msg, cancels, opts)
+				raw := newRawMessage(msg)
+				if opts.CacheBodies || f.fromRaw {
+					result.Raw = raw
+				}
+				result.Account = opts.Account
+				cache.Set(msg.Id, result)
+				plainText := raw != nil && raw.MimeType == "text/plain"
+				results <- messageResult{id: msg.Id, result: result, fromCache: f.fromRaw, reparsed: f.fromRaw, plainText: plainText}
 			}
 		}()
 	}
-
-	// Monitor for rate limit abort
-	aborted := false
 	go func() {
-		<-rateLimitAbort
-		mu.Lock()
-		aborted = true
-		mu.Unlock()
-		close(jobs) // Stop feeding more jobs
+		fetchWg.Wait()
+		close(misses)
+		<-batched
+		close(fetched)
+		parseWg.Wait()
+		close(results)
 	}()
 
-	// Feed jobs to workers
-feedLoop:
-	for _, m := range allMessages {
-		mu.Lock()
-		if aborted {
-			mu.Unlock()
-			break feedLoop
+	processedCount := 0
+	rateLimitErrors := 0
+	for r := range results {
+		processedCount++
+		if r.err != nil {
+			// Skip logging errors caused by cancellation or a deadline
+			if runCtx.Err() == nil && !strings.Contains(r.err.Error(), "context canceled") {
+				log.Printf("process message %s: %v", r.id, r.err)
+				stats.FetchErrors++
+
+				// Check if this is a rate limit error (max retries exceeded)
+				if errors.Is(r.err, errMaxRetries) {
+					rateLimitErrors++
+					if rateLimitErrors >= maxRateLimitErrors {
+						log.Printf("Rate limit threshold exceeded (%d errors), aborting scan", rateLimitErrors)
+						abort()
+					}
+				}
+			}
+			if opts.Audit != nil && ctx.Err() == nil {
+				opts.Audit(AuditRecord{MessageID: r.id, Category: CategoryFetchError})
+			}
+		} else {
+			result := r.result
+			if r.fromCache {
+				stats.FromCache++
+			}
+			if r.reparsed {
+				stats.Reparsed++
+			}
+			if r.plainText {
+				stats.PlainText++
+			}
+			if (result.Order == nil || result.Order.ID == "") && len(result.Shipped) == 0 {
+				stats.ParseErrors++
+			}
+			if result.Order != nil && result.Order.ID != "" && spillErr == nil {
+				wasSpilled := acc.spilled()
+				if spillErr = acc.merge(result.Order); spillErr != nil {
+					abort()
+				} else if !wasSpilled && acc.spilled() {
+					log.Printf("More than %d orders; keeping the rest on disk", opts.SpillThreshold)
+				}
+			}
+			if opts.Audit != nil {
+				opts.Audit(newAuditRecord(r.id, result, r.fromCache))
+			}
+			for _, s := range result.Shipped {
+				key := s.ID + ":" + s.TrackingNumber
+				if _, ok := shippedIDs[key]; !ok {
+					shipped = append(shipped, s)
+					shippedIDs[key] = struct{}{}
+				}
+			}
 		}
-		mu.Unlock()
-
-		select {
-		case <-ctx.Done():
-			break feedLoop
-		case jobs <- m.Id:
+		if progressCallback != nil {
+			progressCallback(newProgress(processedCount, len(allMessages), start))
+		}
+		// Only update progress bar for non-cached items to show API progress
+		if bar != nil && !r.fromCache {
+			bar.Add(1)
 		}
 	}
 
-	// Only close if not already closed by abort
-	mu.Lock()
-	if !aborted {
-		close(jobs)
+	if stats.PlainText > 0 {
+		log.Printf("%d message(s) had no usable HTML part; read their plain text instead", stats.PlainText)
+	}
+	if stats.Reparsed > 0 {
+		log.Printf("%d message(s) re-parsed from cached bodies", stats.Reparsed)
+	}
+
+	if rateLimitErrors >= maxRateLimitErrors {
+		return nil, nil, stats, fmt.Errorf("Gmail API rate limit exceeded. Please wait a few minutes before scanning again")
+	}
+	if spillErr != nil {
+		return nil, nil, stats, spillErr
+	}
+	orders, err := acc.orders()
+	if err != nil {
+		return nil, nil, stats, err
+	}
+
+	finishOrders(orders, shipped)
+
+	stats.Processed = processedCount
+	return orders, shipped, stats, nil
+}
+
+// finishOrders settles orders once every message has been merged.
+func finishOrders(orders map[string]*report.Order, shipped []*report.ShippedOrder) {
+	for id, order := range orders {
+		order.ApplyCanceledItems()
+		if order.Status != "" {
+			continue
+		}
+		if order.Refunded && len(order.Items) == 0 {
+			// Only a refund was seen: the order was placed before the scan
+			// window and would otherwise count as a new, empty one.
+			delete(orders, id)
+			continue
+		}
+		// Only an update email was seen; the confirmation is outside the
+		// scan window.
+		order.Status = "confirmed"
+	}
+	// Likewise a shipment can outlive its confirmation in a narrow window;
+	// give it a bare order so it isn't orphaned in the report.
+	for _, s := range shipped {
+		if _, ok := orders[s.ID]; !ok && s.ID != "" {
+			orders[s.ID] = &report.Order{ID: s.ID, Status: "shipped"}
+		}
 	}
-	mu.Unlock()
+}
 
-	wg.Wait()
+// messageResult is what the pipeline hands back for one message.
+type messageResult struct {
+	id        string
+	result    *CachedResult
+	fromCache bool
+	reparsed  bool // parsed again from the cached raw message
+	plainText bool // parsed from the text/plain part
+	err       error
+}
 
-	// Check if scan was aborted due to rate limits
-	mu.Lock()
-	rateLimitCount := rateLimitErrors
-	mu.Unlock()
+// fetchedMessage is a message on its way to the parse workers; fromRaw marks
+// one rebuilt from the cache rather than fetched.
+type fetchedMessage struct {
+	msg     *gm.Message
+	fromRaw bool
+}
 
-	if rateLimitCount >= maxRateLimitErrors {
-		return nil, nil, fmt.Errorf("Gmail API rate limit exceeded. Please wait a few minutes before scanning again")
+// classifyMessage works out what kind of Walmart email msg is and extracts
+// the order or shipments it describes.
+func classifyMessage(ctx context.Context, srv *gm.Service, user string, msg *gm.Message, cancels cancelMatcher, opts ProcessOptions) *CachedResult {
+	subject := getSubject(msg.Payload.Headers)
+	result := &CachedResult{Subject: subject}
+
+	cancelCategory, canceled := cancels.match(subject)
+	switch {
+	case canceled:
+		result.Category = cancelCategory
+		if orderID := messageOrderID(subject, msg); orderID != "" {
+			result.Order = processCanceledEmail(msg, orderID, cancelCategory)
+		}
+	case isOrderUpdatedSubject(subject):
+		result.Category = CategoryUpdated
+		doc, err := parseMessageHTML(msg)
+		if err == nil {
+			result.Order = extractUpdatedOrder(doc, messageTime(msg), opts.Region)
+		}
+	case isRefundSubject(subject):
+		result.Category = CategoryRefund
+		result.Order = processRefundEmail(msg, subject)
+	case opts.Query.isShipped(subject):
+		result.Category = CategoryShipped
+		result.Shipped = processShippedEmail(msg)
+	case opts.Query.isDelivered(subject):
+		result.Category = CategoryDelivered
+		deliveredOrderID, deliveredDate := processDeliveredEmail(msg)
+		if deliveredOrderID != "" {
+			result.Shipped = []*report.ShippedOrder{
+				{
+					ID:               deliveredOrderID,
+					TrackingNumber:   "DELIVERED",
+					Carrier:          "Delivered",
+					EstimatedArrival: "",
+					DeliveredAt:      messageTime(msg),
+					DeliveredDate:    deliveredDate,
+				},
+			}
+		}
+	default:
+		result.Category = CategoryOrder
+		doc, err := parseMessageHTML(msg)
+		if err == nil {
+			result.Order = extractOrderInfo(doc, subject, opts.Region)
+			if opts.ParseInvoices {
+				applyInvoice(ctx, srv, user, msg, result.Order, opts.Retry)
+			}
+		}
 	}
 
-	return orders, shipped, nil
+	result.InvoiceChecked = opts.ParseInvoices && ctx.Err() == nil
+	return result
 }
@@ -0,0 +1,607 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gm "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// htmlMessage is a single-part HTML email as the Gmail API returns it.
+func htmlMessage(subject, body string) *gm.Message {
+	return &gm.Message{
+		Id: subject,
+		Payload: &gm.MessagePart{
+			MimeType: "text/html",
+			Headers:  []*gm.MessagePartHeader{{Name: "Subject", Value: subject}},
+			Body:     &gm.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(body)), Size: int64(len(body))},
+		},
+	}
+}
+
+func fixtureMessage(t *testing.T, subject, name string) *gm.Message {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return htmlMessage(subject, string(body))
+}
+
+// classifyFixtures classifies msgs with the default cancel patterns and
+// merges their orders the way ProcessEmails does.
+func classifyFixtures(t *testing.T, opts ProcessOptions, msgs ...*gm.Message) map[string]*report.Order {
+	t.Helper()
+	cancels, err := newCancelMatcher(DefaultCancelPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := make(map[string]*report.Order)
+	var shipped []*report.ShippedOrder
+	for _, msg := range msgs {
+		result := classifyMessage(context.Background(), nil, "me", msg, cancels, opts)
+		if result.Order != nil && result.Order.ID != "" {
+			mergeOrCreateOrder(orders, result.Order)
+		}
+		shipped = append(shipped, result.Shipped...)
+	}
+	finishOrders(orders, shipped)
+	return orders
+}
+
+func TestFinishOrdersDropsRefundOnlyOrders(t *testing.T) {
+	orders := map[string]*report.Order{
+		"refund-only": {ID: "refund-only", Refunded: true, RefundTotal: "$5.00"},
+		"refunded":    {ID: "refunded", Status: "delivered", Refunded: true, Items: []report.Item{{Name: "Lamp", Quantity: 1}}},
+		"update-only": {ID: "update-only", Items: []report.Item{{Name: "Rug", Quantity: 1}}},
+	}
+	shipped := []*report.ShippedOrder{{ID: "shipped-only"}}
+
+	finishOrders(orders, shipped)
+
+	if _, ok := orders["refund-only"]; ok {
+		t.Error("an order seen only in a refund email was kept")
+	}
+	want := map[string]string{"refunded": "delivered", "update-only": "confirmed", "shipped-only": "shipped"}
+	for id, status := range want {
+		o, ok := orders[id]
+		if !ok {
+			t.Errorf("order %s was dropped", id)
+			continue
+		}
+		if o.Status != status {
+			t.Errorf("order %s: Status = %q, want %q", id, o.Status, status)
+		}
+	}
+}
+
+func TestPartialCancellation(t *testing.T) {
+	orders := classifyFixtures(t, ProcessOptions{},
+		fixtureMessage(t, "Thanks for your order", "order_3_items.html"),
+		fixtureMessage(t, "Canceled: delivery from order #2000123-45678901", "canceled_1_item.html"),
+	)
+
+	o := orders["200012345678901"]
+	if o == nil {
+		t.Fatalf("order not found; got %v", orders)
+	}
+	if o.Status != "confirmed" {
+		t.Errorf("Status = %q, want confirmed", o.Status)
+	}
+	if len(o.Items) != 2 || o.Items[0].Name != "Desk Lamp" || o.Items[1].Name != "Area Rug" || o.Items[1].Quantity != 2 {
+		t.Errorf("Items = %+v, want Desk Lamp and 2 Area Rug", o.Items)
+	}
+	if len(o.CanceledItems) != 1 || o.CanceledItems[0].Name != "Coffee Mug" || o.CanceledItems[0].Quantity != 1 {
+		t.Errorf("CanceledItems = %+v, want 1 Coffee Mug", o.CanceledItems)
+	}
+	if o.CancelReason != report.CancelReasonWalmart {
+		t.Errorf("CancelReason = %q, want %q", o.CancelReason, report.CancelReasonWalmart)
+	}
+
+	stats := make(map[string]report.ProductStats)
+	for _, s := range report.CalculateProductStats(orders) {
+		stats[s.Name] = s
+	}
+	if s := stats["Coffee Mug"]; s.TotalOrdered != 1 || s.TotalCanceled != 1 {
+		t.Errorf("Coffee Mug: ordered %d, canceled %d; want 1 and 1", s.TotalOrdered, s.TotalCanceled)
+	}
+	if s := stats["Area Rug"]; s.TotalOrdered != 2 || s.TotalCanceled != 0 {
+		t.Errorf("Area Rug: ordered %d, canceled %d; want 2 and 0", s.TotalOrdered, s.TotalCanceled)
+	}
+}
+
+func TestCancelReasons(t *testing.T) {
+	tests := []struct {
+		subject      string
+		wantCategory string
+		wantReason   string
+	}{
+		{"Canceled: delivery from order #2000123-45678901", CategoryCanceled, report.CancelReasonWalmart},
+		{"Your order #2000123-45678901 was canceled 🔴", CategoryPaymentCanceled, report.CancelReasonPaymentFailed},
+	}
+	cancels, err := newCancelMatcher(DefaultCancelPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantCategory, func(t *testing.T) {
+			msg := htmlMessage(tt.subject, "<p>Your order was canceled.</p>")
+			result := classifyMessage(context.Background(), nil, "me", msg, cancels, ProcessOptions{})
+			if result.Category != tt.wantCategory {
+				t.Errorf("Category = %q, want %q", result.Category, tt.wantCategory)
+			}
+			if result.Order == nil {
+				t.Fatal("no order")
+			}
+			if result.Order.ID != "200012345678901" || result.Order.Status != "canceled" {
+				t.Errorf("order %q status %q, want 200012345678901 canceled", result.Order.ID, result.Order.Status)
+			}
+			if result.Order.CancelReason != tt.wantReason {
+				t.Errorf("CancelReason = %q, want %q", result.Order.CancelReason, tt.wantReason)
+			}
+
+			orders := classifyFixtures(t, ProcessOptions{}, fixtureMessage(t, "Thanks for your order", "order_3_items.html"), msg)
+			canceled := report.CanceledOrders(orders)
+			if len(canceled) != 1 || canceled[0].Reason != tt.wantReason || canceled[0].Partial {
+				t.Errorf("CanceledOrders = %+v, want one whole order canceled for %q", canceled, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestPreorderThenConfirmation(t *testing.T) {
+	preorder := fixtureMessage(t, "Thanks for your preorder", "order_3_items.html")
+	preorder.Id = "preorder"
+	confirmation := fixtureMessage(t, "Thanks for your order", "order_3_items.html")
+	confirmation.Id = "confirmation"
+
+	// Emails are processed in whatever order the workers finish them.
+	for name, msgs := range map[string][]*gm.Message{
+		"preorder first":     {preorder, confirmation},
+		"confirmation first": {confirmation, preorder},
+	} {
+		t.Run(name, func(t *testing.T) {
+			orders := classifyFixtures(t, ProcessOptions{}, msgs...)
+			if len(orders) != 1 {
+				t.Fatalf("got %d orders, want 1", len(orders))
+			}
+			order := orders["200012345678901"]
+			if order.Status != "confirmed" || !order.WasPreorder {
+				t.Errorf("status %q, WasPreorder %v; want confirmed, true", order.Status, order.WasPreorder)
+			}
+			if len(order.Items) != 3 {
+				t.Errorf("%d items after merging, want the email's 3", len(order.Items))
+			}
+		})
+	}
+}
+
+func TestPaymentMethod(t *testing.T) {
+	orders := classifyFixtures(t, ProcessOptions{},
+		fixtureMessage(t, "Thanks for your order", "order_paid_by_card.html"),
+		fixtureMessage(t, "Thanks for your order", "order_3_items.html"),
+	)
+	if got := orders["200088812345678"].PaymentMethod; got != "Visa ending in 1234" {
+		t.Errorf("card order paid with %q, want Visa ending in 1234", got)
+	}
+	if got := orders["200012345678901"].PaymentMethod; got != "" {
+		t.Errorf("order without payment info paid with %q, want none", got)
+	}
+
+	spend := report.CalculatePaymentMethodSpend([]*report.Order{orders["200088812345678"], orders["200012345678901"]})
+	want := []report.PaymentMethodSpend{
+		{Method: "Unknown", Orders: 1, TotalSpent: 60},
+		{Method: "Visa ending in 1234", Orders: 1, TotalSpent: 32.40},
+	}
+	if len(spend) != len(want) {
+		t.Fatalf("spend by method = %+v, want %+v", spend, want)
+	}
+	for i := range want {
+		if spend[i].Method != want[i].Method || spend[i].Orders != want[i].Orders || !approxEqual(spend[i].TotalSpent, want[i].TotalSpent) {
+			t.Errorf("spend[%d] = %+v, want %+v", i, spend[i], want[i])
+		}
+	}
+}
+
+func TestExtractPaymentMethod(t *testing.T) {
+	for text, want := range map[string]string{
+		"Paid with Mastercard ending in 4321": "Mastercard ending in 4321",
+		"Walmart Rewards Card ending in 0007": "Walmart Rewards ending in 0007",
+		"Card ending in 9999":                 "Card ending in 9999",
+		"Paid with a Walmart gift card":       "Gift card",
+		"Includes all fees, taxes and tip":    "",
+	} {
+		if got := extractPaymentMethod(text); got != want {
+			t.Errorf("extractPaymentMethod(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+func TestOrderUpdateReplacesItems(t *testing.T) {
+	original := fixtureMessage(t, "Thanks for your order", "order_3_items.html")
+	original.Id = "original"
+	original.InternalDate = time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC).UnixMilli()
+	updated := fixtureMessage(t, "Your order was updated", "order_3_items_updated.html")
+	updated.Id = "updated"
+	updated.InternalDate = time.Date(2025, 3, 2, 9, 0, 0, 0, time.UTC).UnixMilli()
+
+	for name, msgs := range map[string][]*gm.Message{
+		"original first": {original, updated},
+		"update first":   {updated, original},
+	} {
+		t.Run(name, func(t *testing.T) {
+			orders := classifyFixtures(t, ProcessOptions{}, msgs...)
+			o := orders["200012345678901"]
+			if o == nil {
+				t.Fatal("order missing")
+			}
+			if len(o.Items) != 2 || o.Items[0].Name != "Desk Lamp" || o.Items[1].Name != "Area Rug" || o.Items[1].Quantity != 1 {
+				t.Errorf("items = %+v, want the updated Desk Lamp and one Area Rug", o.Items)
+			}
+			if o.Total != "$37.80" || len(o.ConflictingTotals) != 0 {
+				t.Errorf("total %q, conflicting %q; want the update's $37.80 and no conflict", o.Total, o.ConflictingTotals)
+			}
+			if o.Status != "confirmed" {
+				t.Errorf("status %q, want the confirmation's", o.Status)
+			}
+		})
+	}
+}
+
+// fetchCalls counts the message fetches a fake Gmail API answers.
+type fetchCalls struct {
+	total atomic.Int32
+}
+
+// scanMailbox runs a scan over a mailbox holding msgs, served by a fake Gmail
+// API, with cache. It returns the scan's results and the fetches it made.
+func scanMailbox(t *testing.T, cache Cache, msgs ...*gm.Message) (map[string]*report.Order, []*report.ShippedOrder, *fetchCalls) {
+	t.Helper()
+	byID := make(map[string]*gm.Message, len(msgs))
+	list := make([]*gm.Message, len(msgs))
+	for i, msg := range msgs {
+		byID[msg.Id] = msg
+		list[i] = &gm.Message{Id: msg.Id}
+	}
+	calls := new(fetchCalls)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.total.Add(1)
+		msg, ok := byID[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(msg)
+	}))
+	t.Cleanup(ts.Close)
+	srv, err := gm.NewService(context.Background(), option.WithHTTPClient(ts.Client()), option.WithEndpoint(ts.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, shipped, _, err := ProcessEmailsWithOptions(context.Background(), srv, "me", list, ProcessOptions{
+		Cache:    cache,
+		Progress: func(Progress) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orders, shipped, calls
+}
+
+func TestShippedOnlyMailbox(t *testing.T) {
+	msg := fixtureMessage(t, "Shipped: Desk Lamp", "shipped_single_date.html")
+	msg.InternalDate = time.Date(2025, 1, 3, 9, 0, 0, 0, time.UTC).UnixMilli()
+	orders, shipped, _ := scanMailbox(t, NewMemoryCache(time.Hour), msg)
+
+	if len(shipped) != 1 || shipped[0].TrackingNumber != "123456789012" {
+		t.Fatalf("shipments = %+v, want the one tracking number", shipped)
+	}
+	// The confirmation fell outside the scan, so a bare order stands in.
+	o := orders["200012345678901"]
+	if len(orders) != 1 || o == nil {
+		t.Fatalf("orders = %v, want one for the shipment", orders)
+	}
+	if o.Status != "shipped" || len(o.Items) != 0 || o.Total != "" {
+		t.Errorf("order = %+v, want a bare shipped order", o)
+	}
+}
+
+func TestConfirmationsWithDifferentTotals(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "order_3_items.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := htmlMessage("Thanks for your order", string(body))
+	first.Id = "first"
+	second := htmlMessage("Thanks for your order", strings.Replace(string(body), "$60.00", "$64.50", 1))
+	second.Id = "second"
+
+	orders := classifyFixtures(t, ProcessOptions{}, first, second)
+	o := orders["200012345678901"]
+	if o == nil {
+		t.Fatal("order missing")
+	}
+	if o.Total != "$60.00" || len(o.ConflictingTotals) != 1 || o.ConflictingTotals[0] != "$64.50" {
+		t.Errorf("total %q, conflicting %q; want $60.00 with $64.50 conflicting", o.Total, o.ConflictingTotals)
+	}
+	got := report.FindTotalDiscrepancies(orders)
+	if len(got) != 1 || got[0].OrderID != "200012345678901" || strings.Join(got[0].Totals, " ") != "$60.00 $64.50" {
+		t.Errorf("discrepancies = %+v, want the order with both totals", got)
+	}
+}
+
+func TestTipAndFees(t *testing.T) {
+	for _, tt := range []struct {
+		fixture, id        string
+		tip, fees          string
+		total, merchandise float64
+	}{
+		{"mixed_order.html", "200055512345678", "$5.00", "$6.95", 70.25, 58.30},
+		{"order_no_tip.html", "200066612345678", "", "$6.95", 28.55, 21.60},
+		// Without a breakdown, merchandise spend falls back to the total.
+		{"order_3_items.html", "200012345678901", "", "", 60, 60},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			orders := classifyFixtures(t, ProcessOptions{}, fixtureMessage(t, "Thanks for your order", tt.fixture))
+			o := orders[tt.id]
+			if o == nil {
+				t.Fatalf("order %s not found; got %v", tt.id, orders)
+			}
+			if o.Tip != tt.tip || o.Fees != tt.fees {
+				t.Errorf("tip %q fees %q, want %q and %q", o.Tip, o.Fees, tt.tip, tt.fees)
+			}
+			for mode, want := range map[string]float64{report.SpendTotal: tt.total, report.SpendMerchandise: tt.merchandise} {
+				if got, ok := o.Spend(mode); !ok || !approxEqual(got, want) {
+					t.Errorf("%s spend = %.2f, %v; want %.2f", mode, got, ok, want)
+				}
+				var spent float64
+				for _, s := range report.CalculateSummaries([]*report.Order{o}, report.LearnPricesWithMode([]*report.Order{o}, mode)) {
+					spent += s.TotalSpent
+				}
+				if !approxEqual(spent, want) {
+					t.Errorf("%s: products add up to %.2f, want %.2f", mode, spent, want)
+				}
+			}
+		})
+	}
+}
+
+func TestItemUnitPriceIgnoresOrderSubtotal(t *testing.T) {
+	orders := classifyFixtures(t, ProcessOptions{}, fixtureMessage(t, "Thanks for your order", "single_item_order.html"))
+	o := orders["200077712345678"]
+	if o == nil || len(o.Items) != 1 {
+		t.Fatalf("order = %+v, want one item", o)
+	}
+	if o.Items[0].UnitPrice != 0 {
+		t.Errorf("UnitPrice = %v, taken from the order subtotal", o.Items[0].UnitPrice)
+	}
+	if got := report.LearnPrices([]*report.Order{o})["Desk Lamp"]; !approxEqual(got, 21.60) {
+		t.Errorf("learned %.2f, want the total split over 2 units, 21.60", got)
+	}
+}
+
+func TestCanceledSubjectIDMatchesConfirmation(t *testing.T) {
+	confirmation := fixtureMessage(t, "Thanks for your order", "order_3_items.html")
+	orders := classifyFixtures(t, ProcessOptions{}, confirmation)
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders from the confirmation, want 1", len(orders))
+	}
+	var confirmedID string
+	for id := range orders {
+		confirmedID = id
+	}
+
+	// The body carries no order link, so the ID can only come from the subject.
+	for _, subject := range []string{
+		"Canceled: delivery from order #2000123-45678901",
+		"Canceled: delivery from order #200012345678901",
+		"Your order #2000123-45678901 was canceled 🔴",
+	} {
+		t.Run(subject, func(t *testing.T) {
+			msg := htmlMessage(subject, "<p>Your order was canceled.</p>")
+			if got := messageOrderID(subject, msg); got != confirmedID {
+				t.Errorf("ID from subject = %q, want the confirmation's %q", got, confirmedID)
+			}
+			orders := classifyFixtures(t, ProcessOptions{}, confirmation, msg)
+			if o := orders[confirmedID]; len(orders) != 1 || o == nil || o.Status != "canceled" {
+				t.Errorf("orders = %v, want the confirmed order canceled", orders)
+			}
+		})
+	}
+}
+
+func TestMixedOrderPrices(t *testing.T) {
+	orders := classifyFixtures(t, ProcessOptions{}, fixtureMessage(t, "Thanks for your order", "mixed_order.html"))
+	o := orders["200055512345678"]
+	if o == nil {
+		t.Fatalf("order not found; got %v", orders)
+	}
+	if o.Total != "$70.25" || o.Tip != "$5.00" || o.Fees != "$6.95" || o.Tax != "$3.30" {
+		t.Errorf("total %q tip %q fees %q tax %q", o.Total, o.Tip, o.Fees, o.Tax)
+	}
+	wantUnit := map[string]float64{"Desk Lamp": 20, "Area Rug": 15, "Coffee Mug": 5}
+	for _, item := range o.Items {
+		if item.UnitPrice != wantUnit[item.Name] {
+			t.Errorf("%s: UnitPrice = %v, want %v", item.Name, item.UnitPrice, wantUnit[item.Name])
+		}
+	}
+
+	// The printed prices leave out tax and fees, so they only split the
+	// order's spend between its products.
+	for mode, spend := range map[string]float64{report.SpendTotal: 70.25, report.SpendMerchandise: 58.30} {
+		learned := report.LearnPricesWithMode([]*report.Order{o}, mode)
+		var sum float64
+		for _, item := range o.Items {
+			want := spend * wantUnit[item.Name] / 55
+			if got := learned[item.Name]; !approxEqual(got, want) {
+				t.Errorf("%s %s: learned %.4f, want %.4f", mode, item.Name, got, want)
+			}
+			sum += learned[item.Name] * float64(item.Quantity)
+		}
+		if !approxEqual(sum, spend) {
+			t.Errorf("%s: learned prices add up to %.2f, want %.2f", mode, sum, spend)
+		}
+	}
+}
+
+func TestShippedMismatchedCounts(t *testing.T) {
+	msg := fixtureMessage(t, "Shipped: 3 packages", "shipped_mismatched_counts.html")
+	msg.InternalDate = time.Date(2025, 1, 3, 9, 0, 0, 0, time.Local).UnixMilli()
+	shipped := processShippedEmail(msg)
+
+	// Three tracking numbers but two arrival dates: the dates pair by
+	// position and the last package is kept without one.
+	want := []struct{ tracking, arrival string }{
+		{"123456789012", "Arrives Jan 6"},
+		{"123456789013", "Arrives Jan 7"},
+		{"123456789014", ""},
+	}
+	if len(shipped) != len(want) {
+		t.Fatalf("got %d shipments, want %d", len(shipped), len(want))
+	}
+	for i, w := range want {
+		s := shipped[i]
+		if s.TrackingNumber != w.tracking || s.EstimatedArrival != w.arrival || s.ID != "200012345678901" {
+			t.Errorf("shipment %d = %s %q for %s, want %s %q for 200012345678901", i, s.TrackingNumber, s.EstimatedArrival, s.ID, w.tracking, w.arrival)
+		}
+	}
+	if !shipped[2].ArrivalStart.IsZero() {
+		t.Errorf("undated package arrives %v, want no date", shipped[2].ArrivalStart)
+	}
+}
+
+func TestShippedMultiPackage(t *testing.T) {
+	msg := fixtureMessage(t, "Shipped: 3 packages", "shipped_multi_package.html")
+	msg.InternalDate = time.Date(2025, 1, 3, 9, 0, 0, 0, time.Local).UnixMilli()
+	shipped := processShippedEmail(msg)
+
+	// Each package takes its carrier and arrival date from its own block,
+	// wherever the date sits in it; the second block has none.
+	jan := func(day int) time.Time { return time.Date(2025, 1, day, 0, 0, 0, 0, time.Local) }
+	want := []struct {
+		tracking, carrier, arrival string
+		start, end                 time.Time
+	}{
+		{"123456789012", "FedEx", "Arrives Jan 6", jan(6), jan(6)},
+		{"1Z999AA10123456784", "UPS", "", time.Time{}, time.Time{}},
+		{"9400111899223456789012", "USPS", "Arrives Mon–Wed, Jan 6–8", jan(6), jan(8)},
+	}
+	if len(shipped) != len(want) {
+		t.Fatalf("got %d shipments, want %d", len(shipped), len(want))
+	}
+	for i, w := range want {
+		s := shipped[i]
+		if s.TrackingNumber != w.tracking || s.Carrier != w.carrier || s.EstimatedArrival != w.arrival {
+			t.Errorf("shipment %d = %s by %s %q, want %s by %s %q", i, s.TrackingNumber, s.Carrier, s.EstimatedArrival, w.tracking, w.carrier, w.arrival)
+		}
+		if !s.ArrivalStart.Equal(w.start) || !s.ArrivalEnd.Equal(w.end) {
+			t.Errorf("shipment %d arrives %v to %v, want %v to %v", i, s.ArrivalStart, s.ArrivalEnd, w.start, w.end)
+		}
+	}
+}
+
+func TestParseArrival(t *testing.T) {
+	received := time.Date(2025, 1, 3, 9, 0, 0, 0, time.Local)
+	day := func(m time.Month, d int) time.Time { return time.Date(2025, m, d, 0, 0, 0, 0, time.Local) }
+	tests := []struct {
+		text       string
+		start, end time.Time
+	}{
+		{"Arrives Jan 6", day(1, 6), day(1, 6)},
+		{"Arrives Jan 6 - Jan 8", day(1, 6), day(1, 8)},
+		{"Arrives Mon–Wed, Jan 6–8", day(1, 6), day(1, 8)},
+		{"Arrives today", day(1, 3), day(1, 3)},
+		{"Arrives tomorrow", day(1, 4), day(1, 4)},
+		{"Arrives soon", time.Time{}, time.Time{}},
+	}
+	for _, tt := range tests {
+		start, end := parseArrival(tt.text, received)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("parseArrival(%q) = %v, %v; want %v, %v", tt.text, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestExtractTax(t *testing.T) {
+	tests := []struct {
+		fixture, id, wantTax string
+	}{
+		{"mixed_order.html", "200055512345678", "$3.30"},
+		{"order_3_items.html", "200012345678901", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			orders := classifyFixtures(t, ProcessOptions{}, fixtureMessage(t, "Thanks for your order", tt.fixture))
+			o := orders[tt.id]
+			if o == nil {
+				t.Fatalf("order %s not found", tt.id)
+			}
+			if o.Tax != tt.wantTax {
+				t.Errorf("Tax = %q, want %q", o.Tax, tt.wantTax)
+			}
+		})
+	}
+}
+
+func TestShippedArrivalFixtures(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		received   time.Time
+		start, end time.Time
+		carrier    string
+	}{
+		{
+			fixture:  "shipped_single_date.html",
+			received: time.Date(2025, 1, 3, 9, 0, 0, 0, time.Local),
+			start:    time.Date(2025, 1, 6, 0, 0, 0, 0, time.Local),
+			end:      time.Date(2025, 1, 6, 0, 0, 0, 0, time.Local),
+			carrier:  "FedEx",
+		},
+		{
+			// The range crosses into a year the email never names.
+			fixture:  "shipped_date_range.html",
+			received: time.Date(2024, 12, 20, 9, 0, 0, 0, time.Local),
+			start:    time.Date(2024, 12, 30, 0, 0, 0, 0, time.Local),
+			end:      time.Date(2025, 1, 2, 0, 0, 0, 0, time.Local),
+			carrier:  "UPS",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			msg := fixtureMessage(t, "Shipped: Desk Lamp", tt.fixture)
+			msg.InternalDate = tt.received.UnixMilli()
+			shipped := processShippedEmail(msg)
+			if len(shipped) != 1 {
+				t.Fatalf("got %d shipments, want 1", len(shipped))
+			}
+			s := shipped[0]
+			if s.ID != "200012345678901" || s.Carrier != tt.carrier {
+				t.Errorf("shipment %s by %q, want 200012345678901 by %q", s.ID, s.Carrier, tt.carrier)
+			}
+			if !strings.HasPrefix(s.EstimatedArrival, "Arrives") {
+				t.Errorf("EstimatedArrival = %q, want the email's text", s.EstimatedArrival)
+			}
+			if !s.ArrivalStart.Equal(tt.start) || !s.ArrivalEnd.Equal(tt.end) {
+				t.Errorf("arrival %v to %v, want %v to %v", s.ArrivalStart, s.ArrivalEnd, tt.start, tt.end)
+			}
+		})
+	}
+}
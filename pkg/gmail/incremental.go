@@ -0,0 +1,195 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	gm "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// metadataWorkers bounds the concurrent header lookups for new mail in an
+// incremental scan.
+const metadataWorkers = 8
+
+// SyncState is what an incremental scan resumes from: the mailbox's history
+// ID as of the last scan, and the messages the query matched.
+type SyncState struct {
+	HistoryID  uint64   `json:"history_id"`
+	Query      string   `json:"query"`
+	MessageIDs []string `json:"message_ids"`
+	// ListedAt is when the query last ran in full. Incremental scans only add
+	// messages, so a full listing is repeated once the scan window has passed
+	// to drop mail that has aged out.
+	ListedAt time.Time `json:"listed_at"`
+}
+
+// FetchMessagesIncremental returns the messages query matches. When prev was
+// saved for the same query less than window ago, only mail added since its
+// history ID is looked at, keeping messages for which match(from, subject)
+// holds. Otherwise, or when Gmail no longer has that history, query is listed
+// in full. incremental reports which happened. The returned state should be
+// saved once the messages have been processed.
+func FetchMessagesIncremental(ctx context.Context, srv *gm.Service, user, query string, match func(from, subject string) bool, prev *SyncState, window time.Duration) (messages []*gm.Message, state *SyncState, incremental bool, err error) {
+	if prev != nil && prev.HistoryID != 0 && prev.Query == query && time.Since(prev.ListedAt) < window {
+		messages, state, err = fetchSince(ctx, srv, user, match, prev)
+		if err == nil {
+			return messages, state, true, nil
+		}
+		if !isNotFound(err) {
+			return nil, nil, false, err
+		}
+		log.Printf("Gmail history %d has expired, listing all messages", prev.HistoryID)
+	}
+
+	// Read the history ID first so mail arriving during the listing is picked
+	// up by the next incremental scan rather than missed.
+	profile, err := GetProfile(ctx, srv, user)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("get profile: %w", err)
+	}
+	messages, err = FetchMessages(ctx, srv, user, query)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	state = &SyncState{HistoryID: profile.HistoryId, Query: query, ListedAt: time.Now()}
+	for _, m := range messages {
+		state.MessageIDs = append(state.MessageIDs, m.Id)
+	}
+	return messages, state, false, nil
+}
+
+// fetchSince adds the matching messages received since prev to prev's.
+func fetchSince(ctx context.Context, srv *gm.Service, user string, match func(from, subject string) bool, prev *SyncState) ([]*gm.Message, *SyncState, error) {
+	added, latest, err := historyAdded(ctx, srv, user, prev.HistoryID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]bool, len(prev.MessageIDs))
+	for _, id := range prev.MessageIDs {
+		known[id] = true
+	}
+	var fresh []string
+	for _, id := range added {
+		if !known[id] {
+			known[id] = true
+			fresh = append(fresh, id)
+		}
+	}
+	matched, err := matchingMessages(ctx, srv, user, fresh, match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := &SyncState{HistoryID: latest, Query: prev.Query, ListedAt: prev.ListedAt}
+	state.MessageIDs = append(append(state.MessageIDs, prev.MessageIDs...), matched...)
+	if state.HistoryID == 0 {
+		state.HistoryID = prev.HistoryID
+	}
+	messages := make([]*gm.Message, len(state.MessageIDs))
+	for i, id := range state.MessageIDs {
+		messages[i] = &gm.Message{Id: id}
+	}
+	return messages, state, nil
+}
+
+// historyAdded returns the IDs of messages added since startID, and the
+// mailbox's current history ID.
+func historyAdded(ctx context.Context, srv *gm.Service, user string, startID uint64) ([]string, uint64, error) {
+	var ids []string
+	var latest uint64
+	var pageToken string
+	for {
+		var r *gm.ListHistoryResponse
+		err := withRetry(ctx, func() error {
+			req := srv.Users.History.List(user).StartHistoryId(startID).HistoryTypes("messageAdded").Context(ctx)
+			if pageToken != "" {
+				req.PageToken(pageToken)
+			}
+			var err error
+			r, err = req.Do()
+			return err
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("list history: %w", scopeError(err))
+		}
+		for _, h := range r.History {
+			for _, a := range h.MessagesAdded {
+				if a.Message != nil {
+					ids = append(ids, a.Message.Id)
+				}
+			}
+		}
+		latest = r.HistoryId
+		if r.NextPageToken == "" {
+			return ids, latest, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// matchingMessages fetches the From and Subject headers of ids and returns the
+// ones match accepts, in their original order. Messages deleted in the
+// meantime are skipped.
+func matchingMessages(ctx context.Context, srv *gm.Service, user string, ids []string, match func(from, subject string) bool) ([]string, error) {
+	keep := make([]bool, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, metadataWorkers)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var msg *gm.Message
+			err := withRetry(ctx, func() error {
+				var err error
+				msg, err = srv.Users.Messages.Get(user, id).Format("metadata").MetadataHeaders("From", "Subject").Context(ctx).Do()
+				return err
+			})
+			if isNotFound(err) {
+				return
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("get message %s: %w", id, err)
+				return
+			}
+			if msg.Payload != nil {
+				keep[i] = match(header(msg.Payload.Headers, "From"), getSubject(msg.Payload.Headers))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var matched []string
+	for i, id := range ids {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if keep[i] {
+			matched = append(matched, id)
+		}
+	}
+	return matched, nil
+}
+
+func header(headers []*gm.MessagePartHeader, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,309 @@
+package gmail
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gm "google.golang.org/api/gmail/v1"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// maxStreamBytes bounds each decompressed PDF stream so a hostile attachment
+// cannot exhaust memory.
+const maxStreamBytes = 4 << 20
+
+var (
+	invoiceTotalRe = regexp.MustCompile(`(?im)^[^\S\n]*(?:order[^\S\n]+|grand[^\S\n]+)?total[^\S\n]*:?\s*\$[^\S\n]*([\d,]+\.\d{2})`)
+	amountRe       = regexp.MustCompile(`\$\s*([\d,]+\.\d{2})`)
+)
+
+// findPDFParts returns the PDF attachments in a message, searching the same
+// multipart tree findPart walks.
+func findPDFParts(part *gm.MessagePart) []*gm.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.MimeType == "application/pdf" && part.Body != nil {
+		return []*gm.MessagePart{part}
+	}
+	var pdfs []*gm.MessagePart
+	if strings.HasPrefix(part.MimeType, "multipart/") {
+		for _, sub := range part.Parts {
+			pdfs = append(pdfs, findPDFParts(sub)...)
+		}
+	}
+	return pdfs
+}
+
+// fetchAttachment returns a part's decoded body, downloading it when Gmail
+// only sent an attachment ID.
+func fetchAttachment(ctx context.Context, srv *gm.Service, user, msgID string, part *gm.MessagePart, retry RetryPolicy) ([]byte, error) {
+	data := part.Body.Data
+	if data == "" && part.Body.AttachmentId != "" {
+		err := retry.do(ctx, func() error {
+			att, err := srv.Users.Messages.Attachments.Get(user, msgID, part.Body.AttachmentId).Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+			data = att.Data
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get attachment: %w", err)
+		}
+	}
+	decoded, err := decodeBase64(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(decoded), nil
+}
+
+// applyInvoice overrides order's scraped total and item prices with the
+// values printed on any PDF invoice attached to msg. It reports whether an
+// invoice supplied anything.
+func applyInvoice(ctx context.Context, srv *gm.Service, user string, msg *gm.Message, order *report.Order, retry RetryPolicy) bool {
+	applied := false
+	for _, part := range findPDFParts(msg.Payload) {
+		data, err := fetchAttachment(ctx, srv, user, msg.Id, part, retry)
+		if err != nil {
+			continue
+		}
+		text := pdfText(data)
+		if total := invoiceTotal(text); total != "" {
+			order.Total = total
+			applied = true
+		}
+		for i := range order.Items {
+			if price := invoiceLinePrice(text, order.Items[i].Name); price != "" {
+				order.Items[i].Price = price
+				applied = true
+			}
+		}
+	}
+	return applied
+}
+
+// invoiceTotal returns the last "Total $x.xx" line of an invoice, which is the
+// grand total on Walmart's layout. Subtotals don't match.
+func invoiceTotal(text string) string {
+	matches := invoiceTotalRe.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return "$" + matches[len(matches)-1][1]
+}
+
+// invoiceLinePrice returns the first amount printed after an item's name.
+// Invoices often truncate long names, so only the first few words must match.
+func invoiceLinePrice(text, name string) string {
+	flat := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	words := strings.Fields(strings.ToLower(name))
+	if len(words) == 0 {
+		return ""
+	}
+	if len(words) > 4 {
+		words = words[:4]
+	}
+	i := strings.Index(flat, strings.Join(words, " "))
+	if i < 0 {
+		return ""
+	}
+	window := flat[i:min(len(flat), i+300)]
+	if m := amountRe.FindStringSubmatch(window); m != nil {
+		return "$" + m[1]
+	}
+	return ""
+}
+
+// pdfText extracts the text drawn by a PDF's content streams. It only handles
+// what invoice generators typically emit: uncompressed or Flate-compressed
+// streams showing literal strings with Tj/TJ. Text in other encodings is
+// skipped rather than decoded.
+func pdfText(data []byte) string {
+	var out strings.Builder
+	rest := data
+	for {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		header := rest[:i]
+		if j := bytes.LastIndex(header, []byte("obj")); j >= 0 {
+			header = header[j:]
+		}
+		start := i + len("stream")
+		if start < len(rest) && rest[start] == '\r' {
+			start++
+		}
+		if start < len(rest) && rest[start] == '\n' {
+			start++
+		}
+		end := bytes.Index(rest[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		raw := rest[start : start+end]
+		rest = rest[start+end+len("endstream"):]
+
+		var content []byte
+		switch {
+		case bytes.Contains(header, []byte("/FlateDecode")):
+			zr, err := zlib.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				continue
+			}
+			// A truncated stream still yields whatever inflated cleanly.
+			content, _ = io.ReadAll(io.LimitReader(zr, maxStreamBytes))
+			zr.Close()
+		case bytes.Contains(header, []byte("/Filter")):
+			continue
+		default:
+			content = raw
+		}
+		if bytes.Contains(content, []byte("BT")) {
+			contentText(content, &out)
+		}
+	}
+	return out.String()
+}
+
+// contentText appends the strings shown by a content stream to out, starting
+// a new line whenever the text position moves vertically.
+func contentText(content []byte, out *strings.Builder) {
+	var shown []string
+	var nums []float64
+	newline := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte('\n')
+		}
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, n := readLiteral(content[i:])
+			shown = append(shown, s)
+			i += n
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '<' || c == '>' || c == '[' || c == ']' || c == '{' || c == '}' || isPDFSpace(c):
+			i++
+		case c == '/':
+			i++
+			for i < len(content) && !isPDFDelim(content[i]) {
+				i++
+			}
+		default:
+			j := i
+			for j < len(content) && !isPDFDelim(content[j]) {
+				j++
+			}
+			if j == i {
+				i++
+				continue
+			}
+			tok := string(content[i:j])
+			i = j
+			if v, err := strconv.ParseFloat(tok, 64); err == nil {
+				// Large negative TJ adjustments are how generators space words.
+				if v < -200 && len(shown) > 0 {
+					shown = append(shown, " ")
+				}
+				nums = append(nums, v)
+				continue
+			}
+			switch tok {
+			case "Tj", "TJ":
+				out.WriteString(strings.Join(shown, ""))
+			case "'", `"`:
+				newline()
+				out.WriteString(strings.Join(shown, ""))
+			case "Td", "TD":
+				if len(nums) >= 2 && nums[len(nums)-1] != 0 {
+					newline()
+				} else {
+					out.WriteByte(' ')
+				}
+			case "T*", "Tm", "ET":
+				newline()
+			}
+			shown = shown[:0]
+			nums = nums[:0]
+		}
+	}
+	newline()
+}
+
+// readLiteral decodes a PDF literal string starting at b[0] == '(' and returns
+// it with the number of bytes consumed.
+func readLiteral(b []byte) (string, int) {
+	var s strings.Builder
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			depth++
+			if depth > 1 {
+				s.WriteByte(c)
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return s.String(), i + 1
+			}
+			s.WriteByte(c)
+		case '\\':
+			i++
+			if i >= len(b) {
+				break
+			}
+			switch e := b[i]; e {
+			case 'n':
+				s.WriteByte('\n')
+			case 'r':
+				s.WriteByte('\r')
+			case 't':
+				s.WriteByte('\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				if e == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for k := 0; k < 2 && i+1 < len(b) && b[i+1] >= '0' && b[i+1] <= '7'; k++ {
+						i++
+						v = v*8 + int(b[i]-'0')
+					}
+					s.WriteByte(byte(v))
+				} else {
+					s.WriteByte(e)
+				}
+			}
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String(), len(b)
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelim(c byte) bool {
+	return isPDFSpace(c) || strings.IndexByte("()<>[]{}/%", c) >= 0
+}
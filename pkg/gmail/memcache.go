@@ -0,0 +1,116 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a Cache held in process memory, used when the SQLite cache
+// can't be opened. Entries are kept as JSON, like MessageCache, so callers
+// never share a result with the cache.
+type MemoryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]memoryEntry
+	// diskErr is why the SQLite cache couldn't be opened, when this cache
+	// stands in for it. Clear reports it, since the cache on disk is left as
+	// it was.
+	diskErr error
+}
+
+type memoryEntry struct {
+	data    []byte
+	raw     []byte // encoded RawMessage; nil if none was kept
+	account string
+	created time.Time
+}
+
+func NewMemoryCache(ttl time.Duration) *MemoryCache {
+	return &MemoryCache{ttl: ttl, entries: make(map[string]memoryEntry)}
+}
+
+func (c *MemoryCache) Get(msgID string) (*CachedResult, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[msgID]
+	if ok && time.Since(e.created) >= c.ttl {
+		delete(c.entries, msgID)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	var result CachedResult
+	if err := json.Unmarshal(e.data, &result); err != nil {
+		return nil, false
+	}
+	return &result, true
+}
+
+func (c *MemoryCache) GetRaw(msgID string) (*RawMessage, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[msgID]
+	c.mu.Unlock()
+	if !ok || e.raw == nil || time.Since(e.created) >= c.ttl {
+		return nil, false
+	}
+	raw, err := decodeRaw(e.raw)
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
+func (c *MemoryCache) Set(msgID string, result *CachedResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	var raw []byte
+	if result.Raw != nil {
+		if raw, err = encodeRaw(result.Raw); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.entries[msgID] = memoryEntry{data: data, raw: raw, account: result.Account, created: time.Now()}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MemoryCache) Clear() error {
+	c.mu.Lock()
+	c.entries = make(map[string]memoryEntry)
+	c.mu.Unlock()
+	if c.diskErr != nil {
+		return fmt.Errorf("%w: %v", ErrDiskCacheUnavailable, c.diskErr)
+	}
+	return nil
+}
+
+func (c *MemoryCache) DeleteAccount(account string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, e := range c.entries {
+		if e.account == account {
+			delete(c.entries, id)
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Stats() (total int, size int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		size += int64(len(e.data) + len(e.raw))
+	}
+	return len(c.entries), size, nil
+}
+
+func (c *MemoryCache) Close() error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// DefaultQueryConfigPath is where the CLI and web server look for a
+// QueryConfig. The file is optional.
+const DefaultQueryConfigPath = "query.json"
+
+// QueryConfig is what the Gmail search for Walmart mail matches: mail from
+// any of Senders whose subject contains any of Subjects, ShippedSubjects or
+// DeliveredSubjects. The last two also decide how a message is read: a
+// subject containing one of ShippedSubjects is a shipment email, and one
+// starting with one of DeliveredSubjects is a delivery email.
+type QueryConfig struct {
+	Senders           []string `json:"senders"`
+	Subjects          []string `json:"subjects"`
+	ShippedSubjects   []string `json:"shipped_subjects"`
+	DeliveredSubjects []string `json:"delivered_subjects"`
+}
+
+// DefaultQueryConfig matches the emails the parser understands, in the
+// wording Walmart US uses.
+var DefaultQueryConfig = QueryConfig{
+	Senders: []string{"help@walmart.com"},
+	Subjects: []string{
+		"thanks for your preorder",
+		"thanks for your order",
+		"Canceled: delivery from order",
+		"was canceled",
+		"order was updated",
+		"order has been updated",
+		"Your refund",
+	},
+	ShippedSubjects:   []string{"Shipped:"},
+	DeliveredSubjects: []string{"Arrived:", "Delivered:"},
+}
+
+// LoadQueryConfig reads a QueryConfig from a JSON file such as
+// {"senders": ["help@walmart.com", "noreply@walmart.com"]}. A missing file
+// yields DefaultQueryConfig, and a list left empty keeps its default.
+func LoadQueryConfig(path string) (QueryConfig, error) {
+	cfg := DefaultQueryConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	var file QueryConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(file.Senders) > 0 {
+		cfg.Senders = file.Senders
+	}
+	if len(file.Subjects) > 0 {
+		cfg.Subjects = file.Subjects
+	}
+	if len(file.ShippedSubjects) > 0 {
+		cfg.ShippedSubjects = file.ShippedSubjects
+	}
+	if len(file.DeliveredSubjects) > 0 {
+		cfg.DeliveredSubjects = file.DeliveredSubjects
+	}
+	return cfg, nil
+}
+
+// subjects returns every subject phrase searched for, plus extraSubjects.
+func (c QueryConfig) subjects(extraSubjects ...string) []string {
+	return slices.Concat(c.Subjects, c.ShippedSubjects, c.DeliveredSubjects, extraSubjects)
+}
+
+// isShipped reports whether subject is a shipment email's. An empty
+// ShippedSubjects uses the default list.
+func (c QueryConfig) isShipped(subject string) bool {
+	phrases := c.ShippedSubjects
+	if len(phrases) == 0 {
+		phrases = DefaultQueryConfig.ShippedSubjects
+	}
+	return slices.ContainsFunc(phrases, func(p string) bool { return strings.Contains(subject, p) })
+}
+
+// isDelivered reports whether subject is a delivery email's. An empty
+// DeliveredSubjects uses the default list.
+func (c QueryConfig) isDelivered(subject string) bool {
+	phrases := c.DeliveredSubjects
+	if len(phrases) == 0 {
+		phrases = DefaultQueryConfig.DeliveredSubjects
+	}
+	return slices.ContainsFunc(phrases, func(p string) bool { return strings.HasPrefix(subject, p) })
+}
+
+// Query returns the search for the configured senders and subjects, plus
+// extraSubjects, over r.
+func (c QueryConfig) Query(r report.DateRange, extraSubjects ...string) string {
+	var subjects []string
+	for _, s := range c.subjects(extraSubjects...) {
+		subjects = append(subjects, fmt.Sprintf("%q", strings.ReplaceAll(s, `"`, "")))
+	}
+	return fmt.Sprintf("%s subject:(%s) %s", c.from(), strings.Join(subjects, " OR "), dateQuery(r))
+}
+
+// dateOperators are the Gmail search operators that bound a search by date.
+var dateOperators = []string{"newer_than:", "older_than:", "after:", "before:", "newer:", "older:"}
+
+// CustomQuery returns a user-written search limited to r, unless it already
+// uses a date operator of its own, in which case it is returned as is.
+func CustomQuery(query string, r report.DateRange) string {
+	query = strings.TrimSpace(query)
+	lower := strings.ToLower(query)
+	for _, op := range dateOperators {
+		if strings.Contains(lower, op) {
+			return query
+		}
+	}
+	return query + " " + dateQuery(r)
+}
+
+// LabelQuery returns a search for all mail from the configured senders under
+// label, which must already be in Gmail's search form.
+func (c QueryConfig) LabelQuery(label string, r report.DateRange) string {
+	return fmt.Sprintf("label:%s %s %s", label, c.from(), dateQuery(r))
+}
+
+// dateQuery limits a search to r. Gmail's before: excludes its date, so it is
+// given the day after Until.
+func dateQuery(r report.DateRange) string {
+	if !r.Absolute() {
+		return fmt.Sprintf("newer_than:%dd", r.Days)
+	}
+	var terms []string
+	if !r.Since.IsZero() {
+		terms = append(terms, "after:"+r.Since.Format("2006/01/02"))
+	}
+	if !r.Until.IsZero() {
+		terms = append(terms, "before:"+r.Until.AddDate(0, 0, 1).Format("2006/01/02"))
+	}
+	return strings.Join(terms, " ")
+}
+
+func (c QueryConfig) from() string {
+	if len(c.Senders) == 1 {
+		return "from:" + c.Senders[0]
+	}
+	return "from:(" + strings.Join(c.Senders, " OR ") + ")"
+}
+
+// Matches approximates Query for a message already in hand: it reports
+// whether from names one of the senders and subject contains one of the
+// subject phrases or extraSubjects, ignoring case.
+func (c QueryConfig) Matches(from, subject string, extraSubjects ...string) bool {
+	from, subject = strings.ToLower(from), strings.ToLower(subject)
+	sent := false
+	for _, s := range c.Senders {
+		if strings.Contains(from, strings.ToLower(s)) {
+			sent = true
+			break
+		}
+	}
+	if !sent {
+		return false
+	}
+	for _, s := range c.subjects(extraSubjects...) {
+		if strings.Contains(subject, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
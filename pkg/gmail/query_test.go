@@ -0,0 +1,55 @@
+package gmail
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"walmart-order-checker/pkg/report"
+)
+
+func TestQueryLeavesConfigSubjectsAlone(t *testing.T) {
+	cfg := DefaultQueryConfig
+	// Spare capacity is what an append onto Subjects would write into.
+	cfg.Subjects = append(make([]string, 0, 8), "thanks for your order")
+	cfg.Query(report.LastDays(30), "first extra")
+	q := cfg.Query(report.LastDays(30), "second extra")
+	if strings.Contains(q, "first extra") {
+		t.Errorf("query %q kept an earlier call's extra subject", q)
+	}
+	if got := cfg.Subjects[:cap(cfg.Subjects)][1]; got != "" {
+		t.Errorf("Query wrote %q past the end of Subjects", got)
+	}
+}
+
+func TestQueryConfigShippedSubjects(t *testing.T) {
+	cfg := DefaultQueryConfig
+	cfg.ShippedSubjects = []string{"On its way:"}
+	cfg.DeliveredSubjects = []string{"Dropped off:"}
+
+	q := cfg.Query(report.LastDays(30))
+	for _, want := range []string{`"On its way:"`, `"Dropped off:"`} {
+		if !strings.Contains(q, want) {
+			t.Errorf("query %q doesn't search for %s", q, want)
+		}
+	}
+
+	cancels, err := newCancelMatcher(DefaultCancelPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ProcessOptions{Query: cfg}
+	for _, tc := range []struct {
+		subject string
+		want    string
+	}{
+		{"On its way: Desk Lamp", CategoryShipped},
+		{"Dropped off: Desk Lamp", CategoryDelivered},
+		{"Shipped: Desk Lamp", CategoryOrder},
+	} {
+		msg := htmlMessage(tc.subject, "<p>Hello</p>")
+		if got := classifyMessage(context.Background(), nil, "me", msg, cancels, opts).Category; got != tc.want {
+			t.Errorf("%q classified as %q, want %q", tc.subject, got, tc.want)
+		}
+	}
+}
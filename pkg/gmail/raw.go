@@ -0,0 +1,87 @@
+package gmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+
+	gm "google.golang.org/api/gmail/v1"
+)
+
+// RawMessage is what the parser reads from a Gmail message: its headers,
+// when it arrived and its decoded body. Caches keep it next to the parsed
+// result so a parser upgrade can re-run extraction without fetching the
+// message again.
+type RawMessage struct {
+	InternalDate int64
+	Headers      []*gm.MessagePartHeader
+	MimeType     string // "text/html", or "text/plain" when there is no HTML
+	Body         string
+}
+
+// newRawMessage keeps the parts of msg that classifyMessage reads. It returns
+// nil for a message with no readable body.
+func newRawMessage(msg *gm.Message) *RawMessage {
+	if msg.Payload == nil {
+		return nil
+	}
+	for _, mimeType := range []string{"text/html", "text/plain"} {
+		data := findPart(msg.Payload, mimeType)
+		if data == "" {
+			continue
+		}
+		body, err := decodeBase64(data)
+		if err != nil {
+			continue
+		}
+		return &RawMessage{
+			InternalDate: msg.InternalDate,
+			Headers:      msg.Payload.Headers,
+			MimeType:     mimeType,
+			Body:         body,
+		}
+	}
+	return nil
+}
+
+// message rebuilds a single-part Gmail message from r. Attachments aren't
+// kept, so it can't be used to read invoices.
+func (r *RawMessage) message(id string) *gm.Message {
+	data := base64.URLEncoding.EncodeToString([]byte(r.Body))
+	return &gm.Message{
+		Id:           id,
+		InternalDate: r.InternalDate,
+		Payload: &gm.MessagePart{
+			MimeType: r.MimeType,
+			Headers:  r.Headers,
+			Body:     &gm.MessagePartBody{Data: data, Size: int64(len(r.Body))},
+		},
+	}
+}
+
+// encodeRaw stores r as gzipped JSON; email HTML compresses well.
+func encodeRaw(r *RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(r); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRaw(data []byte) (*RawMessage, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var r RawMessage
+	if err := json.NewDecoder(zr).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
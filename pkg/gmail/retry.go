@@ -0,0 +1,237 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gm "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	DefaultMaxAttempts    = 5
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+
+	maxRetryAttempts  = 20
+	minInitialBackoff = 10 * time.Millisecond
+	maxInitialBackoff = time.Minute
+	maxRetryBackoff   = 10 * time.Minute
+)
+
+var errMaxRetries = errors.New("max retries exceeded")
+
+// RetryPolicy controls how transient Gmail API errors are retried. Zero
+// fields take the defaults.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration // doubled after every failed attempt
+	MaxBackoff     time.Duration // the doubling stops here
+	// Sleep waits for d unless ctx ends first. Nil uses a real timer; tests
+	// can substitute one that returns immediately.
+	Sleep func(ctx context.Context, d time.Duration) error
+	// OnRetry, when set, is told of each transient error about to be
+	// retried. It may be called from several goroutines at once.
+	OnRetry func(err error)
+}
+
+// RetryPolicyFromEnv returns the default policy adjusted by
+// GMAIL_RETRY_ATTEMPTS, GMAIL_RETRY_BACKOFF and GMAIL_RETRY_MAX_BACKOFF.
+// Invalid values are logged and ignored.
+func RetryPolicyFromEnv() RetryPolicy {
+	p := RetryPolicy{MaxAttempts: DefaultMaxAttempts, InitialBackoff: DefaultInitialBackoff, MaxBackoff: DefaultMaxBackoff}
+	if v := os.Getenv("GMAIL_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && (RetryPolicy{MaxAttempts: n}).Validate() == nil {
+			p.MaxAttempts = n
+		} else {
+			log.Printf("Warning: invalid GMAIL_RETRY_ATTEMPTS %q, using %d", v, p.MaxAttempts)
+		}
+	}
+	if v := os.Getenv("GMAIL_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && (RetryPolicy{InitialBackoff: d}).Validate() == nil {
+			p.InitialBackoff = d
+		} else {
+			log.Printf("Warning: invalid GMAIL_RETRY_BACKOFF %q, using %s", v, p.InitialBackoff)
+		}
+	}
+	if v := os.Getenv("GMAIL_RETRY_MAX_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && (RetryPolicy{InitialBackoff: p.InitialBackoff, MaxBackoff: d}).Validate() == nil {
+			p.MaxBackoff = d
+		} else {
+			log.Printf("Warning: invalid GMAIL_RETRY_MAX_BACKOFF %q, using %s", v, p.MaxBackoff)
+		}
+	}
+	return p
+}
+
+// Validate reports whether the policy's explicitly set fields are within sane
+// bounds.
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("retry attempts must be between 1 and %d", maxRetryAttempts)
+	}
+	if p.InitialBackoff != 0 && (p.InitialBackoff < minInitialBackoff || p.InitialBackoff > maxInitialBackoff) {
+		return fmt.Errorf("retry backoff must be between %s and %s", minInitialBackoff, maxInitialBackoff)
+	}
+	if p.MaxBackoff != 0 && (p.MaxBackoff < max(p.InitialBackoff, minInitialBackoff) || p.MaxBackoff > maxRetryBackoff) {
+		return fmt.Errorf("max retry backoff must be between the initial backoff and %s", maxRetryBackoff)
+	}
+	return nil
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = max(DefaultMaxBackoff, p.InitialBackoff)
+	}
+	if p.Sleep == nil {
+		p.Sleep = sleep
+	}
+	return p
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do calls fn until it succeeds or returns a non-transient error, doubling the
+// wait between attempts up to MaxBackoff. After MaxAttempts transient failures
+// it gives up with an error wrapping errMaxRetries.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	p = p.withDefaults()
+	backoff := p.InitialBackoff
+	var err error
+	for attempt := 0; attempt < p.MaxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		if attempt == p.MaxAttempts-1 {
+			break
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(err)
+		}
+		if err := p.Sleep(ctx, jitter(backoff)); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, p.MaxBackoff)
+	}
+	return fmt.Errorf("%w: %v", errMaxRetries, err)
+}
+
+// withRetry runs fn under the default retry policy.
+func withRetry(ctx context.Context, fn func() error) error {
+	return RetryPolicy{}.do(ctx, fn)
+}
+
+// jitter picks a wait between half and all of d, so workers that were
+// throttled together don't all retry at the same moment.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// isTransient reports whether err is a Gmail API error worth retrying: rate
+// limiting or a server-side failure.
+func isTransient(err error) bool {
+	if IsRateLimited(err) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsRateLimited reports whether err is Gmail turning a request away for
+// quota: a 429, or a 403 naming a rate-limit reason.
+func IsRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrInsufficientScope means the account's token doesn't include read
+// access to Gmail, as when a narrower scope was approved at sign-in. Signing
+// in again and allowing it is the fix.
+var ErrInsufficientScope = errors.New("Gmail read access was not granted")
+
+// scopeError returns err wrapped in ErrInsufficientScope when it is Gmail
+// refusing a request for lack of scope, and err unchanged otherwise.
+func scopeError(err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return err
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "insufficientPermissions" {
+			return fmt.Errorf("%w: %w", ErrInsufficientScope, err)
+		}
+	}
+	if strings.Contains(apiErr.Message, "insufficient authentication scopes") {
+		return fmt.Errorf("%w: %w", ErrInsufficientScope, err)
+	}
+	return err
+}
+
+// CheckReadAccess lists a single message to find out early whether the
+// token behind srv may read mail. It returns ErrInsufficientScope, wrapped,
+// when it may not.
+func CheckReadAccess(ctx context.Context, srv *gm.Service, user string) error {
+	_, err := srv.Users.Messages.List(user).MaxResults(1).Fields("messages/id").Context(ctx).Do()
+	return scopeError(err)
+}
+
+// GetProfile fetches the profile of user, retrying transient API errors.
+func GetProfile(ctx context.Context, srv *gm.Service, user string) (*gm.Profile, error) {
+	var profile *gm.Profile
+	err := withRetry(ctx, func() error {
+		var err error
+		profile, err = srv.Users.GetProfile(user).Context(ctx).Do()
+		return err
+	})
+	return profile, scopeError(err)
+}
@@ -0,0 +1,98 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// recordSleep returns a Sleep that returns at once, appending each wait it
+// was asked for to waits.
+func recordSleep(waits *[]time.Duration) func(context.Context, time.Duration) error {
+	return func(_ context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+}
+
+func TestRetryBacksOffUntilSuccess(t *testing.T) {
+	var waits []time.Duration
+	p := RetryPolicy{MaxAttempts: 6, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Sleep: recordSleep(&waits)}
+	attempts := 0
+	err := p.do(context.Background(), func() error {
+		attempts++
+		if attempts < 5 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 5 {
+		t.Errorf("%d attempts, want 5", attempts)
+	}
+	// Jitter waits between half and all of each backoff: 1s, 2s, then 3s
+	// once the doubling is capped.
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	if len(waits) != len(want) {
+		t.Fatalf("waited %v, want %d waits", waits, len(want))
+	}
+	for i, d := range waits {
+		if d < want[i]/2 || d > want[i] {
+			t.Errorf("wait %d = %s, want between %s and %s", i, d, want[i]/2, want[i])
+		}
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	var waits []time.Duration
+	p := RetryPolicy{MaxAttempts: 3, Sleep: recordSleep(&waits)}
+	attempts := 0
+	err := p.do(context.Background(), func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusTooManyRequests}
+	})
+	if !errors.Is(err, errMaxRetries) {
+		t.Fatalf("err = %v, want errMaxRetries", err)
+	}
+	if attempts != 3 || len(waits) != 2 {
+		t.Errorf("%d attempts and %d waits, want 3 and 2", attempts, len(waits))
+	}
+}
+
+func TestRetryStopsOnPermanentError(t *testing.T) {
+	var waits []time.Duration
+	p := RetryPolicy{Sleep: recordSleep(&waits)}
+	notFound := &googleapi.Error{Code: http.StatusNotFound}
+	attempts := 0
+	err := p.do(context.Background(), func() error {
+		attempts++
+		return notFound
+	})
+	if err != notFound {
+		t.Fatalf("err = %v, want the 404", err)
+	}
+	if attempts != 1 || len(waits) != 0 {
+		t.Errorf("%d attempts and %d waits, want 1 and 0", attempts, len(waits))
+	}
+}
+
+func TestRetryStopsWhenSleepFails(t *testing.T) {
+	p := RetryPolicy{Sleep: func(context.Context, time.Duration) error { return context.Canceled }}
+	attempts := 0
+	err := p.do(context.Background(), func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusBadGateway}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if attempts != 1 {
+		t.Errorf("%d attempts, want 1", attempts)
+	}
+}
@@ -0,0 +1,160 @@
+package gmail
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"walmart-order-checker/pkg/report"
+)
+
+// orderAccumulator collects the orders of a scan. Once it holds more than
+// limit orders in memory it moves them all to a temporary SQLite database and
+// merges every later email there, keeping them out of memory while messages
+// are still being processed. orders reads them all back at the end, so peak
+// memory isn't lowered. A limit of zero keeps everything in memory.
+type orderAccumulator struct {
+	limit int
+	mem   map[string]*report.Order
+
+	path     string
+	db       *sql.DB
+	loadStmt *sql.Stmt
+	saveStmt *sql.Stmt
+}
+
+func newOrderAccumulator(limit int) *orderAccumulator {
+	return &orderAccumulator{limit: limit, mem: make(map[string]*report.Order)}
+}
+
+func (a *orderAccumulator) merge(o *report.Order) error {
+	if a.db == nil {
+		mergeOrCreateOrder(a.mem, o)
+		if a.limit > 0 && len(a.mem) > a.limit {
+			return a.spill()
+		}
+		return nil
+	}
+
+	existing, err := a.load(o.ID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return a.save(o)
+	}
+	mergeOrder(existing, o)
+	return a.save(existing)
+}
+
+// spill opens the temporary database and moves the in-memory orders to it.
+func (a *orderAccumulator) spill() error {
+	f, err := os.CreateTemp("", "walmart-orders-*.db")
+	if err != nil {
+		return fmt.Errorf("create spill file: %w", err)
+	}
+	a.path = f.Name()
+	f.Close()
+
+	db, err := sql.Open("sqlite", a.path)
+	if err != nil {
+		return fmt.Errorf("open spill database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	a.db = db
+
+	// The file is thrown away after the scan, so durability doesn't matter.
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=OFF",
+		"PRAGMA synchronous=OFF",
+		"CREATE TABLE orders (id TEXT PRIMARY KEY, data BLOB NOT NULL) WITHOUT ROWID",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("prepare spill database: %w", err)
+		}
+	}
+	if a.loadStmt, err = db.Prepare("SELECT data FROM orders WHERE id = ?"); err != nil {
+		return fmt.Errorf("prepare spill database: %w", err)
+	}
+	if a.saveStmt, err = db.Prepare("INSERT OR REPLACE INTO orders (id, data) VALUES (?, ?)"); err != nil {
+		return fmt.Errorf("prepare spill database: %w", err)
+	}
+
+	for id, o := range a.mem {
+		if err := a.save(o); err != nil {
+			return err
+		}
+		delete(a.mem, id)
+	}
+	return nil
+}
+
+func (a *orderAccumulator) load(id string) (*report.Order, error) {
+	var data []byte
+	err := a.loadStmt.QueryRow(id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load spilled order %s: %w", id, err)
+	}
+	var o report.Order
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("decode spilled order %s: %w", id, err)
+	}
+	return &o, nil
+}
+
+func (a *orderAccumulator) save(o *report.Order) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("encode order %s: %w", o.ID, err)
+	}
+	if _, err := a.saveStmt.Exec(o.ID, data); err != nil {
+		return fmt.Errorf("spill order %s: %w", o.ID, err)
+	}
+	return nil
+}
+
+// spilled reports whether orders have moved to disk.
+func (a *orderAccumulator) spilled() bool {
+	return a.db != nil
+}
+
+// orders returns every accumulated order, reading spilled ones back.
+func (a *orderAccumulator) orders() (map[string]*report.Order, error) {
+	if a.db == nil {
+		return a.mem, nil
+	}
+	rows, err := a.db.Query("SELECT data FROM orders")
+	if err != nil {
+		return nil, fmt.Errorf("read spilled orders: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[string]*report.Order)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("read spilled orders: %w", err)
+		}
+		var o report.Order
+		if err := json.Unmarshal(data, &o); err != nil {
+			return nil, fmt.Errorf("decode spilled order: %w", err)
+		}
+		out[o.ID] = &o
+	}
+	return out, rows.Err()
+}
+
+// close deletes the temporary database, if one was created.
+func (a *orderAccumulator) close() {
+	if a.db != nil {
+		a.db.Close()
+	}
+	if a.path != "" {
+		os.Remove(a.path)
+	}
+}
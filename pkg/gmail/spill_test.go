@@ -0,0 +1,56 @@
+package gmail
+
+import (
+	"os"
+	"testing"
+
+	"walmart-order-checker/pkg/report"
+)
+
+func TestOrderAccumulatorSpill(t *testing.T) {
+	acc := newOrderAccumulator(2)
+	defer acc.close()
+
+	merge := func(o *report.Order) {
+		t.Helper()
+		if err := acc.merge(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge(&report.Order{ID: "1", Status: "confirmed", Total: "$10.00", Items: []report.Item{{Name: "Lamp", Quantity: 1}}})
+	merge(&report.Order{ID: "2", Status: "confirmed", Total: "$20.00"})
+	if acc.spilled() {
+		t.Fatal("spilled before passing the limit")
+	}
+	merge(&report.Order{ID: "3", Status: "pre-ordered", WasPreorder: true})
+	if !acc.spilled() {
+		t.Fatal("didn't spill past the limit")
+	}
+	if len(acc.mem) != 0 {
+		t.Errorf("%d orders still in memory after spilling", len(acc.mem))
+	}
+	// Later emails are merged into the spilled copies.
+	merge(&report.Order{ID: "1", Status: "canceled", CancelReason: report.CancelReasonWalmart})
+	merge(&report.Order{ID: "3", Status: "confirmed"})
+	merge(&report.Order{ID: "4", Status: "confirmed"})
+
+	orders, err := acc.orders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 4 {
+		t.Fatalf("got %d orders, want 4", len(orders))
+	}
+	if o := orders["1"]; o.Status != "canceled" || o.Total != "$10.00" || len(o.Items) != 1 || o.CancelReason != report.CancelReasonWalmart {
+		t.Errorf("order 1 = %+v, want the canceled confirmation", o)
+	}
+	if o := orders["3"]; o.Status != "confirmed" || !o.WasPreorder {
+		t.Errorf("order 3: status %q, WasPreorder %v; want confirmed, true", o.Status, o.WasPreorder)
+	}
+
+	path := acc.path
+	acc.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file %s left behind: %v", path, err)
+	}
+}
@@ -0,0 +1,62 @@
+// Package oauth builds HTTP clients from stored Google OAuth tokens. It is
+// shared by the CLI's Gmail client and the web server's sign-in code.
+package oauth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultRefreshSkew is how long before its expiry an access token is
+// refreshed, so a token never expires partway through a request.
+const DefaultRefreshSkew = time.Minute
+
+// RefreshSkew returns the TOKEN_REFRESH_SKEW duration (e.g. "90s"), or
+// DefaultRefreshSkew when it is unset or invalid. The variable is read, and
+// an invalid value logged, only the first time.
+func RefreshSkew() time.Duration {
+	return refreshSkew()
+}
+
+var refreshSkew = sync.OnceValue(func() time.Duration {
+	if v := os.Getenv("TOKEN_REFRESH_SKEW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Warning: invalid TOKEN_REFRESH_SKEW %q, using %s", v, DefaultRefreshSkew)
+	}
+	return DefaultRefreshSkew
+})
+
+// NewClient returns an HTTP client for tok that refreshes it RefreshSkew
+// before it expires.
+func NewClient(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) *http.Client {
+	ts := oauth2.ReuseTokenSourceWithExpiry(tok, refreshSource{ctx, config, tok.RefreshToken}, RefreshSkew())
+	return oauth2.NewClient(ctx, ts)
+}
+
+// RefreshToken exchanges tok's refresh token for a new access token, even if
+// tok itself has not expired yet.
+func RefreshToken(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) (*oauth2.Token, error) {
+	return refreshSource{ctx, config, tok.RefreshToken}.Token()
+}
+
+// refreshSource always fetches a new token. The source returned by
+// config.TokenSource only refreshes within 10 seconds of expiry, which would
+// defeat a larger skew.
+type refreshSource struct {
+	ctx          context.Context
+	config       *oauth2.Config
+	refreshToken string
+}
+
+func (s refreshSource) Token() (*oauth2.Token, error) {
+	return s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.refreshToken}).Token()
+}
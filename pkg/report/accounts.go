@@ -0,0 +1,143 @@
+package report
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Outcomes of one account in a combined scan.
+const (
+	AccountScanned = "scanned"
+	AccountPartial = "partial" // timed out; some messages are missing
+	AccountSkipped = "skipped" // failed before any results were collected
+)
+
+// AccountStatus records how one account fared in a combined scan, so that a
+// report missing an account says so.
+type AccountStatus struct {
+	Account string
+	Status  string
+	Reason  string // why the account was skipped or is partial
+	Orders  int
+}
+
+// AccountNotices describes every account that did not scan cleanly, for the
+// banner at the top of the report.
+func AccountNotices(accounts []AccountStatus) []string {
+	var notices []string
+	for _, a := range accounts {
+		switch a.Status {
+		case AccountSkipped:
+			notices = append(notices, fmt.Sprintf("%s was skipped (%s); no results from this account are included.", a.Account, a.Reason))
+		case AccountPartial:
+			notices = append(notices, fmt.Sprintf("%s is incomplete (%s).", a.Account, a.Reason))
+		}
+	}
+	return notices
+}
+
+// MergeOrders adds the orders of one account's scan to dest, combining an
+// order found in several accounts into one. Of two copies of an order, the
+// one with a parsed order date and a total is kept as the base and the other
+// fills in its gaps: items are united by name, and a cancellation or refund
+// seen in either account is kept.
+func MergeOrders(dest, src map[string]*Order) {
+	for id, order := range src {
+		existing, ok := dest[id]
+		if !ok {
+			dest[id] = order
+			continue
+		}
+		if mergeRank(order) > mergeRank(existing) {
+			existing, order = order, existing
+			dest[id] = existing
+		}
+		existing.mergeCopy(order)
+	}
+}
+
+// mergeRank scores how complete a copy of an order is; a parsed date counts
+// for more than a total.
+func mergeRank(o *Order) int {
+	rank := 0
+	if !o.OrderDateParsed.IsZero() {
+		rank += 2
+	}
+	if _, ok := parseAmount(o.Total); ok {
+		rank++
+	}
+	return rank
+}
+
+// mergeCopy folds another account's copy of the same order into o.
+func (o *Order) mergeCopy(other *Order) {
+	// A copy's items have had its own partial cancellations taken off, so
+	// they go back on before the lists are united and the cancellations of
+	// both copies come off again. Otherwise an item canceled in one account
+	// would also stay ordered through the other.
+	reapply := o.ItemsUpdatedAt.IsZero() && other.ItemsUpdatedAt.IsZero()
+	if reapply {
+		o.Items = unionItems(o.itemsBeforeCancel(), other.itemsBeforeCancel())
+	} else {
+		o.MergeItems(other)
+	}
+	o.MergeTotal(other)
+	if o.PaymentMethod == "" {
+		o.PaymentMethod = other.PaymentMethod
+	}
+	if o.OrderDate == "" || (o.OrderDateParsed.IsZero() && !other.OrderDateParsed.IsZero()) {
+		o.OrderDate = other.OrderDate
+		o.OrderDateParsed = other.OrderDateParsed
+	}
+	o.MergeStatus(other)
+	// The same refund email may be in several mailboxes, so keep the larger
+	// amount rather than adding them.
+	if other.Refunded {
+		have, _ := parseAmount(o.RefundTotal)
+		if add, ok := parseAmount(other.RefundTotal); !o.Refunded || (ok && add > have) {
+			o.RefundTotal = other.RefundTotal
+		}
+		o.Refunded = true
+	}
+	o.CanceledItems = unionItems(o.CanceledItems, other.CanceledItems)
+	if reapply {
+		o.ApplyCanceledItems()
+	}
+	o.IsNew = o.IsNew || other.IsNew
+	o.AddSourceAccounts(other.SourceAccounts...)
+}
+
+// itemsBeforeCancel returns o's items as ordered, with those
+// ApplyCanceledItems took off put back.
+func (o *Order) itemsBeforeCancel() []Item {
+	items := slices.Clone(o.Items)
+	for _, c := range o.CanceledItems {
+		i := slices.IndexFunc(items, func(item Item) bool { return item.Name == c.Name })
+		if i < 0 {
+			items = append(items, c)
+			continue
+		}
+		items[i].Quantity += c.Quantity
+	}
+	return items
+}
+
+// unionItems returns a followed by the items of b whose names a lacks.
+func unionItems(a, b []Item) []Item {
+	if len(b) == 0 {
+		return a
+	}
+	seen := make(map[string]bool, len(a))
+	for _, item := range a {
+		seen[strings.ToLower(item.Name)] = true
+	}
+	union := slices.Clone(a)
+	for _, item := range b {
+		if key := strings.ToLower(item.Name); !seen[key] {
+			seen[key] = true
+			union = append(union, item)
+		}
+	}
+	return union
+}
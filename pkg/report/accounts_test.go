@@ -0,0 +1,108 @@
+package report
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMergeOrders(t *testing.T) {
+	date := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	lamp := Item{Name: "Desk Lamp", Quantity: 1}
+	rug := Item{Name: "Area Rug", Quantity: 2}
+	mug := Item{Name: "Coffee Mug", Quantity: 1}
+
+	tests := []struct {
+		name string
+		a, b *Order
+		want Order
+	}{
+		{
+			name: "copy with a parsed date becomes the base",
+			a:    &Order{ID: "1", Status: "confirmed", Total: "$10.00", PaymentMethod: "Gift card", Items: []Item{lamp}},
+			b:    &Order{ID: "1", Status: "confirmed", Total: "$12.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, Items: []Item{lamp}},
+			want: Order{ID: "1", Status: "confirmed", Total: "$12.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, PaymentMethod: "Gift card", Items: []Item{lamp}},
+		},
+		{
+			name: "copy with a total outranks one without",
+			a:    &Order{ID: "1", Status: "confirmed", Items: []Item{lamp}},
+			b:    &Order{ID: "1", Status: "confirmed", Total: "$12.00", Items: []Item{lamp}},
+			want: Order{ID: "1", Status: "confirmed", Total: "$12.00", Items: []Item{lamp}},
+		},
+		{
+			name: "items are united without duplicates",
+			a:    &Order{ID: "1", Status: "confirmed", Items: []Item{lamp, rug}},
+			b:    &Order{ID: "1", Status: "confirmed", Items: []Item{{Name: "desk lamp", Quantity: 1}, mug}},
+			want: Order{ID: "1", Status: "confirmed", Items: []Item{lamp, rug, mug}},
+		},
+		{
+			name: "larger refund wins",
+			a:    &Order{ID: "1", Status: "confirmed", Refunded: true, RefundTotal: "$5.00"},
+			b:    &Order{ID: "1", Status: "confirmed", Refunded: true, RefundTotal: "$8.00"},
+			want: Order{ID: "1", Status: "confirmed", Refunded: true, RefundTotal: "$8.00"},
+		},
+		{
+			name: "refund seen in one account is kept",
+			a:    &Order{ID: "1", Status: "confirmed", Refunded: true, RefundTotal: "$8.00"},
+			b:    &Order{ID: "1", Status: "confirmed"},
+			want: Order{ID: "1", Status: "confirmed", Refunded: true, RefundTotal: "$8.00"},
+		},
+		{
+			name: "cancellation in the base account is kept",
+			a:    &Order{ID: "1", Status: "canceled", CancelReason: CancelReasonWalmart, Total: "$12.00", Items: []Item{lamp}},
+			b:    &Order{ID: "1", Status: "confirmed", Items: []Item{lamp}},
+			want: Order{ID: "1", Status: "canceled", CancelReason: CancelReasonWalmart, Total: "$12.00", Items: []Item{lamp}},
+		},
+		{
+			name: "cancellation in the other account is kept",
+			a:    &Order{ID: "1", Status: "confirmed", Total: "$12.00", Items: []Item{lamp}},
+			b:    &Order{ID: "1", Status: "canceled", CancelReason: CancelReasonPaymentFailed, Items: []Item{lamp}},
+			want: Order{ID: "1", Status: "canceled", CancelReason: CancelReasonPaymentFailed, Total: "$12.00", Items: []Item{lamp}},
+		},
+		{
+			name: "canceled items are united",
+			a:    &Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Items: []Item{lamp}, CanceledItems: []Item{rug}},
+			b:    &Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Items: []Item{lamp}, CanceledItems: []Item{mug}},
+			want: Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Items: []Item{lamp}, CanceledItems: []Item{rug, mug}},
+		},
+		{
+			name: "partial cancel in the other account is not counted twice",
+			a:    &Order{ID: "1", Status: "confirmed", Total: "$60.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, Items: []Item{lamp, rug, mug}},
+			b:    &Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Items: []Item{lamp, {Name: "Area Rug", Quantity: 1}}, CanceledItems: []Item{{Name: "Area Rug", Quantity: 1}, mug}},
+			want: Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Total: "$60.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, Items: []Item{lamp, {Name: "Area Rug", Quantity: 1}}, CanceledItems: []Item{{Name: "Area Rug", Quantity: 1}, mug}},
+		},
+		{
+			name: "partial cancel in the base account is not counted twice",
+			a:    &Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Total: "$60.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, Items: []Item{lamp, rug}, CanceledItems: []Item{mug}},
+			b:    &Order{ID: "1", Status: "confirmed", Items: []Item{lamp, rug, mug}},
+			want: Order{ID: "1", Status: "confirmed", CancelReason: CancelReasonWalmart, Total: "$60.00", OrderDate: "Mar 1, 2025", OrderDateParsed: date, Items: []Item{lamp, rug}, CanceledItems: []Item{mug}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := map[string]*Order{"1": tt.a}
+			MergeOrders(dest, map[string]*Order{"1": tt.b})
+			got := dest["1"]
+
+			if got.Status != tt.want.Status || got.CancelReason != tt.want.CancelReason {
+				t.Errorf("status %q (%q), want %q (%q)", got.Status, got.CancelReason, tt.want.Status, tt.want.CancelReason)
+			}
+			if got.Total != tt.want.Total || got.PaymentMethod != tt.want.PaymentMethod {
+				t.Errorf("total %q, payment %q; want %q, %q", got.Total, got.PaymentMethod, tt.want.Total, tt.want.PaymentMethod)
+			}
+			if got.OrderDate != tt.want.OrderDate || !got.OrderDateParsed.Equal(tt.want.OrderDateParsed) {
+				t.Errorf("date %q, want %q", got.OrderDate, tt.want.OrderDate)
+			}
+			if got.Refunded != tt.want.Refunded || got.RefundTotal != tt.want.RefundTotal {
+				t.Errorf("refund %v %q, want %v %q", got.Refunded, got.RefundTotal, tt.want.Refunded, tt.want.RefundTotal)
+			}
+			if !slices.Equal(got.Items, tt.want.Items) {
+				t.Errorf("Items = %+v, want %+v", got.Items, tt.want.Items)
+			}
+			if !slices.Equal(got.CanceledItems, tt.want.CanceledItems) {
+				t.Errorf("CanceledItems = %+v, want %+v", got.CanceledItems, tt.want.CanceledItems)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultAliasesPath is where the CLI and web server look for product
+// aliases. The file is optional.
+const DefaultAliasesPath = "aliases.json"
+
+// ProductAlias gives every product whose name matches Pattern the display
+// name Name, so differently worded listings of one product are grouped
+// together. Matching ignores case.
+type ProductAlias struct {
+	Match   string `json:"match,omitempty"` // "contains" (the default) or "regexp"
+	Pattern string `json:"pattern"`
+	Name    string `json:"name"`
+
+	re *regexp.Regexp
+}
+
+// LoadProductAliases reads an array of {"match", "pattern", "name"} objects
+// from a JSON file such as aliases.json. A missing file yields no aliases.
+func LoadProductAliases(path string) ([]ProductAlias, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var aliases []ProductAlias
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range aliases {
+		if err := aliases[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return aliases, nil
+}
+
+func (a *ProductAlias) compile() error {
+	if a.Pattern == "" || strings.TrimSpace(a.Name) == "" {
+		return fmt.Errorf("alias %q: pattern and name are required", a.Pattern)
+	}
+	switch a.Match {
+	case "", "contains":
+	case "regexp":
+		re, err := regexp.Compile("(?i)" + a.Pattern)
+		if err != nil {
+			return fmt.Errorf("alias %q: %w", a.Pattern, err)
+		}
+		a.re = re
+	default:
+		return fmt.Errorf("alias %q: unknown match type %q", a.Pattern, a.Match)
+	}
+	return nil
+}
+
+func (a *ProductAlias) matches(name string) bool {
+	if a.re != nil {
+		return a.re.MatchString(name)
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(a.Pattern))
+}
+
+// NormalizationRules returns the rules applied to names none of aliases
+// matches: DefaultNormalizationRules, unless there are aliases, which
+// replace the built-in rules.
+func NormalizationRules(aliases []ProductAlias) []NormalizationRule {
+	if aliases != nil {
+		return nil
+	}
+	return DefaultNormalizationRules
+}
+
+// productKey returns the key name is grouped under and, when one of aliases
+// matched, the name the group is shown as. The first matching alias wins.
+func productKey(name string, aliases []ProductAlias, rules []NormalizationRule) (key, alias string) {
+	for i := range aliases {
+		if aliases[i].matches(name) {
+			return NormalizeProductNameWithRules(aliases[i].Name, nil), aliases[i].Name
+		}
+	}
+	return NormalizeProductNameWithRules(name, rules), ""
+}
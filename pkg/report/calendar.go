@@ -0,0 +1,60 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// icsEscaper escapes the characters RFC 5545 reserves in text values.
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// GenerateShipmentsICS writes an iCalendar file with an all-day event for
+// each shipment still on its way, spanning its estimated arrival window.
+func GenerateShipmentsICS(shippedOrders []*ShippedOrder, path string) error {
+	return createFile(path, "ics", func(w io.Writer) error {
+		return GenerateShipmentsICSTo(w, shippedOrders)
+	})
+}
+
+// GenerateShipmentsICSTo writes the calendar of GenerateShipmentsICS to out.
+// Shipments already delivered, or whose arrival text held no date, are left
+// out. Events are ordered by the start of their window, like SortShipments.
+func GenerateShipmentsICSTo(out io.Writer, shippedOrders []*ShippedOrder) error {
+	w := bufio.NewWriter(out)
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	line := func(s string) { w.WriteString(s + "\r\n") }
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//walmart-order-checker//shipments//EN")
+	line("CALSCALE:GREGORIAN")
+	for _, s := range SortShipments(shippedOrders) {
+		if s.Delivered() || s.ArrivalStart.IsZero() {
+			continue
+		}
+		end := s.ArrivalEnd
+		if end.Before(s.ArrivalStart) {
+			end = s.ArrivalStart
+		}
+		description := fmt.Sprintf("%s tracking number %s. %s", s.Carrier, s.TrackingNumber, strings.TrimSpace(s.EstimatedArrival))
+		line("BEGIN:VEVENT")
+		line("UID:" + icsEscaper.Replace(s.ID+"-"+s.TrackingNumber) + "@walmart-order-checker")
+		line("DTSTAMP:" + stamp)
+		line("DTSTART;VALUE=DATE:" + s.ArrivalStart.Format("20060102"))
+		// DTEND is exclusive, so an event ending on the last day of the
+		// window ends the day after it.
+		line("DTEND;VALUE=DATE:" + end.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:" + icsEscaper.Replace("Walmart order "+FormatOrderID(s.ID)+" arrives"))
+		line("DESCRIPTION:" + icsEscaper.Replace(strings.TrimSpace(description)))
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write calendar: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateShipmentsICSTo(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2025, m, d, 0, 0, 0, 0, time.Local) }
+	shipped := []*ShippedOrder{
+		{ID: "200012345678901", TrackingNumber: "1Z999", Carrier: "UPS", EstimatedArrival: "Arrives Mon–Wed, Jan 6–8", ArrivalStart: day(1, 6), ArrivalEnd: day(1, 8)},
+		{ID: "200012345678902", TrackingNumber: "7777", Carrier: "FedEx", EstimatedArrival: "Arrives Jan 3", ArrivalStart: day(1, 3), ArrivalEnd: day(1, 3)},
+		{ID: "200012345678903", TrackingNumber: "8888", EstimatedArrival: "Arrives soon"},
+		{ID: "200012345678904", TrackingNumber: "DELIVERED", Carrier: "Delivered", ArrivalStart: day(1, 2), DeliveredAt: day(1, 2)},
+	}
+
+	var buf bytes.Buffer
+	if err := GenerateShipmentsICSTo(&buf, shipped); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	if !strings.HasPrefix(out, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(out, "END:VCALENDAR\r\n") {
+		t.Fatalf("not a CRLF-terminated calendar:\n%s", out)
+	}
+	if n := strings.Count(out, "BEGIN:VEVENT"); n != 2 {
+		t.Fatalf("got %d events, want 2 (undated and delivered shipments left out)", n)
+	}
+	// The earlier arrival comes first; DTEND is the day after the window.
+	for _, want := range []string{
+		"DTSTART;VALUE=DATE:20250103\r\nDTEND;VALUE=DATE:20250104\r\nSUMMARY:Walmart order 2000123-45678902 arrives",
+		"DTSTART;VALUE=DATE:20250106\r\nDTEND;VALUE=DATE:20250109\r\nSUMMARY:Walmart order 2000123-45678901 arrives",
+		`DESCRIPTION:UPS tracking number 1Z999. Arrives Mon–Wed\, Jan 6–8`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("calendar lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "20250103") > strings.Index(out, "20250106") {
+		t.Error("events aren't ordered by arrival")
+	}
+}
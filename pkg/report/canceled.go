@@ -0,0 +1,104 @@
+package report
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// CanceledOrder is an order Walmart canceled, in whole or in part.
+type CanceledOrder struct {
+	ID        string
+	OrderDate string
+	Total     string
+	// Items are the canceled items: all of the order's, or for a partial
+	// cancellation only those dropped from it.
+	Items   []Item
+	Partial bool
+	Reason  string // an Order.CancelReason
+
+	dateParsed time.Time
+}
+
+// CanceledOrders lists the canceled orders and the orders with canceled
+// items, newest first.
+func CanceledOrders(orders map[string]*Order) []CanceledOrder {
+	var list []CanceledOrder
+	for _, o := range orders {
+		c := CanceledOrder{ID: o.ID, OrderDate: o.OrderDate, Total: o.Total, Reason: o.CancelReason, dateParsed: o.OrderDateParsed}
+		switch {
+		case o.Status == "canceled":
+			c.Items = o.Items
+		case len(o.CanceledItems) > 0:
+			c.Items = o.CanceledItems
+			c.Partial = true
+		default:
+			continue
+		}
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b CanceledOrder) int {
+		if c := b.dateParsed.Compare(a.dateParsed); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// ReasonLabel describes Reason for people; it is empty when the reason isn't
+// known.
+func (c CanceledOrder) ReasonLabel() string {
+	switch c.Reason {
+	case CancelReasonWalmart:
+		return "Canceled by Walmart"
+	case CancelReasonPaymentFailed:
+		return "Payment failed"
+	}
+	return ""
+}
+
+func GenerateCanceledCSV(orders map[string]*Order, path string) error {
+	return createFile(path, "csv", func(w io.Writer) error {
+		return GenerateCanceledCSVTo(w, orders)
+	})
+}
+
+// GenerateCanceledCSVTo writes one line per canceled item, whether its whole
+// order was canceled or only the item. A canceled order whose items were
+// never seen gets a single line without an item.
+func GenerateCanceledCSVTo(out io.Writer, orders map[string]*Order) error {
+	w := csv.NewWriter(out)
+
+	if err := w.Write([]string{"Order ID", "Order Date", "Order Total", "Item Name", "Quantity", "Canceled", "Reason"}); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	for _, c := range CanceledOrders(orders) {
+		scope := "Order"
+		if c.Partial {
+			scope = "Item"
+		}
+		items := c.Items
+		if len(items) == 0 {
+			items = []Item{{}}
+		}
+		for _, item := range items {
+			qty := ""
+			if item.Quantity > 0 {
+				qty = fmt.Sprintf("%d", item.Quantity)
+			}
+			rec := []string{FormatOrderID(c.ID), c.OrderDate, c.Total, item.Name, qty, scope, c.ReasonLabel()}
+			if err := w.Write(rec); err != nil {
+				return fmt.Errorf("write row: %w", err)
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
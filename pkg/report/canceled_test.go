@@ -0,0 +1,76 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"slices"
+	"testing"
+	"time"
+)
+
+func canceledFixture() map[string]*Order {
+	return map[string]*Order{
+		"100000011111111": {
+			ID: "100000011111111", OrderDate: "Mar 2, 2025", OrderDateParsed: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC),
+			Total: "$20.00", Status: "canceled", CancelReason: CancelReasonWalmart,
+			Items: []Item{{Name: "Desk Lamp", Quantity: 1}},
+		},
+		"200000022222222": {
+			ID: "200000022222222", OrderDate: "Mar 1, 2025", OrderDateParsed: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+			Total: "$5.00", Status: "canceled", CancelReason: CancelReasonPaymentFailed,
+			Items: []Item{{Name: "Coffee Mug", Quantity: 1}},
+		},
+		"300000033333333": {
+			ID: "300000033333333", OrderDate: "Mar 3, 2025", OrderDateParsed: time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC),
+			Total: "$30.00", Status: "confirmed", CancelReason: CancelReasonWalmart,
+			Items:         []Item{{Name: "Area Rug", Quantity: 1}},
+			CanceledItems: []Item{{Name: "Coffee Mug", Quantity: 2}},
+		},
+		"400000044444444": {ID: "400000044444444", Total: "$9.00", Status: "delivered", Items: []Item{{Name: "Area Rug", Quantity: 1}}},
+	}
+}
+
+func TestGenerateCanceledCSVTo(t *testing.T) {
+	var buf bytes.Buffer
+	if err := GenerateCanceledCSVTo(&buf, canceledFixture()); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Order ID", "Order Date", "Order Total", "Item Name", "Quantity", "Canceled", "Reason"},
+		{"3000000-33333333", "Mar 3, 2025", "$30.00", "Coffee Mug", "2", "Item", "Canceled by Walmart"},
+		{"1000000-11111111", "Mar 2, 2025", "$20.00", "Desk Lamp", "1", "Order", "Canceled by Walmart"},
+		{"2000000-22222222", "Mar 1, 2025", "$5.00", "Coffee Mug", "1", "Order", "Payment failed"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d:\n%q", len(rows), len(want), rows)
+	}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestCancelStatsByReason(t *testing.T) {
+	orders := canceledFixture()
+
+	stats := CalculateEmailStats(orders, 0)
+	if stats.TotalCanceled != 2 || stats.CanceledByWalmart != 1 || stats.CanceledPaymentFailed != 1 {
+		t.Errorf("EmailStats canceled %d (Walmart %d, payment %d), want 2 (1, 1)",
+			stats.TotalCanceled, stats.CanceledByWalmart, stats.CanceledPaymentFailed)
+	}
+
+	for _, s := range CalculateProductStats(orders) {
+		if s.Name != "Coffee Mug" {
+			continue
+		}
+		if s.TotalOrdered != 3 || s.TotalCanceled != 3 || s.CanceledByWalmart != 2 || s.CanceledPaymentFailed != 1 {
+			t.Errorf("Coffee Mug: ordered %d, canceled %d (Walmart %d, payment %d); want 3, 3 (2, 1)",
+				s.TotalOrdered, s.TotalCanceled, s.CanceledByWalmart, s.CanceledPaymentFailed)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package report
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateLayout is how DateRange bounds are written on the command line.
+const DateLayout = "2006-01-02"
+
+// DateRange is the window of email a scan covers: the last Days days or, when
+// either bound is set, the calendar days Since through Until.
+type DateRange struct {
+	Days  int
+	Since time.Time // first day included; zero leaves the start open
+	Until time.Time // last day included; zero means up to today
+}
+
+// LastDays is the rolling window of the last days days.
+func LastDays(days int) DateRange {
+	return DateRange{Days: days}
+}
+
+// ParseDateRange builds an absolute range from since and until, either of
+// which may be empty but not both.
+func ParseDateRange(since, until string) (DateRange, error) {
+	var r DateRange
+	if since == "" && until == "" {
+		return r, fmt.Errorf("a date range needs a start or an end date")
+	}
+	var err error
+	if since != "" {
+		if r.Since, err = time.ParseInLocation(DateLayout, since, time.Local); err != nil {
+			return r, fmt.Errorf("invalid start date %q (want YYYY-MM-DD)", since)
+		}
+	}
+	if until != "" {
+		if r.Until, err = time.ParseInLocation(DateLayout, until, time.Local); err != nil {
+			return r, fmt.Errorf("invalid end date %q (want YYYY-MM-DD)", until)
+		}
+	}
+	if !r.Since.IsZero() && !r.Until.IsZero() && r.Since.After(r.Until) {
+		return r, fmt.Errorf("start date %s is after end date %s", since, until)
+	}
+	return r, nil
+}
+
+// Absolute reports whether r is bounded by dates rather than a day count.
+func (r DateRange) Absolute() bool {
+	return !r.Since.IsZero() || !r.Until.IsZero()
+}
+
+// Bounds returns the first and last day r covers as of now. start is zero
+// for a range with an open start.
+func (r DateRange) Bounds(now time.Time) (start, end time.Time) {
+	if !r.Absolute() {
+		return now.AddDate(0, 0, -r.Days), now
+	}
+	end = now
+	if !r.Until.IsZero() {
+		end = r.Until
+	}
+	return r.Since, end
+}
+
+// Label describes r for the top of a report.
+func (r DateRange) Label() string {
+	start, end := r.Bounds(time.Now())
+	if start.IsZero() {
+		return fmt.Sprintf("Email Scan Range: through %s", end.Format("Jan 2, 2006"))
+	}
+	days := r.Days
+	if r.Absolute() {
+		days = int(end.Sub(start).Hours()/24+0.5) + 1
+	}
+	return fmt.Sprintf(
+		"Email Scan Range: %s to %s (%d days)",
+		start.Format("Jan 2, 2006"),
+		end.Format("Jan 2, 2006"),
+		days,
+	)
+}
@@ -0,0 +1,170 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FulfillmentBuckets are the upper bounds, in whole days, of the fulfillment
+// time distribution. Anything longer lands in a final open-ended bucket.
+var FulfillmentBuckets = []int{1, 3, 7, 14, 30}
+
+// DurationStats summarizes a set of durations measured in days.
+type DurationStats struct {
+	Count   int
+	AvgDays float64
+	MinDays float64
+	MaxDays float64
+	// Distribution[i] counts durations of at most FulfillmentBuckets[i] days
+	// (and more than the previous bound); the last entry counts the rest.
+	Distribution []int
+}
+
+// FulfillmentTimes holds order→ship and ship→delivery statistics.
+type FulfillmentTimes struct {
+	OrderToShip     DurationStats
+	ShipToDelivered DurationStats
+}
+
+type ProductFulfillment struct {
+	Name string
+	FulfillmentTimes
+}
+
+type FulfillmentSummary struct {
+	Overall    FulfillmentTimes
+	PerProduct []ProductFulfillment
+}
+
+type durationSamples struct {
+	orderToShip     []float64
+	shipToDelivered []float64
+}
+
+// CalculateFulfillment measures how long non-canceled orders took to ship and
+// then arrive. The ship time is when the first "Shipped" email for an order was
+// received and the delivery time when the last "Delivered"/"Arrived" email was.
+// Orders missing either end of an interval are left out of that interval.
+func CalculateFulfillment(orders map[string]*Order, shipped []*ShippedOrder) FulfillmentSummary {
+	shippedAt := make(map[string]time.Time)
+	deliveredAt := make(map[string]time.Time)
+	for _, s := range shipped {
+		if t := s.ShippedAt; !t.IsZero() {
+			if cur, ok := shippedAt[s.ID]; !ok || t.Before(cur) {
+				shippedAt[s.ID] = t
+			}
+		}
+		if t := s.DeliveredAt; !t.IsZero() && t.After(deliveredAt[s.ID]) {
+			deliveredAt[s.ID] = t
+		}
+	}
+
+	var overall durationSamples
+	perProduct := make(map[string]*durationSamples)
+	for _, order := range orders {
+		if order.Status == "canceled" {
+			continue
+		}
+		shipTime, hasShip := shippedAt[order.ID]
+		if !hasShip {
+			continue
+		}
+
+		var toShip, toDeliver float64
+		hasToShip := !order.OrderDateParsed.IsZero() && !shipTime.Before(order.OrderDateParsed)
+		if hasToShip {
+			toShip = days(shipTime.Sub(order.OrderDateParsed))
+			overall.orderToShip = append(overall.orderToShip, toShip)
+		}
+		deliverTime, hasDeliver := deliveredAt[order.ID]
+		hasDeliver = hasDeliver && !deliverTime.Before(shipTime)
+		if hasDeliver {
+			toDeliver = days(deliverTime.Sub(shipTime))
+			overall.shipToDelivered = append(overall.shipToDelivered, toDeliver)
+		}
+
+		seen := make(map[string]bool)
+		for _, item := range order.Items {
+			if seen[item.Name] {
+				continue
+			}
+			seen[item.Name] = true
+			p := perProduct[item.Name]
+			if p == nil {
+				p = &durationSamples{}
+				perProduct[item.Name] = p
+			}
+			if hasToShip {
+				p.orderToShip = append(p.orderToShip, toShip)
+			}
+			if hasDeliver {
+				p.shipToDelivered = append(p.shipToDelivered, toDeliver)
+			}
+		}
+	}
+
+	summary := FulfillmentSummary{Overall: overall.times()}
+	for name, samples := range perProduct {
+		summary.PerProduct = append(summary.PerProduct, ProductFulfillment{Name: name, FulfillmentTimes: samples.times()})
+	}
+	sort.Slice(summary.PerProduct, func(i, j int) bool {
+		a, b := summary.PerProduct[i].OrderToShip, summary.PerProduct[j].OrderToShip
+		if a.AvgDays != b.AvgDays {
+			return a.AvgDays > b.AvgDays
+		}
+		return summary.PerProduct[i].Name < summary.PerProduct[j].Name
+	})
+	return summary
+}
+
+func (d durationSamples) times() FulfillmentTimes {
+	return FulfillmentTimes{
+		OrderToShip:     summarizeDays(d.orderToShip),
+		ShipToDelivered: summarizeDays(d.shipToDelivered),
+	}
+}
+
+func summarizeDays(samples []float64) DurationStats {
+	stats := DurationStats{Count: len(samples), Distribution: make([]int, len(FulfillmentBuckets)+1)}
+	if len(samples) == 0 {
+		return stats
+	}
+	stats.MinDays, stats.MaxDays = samples[0], samples[0]
+	var total float64
+	for _, d := range samples {
+		total += d
+		stats.MinDays = min(stats.MinDays, d)
+		stats.MaxDays = max(stats.MaxDays, d)
+		bucket := len(FulfillmentBuckets)
+		for i, bound := range FulfillmentBuckets {
+			if d <= float64(bound) {
+				bucket = i
+				break
+			}
+		}
+		stats.Distribution[bucket]++
+	}
+	stats.AvgDays = total / float64(len(samples))
+	return stats
+}
+
+func days(d time.Duration) float64 {
+	return d.Hours() / 24
+}
+
+// FulfillmentBucketLabels names the Distribution buckets, e.g. "≤1d", "2–3d",
+// "31d+".
+func FulfillmentBucketLabels() []string {
+	labels := make([]string, 0, len(FulfillmentBuckets)+1)
+	prev := 0
+	for _, bound := range FulfillmentBuckets {
+		if prev == 0 {
+			labels = append(labels, fmt.Sprintf("≤%dd", bound))
+		} else {
+			labels = append(labels, fmt.Sprintf("%d–%dd", prev+1, bound))
+		}
+		prev = bound
+	}
+	return append(labels, fmt.Sprintf("%dd+", prev+1))
+}
@@ -0,0 +1,211 @@
+package report
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultImageWorkers = 8
+	DefaultImageTimeout = 15 * time.Second
+	// DefaultInlineBudget caps the whole InlineImages pass so a batch of slow
+	// image hosts cannot hold up report generation indefinitely.
+	DefaultInlineBudget = 2 * time.Minute
+	maxImageBytes       = 512 << 10
+	maxImageRedirects   = 10
+)
+
+var templateFuncs = template.FuncMap{
+	"imgsrc": imageSource,
+}
+
+// imageSource lets inlined data:image URIs through html/template, which would
+// otherwise replace them with "#ZgotmplZ". Everything else is escaped as usual.
+func imageSource(src string) any {
+	if strings.HasPrefix(src, "data:image/") {
+		return template.URL(src)
+	}
+	return src
+}
+
+// Image is a downloaded item image.
+type Image struct {
+	ContentType string
+	Data        []byte
+}
+
+// DataURI returns the image as a base64 data URI.
+func (img *Image) DataURI() string {
+	return "data:" + img.ContentType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+}
+
+// ImageFetcher downloads item images with bounded concurrency. At most
+// `workers` downloads are in flight at once across all callers, and each one is
+// limited to `timeout`.
+type ImageFetcher struct {
+	client  *http.Client
+	sem     chan struct{}
+	timeout time.Duration
+	// allow, when set, must accept the URL and every redirect it leads to.
+	allow func(*url.URL) bool
+}
+
+func NewImageFetcher(workers int, timeout time.Duration) *ImageFetcher {
+	if workers < 1 {
+		workers = DefaultImageWorkers
+	}
+	if timeout <= 0 {
+		timeout = DefaultImageTimeout
+	}
+	f := &ImageFetcher{
+		sem:     make(chan struct{}, workers),
+		timeout: timeout,
+	}
+	f.client = &http.Client{CheckRedirect: f.checkRedirect}
+	return f
+}
+
+// RestrictURLs makes f refuse any image URL that allow rejects, and any
+// redirect to one, so an allowed host can't bounce a request elsewhere.
+func (f *ImageFetcher) RestrictURLs(allow func(*url.URL) bool) {
+	f.allow = allow
+}
+
+func (f *ImageFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxImageRedirects {
+		return errors.New("too many redirects")
+	}
+	if f.allow != nil && !f.allow(req.URL) {
+		return fmt.Errorf("redirect to %s not allowed", req.URL.Redacted())
+	}
+	return nil
+}
+
+// Fetch downloads a single image. It waits for a free slot, so it returns
+// ctx.Err() if ctx ends before the download could start.
+func (f *ImageFetcher) Fetch(ctx context.Context, url string) (*Image, error) {
+	select {
+	case f.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-f.sem }()
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.allow != nil && !f.allow(req.URL) {
+		return nil, fmt.Errorf("%s not allowed", req.URL.Redacted())
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image larger than %d bytes", maxImageBytes)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("not an image (%s)", contentType)
+	}
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return &Image{ContentType: contentType, Data: data}, nil
+}
+
+// FetchAll downloads urls concurrently and returns the images that succeeded.
+// Failures are logged and skipped; once ctx ends the remaining downloads are
+// abandoned.
+func (f *ImageFetcher) FetchAll(ctx context.Context, urls []string) map[string]*Image {
+	images := make(map[string]*Image, len(urls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			img, err := f.Fetch(ctx, url)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("fetch image %s: %v", url, err)
+				}
+				return
+			}
+			mu.Lock()
+			images[url] = img
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return images
+}
+
+// InlineImages downloads every item image referenced by orders and replaces its
+// URL with a base64 data URI so the HTML report is self-contained. Images that
+// fail to download, are not images, or exceed the size limit keep their remote
+// URL. It returns the number of distinct images inlined.
+func InlineImages(orders map[string]*Order) int {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultInlineBudget)
+	defer cancel()
+	return InlineImagesWith(ctx, orders, NewImageFetcher(DefaultImageWorkers, DefaultImageTimeout))
+}
+
+// InlineImagesWith is InlineImages using the given fetcher. Images not
+// downloaded by the time ctx ends keep their remote URL.
+func InlineImagesWith(ctx context.Context, orders map[string]*Order, fetcher *ImageFetcher) int {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, order := range orders {
+		for _, item := range order.Items {
+			if item.ImageURL != "" && !strings.HasPrefix(item.ImageURL, "data:") && !seen[item.ImageURL] {
+				seen[item.ImageURL] = true
+				urls = append(urls, item.ImageURL)
+			}
+		}
+	}
+
+	images := fetcher.FetchAll(ctx, urls)
+	if ctx.Err() != nil {
+		log.Printf("inline images: stopped after %d of %d: %v", len(images), len(urls), ctx.Err())
+	}
+
+	for _, order := range orders {
+		for i := range order.Items {
+			if img := images[order.Items[i].ImageURL]; img != nil {
+				order.Items[i].ImageURL = img.DataURI()
+			}
+		}
+	}
+	return len(images)
+}
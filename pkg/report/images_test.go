@@ -0,0 +1,59 @@
+package report
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+var pngBytes = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestImageFetcherRefusesRedirectToDisallowedHost(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the disallowed host")
+		w.Write(pngBytes)
+	}))
+	defer internal.Close()
+
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, internal.URL+"/secret", http.StatusFound)
+		case "/hop":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngBytes)
+		}
+	}))
+	defer allowed.Close()
+
+	allowedHost := mustParseURL(t, allowed.URL).Host
+	f := NewImageFetcher(1, DefaultImageTimeout)
+	f.RestrictURLs(func(u *url.URL) bool { return u.Host == allowedHost })
+
+	if _, err := f.Fetch(context.Background(), allowed.URL+"/redirect"); err == nil {
+		t.Error("Fetch followed a redirect to a disallowed host")
+	}
+	if _, err := f.Fetch(context.Background(), internal.URL+"/secret"); err == nil {
+		t.Error("Fetch allowed a disallowed host")
+	}
+	img, err := f.Fetch(context.Background(), allowed.URL+"/hop")
+	if err != nil {
+		t.Fatalf("Fetch of a redirect within the allowed host: %v", err)
+	}
+	if img.ContentType != "image/png" {
+		t.Errorf("ContentType = %q, want image/png", img.ContentType)
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,121 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MarkdownOptions carries the optional parts of the Markdown report.
+type MarkdownOptions struct {
+	// DaysScanned adds the scan range under the title when non-zero.
+	DaysScanned int
+	// SpendMode is SpendTotal (the default) or SpendMerchandise.
+	SpendMode string
+	// Region sets how money is shown; the zero value is RegionUS.
+	Region Region
+	// Range, when absolute, is shown instead of the last DaysScanned days.
+	Range DateRange
+	// Aliases group product names as in HTMLOptions.
+	Aliases []ProductAlias
+}
+
+// GenerateMarkdown writes a Markdown summary meant for pasting into forums
+// and chat: spend by product, live orders and shipments as pipe tables.
+func GenerateMarkdown(orders map[string]*Order, shipped []*ShippedOrder, path string) error {
+	return createFile(path, "markdown", func(w io.Writer) error {
+		return RenderMarkdown(w, orders, shipped, MarkdownOptions{})
+	})
+}
+
+// RenderMarkdown writes the summary of GenerateMarkdown to out. Its figures
+// are computed the same way as the HTML report's.
+func RenderMarkdown(out io.Writer, orders map[string]*Order, shipped []*ShippedOrder, opts MarkdownOptions) error {
+	normalizeProductNames(orders, opts.Aliases)
+	nonCanceled := filterNonCanceled(orders)
+	learned := LearnPricesWithMode(nonCanceled, opts.SpendMode)
+	productSummaries := buildProductSummaries(nonCanceled, learned)
+	liveOrders := PrepareOrderDetails(filterLiveOrders(nonCanceled, shipped), learned)
+	money := opts.Region.FormatAmount
+
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "# Walmart Order Summary")
+	if opts.Range.Absolute() {
+		fmt.Fprintf(w, "\n_%s_\n", opts.Range.Label())
+	} else if opts.DaysScanned > 0 {
+		fmt.Fprintf(w, "\n_%s_\n", LastDays(opts.DaysScanned).Label())
+	}
+
+	fmt.Fprintln(w, "\n## Spend by Product")
+	rows := make([][]string, 0, len(productSummaries))
+	for _, p := range productSummaries {
+		spent := money(p.TotalSpent)
+		if p.Refunded > 0 {
+			spent += " (−" + money(p.Refunded) + " refunded)"
+		}
+		rows = append(rows, []string{p.Name, strconv.Itoa(p.TotalUnits), money(p.PricePerUnit), spent})
+	}
+	writeMarkdownTable(w, []string{"Product", "Units", "Price / Unit (Est.)", "Total Spent (Est.)"}, "lrrr", rows)
+
+	fmt.Fprintln(w, "\n## Live Orders")
+	rows = make([][]string, 0, len(liveOrders))
+	for _, o := range liveOrders {
+		id := o.OrderID
+		if o.WasPreorder {
+			id += " (preorder)"
+		}
+		rows = append(rows, []string{o.OrderDate, id, o.Name, strconv.Itoa(o.Quantity), o.Total})
+	}
+	writeMarkdownTable(w, []string{"Order Date", "Order #", "Product", "Qty", "Line Total (Est.)"}, "lllrr", rows)
+
+	fmt.Fprintln(w, "\n## Shipments")
+	shipped = SortShipments(shipped)
+	rows = make([][]string, 0, len(shipped))
+	for _, s := range shipped {
+		arrival := s.EstimatedArrival
+		if s.Delivered() {
+			arrival = strings.TrimSpace("Delivered " + s.DeliveredDate)
+		}
+		rows = append(rows, []string{FormatOrderID(s.ID), s.Carrier, s.TrackingNumber, arrival})
+	}
+	writeMarkdownTable(w, []string{"Order #", "Carrier", "Tracking #", "Estimated Arrival"}, "llll", rows)
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write markdown: %w", err)
+	}
+	return nil
+}
+
+// writeMarkdownTable writes a GitHub-flavored pipe table; align holds an 'l'
+// or 'r' per column. An empty table is written as a note instead.
+func writeMarkdownTable(w io.Writer, header []string, align string, rows [][]string) {
+	if len(rows) == 0 {
+		fmt.Fprintln(w, "\n_None._")
+		return
+	}
+	fmt.Fprintln(w)
+	writeMarkdownRow(w, header)
+	sep := make([]string, len(header))
+	for i := range sep {
+		sep[i] = "---"
+		if align[i] == 'r' {
+			sep[i] = "---:"
+		}
+	}
+	writeMarkdownRow(w, sep)
+	for _, row := range rows {
+		writeMarkdownRow(w, row)
+	}
+}
+
+var markdownCellEscaper = strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+
+func writeMarkdownRow(w io.Writer, cells []string) {
+	escaped := make([]string, len(cells))
+	for i, c := range cells {
+		escaped[i] = markdownCellEscaper.Replace(c)
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+}
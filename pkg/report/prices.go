@@ -0,0 +1,109 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// LearnedPrices returns the unit prices the reports estimate for orders,
+// rounded to cents and keyed by product name as grouped under aliases.
+func LearnedPrices(orders map[string]*Order, spendMode string, aliases []ProductAlias) map[string]float64 {
+	normalizeProductNames(orders, aliases)
+	learned := LearnPricesWithMode(filterNonCanceled(orders), spendMode)
+	for name, price := range learned {
+		learned[name] = math.Round(price*100) / 100
+	}
+	return learned
+}
+
+// ExportLearnedPrices writes the unit prices the reports estimate, as a JSON
+// object of product name to price. Edited, it can be sent back as the
+// price_overrides of a report recompute.
+func ExportLearnedPrices(orders map[string]*Order, spendMode string, aliases []ProductAlias, path string) error {
+	return createFile(path, "json", func(w io.Writer) error {
+		return ExportLearnedPricesTo(w, orders, spendMode, aliases)
+	})
+}
+
+func ExportLearnedPricesTo(out io.Writer, orders map[string]*Order, spendMode string, aliases []ProductAlias) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(LearnedPrices(orders, spendMode, aliases)); err != nil {
+		return fmt.Errorf("write learned prices: %w", err)
+	}
+	return nil
+}
+
+var priceHistoryHeader = []string{"timestamp", "product", "price_per_unit"}
+
+// AppendPriceHistory adds a row per product to the price history CSV at path,
+// creating it if needed. Products whose price is unchanged since their last
+// row are skipped, so the file only grows when a price moves.
+func AppendPriceHistory(learned map[string]float64, path string) error {
+	last := make(map[string]string)
+	existing, err := os.Open(path)
+	switch {
+	case err == nil:
+		records, err := csv.NewReader(existing).ReadAll()
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("read price history: %w", err)
+		}
+		if len(records) > 0 && !slices.Equal(records[0], priceHistoryHeader) {
+			return fmt.Errorf("%s is not a price history CSV", path)
+		}
+		for _, rec := range records[1:] {
+			if len(rec) == len(priceHistoryHeader) {
+				last[rec[1]] = rec[2]
+			}
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("open price history: %w", err)
+	}
+
+	names := make([]string, 0, len(learned))
+	for name := range learned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open price history: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("open price history: %w", err)
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		if err := w.Write(priceHistoryHeader); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, name := range names {
+		price := strconv.FormatFloat(learned[name], 'f', 2, 64)
+		if last[name] == price {
+			continue
+		}
+		if err := w.Write([]string{now, name, price}); err != nil {
+			return fmt.Errorf("write row: %w", err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return f.Close()
+}
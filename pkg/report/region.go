@@ -0,0 +1,126 @@
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Region is a Walmart storefront: how its emails write money and dates, and
+// how reports should show them.
+type Region struct {
+	Code     string // ISO 3166 country code, e.g. "US"
+	Currency string // ISO 4217 currency code, e.g. "USD"
+	// Symbol is written before amounts in reports. Emails themselves may use
+	// a bare "$" either way; parsing doesn't depend on it.
+	Symbol string
+	// DateLayouts are the forms the "Order date:" line takes, tried in order.
+	DateLayouts []string
+}
+
+var (
+	RegionUS = Region{
+		Code:        "US",
+		Currency:    "USD",
+		Symbol:      "$",
+		DateLayouts: []string{"Mon, Jan 2, 2006"},
+	}
+	RegionCA = Region{
+		Code:     "CA",
+		Currency: "CAD",
+		Symbol:   "CA$",
+		DateLayouts: []string{
+			"Mon, Jan 2, 2006",
+			"Monday, January 2, 2006",
+			"January 2, 2006",
+			"2 January 2006",
+			"2006-01-02",
+		},
+	}
+)
+
+// ParseRegion looks up a region by country code; empty means RegionUS.
+func ParseRegion(code string) (Region, error) {
+	switch strings.ToUpper(strings.TrimSpace(code)) {
+	case "", "US":
+		return RegionUS, nil
+	case "CA":
+		return RegionCA, nil
+	}
+	return Region{}, fmt.Errorf("unknown region %q (want US or CA)", code)
+}
+
+func (r Region) symbol() string {
+	if r.Symbol == "" {
+		return "$"
+	}
+	return r.Symbol
+}
+
+// FormatAmount writes v the way the region's reports show money.
+func (r Region) FormatAmount(v float64) string {
+	if v < 0 {
+		return "-" + r.symbol() + strconv.FormatFloat(-v, 'f', 2, 64)
+	}
+	return r.symbol() + strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// ParseDate parses an order date in any of the region's layouts.
+func (r Region) ParseDate(s string) (time.Time, bool) {
+	layouts := r.DateLayouts
+	if len(layouts) == 0 {
+		layouts = RegionUS.DateLayouts
+	}
+	s = strings.TrimSpace(s)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseAmount parses an amount such as "$1,234.56", "CA$12.00" or, as French
+// Canadian emails write it, "1 234,56 $". A comma followed by exactly two
+// final digits is taken as the decimal separator. Text holding anything more
+// than one number is rejected.
+func parseAmount(s string) (float64, bool) {
+	s = strings.NewReplacer("\u00a0", " ", "\u202f", " ").Replace(s)
+	start := strings.IndexAny(s, "0123456789")
+	if start < 0 {
+		return 0, false
+	}
+	end := start
+	for end < len(s) && strings.IndexByte("0123456789., ", s[end]) >= 0 {
+		end++
+	}
+	if strings.ContainsAny(s[end:], "0123456789") {
+		return 0, false
+	}
+	n := strings.ReplaceAll(strings.TrimSpace(s[start:end]), " ", "")
+	if i := strings.LastIndexByte(n, ','); i >= 0 && len(n)-i == 3 && !strings.Contains(n[i:], ".") {
+		n = strings.ReplaceAll(n[:i], ".", "") + "." + n[i+1:]
+	}
+	v, err := strconv.ParseFloat(strings.ReplaceAll(n, ",", ""), 64)
+	if err != nil {
+		return 0, false
+	}
+	if strings.ContainsAny(s[:start], "-−") {
+		v = -v
+	}
+	return v, true
+}
+
+// formatLike writes v with the currency notation of like, an amount taken
+// from the same order, so derived amounts match what the email showed.
+func formatLike(like string, v float64) string {
+	prefix := strings.TrimSpace(like)
+	if i := strings.IndexAny(prefix, "-0123456789"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if prefix == "" || len(prefix) > 4 {
+		prefix = "$"
+	}
+	return Region{Symbol: prefix}.FormatAmount(v)
+}
@@ -3,19 +3,46 @@ package report
 import (
 	_ "embed"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"math"
 	"os"
 	"regexp"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
+	"unicode"
 )
 
 //go:embed template.html
 var templateHTML string
 
+//go:embed template_compact.html
+var compactTemplateHTML string
+
+// HTML report variants.
+const (
+	VariantFull = "full"
+	// VariantCompact is a print-friendly report of orders and totals only,
+	// without images.
+	VariantCompact = "compact"
+)
+
+// ParseVariant checks an HTML report variant name; empty means VariantFull.
+func ParseVariant(s string) (string, error) {
+	switch s {
+	case "":
+		return VariantFull, nil
+	case VariantFull, VariantCompact:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown report variant %q (want %q or %q)", s, VariantFull, VariantCompact)
+}
+
 type Order struct {
 	ID               string
 	Items            []Item
@@ -23,9 +50,240 @@ type Order struct {
 	OrderDate        string
 	OrderDateParsed  time.Time
 	Status           string
+	WasPreorder      bool
 	TrackingNumber   string
 	Carrier          string
 	EstimatedArrival string
+	PaymentMethod    string // e.g. "Visa ending in 1234"; empty when not shown
+	// SourceAccounts lists the mailboxes the order was found in when several
+	// accounts are combined.
+	SourceAccounts []string
+	// ItemsUpdatedAt is when an "order updated" email last replaced Items;
+	// zero if the items are from the original confirmation.
+	ItemsUpdatedAt time.Time
+	// ConflictingTotals holds totals from other emails for this order that
+	// disagree with Total, which may point to a duplicate or wrong charge.
+	ConflictingTotals []string `json:",omitempty"`
+	// Tip, Fees and Tax are the driver tip, the summed fee lines and the tax
+	// included in Total, when the email itemized them.
+	Tip  string `json:",omitempty"`
+	Fees string `json:",omitempty"`
+	Tax  string `json:",omitempty"`
+	// Refunded is set once a refund email was seen for the order; RefundTotal
+	// sums the amounts those emails stated.
+	Refunded    bool   `json:",omitempty"`
+	RefundTotal string `json:",omitempty"`
+	// IsNew marks an order that the previous scan of the same mailbox did not
+	// find. See MarkNewOrders.
+	IsNew bool `json:",omitempty"`
+	// CanceledItems are items dropped from an order that otherwise went
+	// ahead. See ApplyCanceledItems.
+	CanceledItems []Item `json:",omitempty"`
+	// CancelReason says why the order or its CanceledItems were canceled:
+	// CancelReasonWalmart or CancelReasonPaymentFailed. Empty if not known.
+	CancelReason string `json:",omitempty"`
+}
+
+// Why an order was canceled; see Order.CancelReason.
+const (
+	CancelReasonWalmart       = "walmart_canceled"
+	CancelReasonPaymentFailed = "payment_failed"
+)
+
+// MarkNewOrders sets IsNew on every order whose ID is not in previous, and
+// returns the sorted IDs of orders to remember for the next scan. Pass a nil
+// previous on the first scan so that nothing is flagged.
+func MarkNewOrders(orders map[string]*Order, previous map[string]bool) []string {
+	ids := make([]string, 0, len(orders))
+	for id, o := range orders {
+		o.IsNew = previous != nil && !previous[id]
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// MergeTotal folds the total of another email for the same order into o. A
+// missing total is filled in; a different one is kept in ConflictingTotals
+// rather than dropped. Totals from "order updated" emails are expected to
+// differ and are handled by MergeItems instead.
+func (o *Order) MergeTotal(other *Order) {
+	for _, t := range other.ConflictingTotals {
+		o.addConflictingTotal(t)
+	}
+	switch {
+	case other.Total == "" || !other.ItemsUpdatedAt.IsZero():
+	case o.Total == "":
+		o.Total = other.Total
+		o.Tip, o.Fees, o.Tax = other.Tip, other.Fees, other.Tax
+	case !o.ItemsUpdatedAt.IsZero():
+	case o.Tip == "" && o.Fees == "" && o.Tax == "" && sameAmount(o.Total, other.Total):
+		o.Tip, o.Fees, o.Tax = other.Tip, other.Fees, other.Tax
+	default:
+		o.addConflictingTotal(other.Total)
+	}
+}
+
+func (o *Order) addConflictingTotal(total string) {
+	if sameAmount(total, o.Total) {
+		return
+	}
+	for _, t := range o.ConflictingTotals {
+		if sameAmount(t, total) {
+			return
+		}
+	}
+	o.ConflictingTotals = append(o.ConflictingTotals, total)
+}
+
+func sameAmount(a, b string) bool {
+	x, okA := parseAmount(a)
+	y, okB := parseAmount(b)
+	if okA && okB {
+		return math.Abs(x-y) < 0.005
+	}
+	return strings.TrimSpace(a) == strings.TrimSpace(b)
+}
+
+// TotalDiscrepancy is an order whose emails reported different totals.
+type TotalDiscrepancy struct {
+	OrderID string
+	Totals  []string
+}
+
+// FindTotalDiscrepancies lists orders with conflicting totals, by order ID.
+func FindTotalDiscrepancies(orders map[string]*Order) []TotalDiscrepancy {
+	var out []TotalDiscrepancy
+	for _, o := range orders {
+		if len(o.ConflictingTotals) > 0 {
+			out = append(out, TotalDiscrepancy{
+				OrderID: o.ID,
+				Totals:  append([]string{o.Total}, o.ConflictingTotals...),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OrderID < out[j].OrderID })
+	return out
+}
+
+// MergeItems folds the items of another email for the same order into o. Items
+// from an "order updated" email replace the list (the newest update wins) and
+// bring their total with them; otherwise items only fill in a missing list.
+func (o *Order) MergeItems(other *Order) {
+	switch {
+	case !other.ItemsUpdatedAt.IsZero():
+		if other.ItemsUpdatedAt.After(o.ItemsUpdatedAt) && len(other.Items) > 0 {
+			o.Items = other.Items
+			o.ItemsUpdatedAt = other.ItemsUpdatedAt
+			if other.Total != "" {
+				o.Total = other.Total
+				o.Tip, o.Fees, o.Tax = other.Tip, other.Fees, other.Tax
+			}
+		}
+	case len(o.Items) == 0:
+		o.Items = other.Items
+	}
+}
+
+// AddSourceAccounts records that the order was also seen in accounts.
+func (o *Order) AddSourceAccounts(accounts ...string) {
+	for _, a := range accounts {
+		if a != "" && !slices.Contains(o.SourceAccounts, a) {
+			o.SourceAccounts = append(o.SourceAccounts, a)
+		}
+	}
+}
+
+// MergeStatus folds the status of another email for the same order into o.
+// Emails that carry no status (such as order updates) leave it unchanged. A
+// cancellation is final, and a late-arriving preorder email never downgrades
+// an order that has already been confirmed. "shipped" only stands in for an
+// order whose confirmation wasn't seen, so any other status replaces it.
+// WasPreorder is kept whenever either side started out as a preorder, and
+// CancelReason follows the cancellation that decided the status.
+func (o *Order) MergeStatus(other *Order) {
+	if other.WasPreorder || other.Status == "pre-ordered" {
+		o.WasPreorder = true
+	}
+	if other.CancelReason != "" && (o.CancelReason == "" || other.Status == "canceled" && o.Status != "canceled") {
+		o.CancelReason = other.CancelReason
+	}
+	switch {
+	case other.Status == "":
+	case o.Status == "canceled":
+	case o.Status == "confirmed" && other.Status == "pre-ordered":
+	case o.Status != "" && other.Status == "shipped":
+	default:
+		o.Status = other.Status
+	}
+}
+
+// MergeRefund adds the refund carried by another email for the same order to
+// o. Each refund email covers separate items, so amounts are summed.
+func (o *Order) MergeRefund(other *Order) {
+	if !other.Refunded {
+		return
+	}
+	o.Refunded = true
+	add, ok := parseAmount(other.RefundTotal)
+	if !ok {
+		return
+	}
+	have, _ := parseAmount(o.RefundTotal)
+	o.RefundTotal = formatLike(other.RefundTotal, have+add)
+}
+
+// ApplyCanceledItems takes the items named by cancellation emails off
+// o.Items, leaving CanceledItems holding what was actually removed. Call it
+// once, after every email for the order has been merged. If nothing would be
+// left, the whole order is marked canceled instead, with its items kept as
+// ordered. Items replaced by an "order updated" email already reflect the
+// cancellation and are left alone.
+func (o *Order) ApplyCanceledItems() {
+	switch {
+	case len(o.CanceledItems) == 0:
+		return
+	case o.Status == "canceled":
+		o.CanceledItems = nil
+		return
+	case len(o.Items) == 0:
+		// The confirmation is outside the scan window.
+		o.Items, o.CanceledItems = o.CanceledItems, nil
+		o.Status = "canceled"
+		return
+	case !o.ItemsUpdatedAt.IsZero():
+		return
+	}
+
+	pending := make(map[string]int)
+	for _, c := range o.CanceledItems {
+		pending[c.Name] += c.Quantity
+	}
+	removed := make(map[string]int)
+	var remaining []Item
+	for _, item := range o.Items {
+		n := min(pending[item.Name], item.Quantity)
+		pending[item.Name] -= n
+		removed[item.Name] += n
+		if item.Quantity -= n; item.Quantity > 0 {
+			remaining = append(remaining, item)
+		}
+	}
+	if len(remaining) == 0 {
+		o.Status = "canceled"
+		o.CanceledItems = nil
+		return
+	}
+
+	var canceled []Item
+	for _, c := range o.CanceledItems {
+		if n := min(c.Quantity, removed[c.Name]); n > 0 {
+			removed[c.Name] -= n
+			c.Quantity = n
+			canceled = append(canceled, c)
+		}
+	}
+	o.Items, o.CanceledItems = remaining, canceled
 }
 
 type ShippedOrder struct {
@@ -33,12 +291,48 @@ type ShippedOrder struct {
 	TrackingNumber   string
 	Carrier          string
 	EstimatedArrival string
+	ArrivalStart     time.Time
+	ArrivalEnd       time.Time
+	// ShippedAt and DeliveredAt are when the shipping and delivery emails
+	// were received; zero when unknown.
+	ShippedAt   time.Time
+	DeliveredAt time.Time
+	// DeliveredDate is the delivery date as the delivery email wrote it, e.g.
+	// "Mon, Jan 6"; empty when the email gave none.
+	DeliveredDate string `json:",omitempty"`
+}
+
+// Delivered reports whether s comes from a delivery email rather than a
+// shipment still in transit.
+func (s *ShippedOrder) Delivered() bool {
+	return !s.DeliveredAt.IsZero() || s.DeliveredDate != ""
+}
+
+// SortShipments returns a copy of shipments ordered by the start of their
+// estimated arrival window. Shipments without a parsed arrival sort last.
+func SortShipments(shipments []*ShippedOrder) []*ShippedOrder {
+	out := append([]*ShippedOrder(nil), shipments...)
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i].ArrivalStart, out[j].ArrivalStart
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		return a.Before(b)
+	})
+	return out
 }
 
 type Item struct {
 	Name     string
 	Quantity int
 	ImageURL string
+	// Price is the line total from a PDF invoice, e.g. "$12.34". Order emails
+	// don't itemize prices, so it is empty unless invoice parsing is enabled.
+	Price string `json:",omitempty"`
+	// UnitPrice is the per-unit price printed next to the item in the order
+	// email, when it shows one. It leaves out tax and fees, so it only weighs
+	// an order's items against each other.
+	UnitPrice float64 `json:",omitempty"`
 }
 
 type ProductStats struct {
@@ -47,6 +341,10 @@ type ProductStats struct {
 	TotalOrdered  int
 	TotalCanceled int
 	CancelRate    float64
+	// CanceledByWalmart and CanceledPaymentFailed split TotalCanceled by
+	// CancelReason; units whose reason isn't known are in neither.
+	CanceledByWalmart     int
+	CanceledPaymentFailed int
 }
 
 type EmailStats struct {
@@ -54,63 +352,196 @@ type EmailStats struct {
 	TotalOrders      int
 	TotalCanceled    int
 	CancellationRate float64
+	// CanceledByWalmart and CanceledPaymentFailed split TotalCanceled by
+	// CancelReason.
+	CanceledByWalmart     int
+	CanceledPaymentFailed int
+	// TotalTax sums the itemized tax of orders that weren't canceled.
+	TotalTax float64
 }
 
 type TemplateData struct {
-	Stats            []ProductStats
-	EmailStats       EmailStats
-	Orders           []OrderDetail
-	ShippedOrders    []*ShippedOrder
-	DateRange        string
-	ProductSpend     []ProductSummary
-	ProductCancel    []ProductStats
-	OrderLines       []OrderDetail
-	Shipments        []*ShippedOrder
-	LiveOrders       []OrderDetail
-	LiveOrderSummary []ProductSummary
+	Stats              []ProductStats
+	EmailStats         EmailStats
+	Orders             []OrderDetail
+	ShippedOrders      []*ShippedOrder
+	DateRange          string
+	ProductSpend       []ProductSummary
+	ProductCancel      []ProductStats
+	OrderLines         []OrderDetail
+	Shipments          []*ShippedOrder
+	LiveOrders         []OrderDetail
+	LiveOrderSummary   []ProductSummary
+	Notices            []string
+	Fulfillment        FulfillmentSummary
+	FulfillmentBuckets []string
+	PaymentSpend       []PaymentMethodSpend
+	Discrepancies      []TotalDiscrepancy
+	Accounts           []AccountStatus
+	Canceled           []CanceledOrder
+}
+
+// HTMLOptions carries the optional parts of the HTML report.
+type HTMLOptions struct {
+	DaysScanned int
+	// Notices are shown in a banner at the top of the report, e.g. to flag
+	// accounts whose results are missing from a combined report.
+	Notices []string
+	// Accounts lists each account of a combined report and whether it was
+	// scanned in full.
+	Accounts []AccountStatus
+	// SpendMode is SpendTotal (the default) or SpendMerchandise.
+	SpendMode string
+	// Variant is VariantFull (the default) or VariantCompact.
+	Variant string
+	// Region sets how money is shown; the zero value is RegionUS.
+	Region Region
+	// Range, when absolute, is shown instead of the last DaysScanned days.
+	Range DateRange
+	// Aliases group product names in place of DefaultNormalizationRules;
+	// see NormalizeProductNames.
+	Aliases []ProductAlias
+}
+
+func (o HTMLOptions) dateRange() DateRange {
+	if o.Range.Absolute() {
+		return o.Range
+	}
+	return LastDays(o.DaysScanned)
 }
 
 type OrderDetail struct {
-	OrderID   string
-	OrderDate string
-	Thumbnail string
-	Name      string
-	Quantity  int
-	Total     string
+	OrderID     string
+	OrderDate   string
+	Thumbnail   string
+	Name        string
+	Quantity    int
+	Total       string
+	WasPreorder bool
+	IsNew       bool
+}
+
+type PaymentMethodSpend struct {
+	Method     string
+	Orders     int
+	TotalSpent float64
 }
 
 type ProductSummary struct {
 	Name         string
 	Thumbnail    string
 	TotalUnits   int
-	TotalSpent   float64
+	TotalSpent   float64 // net of Refunded
 	PricePerUnit float64
+	Refunded     float64
 }
 
 var nonAlnum = regexp.MustCompile("[^a-z0-9]+")
 
-func NormalizeProductName(name string) string {
+// NormalizationRule is a lowercase substring replacement applied to product
+// names before grouping.
+type NormalizationRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+var DefaultNormalizationRules = []NormalizationRule{
+	{Match: "pokemon trading card games", Replace: ""},
+	{Match: "pokemon", Replace: ""},
+	{Match: "scarlett violet", Replace: "sv"},
+	{Match: "evolutions", Replace: "evo"},
+	{Match: "suprise", Replace: "surprise"},
+}
+
+// NormalizeProductName returns the key name is grouped under, using aliases
+// or, without any, DefaultNormalizationRules.
+func NormalizeProductName(name string, aliases []ProductAlias) string {
+	key, _ := productKey(name, aliases, NormalizationRules(aliases))
+	return key
+}
+
+func NormalizeProductNameWithRules(name string, rules []NormalizationRule) string {
 	normalized := strings.ToLower(name)
-	normalized = strings.ReplaceAll(normalized, "pokemon trading card games", "")
-	normalized = strings.ReplaceAll(normalized, "pokemon", "")
-	normalized = strings.ReplaceAll(normalized, "scarlett violet", "sv")
-	normalized = strings.ReplaceAll(normalized, "evolutions", "evo")
-	normalized = strings.ReplaceAll(normalized, "suprise", "surprise")
+	for _, rule := range rules {
+		if rule.Match == "" {
+			continue
+		}
+		normalized = strings.ReplaceAll(normalized, strings.ToLower(rule.Match), strings.ToLower(rule.Replace))
+	}
 	normalized = nonAlnum.ReplaceAllString(normalized, "")
 	return normalized
 }
 
+// CanonicalOrderID returns the form order IDs are keyed by: no leading "#",
+// hyphens or spaces, so "#2000123-45678901" and "200012345678901" match.
+func CanonicalOrderID(raw string) string {
+	id := strings.TrimPrefix(strings.TrimSpace(raw), "#")
+	return strings.Join(strings.FieldsFunc(id, func(r rune) bool {
+		return r == '-' || unicode.IsSpace(r)
+	}), "")
+}
+
+// FormatOrderID returns an order ID the way Walmart prints it, with a hyphen
+// after the seventh digit.
 func FormatOrderID(id string) string {
-	if len(id) > 7 && !strings.Contains(id, "-") {
+	id = CanonicalOrderID(id)
+	if len(id) > 7 {
 		return id[:7] + "-" + id[7:]
 	}
 	return id
 }
 
 func LearnPrices(nonCanceledOrders []*Order) map[string]float64 {
+	return LearnPricesWithMode(nonCanceledOrders, SpendTotal)
+}
+
+// LearnPricesWithMode finds unit prices from invoices, and otherwise
+// estimates them from order totals counted under the given spend mode. An
+// order whose email printed a price beside every item has its total split in
+// proportion to those prices, since they leave out tax and fees; other orders
+// only count when they hold a single product. Orders changed after they were
+// placed are left out of the estimate, since their total no longer matches
+// their items.
+func LearnPricesWithMode(nonCanceledOrders []*Order, mode string) map[string]float64 {
 	learned := make(map[string]float64)
+	// Invoice prices are authoritative, so take them before estimating.
+	for _, order := range nonCanceledOrders {
+		for _, item := range order.Items {
+			if _, ok := learned[item.Name]; ok || item.Price == "" || item.Quantity <= 0 {
+				continue
+			}
+			if price, ok := parseAmount(item.Price); ok {
+				learned[item.Name] = price / float64(item.Quantity)
+			}
+		}
+	}
 	for _, order := range nonCanceledOrders {
-		if len(order.Items) == 0 {
+		if len(order.Items) == 0 || order.changedAfterOrder() {
+			continue
+		}
+		printed := 0.0
+		for _, item := range order.Items {
+			if item.UnitPrice <= 0 || item.Quantity <= 0 {
+				printed = 0
+				break
+			}
+			printed += item.UnitPrice * float64(item.Quantity)
+		}
+		if printed == 0 {
+			continue
+		}
+		spend, ok := order.Spend(mode)
+		if !ok {
+			continue
+		}
+		for _, item := range order.Items {
+			if _, ok := learned[item.Name]; !ok {
+				learned[item.Name] = spend * item.UnitPrice / printed
+			}
+		}
+	}
+	for _, order := range nonCanceledOrders {
+		if len(order.Items) == 0 || order.changedAfterOrder() {
 			continue
 		}
 		same := true
@@ -127,10 +558,8 @@ func LearnPrices(nonCanceledOrders []*Order) map[string]float64 {
 		if _, ok := learned[first]; ok {
 			continue
 		}
-		totalString := strings.ReplaceAll(order.Total, "$", "")
-		totalString = strings.ReplaceAll(totalString, ",", "")
-		totalFloat, err := strconv.ParseFloat(totalString, 64)
-		if err != nil {
+		totalFloat, ok := order.Spend(mode)
+		if !ok {
 			continue
 		}
 		totalQty := 0
@@ -144,8 +573,16 @@ func LearnPrices(nonCanceledOrders []*Order) map[string]float64 {
 	return learned
 }
 
+// changedAfterOrder reports whether money or items were taken off the order
+// after it was placed, by a refund, an "order updated" email or a partial
+// cancellation.
+func (o *Order) changedAfterOrder() bool {
+	return o.Refunded || !o.ItemsUpdatedAt.IsZero() || len(o.CanceledItems) > 0
+}
+
 func CalculateSummaries(nonCanceledOrders []*Order, learnedPrices map[string]float64) map[string]*ProductSummary {
 	m := make(map[string]*ProductSummary)
+	refunds := make(map[string]float64)
 	for _, order := range nonCanceledOrders {
 		for _, item := range order.Items {
 			if _, ok := m[item.Name]; !ok {
@@ -158,10 +595,46 @@ func CalculateSummaries(nonCanceledOrders []*Order, learnedPrices map[string]flo
 				s.TotalSpent = price * float64(s.TotalUnits)
 			}
 		}
+		if refund, ok := parseAmount(order.RefundTotal); ok && order.Refunded {
+			splitRefund(order, refund, learnedPrices, refunds)
+		}
+	}
+	for name, refund := range refunds {
+		if s := m[name]; s != nil && s.TotalSpent > 0 {
+			s.Refunded = min(refund, s.TotalSpent)
+			s.TotalSpent -= s.Refunded
+		}
 	}
 	return m
 }
 
+// splitRefund shares an order's refund among its products in proportion to
+// their estimated cost, or to their quantity when a price is unknown, and adds
+// the shares to refunds. Refund emails don't say which items they cover.
+func splitRefund(order *Order, refund float64, learnedPrices map[string]float64, refunds map[string]float64) {
+	weights := make([]float64, len(order.Items))
+	byPrice := true
+	for _, item := range order.Items {
+		if _, ok := learnedPrices[item.Name]; !ok {
+			byPrice = false
+		}
+	}
+	total := 0.0
+	for i, item := range order.Items {
+		weights[i] = float64(item.Quantity)
+		if byPrice {
+			weights[i] *= learnedPrices[item.Name]
+		}
+		total += weights[i]
+	}
+	if total <= 0 {
+		return
+	}
+	for i, item := range order.Items {
+		refunds[item.Name] += refund * weights[i] / total
+	}
+}
+
 func CalculateLiveOrderSummary(liveOrders []*Order, learnedPrices map[string]float64) []ProductSummary {
 	m := CalculateSummaries(liveOrders, learnedPrices)
 	out := make([]ProductSummary, 0, len(m))
@@ -174,24 +647,83 @@ func CalculateLiveOrderSummary(liveOrders []*Order, learnedPrices map[string]flo
 	return out
 }
 
+// CalculatePaymentMethodSpend totals order amounts by payment method, largest
+// first. Orders whose email didn't show a payment method are grouped under
+// "Unknown".
+func CalculatePaymentMethodSpend(nonCanceledOrders []*Order) []PaymentMethodSpend {
+	m := make(map[string]*PaymentMethodSpend)
+	for _, order := range nonCanceledOrders {
+		method := order.PaymentMethod
+		if method == "" {
+			method = "Unknown"
+		}
+		p := m[method]
+		if p == nil {
+			p = &PaymentMethodSpend{Method: method}
+			m[method] = p
+		}
+		p.Orders++
+		if total, ok := parseAmount(order.Total); ok {
+			p.TotalSpent += total
+		}
+	}
+	out := make([]PaymentMethodSpend, 0, len(m))
+	for _, p := range m {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].TotalSpent != out[j].TotalSpent {
+			return out[i].TotalSpent > out[j].TotalSpent
+		}
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
 func CalculateEmailStats(orders map[string]*Order, liveOrderCount int) EmailStats {
 	totalOrders := len(orders)
-	totalCanceled := 0
+	totalCanceled, byWalmart, paymentFailed := 0, 0, 0
 	for _, order := range orders {
-		if order.Status == "canceled" {
-			totalCanceled++
+		if order.Status != "canceled" {
+			continue
+		}
+		totalCanceled++
+		switch order.CancelReason {
+		case CancelReasonWalmart:
+			byWalmart++
+		case CancelReasonPaymentFailed:
+			paymentFailed++
 		}
 	}
+	totalTax := TotalTax(orders)
 	var cancelRate float64
 	if totalOrders > 0 {
 		cancelRate = float64(totalCanceled) / float64(totalOrders) * 100
 	}
 	return EmailStats{
-		LiveOrderCount:   liveOrderCount,
-		TotalOrders:      totalOrders,
-		TotalCanceled:    totalCanceled,
-		CancellationRate: cancelRate,
+		LiveOrderCount:        liveOrderCount,
+		TotalOrders:           totalOrders,
+		TotalCanceled:         totalCanceled,
+		CancellationRate:      cancelRate,
+		TotalTax:              totalTax,
+		CanceledByWalmart:     byWalmart,
+		CanceledPaymentFailed: paymentFailed,
+	}
+}
+
+// TotalTax sums the tax of every order that wasn't canceled. Orders whose
+// email didn't itemize tax add nothing.
+func TotalTax(orders map[string]*Order) float64 {
+	var total float64
+	for _, order := range orders {
+		if order.Status == "canceled" {
+			continue
+		}
+		if tax, ok := parseAmount(order.Tax); ok {
+			total += tax
+		}
 	}
+	return total
 }
 
 func CalculateProductStats(orders map[string]*Order) []ProductStats {
@@ -203,9 +735,17 @@ func CalculateProductStats(orders map[string]*Order) []ProductStats {
 			}
 			statsMap[item.Name].TotalOrdered += item.Quantity
 			if order.Status == "canceled" {
-				statsMap[item.Name].TotalCanceled += item.Quantity
+				statsMap[item.Name].addCanceled(item.Quantity, order.CancelReason)
 			}
 		}
+		// Partially canceled items no longer appear in Items.
+		for _, item := range order.CanceledItems {
+			if _, ok := statsMap[item.Name]; !ok {
+				statsMap[item.Name] = &ProductStats{Name: item.Name, Thumbnail: item.ImageURL}
+			}
+			statsMap[item.Name].TotalOrdered += item.Quantity
+			statsMap[item.Name].addCanceled(item.Quantity, order.CancelReason)
+		}
 	}
 	var stats []ProductStats
 	for _, stat := range statsMap {
@@ -220,92 +760,194 @@ func CalculateProductStats(orders map[string]*Order) []ProductStats {
 	return stats
 }
 
+func (s *ProductStats) addCanceled(qty int, reason string) {
+	s.TotalCanceled += qty
+	switch reason {
+	case CancelReasonWalmart:
+		s.CanceledByWalmart += qty
+	case CancelReasonPaymentFailed:
+		s.CanceledPaymentFailed += qty
+	}
+}
+
 func PrepareOrderDetails(nonCanceledOrders []*Order, learnedPrices map[string]float64) []OrderDetail {
 	var out []OrderDetail
 	for _, order := range nonCanceledOrders {
 		for _, item := range order.Items {
 			totalStr := order.Total
 			if price, ok := learnedPrices[item.Name]; ok {
-				totalStr = fmt.Sprintf("$%.2f", price*float64(item.Quantity))
+				totalStr = formatLike(order.Total, price*float64(item.Quantity))
 			}
 			out = append(out, OrderDetail{
-				OrderID:   FormatOrderID(order.ID),
-				OrderDate: order.OrderDate,
-				Thumbnail: item.ImageURL,
-				Name:      item.Name,
-				Quantity:  item.Quantity,
-				Total:     totalStr,
+				OrderID:     FormatOrderID(order.ID),
+				OrderDate:   order.OrderDate,
+				Thumbnail:   item.ImageURL,
+				Name:        item.Name,
+				Quantity:    item.Quantity,
+				Total:       totalStr,
+				WasPreorder: order.WasPreorder,
+				IsNew:       order.IsNew,
 			})
 		}
 	}
 	return out
 }
 
+// createFile runs write against a newly created file at path, reporting close
+// errors so truncated output isn't mistaken for success.
+func createFile(path, kind string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", kind, err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func GenerateHTML(orders map[string]*Order, totalEmailsScanned int, daysToScan int, path string, shippedOrders []*ShippedOrder) error {
-	endDate := time.Now()
-	startDate := endDate.AddDate(0, 0, -daysToScan)
-	dateRangeStr := fmt.Sprintf(
-		"Email Scan Range: %s to %s (%d days)",
-		startDate.Format("Jan 2, 2006"),
-		endDate.Format("Jan 2, 2006"),
-		daysToScan,
-	)
-
-	normalizeProductNames(orders)
+	return createFile(path, "html", func(w io.Writer) error {
+		return GenerateHTMLTo(w, orders, totalEmailsScanned, daysToScan, shippedOrders)
+	})
+}
+
+func GenerateHTMLTo(w io.Writer, orders map[string]*Order, totalEmailsScanned int, daysToScan int, shippedOrders []*ShippedOrder) error {
+	return RenderHTML(w, orders, shippedOrders, HTMLOptions{DaysScanned: daysToScan})
+}
+
+func RenderHTML(w io.Writer, orders map[string]*Order, shippedOrders []*ShippedOrder, opts HTMLOptions) error {
+	variant, err := ParseVariant(opts.Variant)
+	if err != nil {
+		return err
+	}
+	tmpl := templateHTML
+	if variant == VariantCompact {
+		tmpl = compactTemplateHTML
+	}
+
+	dateRangeStr := opts.dateRange().Label()
+
+	normalizeProductNames(orders, opts.Aliases)
 	stats := CalculateProductStats(orders)
 	nonCanceled := filterNonCanceled(orders)
-	learned := LearnPrices(nonCanceled)
+	learned := LearnPricesWithMode(nonCanceled, opts.SpendMode)
 	productSummaries := buildProductSummaries(nonCanceled, learned)
 	orderDetails := PrepareOrderDetails(nonCanceled, learned)
 	liveOrdersFiltered := filterLiveOrders(nonCanceled, shippedOrders)
 	liveOrdersForTemplate := PrepareOrderDetails(liveOrdersFiltered, learned)
 	liveOrderSummary := CalculateLiveOrderSummary(liveOrdersFiltered, learned)
 	emailStats := CalculateEmailStats(orders, len(liveOrdersFiltered))
+	fulfillment := CalculateFulfillment(orders, shippedOrders)
+	paymentSpend := CalculatePaymentMethodSpend(nonCanceled)
+	shippedOrders = SortShipments(shippedOrders)
 
 	data := TemplateData{
-		Stats:            stats,
-		EmailStats:       emailStats,
-		Orders:           orderDetails,
-		ShippedOrders:    shippedOrders,
-		DateRange:        dateRangeStr,
-		ProductSpend:     productSummaries,
-		ProductCancel:    stats,
-		OrderLines:       orderDetails,
-		Shipments:        shippedOrders,
-		LiveOrders:       liveOrdersForTemplate,
-		LiveOrderSummary: liveOrderSummary,
-	}
-
-	t := template.Must(template.New("webpage").Parse(templateHTML))
-	f, err := os.Create(path)
+		Stats:              stats,
+		EmailStats:         emailStats,
+		Orders:             orderDetails,
+		ShippedOrders:      shippedOrders,
+		DateRange:          dateRangeStr,
+		ProductSpend:       productSummaries,
+		ProductCancel:      stats,
+		OrderLines:         orderDetails,
+		Shipments:          shippedOrders,
+		LiveOrders:         liveOrdersForTemplate,
+		LiveOrderSummary:   liveOrderSummary,
+		Notices:            opts.Notices,
+		Fulfillment:        fulfillment,
+		PaymentSpend:       paymentSpend,
+		FulfillmentBuckets: FulfillmentBucketLabels(),
+		Discrepancies:      FindTotalDiscrepancies(orders),
+		Accounts:           opts.Accounts,
+		Canceled:           CanceledOrders(orders),
+	}
+
+	funcs := template.FuncMap{"money": opts.Region.FormatAmount}
+	t, err := template.New("webpage").Funcs(templateFuncs).Funcs(funcs).Parse(tmpl)
 	if err != nil {
-		return fmt.Errorf("create html: %w", err)
+		return fmt.Errorf("parse template: %w", err)
 	}
-	defer f.Close()
-	if err := t.Execute(f, data); err != nil {
+	if err := t.Execute(w, data); err != nil {
 		return fmt.Errorf("execute template: %w", err)
 	}
 	return nil
 }
 
-func normalizeProductNames(orders map[string]*Order) {
-	canonical := make(map[string]string)
+func normalizeProductNames(orders map[string]*Order, aliases []ProductAlias) {
+	NormalizeProductNames(orders, aliases, NormalizationRules(aliases))
+}
+
+// NormalizeProductNames groups items, canceled ones included, whose names
+// share a normalized key and gives each group one display name. Names
+// matching one of aliases, the first match winning, are grouped under it and
+// shown as the alias name; the rest are keyed by rules.
+// The key is only used for matching; the name shown is the group's most
+// common original spelling (the shortest, then alphabetically first, on a
+// tie), so rules that strip words like "pokemon" never leak into the report.
+func NormalizeProductNames(orders map[string]*Order, aliases []ProductAlias, rules []NormalizationRule) {
+	counts := make(map[string]map[string]int)
+	aliased := make(map[string]string)
 	for _, order := range orders {
-		for i := range order.Items {
-			norm := NormalizeProductName(order.Items[i].Name)
-			if _, ok := canonical[norm]; !ok {
-				canonical[norm] = order.Items[i].Name
+		for _, items := range [][]Item{order.Items, order.CanceledItems} {
+			for _, item := range items {
+				key, alias := productKey(item.Name, aliases, rules)
+				if alias != "" {
+					aliased[key] = alias
+				}
+				if counts[key] == nil {
+					counts[key] = make(map[string]int)
+				}
+				counts[key][item.Name]++
+			}
+		}
+	}
+
+	display := make(map[string]string, len(counts))
+	for key, names := range counts {
+		best, bestCount := "", 0
+		for name, n := range names {
+			if n > bestCount || (n == bestCount && preferDisplayName(name, best)) {
+				best, bestCount = name, n
 			}
 		}
+		display[key] = best
 	}
+	for key, alias := range aliased {
+		display[key] = alias
+	}
+
 	for _, order := range orders {
-		for i := range order.Items {
-			norm := NormalizeProductName(order.Items[i].Name)
-			order.Items[i].Name = canonical[norm]
+		for _, items := range [][]Item{order.Items, order.CanceledItems} {
+			for i := range items {
+				key, _ := productKey(items[i].Name, aliases, rules)
+				items[i].Name = display[key]
+			}
 		}
 	}
 }
 
+// CloneOrders copies orders deeply enough that NormalizeProductNames can
+// rename the copies' items without touching the originals.
+func CloneOrders(orders map[string]*Order) map[string]*Order {
+	out := make(map[string]*Order, len(orders))
+	for id, order := range orders {
+		c := *order
+		c.Items = append([]Item(nil), order.Items...)
+		c.CanceledItems = append([]Item(nil), order.CanceledItems...)
+		out[id] = &c
+	}
+	return out
+}
+
+func preferDisplayName(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
 func filterNonCanceled(orders map[string]*Order) []*Order {
 	var result []*Order
 	for _, order := range orders {
@@ -325,10 +967,52 @@ func buildProductSummaries(orders []*Order, learnedPrices map[string]float64) []
 	for _, s := range m {
 		out = append(out, *s)
 	}
-	sort.Slice(out, func(i, j int) bool {
-		return out[i].TotalSpent > out[j].TotalSpent
+	return SortProductSummaries(out, SortBySpend, 0)
+}
+
+// Sort keys for SortProductSummaries.
+const (
+	SortBySpend = "spend"
+	SortByUnits = "units"
+	SortByPrice = "price" // price per unit
+	SortByName  = "name"
+)
+
+// ValidProductSort reports whether key is a known sort key or empty.
+func ValidProductSort(key string) bool {
+	switch key {
+	case "", SortBySpend, SortByUnits, SortByPrice, SortByName:
+		return true
+	}
+	return false
+}
+
+// SortProductSummaries sorts summaries in place by key, largest first except
+// for names, and keeps the first limit when limit > 0. An empty or unknown key
+// sorts by spend.
+func SortProductSummaries(summaries []ProductSummary, key string, limit int) []ProductSummary {
+	less := func(a, b ProductSummary) bool { return a.TotalSpent > b.TotalSpent }
+	switch key {
+	case SortByUnits:
+		less = func(a, b ProductSummary) bool { return a.TotalUnits > b.TotalUnits }
+	case SortByPrice:
+		less = func(a, b ProductSummary) bool { return a.PricePerUnit > b.PricePerUnit }
+	case SortByName:
+		less = func(a, b ProductSummary) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if less(summaries[i], summaries[j]) {
+			return true
+		}
+		if less(summaries[j], summaries[i]) {
+			return false
+		}
+		return summaries[i].Name < summaries[j].Name
 	})
-	return out
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries
 }
 
 func filterLiveOrders(nonCanceledOrders []*Order, shippedOrders []*ShippedOrder) []*Order {
@@ -349,17 +1033,49 @@ func filterLiveOrders(nonCanceledOrders []*Order, shippedOrders []*ShippedOrder)
 	return liveOrders
 }
 
-func GenerateCSV(orders map[string]*Order, path string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("create csv: %w", err)
+// csvHeader is the orders CSV header. Order Tax came last, so master CSVs
+// started before it have the header without it, and AppendCSV keeps to that.
+var csvHeader = []string{"Order ID", "Order Date", "Order Total", "Item Name", "Quantity", "Order Tax"}
+
+func orderCSVRows(order *Order) [][]string {
+	var rows [][]string
+	for _, item := range order.Items {
+		rows = append(rows, []string{
+			FormatOrderID(order.ID),
+			order.OrderDate,
+			order.Total,
+			item.Name,
+			fmt.Sprintf("%d", item.Quantity),
+			order.Tax,
+		})
 	}
-	defer f.Close()
+	return rows
+}
 
-	w := csv.NewWriter(f)
-	defer w.Flush()
+func GenerateCSV(orders map[string]*Order, path string) error {
+	return createFile(path, "csv", func(w io.Writer) error {
+		return GenerateCSVTo(w, orders)
+	})
+}
 
-	if err := w.Write([]string{"Order ID", "Order Date", "Order Total", "Item Name", "Quantity"}); err != nil {
+func GenerateCSVTo(out io.Writer, orders map[string]*Order) error {
+	return writeOrdersCSV(out, orders, false)
+}
+
+// GenerateCombinedCSVTo writes the same lines as GenerateCSVTo plus an
+// "Account" column naming the mailbox(es) each order was found in.
+func GenerateCombinedCSVTo(out io.Writer, orders map[string]*Order) error {
+	return writeOrdersCSV(out, orders, true)
+}
+
+func writeOrdersCSV(out io.Writer, orders map[string]*Order, withAccount bool) error {
+	w := csv.NewWriter(out)
+
+	header := csvHeader
+	if withAccount {
+		header = append(slices.Clone(csvHeader), "Account")
+	}
+	if err := w.Write(header); err != nil {
 		return fmt.Errorf("write header: %w", err)
 	}
 
@@ -367,13 +1083,9 @@ func GenerateCSV(orders map[string]*Order, path string) error {
 		if order.Status == "canceled" {
 			continue
 		}
-		for _, item := range order.Items {
-			rec := []string{
-				FormatOrderID(order.ID),
-				order.OrderDate,
-				order.Total,
-				item.Name,
-				fmt.Sprintf("%d", item.Quantity),
+		for _, rec := range orderCSVRows(order) {
+			if withAccount {
+				rec = append(rec, strings.Join(order.SourceAccounts, "; "))
 			}
 			if err := w.Write(rec); err != nil {
 				return fmt.Errorf("write row: %w", err)
@@ -381,6 +1093,7 @@ func GenerateCSV(orders map[string]*Order, path string) error {
 		}
 	}
 
+	w.Flush()
 	if err := w.Error(); err != nil {
 		return fmt.Errorf("flush: %w", err)
 	}
@@ -388,17 +1101,175 @@ func GenerateCSV(orders map[string]*Order, path string) error {
 	return nil
 }
 
-func GenerateShippedCSV(shippedOrders []*ShippedOrder, path string) error {
-	f, err := os.Create(path)
+// GenerateJSONLTo writes one JSON object per order, one per line (JSON Lines),
+// in order ID order. Each line is written as soon as it is encoded, so large
+// result sets can be streamed and parsed incrementally.
+func GenerateJSONLTo(out io.Writer, orders map[string]*Order) error {
+	ids := make([]string, 0, len(orders))
+	for id := range orders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	enc := json.NewEncoder(out)
+	for _, id := range ids {
+		if err := enc.Encode(orders[id]); err != nil {
+			return fmt.Errorf("write order %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// jsonReport is the document written by GenerateJSON.
+type jsonReport struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	TotalTax    float64         `json:"total_tax"`
+	Orders      []jsonOrder     `json:"orders"`
+	Shipped     []*ShippedOrder `json:"shipped"`
+}
+
+// jsonOrder flags canceled orders explicitly, since the JSON report keeps
+// them where the CSV leaves them out.
+type jsonOrder struct {
+	*Order
+	Canceled bool
+}
+
+func GenerateJSON(orders map[string]*Order, shipped []*ShippedOrder, path string) error {
+	return createFile(path, "json", func(w io.Writer) error {
+		return GenerateJSONTo(w, orders, shipped)
+	})
+}
+
+// GenerateJSONTo writes every order, canceled ones included, and every
+// shipment as a single JSON document. Orders are in order ID order; times are
+// RFC 3339.
+func GenerateJSONTo(out io.Writer, orders map[string]*Order, shipped []*ShippedOrder) error {
+	ids := make([]string, 0, len(orders))
+	for id := range orders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	doc := jsonReport{
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		TotalTax:    math.Round(TotalTax(orders)*100) / 100,
+		Orders:      make([]jsonOrder, 0, len(ids)),
+		Shipped:     shipped,
+	}
+	for _, id := range ids {
+		o := orders[id]
+		doc.Orders = append(doc.Orders, jsonOrder{Order: o, Canceled: o.Status == "canceled"})
+	}
+	if doc.Shipped == nil {
+		doc.Shipped = []*ShippedOrder{}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("write json: %w", err)
+	}
+	return nil
+}
+
+// AppendCSV adds the non-canceled order lines to an existing CSV written by
+// GenerateCSV, skipping lines whose order ID and item name are already present.
+// The file is created with a header if it does not exist yet. It returns the
+// number of lines appended.
+func AppendCSV(orders map[string]*Order, path string) (int, error) {
+	existing, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if err := GenerateCSV(orders, path); err != nil {
+			return 0, err
+		}
+		added := 0
+		for _, order := range orders {
+			if order.Status != "canceled" {
+				added += len(order.Items)
+			}
+		}
+		return added, nil
+	}
 	if err != nil {
-		return fmt.Errorf("create csv: %w", err)
+		return 0, fmt.Errorf("open csv: %w", err)
+	}
+
+	records, err := csv.NewReader(existing).ReadAll()
+	existing.Close()
+	if err != nil {
+		return 0, fmt.Errorf("read csv: %w", err)
+	}
+	if len(records) == 0 || !isOrdersCSVHeader(records[0]) {
+		return 0, fmt.Errorf("%s is not an orders CSV", path)
+	}
+	columns := len(records[0])
+	seen := make(map[string]struct{}, len(records))
+	for _, rec := range records[1:] {
+		if len(rec) < columns {
+			continue
+		}
+		seen[rec[0]+"|"+rec[3]] = struct{}{}
+	}
+
+	sorted := make([]*Order, 0, len(orders))
+	for _, order := range orders {
+		if order.Status != "canceled" {
+			sorted = append(sorted, order)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].OrderDateParsed.Equal(sorted[j].OrderDateParsed) {
+			return sorted[i].OrderDateParsed.Before(sorted[j].OrderDateParsed)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("open csv: %w", err)
 	}
 	defer f.Close()
 
 	w := csv.NewWriter(f)
-	defer w.Flush()
+	added := 0
+	for _, order := range sorted {
+		for _, rec := range orderCSVRows(order) {
+			key := rec[0] + "|" + rec[3]
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			if err := w.Write(rec[:columns]); err != nil {
+				return added, fmt.Errorf("write row: %w", err)
+			}
+			seen[key] = struct{}{}
+			added++
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return added, fmt.Errorf("flush: %w", err)
+	}
+	return added, nil
+}
+
+// isOrdersCSVHeader reports whether header is csvHeader, with or without
+// its last column.
+func isOrdersCSVHeader(header []string) bool {
+	n := len(header)
+	return (n == len(csvHeader) || n == len(csvHeader)-1) && slices.Equal(header, csvHeader[:n])
+}
+
+func GenerateShippedCSV(shippedOrders []*ShippedOrder, path string) error {
+	return createFile(path, "csv", func(w io.Writer) error {
+		return GenerateShippedCSVTo(w, shippedOrders)
+	})
+}
 
-	if err := w.Write([]string{"Order ID", "Carrier", "Tracking #", "Estimated Arrival"}); err != nil {
+func GenerateShippedCSVTo(out io.Writer, shippedOrders []*ShippedOrder) error {
+	w := csv.NewWriter(out)
+
+	if err := w.Write([]string{"Order ID", "Carrier", "Tracking #", "Estimated Arrival", "Delivered Date"}); err != nil {
 		return fmt.Errorf("write header: %w", err)
 	}
 	for _, order := range shippedOrders {
@@ -407,13 +1278,59 @@ func GenerateShippedCSV(shippedOrders []*ShippedOrder, path string) error {
 			order.Carrier,
 			order.TrackingNumber,
 			order.EstimatedArrival,
+			order.DeliveredDate,
 		}
 		if err := w.Write(rec); err != nil {
 			return fmt.Errorf("write row: %w", err)
 		}
 	}
+	w.Flush()
 	if err := w.Error(); err != nil {
 		return fmt.Errorf("flush: %w", err)
 	}
 	return nil
 }
+
+// WriteOrderList prints one line per order (ID, date, status, item count,
+// total), newest first. When statuses is non-empty only orders whose status
+// is listed are included.
+func WriteOrderList(out io.Writer, orders map[string]*Order, statuses []string) error {
+	keep := make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		keep[strings.ToLower(strings.TrimSpace(s))] = true
+	}
+
+	list := make([]*Order, 0, len(orders))
+	for _, o := range orders {
+		if len(keep) > 0 && !keep[o.Status] {
+			continue
+		}
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].OrderDateParsed.Equal(list[j].OrderDateParsed) {
+			return list[i].OrderDateParsed.After(list[j].OrderDateParsed)
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ORDER ID\tDATE\tSTATUS\tITEMS\tTOTAL")
+	for _, o := range list {
+		items := 0
+		for _, it := range o.Items {
+			items += it.Quantity
+		}
+		date := "-"
+		if !o.OrderDateParsed.IsZero() {
+			date = o.OrderDateParsed.Format("2006-01-02")
+		}
+		total := o.Total
+		if total == "" {
+			total = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", FormatOrderID(o.ID), date, o.Status, items, total)
+	}
+	fmt.Fprintf(w, "\n%d order(s)\n", len(list))
+	return w.Flush()
+}
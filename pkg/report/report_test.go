@@ -0,0 +1,343 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNormalizeProductNamesWithAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	if err := os.WriteFile(path, []byte(`[{"match": "regexp", "pattern": "prismatic.*(elite trainer|etb)", "name": "Prismatic ETB"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := LoadProductAliases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOrders := func() map[string]*Order {
+		return map[string]*Order{
+			"1": {ID: "1", Status: "confirmed", Total: "$50.00", Items: []Item{{Name: "Prismatic Evolutions Elite Trainer Box", Quantity: 1}}},
+			"2": {ID: "2", Status: "confirmed", Total: "$50.00", Items: []Item{{Name: "Pokemon TCG: Prismatic Evo ETB", Quantity: 1}}},
+		}
+	}
+
+	orders := newOrders()
+	NormalizeProductNames(orders, aliases, NormalizationRules(aliases))
+	for id, order := range orders {
+		if got := order.Items[0].Name; got != "Prismatic ETB" {
+			t.Errorf("order %s item named %q, want %q", id, got, "Prismatic ETB")
+		}
+	}
+	if learned := LearnedPrices(newOrders(), SpendTotal, aliases); len(learned) != 1 || learned["Prismatic ETB"] != 50 {
+		t.Errorf("learned prices = %v, want one price of 50 for Prismatic ETB", learned)
+	}
+
+	// Aliases apply only where they are passed.
+	orders = newOrders()
+	NormalizeProductNames(orders, nil, DefaultNormalizationRules)
+	if orders["1"].Items[0].Name == orders["2"].Items[0].Name {
+		t.Errorf("spellings merged without aliases: %q", orders["1"].Items[0].Name)
+	}
+}
+
+func TestNormalizeProductNamesIncludesCanceledItems(t *testing.T) {
+	orders := map[string]*Order{
+		"1": {ID: "1", Status: "confirmed", Items: []Item{{Name: "Pokemon Evolutions Booster", Quantity: 2}}},
+		"2": {ID: "2", Status: "confirmed", Items: []Item{{Name: "Pokemon Evolutions Booster", Quantity: 1}}},
+		"3": {
+			ID:            "3",
+			Status:        "confirmed",
+			Items:         []Item{{Name: "Desk Lamp", Quantity: 1}},
+			CanceledItems: []Item{{Name: "Pokemon Trading Card Games Evolutions Booster", Quantity: 1}},
+		},
+	}
+
+	NormalizeProductNames(orders, nil, DefaultNormalizationRules)
+
+	if got := orders["3"].CanceledItems[0].Name; got != "Pokemon Evolutions Booster" {
+		t.Errorf("canceled item name = %q, want the group's display name", got)
+	}
+	var rows int
+	for _, s := range CalculateProductStats(orders) {
+		if s.Name == "Pokemon Evolutions Booster" {
+			rows++
+			if s.TotalOrdered != 4 || s.TotalCanceled != 1 {
+				t.Errorf("ordered %d, canceled %d; want 4 and 1", s.TotalOrdered, s.TotalCanceled)
+			}
+		}
+	}
+	if rows != 1 {
+		t.Errorf("product split into %d rows, want 1", rows)
+	}
+}
+
+func TestOrdersCSVTaxColumn(t *testing.T) {
+	orders := map[string]*Order{
+		"100000011111111": {ID: "100000011111111", OrderDate: "Mar 1, 2025", Total: "$21.60", Tax: "$1.60", Status: "confirmed", Items: []Item{{Name: "Desk Lamp", Quantity: 1}}},
+		"200000022222222": {ID: "200000022222222", OrderDate: "Mar 2, 2025", Total: "$5.00", Status: "confirmed", Items: []Item{{Name: "Coffee Mug", Quantity: 1}}},
+	}
+	var buf bytes.Buffer
+	if err := GenerateCSVTo(&buf, orders); err != nil {
+		t.Fatal(err)
+	}
+	rows := readCSV(t, &buf)
+	if !slices.Equal(rows[0], csvHeader) || rows[0][5] != "Order Tax" {
+		t.Errorf("header = %q", rows[0])
+	}
+	tax := make(map[string]string)
+	for _, rec := range rows[1:] {
+		tax[rec[0]] = rec[5]
+	}
+	if tax["1000000-11111111"] != "$1.60" || tax["2000000-22222222"] != "" {
+		t.Errorf("Order Tax column = %v, want $1.60 and empty", tax)
+	}
+	if got := TotalTax(orders); got != 1.60 {
+		t.Errorf("TotalTax = %v, want 1.60", got)
+	}
+}
+
+func TestAppendCSVKeepsLegacyColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.csv")
+	legacy := "Order ID,Order Date,Order Total,Item Name,Quantity\n1000000-11111111,\"Mar 1, 2025\",$21.60,Desk Lamp,1\n"
+	if err := os.WriteFile(path, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orders := map[string]*Order{
+		"200000022222222": {ID: "200000022222222", OrderDate: "Mar 2, 2025", Total: "$5.40", Tax: "$0.40", Status: "confirmed", Items: []Item{{Name: "Coffee Mug", Quantity: 1}}},
+	}
+	added, err := AppendCSV(orders, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Errorf("added %d lines, want 1", added)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows := readCSV(t, f)
+	if len(rows) != 3 || len(rows[2]) != 5 || rows[2][3] != "Coffee Mug" {
+		t.Errorf("rows = %q, want the new line in the file's 5 columns", rows)
+	}
+}
+
+func TestAppendCSVSkipsOrdersAlreadyPresent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.csv")
+	lamp := &Order{ID: "100000011111111", OrderDate: "Mar 1, 2025", OrderDateParsed: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), Total: "$21.60", Status: "confirmed",
+		Items: []Item{{Name: "Desk Lamp, Brass", Quantity: 1}, {Name: "Light Bulb \"Soft\"", Quantity: 2}}}
+	mug := &Order{ID: "200000022222222", OrderDate: "Mar 2, 2025", OrderDateParsed: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC), Total: "$5.40", Status: "confirmed",
+		Items: []Item{{Name: "Coffee Mug", Quantity: 1}}}
+	rug := &Order{ID: "300000033333333", OrderDate: "Mar 3, 2025", OrderDateParsed: time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC), Total: "$30.00", Status: "confirmed",
+		Items: []Item{{Name: "Area Rug", Quantity: 1}}}
+
+	added, err := AppendCSV(map[string]*Order{lamp.ID: lamp, mug.ID: mug}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 {
+		t.Errorf("first batch added %d lines, want 3", added)
+	}
+	// The second scan overlaps the first on the mug order.
+	added, err = AppendCSV(map[string]*Order{mug.ID: mug, rug.ID: rug}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Errorf("second batch added %d lines, want 1", added)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows := readCSV(t, f)
+	var items []string
+	for _, row := range rows[1:] {
+		items = append(items, row[3])
+	}
+	want := []string{"Desk Lamp, Brass", "Light Bulb \"Soft\"", "Coffee Mug", "Area Rug"}
+	if !slices.Equal(items, want) {
+		t.Errorf("file holds items %q, want %q", items, want)
+	}
+}
+
+func readCSV(t *testing.T, r io.Reader) [][]string {
+	t.Helper()
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestNormalizeProductNamesKeepsReadableNames(t *testing.T) {
+	orders := map[string]*Order{
+		"1": {ID: "1", Status: "confirmed", Items: []Item{{Name: "Pokemon Scarlett Violet Booster", Quantity: 1}}},
+		"2": {ID: "2", Status: "confirmed", Items: []Item{{Name: "Pokemon Scarlett Violet Booster", Quantity: 1}}},
+		"3": {ID: "3", Status: "confirmed", Items: []Item{{Name: "Scarlett Violet Booster", Quantity: 1}}},
+		"4": {ID: "4", Status: "confirmed", Items: []Item{{Name: "Pokemon Evolutions Tin", Quantity: 1}}},
+		"5": {ID: "5", Status: "confirmed", Items: []Item{{Name: "Evolutions Tin", Quantity: 1}}},
+	}
+
+	NormalizeProductNames(orders, nil, DefaultNormalizationRules)
+
+	// The most common spelling wins, even when it is the longer one; a tie
+	// goes to the shorter. Neither is the lowercased, rewritten key.
+	for id, want := range map[string]string{
+		"1": "Pokemon Scarlett Violet Booster",
+		"2": "Pokemon Scarlett Violet Booster",
+		"3": "Pokemon Scarlett Violet Booster",
+		"4": "Evolutions Tin",
+		"5": "Evolutions Tin",
+	} {
+		if got := orders[id].Items[0].Name; got != want {
+			t.Errorf("order %s item named %q, want %q", id, got, want)
+		}
+	}
+}
+
+// failWriter fails every write, like a full disk or a closed connection.
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestGenerateErrorsPropagate(t *testing.T) {
+	orders := canceledFixture()
+	shipped := []*ShippedOrder{{
+		ID:               "300000033333333",
+		Carrier:          "FedEx",
+		TrackingNumber:   "123456789012",
+		EstimatedArrival: "Arrives Mar 4",
+		ArrivalStart:     time.Date(2025, 3, 4, 0, 0, 0, 0, time.Local),
+		ArrivalEnd:       time.Date(2025, 3, 4, 0, 0, 0, 0, time.Local),
+	}}
+
+	missing := filepath.Join(t.TempDir(), "missing", "report")
+	for name, generate := range map[string]func(path string) error{
+		"GenerateHTML":         func(p string) error { return GenerateHTML(orders, 1, 30, p, shipped) },
+		"GenerateCSV":          func(p string) error { return GenerateCSV(orders, p) },
+		"GenerateJSON":         func(p string) error { return GenerateJSON(orders, shipped, p) },
+		"GenerateShippedCSV":   func(p string) error { return GenerateShippedCSV(shipped, p) },
+		"GenerateCanceledCSV":  func(p string) error { return GenerateCanceledCSV(orders, p) },
+		"GenerateMarkdown":     func(p string) error { return GenerateMarkdown(orders, shipped, p) },
+		"GenerateShipmentsICS": func(p string) error { return GenerateShipmentsICS(shipped, p) },
+		"AppendCSV":            func(p string) error { _, err := AppendCSV(orders, p); return err },
+	} {
+		if err := generate(missing); err == nil {
+			t.Errorf("%s into a missing directory returned no error", name)
+		}
+	}
+
+	for name, generate := range map[string]func(w io.Writer) error{
+		"GenerateHTMLTo":         func(w io.Writer) error { return GenerateHTMLTo(w, orders, 1, 30, shipped) },
+		"GenerateCSVTo":          func(w io.Writer) error { return GenerateCSVTo(w, orders) },
+		"GenerateCombinedCSVTo":  func(w io.Writer) error { return GenerateCombinedCSVTo(w, orders) },
+		"GenerateJSONTo":         func(w io.Writer) error { return GenerateJSONTo(w, orders, shipped) },
+		"GenerateJSONLTo":        func(w io.Writer) error { return GenerateJSONLTo(w, orders) },
+		"GenerateShippedCSVTo":   func(w io.Writer) error { return GenerateShippedCSVTo(w, shipped) },
+		"GenerateCanceledCSVTo":  func(w io.Writer) error { return GenerateCanceledCSVTo(w, orders) },
+		"RenderMarkdown":         func(w io.Writer) error { return RenderMarkdown(w, orders, shipped, MarkdownOptions{}) },
+		"GenerateShipmentsICSTo": func(w io.Writer) error { return GenerateShipmentsICSTo(w, shipped) },
+	} {
+		if err := generate(failWriter{}); err == nil {
+			t.Errorf("%s to a failing writer returned no error", name)
+		}
+	}
+}
+
+func TestLearnedPricesSkipRefundedOrders(t *testing.T) {
+	orders := map[string]*Order{
+		// Fully refunded: the $99.00 charged says nothing about the lamp's price.
+		"100000011111111": {
+			ID: "100000011111111", OrderDateParsed: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), Status: "confirmed",
+			Total: "$99.00", Refunded: true, RefundTotal: "$99.00",
+			Items: []Item{{Name: "Desk Lamp", Quantity: 1}},
+		},
+		"200000022222222": {
+			ID: "200000022222222", OrderDateParsed: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC), Status: "confirmed",
+			Total: "$20.00", Items: []Item{{Name: "Desk Lamp", Quantity: 1}},
+		},
+		"300000033333333": {
+			ID: "300000033333333", OrderDateParsed: time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC), Status: "confirmed",
+			Total: "$12.00", Refunded: true, RefundTotal: "$12.00",
+			Items: []Item{{Name: "Coffee Mug", Quantity: 1}},
+		},
+	}
+
+	learned := LearnedPrices(orders, SpendTotal, nil)
+	if len(learned) != 1 || learned["Desk Lamp"] != 20 {
+		t.Errorf("learned prices = %v, want only Desk Lamp at 20", learned)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportLearnedPricesTo(&buf, orders, SpendTotal, nil); err != nil {
+		t.Fatal(err)
+	}
+	var exported map[string]float64
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exported["Coffee Mug"]; ok || exported["Desk Lamp"] != 20 {
+		t.Errorf("exported prices = %v, want only Desk Lamp at 20", exported)
+	}
+}
+
+func TestGenerateToMatchesFile(t *testing.T) {
+	orders := map[string]*Order{
+		"100000011111111": {ID: "100000011111111", OrderDate: "Mar 1, 2025", Total: "$21.60", Tax: "$1.60", Status: "confirmed", Items: []Item{{Name: "Desk Lamp", Quantity: 1}}},
+	}
+	shipped := []*ShippedOrder{{ID: "100000011111111", Carrier: "FedEx", TrackingNumber: "123456789012", EstimatedArrival: "Arrives Mar 4"}}
+
+	for _, tt := range []struct {
+		name   string
+		header []string
+		toFile func(path string) error
+		to     func(w io.Writer) error
+	}{
+		{
+			name:   "orders",
+			header: csvHeader,
+			toFile: func(p string) error { return GenerateCSV(orders, p) },
+			to:     func(w io.Writer) error { return GenerateCSVTo(w, orders) },
+		},
+		{
+			name:   "shipped",
+			header: []string{"Order ID", "Carrier", "Tracking #", "Estimated Arrival", "Delivered Date"},
+			toFile: func(p string) error { return GenerateShippedCSV(shipped, p) },
+			to:     func(w io.Writer) error { return GenerateShippedCSVTo(w, shipped) },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.name+".csv")
+			if err := tt.toFile(path); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := tt.to(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(file, buf.Bytes()) {
+				t.Errorf("file and writer output differ:\n%s\n---\n%s", file, buf.Bytes())
+			}
+			rows := readCSV(t, &buf)
+			if len(rows) != 2 || !slices.Equal(rows[0], tt.header) || rows[1][0] != "1000000-11111111" {
+				t.Errorf("rows = %q, want the header and the order", rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package report
+
+import "fmt"
+
+// Spend modes decide what part of an order's total counts as spend.
+const (
+	// SpendTotal counts everything charged: merchandise, tax, fees and tip.
+	SpendTotal = "total"
+	// SpendMerchandise leaves out the driver tip and fees. Orders whose email
+	// had no breakdown still count in full.
+	SpendMerchandise = "merchandise"
+)
+
+// ParseSpendMode checks a spend mode name; empty means SpendTotal.
+func ParseSpendMode(s string) (string, error) {
+	switch s {
+	case "":
+		return SpendTotal, nil
+	case SpendTotal, SpendMerchandise:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown spend mode %q (want %q or %q)", s, SpendTotal, SpendMerchandise)
+}
+
+// Spend returns the amount of the order that counts as spend under mode.
+func (o *Order) Spend(mode string) (float64, bool) {
+	total, ok := parseAmount(o.Total)
+	if !ok || mode != SpendMerchandise {
+		return total, ok
+	}
+	merchandise := total
+	for _, extra := range []string{o.Tip, o.Fees} {
+		if v, ok := parseAmount(extra); ok {
+			merchandise -= v
+		}
+	}
+	// A breakdown larger than the total was misread; trust the total.
+	if merchandise < 0 {
+		return total, true
+	}
+	return merchandise, true
+}
@@ -2,11 +2,30 @@ package util
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
+// OpenBrowser opens url in the user's browser. When the BROWSER environment
+// variable is set it is used as the command (with url appended as the final
+// argument), which covers WSL and desktops without a working xdg-open.
 func OpenBrowser(url string) error {
+	return OpenBrowserWith("", url)
+}
+
+// OpenBrowserWith is OpenBrowser with command, when non-empty, used in place
+// of BROWSER.
+func OpenBrowserWith(command, url string) error {
+	if command == "" {
+		command = os.Getenv("BROWSER")
+	}
+	if browser := strings.Fields(command); len(browser) > 0 {
+		args := append(browser[1:], url)
+		return exec.Command(browser[0], args...).Start()
+	}
+
 	var err error
 	switch runtime.GOOS {
 	case "linux":
@@ -27,6 +27,7 @@ export function Dashboard() {
         if (age < REPORT_MAX_AGE_MS) {
           const parsedReport = JSON.parse(storedReport);
           setReportData(parsedReport);
+          return;
         } else {
           // Clear stale data
           localStorage.removeItem(REPORT_STORAGE_KEY);
@@ -39,6 +40,16 @@ export function Dashboard() {
       localStorage.removeItem(REPORT_STORAGE_KEY);
       localStorage.removeItem(REPORT_TIMESTAMP_KEY);
     }
+
+    // Nothing cached in this browser: load the server's last completed scan.
+    fetch('/api/report?exclude_acked=true', { credentials: 'include' })
+      .then((response) => (response.ok ? response.json() : null))
+      .then((data) => {
+        if (data) {
+          setReportData((current) => current ?? data);
+        }
+      })
+      .catch(() => {});
   }, []);
 
   // Save report to localStorage whenever it changes
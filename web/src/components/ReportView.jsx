@@ -1,17 +1,42 @@
 import { useState } from 'react';
 
+// Thumbnails are loaded through the server's image proxy rather than straight
+// from Walmart's CDN.
+const proxiedImage = (url) =>
+  url && url.startsWith('https://') ? `/api/img?url=${encodeURIComponent(url)}` : url;
+
+// timeAgo describes how long ago an ISO timestamp was, e.g. "3 hours ago".
+const timeAgo = (iso) => {
+  const seconds = Math.max(0, (Date.now() - new Date(iso).getTime()) / 1000);
+  const units = [['day', 86400], ['hour', 3600], ['minute', 60]];
+  for (const [unit, size] of units) {
+    const n = Math.floor(seconds / size);
+    if (n >= 1) return `${n} ${unit}${n === 1 ? '' : 's'} ago`;
+  }
+  return 'just now';
+};
+
+// Go encodes an unset time as year 1, so only a real DeliveredAt counts.
+const isDelivered = (shipment) =>
+  Boolean(shipment.DeliveredDate) || (shipment.DeliveredAt && !shipment.DeliveredAt.startsWith('0001-'));
+
 export function ReportView({ data }) {
   const [searchTerm, setSearchTerm] = useState('');
+  const [acked, setAcked] = useState(() => new Set());
 
-  if (!data || !data.orders) {
+  if (!data || !data.email_stats) {
     return null;
   }
 
-  const orders = Object.values(data.orders);
-  const totalOrders = orders.length;
-  const canceledOrders = orders.filter(o => o.Status === 'canceled').length;
+  const totalOrders = data.email_stats.TotalOrders || 0;
+  const canceledOrders = data.email_stats.TotalCanceled || 0;
   const liveOrderCount = data.email_stats?.LiveOrderCount || 0;
   const cancellationRate = data.email_stats?.CancellationRate || 0;
+  const canceledByWalmart = data.email_stats?.CanceledByWalmart || 0;
+  const canceledPaymentFailed = data.email_stats?.CanceledPaymentFailed || 0;
+  const totalTax = data.email_stats?.TotalTax || 0;
+  const currencySymbol = data.currency_symbol || '$';
+  const money = (value) => `${currencySymbol}${value.toFixed(2)}`;
 
   const filterRows = (rows) => {
     if (!searchTerm) return rows;
@@ -22,11 +47,28 @@ export function ReportView({ data }) {
   };
 
   const liveOrderSummary = filterRows(data.live_order_summary || []);
-  const liveOrders = filterRows(data.live_orders || []);
+  const liveOrders = filterRows(data.live_orders || []).filter(o => !acked.has(o.OrderID));
+
+  const ackOrder = async (orderID) => {
+    const response = await fetch(`/api/orders/${encodeURIComponent(orderID)}/ack`, {
+      method: 'POST',
+      credentials: 'include',
+    });
+    if (response.ok) {
+      setAcked(prev => new Set(prev).add(orderID));
+    }
+  };
   const productCancel = filterRows(data.product_cancel || []);
   const orderLines = filterRows(data.order_lines || []);
   const productSpend = filterRows(data.product_spend || []);
   const shipments = filterRows(data.shipments || []);
+  const paymentSpend = filterRows(data.payment_spend || []);
+  const discrepancies = data.discrepancies || [];
+  const fulfillmentBuckets = data.fulfillment_buckets || [];
+  const fulfillmentRows = [
+    ['Order → Ship', data.fulfillment?.Overall?.OrderToShip],
+    ['Ship → Delivered', data.fulfillment?.Overall?.ShipToDelivered],
+  ].filter(([, stats]) => stats && stats.Count > 0);
 
   return (
     <div className="space-y-6">
@@ -35,8 +77,14 @@ export function ReportView({ data }) {
         <div>
           <h1 className="text-2xl font-semibold mb-1">Walmart Order Checker</h1>
           <p className="text-muted text-sm">{data.date_range || 'Order Report'}</p>
+          {data.completed_at && (
+            <p className="text-muted text-xs">Results from {timeAgo(data.completed_at)}</p>
+          )}
         </div>
-        <div>
+        <div className="flex items-center gap-4">
+          <a href="/api/report/csv" className="text-sm text-muted hover:text-text underline">Orders CSV</a>
+          <a href="/api/report/csv/shipped" className="text-sm text-muted hover:text-text underline">Shipments CSV</a>
+          <a href="/api/report/html?variant=compact" target="_blank" rel="noreferrer" className="text-sm text-muted hover:text-text underline">Print view</a>
           <input
             type="text"
             placeholder="Search products..."
@@ -65,6 +113,9 @@ export function ReportView({ data }) {
           <div className="text-3xl mb-2">❌</div>
           <div className="text-muted text-xs uppercase tracking-wider mb-2">Total Canceled Orders</div>
           <div className="text-2xl font-semibold text-primary font-mono">{canceledOrders}</div>
+          {(canceledByWalmart > 0 || canceledPaymentFailed > 0) && (
+            <div className="text-muted text-xs mt-1">{canceledByWalmart} by Walmart · {canceledPaymentFailed} payment failed</div>
+          )}
         </div>
 
         <div className="bg-panel rounded-xl p-5 border border-muted/10 shadow-sm text-center">
@@ -72,6 +123,14 @@ export function ReportView({ data }) {
           <div className="text-muted text-xs uppercase tracking-wider mb-2">Cancellation Rate</div>
           <div className="text-2xl font-semibold text-primary font-mono">{cancellationRate.toFixed(2)}%</div>
         </div>
+
+        {totalTax > 0 && (
+          <div className="bg-panel rounded-xl p-5 border border-muted/10 shadow-sm text-center">
+            <div className="text-3xl mb-2">🧾</div>
+            <div className="text-muted text-xs uppercase tracking-wider mb-2">Total Tax</div>
+            <div className="text-2xl font-semibold text-primary font-mono">{money(totalTax)}</div>
+          </div>
+        )}
       </div>
 
       {/* Live Order Summary */}
@@ -98,15 +157,15 @@ export function ReportView({ data }) {
                 {liveOrderSummary.map((item, idx) => (
                   <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
                     <td className="px-4 py-3">
-                      <img src={item.Thumbnail} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
+                      <img src={proxiedImage(item.Thumbnail)} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
                     </td>
                     <td className="px-4 py-3 text-sm">{item.Name}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{item.TotalUnits}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">
-                      {item.PricePerUnit > 0 ? `$${item.PricePerUnit.toFixed(2)}` : '—'}
+                      {item.PricePerUnit > 0 ? money(item.PricePerUnit) : '—'}
                     </td>
                     <td className="px-4 py-3 text-sm text-right font-mono">
-                      {item.TotalSpent > 0 ? `$${item.TotalSpent.toFixed(2)}` : '—'}
+                      {item.TotalSpent > 0 ? money(item.TotalSpent) : '—'}
                     </td>
                   </tr>
                 ))}
@@ -133,15 +192,21 @@ export function ReportView({ data }) {
                   <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Product Name</th>
                   <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Quantity</th>
                   <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Status</th>
+                  <th className="px-4 py-3"></th>
                 </tr>
               </thead>
               <tbody>
                 {liveOrders.map((order, idx) => (
                   <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
                     <td className="px-4 py-3 text-sm font-mono">{order.OrderDate}</td>
-                    <td className="px-4 py-3 text-sm font-mono">{order.OrderID}</td>
+                    <td className="px-4 py-3 text-sm font-mono">
+                      {order.OrderID}
+                      {order.IsNew && (
+                        <span className="ml-2 inline-flex px-2 py-0.5 text-xs font-medium rounded-full border border-primary/20 bg-primary/10 text-primary">New</span>
+                      )}
+                    </td>
                     <td className="px-4 py-3">
-                      <img src={order.Thumbnail} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
+                      <img src={proxiedImage(order.Thumbnail)} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
                     </td>
                     <td className="px-4 py-3 text-sm">{order.Name}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{order.Quantity}</td>
@@ -150,6 +215,15 @@ export function ReportView({ data }) {
                         Confirmed
                       </span>
                     </td>
+                    <td className="px-4 py-3 text-right">
+                      <button
+                        onClick={() => ackOrder(order.OrderID)}
+                        title="Hide this order from the live list on future scans"
+                        className="text-xs text-muted hover:text-primary transition-colors"
+                      >
+                        Ack
+                      </button>
+                    </td>
                   </tr>
                 ))}
               </tbody>
@@ -173,6 +247,8 @@ export function ReportView({ data }) {
                   <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Product Name</th>
                   <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Total Ordered</th>
                   <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Total Canceled</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">By Walmart</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Payment Failed</th>
                   <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Cancel Rate</th>
                 </tr>
               </thead>
@@ -180,11 +256,13 @@ export function ReportView({ data }) {
                 {productCancel.map((product, idx) => (
                   <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
                     <td className="px-4 py-3">
-                      <img src={product.Thumbnail} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
+                      <img src={proxiedImage(product.Thumbnail)} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
                     </td>
                     <td className="px-4 py-3 text-sm">{product.Name}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{product.TotalOrdered}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{product.TotalCanceled}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{product.CanceledByWalmart || 0}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{product.CanceledPaymentFailed || 0}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{product.CancelRate.toFixed(2)}%</td>
                   </tr>
                 ))}
@@ -200,6 +278,12 @@ export function ReportView({ data }) {
           <div className="px-5 py-4 border-b border-muted/10">
             <h2 className="text-lg font-semibold">Order Lines</h2>
             <p className="text-muted text-xs mt-0.5">Individual line items</p>
+            {data.truncated && (
+              <p className="text-xs mt-1 text-danger">
+                Showing the {(data.order_lines || []).length} most recent of {data.order_lines_total} lines.{' '}
+                <a href={data.full_export} className="underline">Download all as JSON Lines</a>
+              </p>
+            )}
           </div>
           <div className="overflow-x-auto">
             <table className="w-full min-w-[720px]">
@@ -217,9 +301,14 @@ export function ReportView({ data }) {
                 {orderLines.map((line, idx) => (
                   <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
                     <td className="px-4 py-3 text-sm font-mono">{line.OrderDate}</td>
-                    <td className="px-4 py-3 text-sm font-mono">{line.OrderID}</td>
+                    <td className="px-4 py-3 text-sm font-mono">
+                      {line.OrderID}
+                      {line.IsNew && (
+                        <span className="ml-2 inline-flex px-2 py-0.5 text-xs font-medium rounded-full border border-primary/20 bg-primary/10 text-primary">New</span>
+                      )}
+                    </td>
                     <td className="px-4 py-3">
-                      <img src={line.Thumbnail} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
+                      <img src={proxiedImage(line.Thumbnail)} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
                     </td>
                     <td className="px-4 py-3 text-sm">{line.Name}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{line.Quantity}</td>
@@ -254,12 +343,17 @@ export function ReportView({ data }) {
                 {productSpend.map((product, idx) => (
                   <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
                     <td className="px-4 py-3">
-                      <img src={product.Thumbnail} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
+                      <img src={proxiedImage(product.Thumbnail)} alt="" className="w-10 h-10 rounded-lg object-cover bg-bg border border-muted/10" />
                     </td>
                     <td className="px-4 py-3 text-sm">{product.Name}</td>
                     <td className="px-4 py-3 text-sm text-right font-mono">{product.TotalUnits}</td>
-                    <td className="px-4 py-3 text-sm text-right font-mono">${product.PricePerUnit.toFixed(2)}</td>
-                    <td className="px-4 py-3 text-sm text-right font-mono">${product.TotalSpent.toFixed(2)}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{money(product.PricePerUnit)}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">
+                      {money(product.TotalSpent)}
+                      {product.Refunded > 0 && (
+                        <div className="text-muted text-xs">−{money(product.Refunded)} refunded</div>
+                      )}
+                    </td>
                   </tr>
                 ))}
               </tbody>
@@ -287,11 +381,111 @@ export function ReportView({ data }) {
               </thead>
               <tbody>
                 {shipments.map((shipment, idx) => (
-                  <tr key={idx} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
+                  <tr key={idx} className={`border-b border-muted/10 hover:bg-primary/5 transition-colors ${isDelivered(shipment) ? 'text-muted' : ''}`}>
                     <td className="px-4 py-3 text-sm font-mono">{shipment.ID}</td>
                     <td className="px-4 py-3 text-sm">{shipment.Carrier}</td>
                     <td className="px-4 py-3 text-sm font-mono">{shipment.TrackingNumber}</td>
-                    <td className="px-4 py-3 text-sm font-mono">{shipment.EstimatedArrival}</td>
+                    <td className="px-4 py-3 text-sm font-mono">
+                      {isDelivered(shipment) ? (
+                        <span className="inline-flex px-2 py-1 text-xs font-medium rounded-full border border-success/20 bg-success/10 text-success">
+                          Delivered{shipment.DeliveredDate ? ` ${shipment.DeliveredDate}` : ''}
+                        </span>
+                      ) : shipment.EstimatedArrival}
+                    </td>
+                  </tr>
+                ))}
+              </tbody>
+            </table>
+          </div>
+        </section>
+      )}
+
+      {/* Spend by Payment Method */}
+      {paymentSpend.length > 0 && (
+        <section className="bg-panel rounded-xl border border-muted/10 shadow-sm overflow-hidden">
+          <div className="px-5 py-4 border-b border-muted/10">
+            <h2 className="text-lg font-semibold">Spend by Payment Method</h2>
+            <p className="text-muted text-xs mt-0.5">Order totals, excluding canceled orders</p>
+          </div>
+          <div className="overflow-x-auto">
+            <table className="w-full min-w-[720px]">
+              <thead>
+                <tr className="border-b border-muted/10">
+                  <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Payment Method</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Orders</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Total Spent</th>
+                </tr>
+              </thead>
+              <tbody>
+                {paymentSpend.map((row) => (
+                  <tr key={row.Method} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
+                    <td className="px-4 py-3 text-sm">{row.Method}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{row.Orders}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{money(row.TotalSpent)}</td>
+                  </tr>
+                ))}
+              </tbody>
+            </table>
+          </div>
+        </section>
+      )}
+
+      {/* Total Discrepancies */}
+      {discrepancies.length > 0 && (
+        <section className="bg-panel rounded-xl border border-muted/10 shadow-sm overflow-hidden">
+          <div className="px-5 py-4 border-b border-muted/10">
+            <h2 className="text-lg font-semibold">Total Discrepancies</h2>
+            <p className="text-muted text-xs mt-0.5">Orders whose emails reported different totals; check for duplicate charges</p>
+          </div>
+          <div className="overflow-x-auto">
+            <table className="w-full min-w-[720px]">
+              <thead>
+                <tr className="border-b border-muted/10">
+                  <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Order ID</th>
+                  <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Totals Seen</th>
+                </tr>
+              </thead>
+              <tbody>
+                {discrepancies.map((row) => (
+                  <tr key={row.OrderID} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
+                    <td className="px-4 py-3 text-sm font-mono">{row.OrderID}</td>
+                    <td className="px-4 py-3 text-sm font-mono">{row.Totals.join(', ')}</td>
+                  </tr>
+                ))}
+              </tbody>
+            </table>
+          </div>
+        </section>
+      )}
+
+      {/* Fulfillment Times */}
+      {fulfillmentRows.length > 0 && (
+        <section className="bg-panel rounded-xl border border-muted/10 shadow-sm overflow-hidden">
+          <div className="px-5 py-4 border-b border-muted/10">
+            <h2 className="text-lg font-semibold">Fulfillment Times</h2>
+            <p className="text-muted text-xs mt-0.5">Days from order to ship and ship to delivery</p>
+          </div>
+          <div className="overflow-x-auto">
+            <table className="w-full min-w-[720px]">
+              <thead>
+                <tr className="border-b border-muted/10">
+                  <th className="text-left px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Interval</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Orders</th>
+                  <th className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">Avg Days</th>
+                  {fulfillmentBuckets.map(label => (
+                    <th key={label} className="text-right px-4 py-3 text-xs font-semibold text-muted uppercase tracking-wider">{label}</th>
+                  ))}
+                </tr>
+              </thead>
+              <tbody>
+                {fulfillmentRows.map(([label, stats]) => (
+                  <tr key={label} className="border-b border-muted/10 hover:bg-primary/5 transition-colors">
+                    <td className="px-4 py-3 text-sm">{label}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{stats.Count}</td>
+                    <td className="px-4 py-3 text-sm text-right font-mono">{stats.AvgDays.toFixed(1)}</td>
+                    {(stats.Distribution || []).map((n, i) => (
+                      <td key={i} className="px-4 py-3 text-sm text-right font-mono">{n}</td>
+                    ))}
                   </tr>
                 ))}
               </tbody>
@@ -18,7 +18,8 @@ export function ScanControls({ onScanStart, onScanComplete }) {
       });
 
       if (!response.ok) {
-        throw new Error('Scan failed');
+        const body = await response.json().catch(() => null);
+        throw new Error(body?.error?.message || 'Scan failed');
       }
 
       const pollStatus = setInterval(async () => {
@@ -38,7 +39,7 @@ export function ScanControls({ onScanStart, onScanComplete }) {
           }
 
           // Fetch report on successful completion
-          const reportResponse = await fetch('/api/report', {
+          const reportResponse = await fetch('/api/report?exclude_acked=true', {
             credentials: 'include',
           });
 
@@ -1,11 +1,21 @@
+import { useRef } from 'react';
 import { useWebSocket } from '../hooks/useWebSocket';
 
 export function ScanProgress() {
-  const { data: progress } = useWebSocket('/api/ws/scan');
+  const { data: frame } = useWebSocket('/api/ws/scan');
+  const lastProgress = useRef({ total_messages: 0, processed: 0 });
 
-  if (!progress || !progress.in_progress) {
+  // Frames are {type, data}: progress while the scan runs, then one complete
+  // or error frame. ScanControls picks up the finished report itself.
+  if (!frame || frame.type === 'complete') {
     return null;
   }
+  if (frame.type === 'progress') {
+    lastProgress.current = frame.data;
+  }
+  const progress = frame.type === 'error'
+    ? { ...lastProgress.current, ...frame.data }
+    : frame.data;
 
   const percentage = progress.total_messages > 0
     ? Math.round((progress.processed / progress.total_messages) * 100)
@@ -15,11 +25,11 @@ export function ScanProgress() {
     ? Math.round((Date.now() - new Date(progress.start_time).getTime()) / 1000)
     : 0;
 
-  // Calculate estimated time remaining
-  const estimatedTotal = progress.processed > 0
-    ? (elapsed / progress.processed) * progress.total_messages
+  // Estimate time remaining from the server-measured throughput
+  const rate = progress.rate || 0;
+  const remaining = rate > 0
+    ? Math.max(0, Math.round((progress.total_messages - progress.processed) / rate))
     : 0;
-  const remaining = Math.max(0, Math.round(estimatedTotal - elapsed));
 
   // Format time as MM:SS
   const formatTime = (seconds) => {
@@ -28,6 +38,14 @@ export function ScanProgress() {
     return `${mins}:${secs.toString().padStart(2, '0')}`;
   };
 
+  const cancelScan = async () => {
+    try {
+      await fetch('/api/scan', { method: 'DELETE', credentials: 'include' });
+    } catch (error) {
+      console.error('Failed to cancel scan:', error);
+    }
+  };
+
   return (
     <div className="bg-panel rounded-lg p-6 shadow-lg">
       <div className="space-y-4">
@@ -44,9 +62,17 @@ export function ScanProgress() {
               <p className="text-xs text-muted">{progress.days_scanned} days</p>
             </div>
           </div>
-          <div className="text-right">
-            <div className="text-2xl font-bold text-primary">{percentage}%</div>
-            <div className="text-xs text-muted">Complete</div>
+          <div className="flex items-center gap-4">
+            <button
+              onClick={cancelScan}
+              className="text-sm text-muted hover:text-danger transition-colors"
+            >
+              Cancel
+            </button>
+            <div className="text-right">
+              <div className="text-2xl font-bold text-primary">{percentage}%</div>
+              <div className="text-xs text-muted">Complete</div>
+            </div>
           </div>
         </div>
 
@@ -94,6 +120,9 @@ export function ScanProgress() {
           <div className="text-sm">
             <span className="text-muted">Elapsed: </span>
             <span className="font-medium">{formatTime(elapsed)}</span>
+            {rate > 0 && (
+              <span className="text-muted"> · {rate.toFixed(1)} msg/s</span>
+            )}
           </div>
           <div className="text-xs text-muted">
             {progress.current_email}